@@ -40,7 +40,7 @@ var URL = map[string]string{
 
 type OnePasswordAdapter struct {
 	conf       OnePasswordConfig
-	uspClient  *uspclient.Client
+	uspClient  *utils.USPClient
 	httpClient *http.Client
 
 	endpoint string
@@ -56,6 +56,8 @@ type OnePasswordConfig struct {
 	ClientOptions uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
 	Token         string                  `json:"token" yaml:"token"`
 	Endpoint      string                  `json:"endpoint" yaml:"endpoint"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *OnePasswordConfig) Validate() error {
@@ -91,7 +93,7 @@ func NewOnePasswordpAdapter(ctx context.Context, conf OnePasswordConfig) (*OnePa
 		return nil, nil, fmt.Errorf("not a valid api endpoint: %s", conf.Endpoint)
 	}
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -0,0 +1,443 @@
+package usp_azure_blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/refractionPOINT/usp-adapters/utils"
+)
+
+type AzureBlobAdapter struct {
+	conf      AzureBlobConfig
+	uspClient *utils.USPClient
+
+	ctx context.Context
+
+	client *azblob.Client
+
+	isStop uint32
+	wg     sync.WaitGroup
+
+	memBudget    *utils.MemoryBudget
+	streamBudget *utils.MemoryBudget
+}
+
+type AzureBlobConfig struct {
+	ClientOptions uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
+	AccountName   string                  `json:"account_name" yaml:"account_name"`
+	ContainerName string                  `json:"container_name" yaml:"container_name"`
+	// Optional, defaults to https://<account_name>.blob.core.windows.net/
+	ServiceURL string `json:"service_url,omitempty" yaml:"service_url,omitempty"`
+
+	// Authentication, one of the following must be provided.
+	SASToken         string `json:"sas_token,omitempty" yaml:"sas_token,omitempty"`
+	AccountKey       string `json:"account_key,omitempty" yaml:"account_key,omitempty"`
+	TenantID         string `json:"tenant_id,omitempty" yaml:"tenant_id,omitempty"`
+	ClientID         string `json:"client_id,omitempty" yaml:"client_id,omitempty"`
+	ClientSecret     string `json:"client_secret,omitempty" yaml:"client_secret,omitempty"`
+	ConnectionString string `json:"connection_string,omitempty" yaml:"connection_string,omitempty"`
+
+	IsOneTimeLoad bool   `json:"single_load" yaml:"single_load"`
+	Prefix        string `json:"prefix" yaml:"prefix"`
+	ParallelFetch int    `json:"parallel_fetch" yaml:"parallel_fetch"`
+	MaxMemoryMB   int    `json:"max_memory_mb,omitempty" yaml:"max_memory_mb,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+}
+
+func (c *AzureBlobConfig) Validate() error {
+	if err := c.ClientOptions.Validate(); err != nil {
+		return fmt.Errorf("client_options: %v", err)
+	}
+	if c.ContainerName == "" {
+		return errors.New("missing container_name")
+	}
+	if c.ConnectionString != "" {
+		return nil
+	}
+	if c.AccountName == "" && c.ServiceURL == "" {
+		return errors.New("missing account_name or service_url")
+	}
+	if c.SASToken == "" && c.AccountKey == "" && c.ClientSecret == "" {
+		return errors.New("missing sas_token, account_key, client_secret or connection_string")
+	}
+	if c.AccountKey != "" && c.AccountName == "" {
+		return errors.New("account_key requires account_name")
+	}
+	if c.ClientSecret != "" && (c.TenantID == "" || c.ClientID == "") {
+		return errors.New("client_secret requires tenant_id and client_id")
+	}
+	return nil
+}
+
+type azureBlobLocalFile struct {
+	Name         string
+	Size         int64
+	Data         []byte
+	IsCompressed bool
+	IsStreamed   bool
+	Reserved     int64
+	Err          error
+}
+
+func NewAzureBlobAdapter(ctx context.Context, conf AzureBlobConfig) (*AzureBlobAdapter, chan struct{}, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if conf.ParallelFetch <= 0 {
+		conf.ParallelFetch = 1
+	}
+	if conf.MaxMemoryMB <= 0 {
+		conf.MaxMemoryMB = utils.DefaultMaxMemoryMB
+	}
+	a := &AzureBlobAdapter{
+		conf: conf,
+		ctx:  context.Background(),
+	}
+	// One chunk per fetcher, plus a budget for the
+	// file currently being streamed and shipped.
+	a.memBudget, a.streamBudget = utils.NewFetchMemoryBudgets(int64(conf.MaxMemoryMB)*1024*1024, conf.ParallelFetch)
+
+	var err error
+	if a.client, err = newClient(conf); err != nil {
+		return nil, nil, err
+	}
+
+	a.uspClient, err = utils.NewBundleUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chStopped := make(chan struct{})
+
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer close(chStopped)
+
+		for {
+			isFilesFound := false
+			if atomic.LoadUint32(&a.isStop) == 1 {
+				break
+			}
+
+			isFilesFound, err = a.lookForFiles()
+			if err != nil || a.conf.IsOneTimeLoad {
+				break
+			}
+
+			if !isFilesFound {
+				time.Sleep(5 * time.Second)
+			}
+		}
+
+		if err != nil {
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("azure_blob stoppped with error: %v", err))
+		}
+	}()
+
+	return a, chStopped, nil
+}
+
+func newClient(conf AzureBlobConfig) (*azblob.Client, error) {
+	if conf.ConnectionString != "" {
+		client, err := azblob.NewClientFromConnectionString(conf.ConnectionString, nil)
+		if err != nil {
+			return nil, fmt.Errorf("azblob.NewClientFromConnectionString(): %v", err)
+		}
+		return client, nil
+	}
+
+	serviceURL := conf.ServiceURL
+	if serviceURL == "" {
+		serviceURL = fmt.Sprintf("https://%s.blob.core.windows.net/", conf.AccountName)
+	}
+
+	if conf.SASToken != "" {
+		sasURL := serviceURL
+		if strings.Contains(sasURL, "?") {
+			sasURL += "&"
+		} else {
+			sasURL += "?"
+		}
+		sasURL += strings.TrimPrefix(conf.SASToken, "?")
+		client, err := azblob.NewClientWithNoCredential(sasURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("azblob.NewClientWithNoCredential(): %v", err)
+		}
+		return client, nil
+	}
+
+	if conf.AccountKey != "" {
+		cred, err := azblob.NewSharedKeyCredential(conf.AccountName, conf.AccountKey)
+		if err != nil {
+			return nil, fmt.Errorf("azblob.NewSharedKeyCredential(): %v", err)
+		}
+		client, err := azblob.NewClientWithSharedKeyCredential(serviceURL, cred, nil)
+		if err != nil {
+			return nil, fmt.Errorf("azblob.NewClientWithSharedKeyCredential(): %v", err)
+		}
+		return client, nil
+	}
+
+	cred, err := azidentity.NewClientSecretCredential(conf.TenantID, conf.ClientID, conf.ClientSecret, nil)
+	if err != nil {
+		return nil, fmt.Errorf("azidentity.NewClientSecretCredential(): %v", err)
+	}
+	client, err := azblob.NewClient(serviceURL, cred, nil)
+	if err != nil {
+		return nil, fmt.Errorf("azblob.NewClient(): %v", err)
+	}
+	return client, nil
+}
+
+func (a *AzureBlobAdapter) Close() error {
+	a.conf.ClientOptions.DebugLog("closing")
+	atomic.StoreUint32(&a.isStop, 1)
+	a.wg.Wait()
+	err1 := a.uspClient.Drain(1 * time.Minute)
+	_, err2 := a.uspClient.Close()
+
+	if err1 != nil {
+		return err1
+	}
+
+	return err2
+}
+
+func (a *AzureBlobAdapter) lookForFiles() (bool, error) {
+	pager := a.client.NewListBlobsFlatPager(a.conf.ContainerName, &azblob.ListBlobsFlatOptions{
+		Prefix: &a.conf.Prefix,
+	})
+	pending := []*container.BlobItem{}
+
+	// We pipeline the downloading of files from Azure to support
+	// high throughputs. It is important we keep file ordering
+	// but beyond that we can download in parallel.
+	filesMutex := sync.Mutex{}
+	genNewFile, close, err := utils.Pipeliner(func() (utils.Element, error) {
+		if atomic.LoadUint32(&a.isStop) == 1 {
+			return nil, nil
+		}
+		filesMutex.Lock()
+		defer filesMutex.Unlock()
+
+		for len(pending) == 0 {
+			if !pager.More() {
+				return nil, nil
+			}
+			page, err := pager.NextPage(a.ctx)
+			if err != nil {
+				return nil, err
+			}
+			pending = page.Segment.BlobItems
+		}
+		item := pending[0]
+		pending = pending[1:]
+		return item, nil
+	}, a.conf.ParallelFetch, func(e utils.Element) utils.Element {
+		item := e.(*container.BlobItem)
+		name := *item.Name
+		size := int64(0)
+		contentEncoding := ""
+		if item.Properties != nil {
+			if item.Properties.ContentLength != nil {
+				size = *item.Properties.ContentLength
+			}
+			if item.Properties.ContentEncoding != nil {
+				contentEncoding = *item.Properties.ContentEncoding
+			}
+		}
+
+		isCompressed := false
+
+		if strings.HasSuffix(name, ".gz") || contentEncoding == "gzip" {
+			isCompressed = true
+		}
+
+		if size > a.memBudget.ChunkSize() {
+			// Too large to be held in memory, it will
+			// be streamed in chunks when its turn comes.
+			return &azureBlobLocalFile{
+				Name:         name,
+				Size:         size,
+				IsCompressed: isCompressed,
+				IsStreamed:   true,
+			}
+		}
+
+		reserved := a.memBudget.Acquire(size)
+
+		startTime := time.Now().UTC()
+		a.conf.ClientOptions.DebugLog(fmt.Sprintf("downloading file %s (%d)", name, size))
+
+		resp, err := a.client.DownloadStream(a.ctx, a.conf.ContainerName, name, nil)
+		if err != nil {
+			a.memBudget.Release(reserved)
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("azblob.DownloadStream(): %v", err))
+			return &azureBlobLocalFile{
+				Name: name,
+				Data: nil,
+				Err:  err,
+			}
+		}
+
+		objData, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if err != nil {
+			a.memBudget.Release(reserved)
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("azblob.Download(): %v", err))
+			return &azureBlobLocalFile{
+				Name: name,
+				Data: nil,
+				Err:  err,
+			}
+		}
+
+		a.conf.ClientOptions.DebugLog(fmt.Sprintf("file %s downloaded in %v (%d)", name, time.Since(startTime), size))
+
+		return &azureBlobLocalFile{
+			Name:         name,
+			Size:         size,
+			Data:         objData,
+			IsCompressed: isCompressed,
+			Reserved:     reserved,
+		}
+	})
+
+	if err != nil {
+		return false, err
+	}
+	defer close()
+
+	isDataFound := false
+	for {
+		var newFile interface{}
+		newFile, err = genNewFile()
+		if err != nil {
+			break
+		}
+		if newFile == nil {
+			break
+		}
+		localFile := newFile.(*azureBlobLocalFile)
+
+		if localFile.Err != nil {
+			// We failed downloading this file
+			// but we logged this fact earlier
+			// so we can just skip it.
+			continue
+		}
+
+		startTime := time.Now().UTC()
+
+		var isProcessed bool
+		if localFile.IsStreamed {
+			isProcessed = a.streamFile(localFile)
+		} else {
+			isProcessed = a.processEvent(localFile.Data, localFile.IsCompressed)
+			localFile.Data = nil
+			a.memBudget.Release(localFile.Reserved)
+		}
+		if !isProcessed {
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("file %s NOT processed in %v (%d)", localFile.Name, time.Since(startTime), localFile.Size))
+			continue
+		}
+
+		a.conf.ClientOptions.DebugLog(fmt.Sprintf("file %s processed in %v (%d)", localFile.Name, time.Since(startTime), localFile.Size))
+
+		if a.conf.IsOneTimeLoad {
+			// In one time loads we don't delete the contents.
+			continue
+		}
+
+		if _, err := a.client.DeleteBlob(a.ctx, a.conf.ContainerName, localFile.Name, nil); err != nil {
+			a.conf.ClientOptions.OnError(fmt.Errorf("azblob.DeleteBlob(): %v", err))
+			// Since we rely on object deletion to prevent re-ingesting
+			// the same files over and over again, we need to abort
+			// if we cannot delete a file.
+			a.conf.ClientOptions.OnWarning("aborting because files cannot be deleted")
+			return isDataFound, err
+		}
+
+		isDataFound = true
+	}
+
+	return isDataFound, err
+}
+
+// streamFile downloads a large file and ships it in chunks
+// as it goes so that it never has to be fully held in memory.
+func (a *AzureBlobAdapter) streamFile(localFile *azureBlobLocalFile) bool {
+	startTime := time.Now().UTC()
+	a.conf.ClientOptions.DebugLog(fmt.Sprintf("streaming file %s (%d)", localFile.Name, localFile.Size))
+
+	resp, err := a.client.DownloadStream(a.ctx, a.conf.ContainerName, localFile.Name, nil)
+	if err != nil {
+		a.conf.ClientOptions.OnWarning(fmt.Sprintf("azblob.DownloadStream(): %v", err))
+		return false
+	}
+	defer resp.Body.Close()
+
+	chunker := utils.ChunkStream
+	if localFile.IsCompressed {
+		chunker = utils.ChunkCompressedStream
+	}
+	nChunks := 0
+	if err := chunker(resp.Body, a.streamBudget, func(chunk []byte) error {
+		nChunks++
+		if !a.processEvent(chunk, false) {
+			return errors.New("failed to ship chunk")
+		}
+		return nil
+	}); err != nil {
+		a.conf.ClientOptions.OnError(fmt.Errorf("streaming %s: %v", localFile.Name, err))
+		return false
+	}
+
+	a.conf.ClientOptions.DebugLog(fmt.Sprintf("file %s streamed in %v (%d chunks)", localFile.Name, time.Since(startTime), nChunks))
+	return true
+}
+
+func (a *AzureBlobAdapter) processEvent(data []byte, isCompressed bool) bool {
+	// Since we're dealing with files, we use the
+	// bundle payloads to avoid having to go through
+	// the whole unmarshal+marshal roundtrip.
+	var msg *protocol.DataMessage
+	if isCompressed {
+		msg = &protocol.DataMessage{
+			CompressedBundlePayload: data,
+			TimestampMs:             uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+		}
+	} else {
+		msg = &protocol.DataMessage{
+			BundlePayload: data,
+			TimestampMs:   uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+		}
+	}
+
+	if err := a.uspClient.Ship(msg, 10*time.Second); err != nil {
+		if err == uspclient.ErrorBufferFull {
+			a.conf.ClientOptions.OnWarning("stream falling behind")
+			err = a.uspClient.Ship(msg, 1*time.Hour)
+		}
+		if err != nil {
+			a.conf.ClientOptions.OnError(fmt.Errorf("Ship(): %v", err))
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package usp_azure_blob
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigValidate(t *testing.T) {
+	c := AzureBlobConfig{}
+	assert.Error(t, c.Validate())
+
+	c = AzureBlobConfig{ContainerName: "logs", AccountName: "acct"}
+	assert.Error(t, c.Validate(), "missing credentials")
+
+	c = AzureBlobConfig{ContainerName: "logs", AccountName: "acct", SASToken: "sv=2022&sig=x"}
+	assert.NoError(t, c.Validate())
+
+	c = AzureBlobConfig{ContainerName: "logs", ServiceURL: "https://acct.blob.core.windows.net/", AccountKey: "a2V5"}
+	assert.Error(t, c.Validate(), "account key without account name")
+
+	c = AzureBlobConfig{ContainerName: "logs", AccountName: "acct", ClientSecret: "secret"}
+	assert.Error(t, c.Validate(), "service principal without tenant")
+
+	c = AzureBlobConfig{ContainerName: "logs", AccountName: "acct", TenantID: "t", ClientID: "c", ClientSecret: "secret"}
+	assert.NoError(t, c.Validate())
+
+	c = AzureBlobConfig{ContainerName: "logs", ConnectionString: "UseDevelopmentStorage=true"}
+	assert.NoError(t, c.Validate())
+}
+
+// The adapter is tested against a local Azurite emulator, for example:
+//
+//	docker run -p 10000:10000 mcr.microsoft.com/azure-storage/azurite azurite-blob --blobHost 0.0.0.0
+//	AZURITE_CONNECTION_STRING="DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;AccountKey=Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==;BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;" go test ./azure_blob/
+func TestAzuriteIngestion(t *testing.T) {
+	connectionString := os.Getenv("AZURITE_CONNECTION_STRING")
+	if connectionString == "" {
+		t.Skip("AZURITE_CONNECTION_STRING not set")
+	}
+	ctx := context.Background()
+	containerName := fmt.Sprintf("test-logs-%d", time.Now().UnixNano())
+
+	client, err := azblob.NewClientFromConnectionString(connectionString, nil)
+	require.NoError(t, err)
+	_, err = client.CreateContainer(ctx, containerName, nil)
+	require.NoError(t, err)
+	defer client.DeleteContainer(ctx, containerName, nil)
+
+	compressed := bytes.Buffer{}
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("{\"a\":1}\n{\"a\":2}\n"))
+	gz.Close()
+
+	blobs := map[string][]byte{
+		"logs/1.json":    []byte("{\"b\":1}\n"),
+		"logs/2.json.gz": compressed.Bytes(),
+		"other/3.json":   []byte("{\"c\":1}\n"),
+	}
+	for name, data := range blobs {
+		_, err := client.UploadBuffer(ctx, containerName, name, data, nil)
+		require.NoError(t, err)
+	}
+
+	errs := []error{}
+	a, chStopped, err := NewAzureBlobAdapter(ctx, AzureBlobConfig{
+		ClientOptions: uspclient.ClientOptions{
+			TestSinkMode: true,
+			DebugLog:     func(msg string) {},
+			OnWarning:    func(msg string) {},
+			OnError:      func(err error) { errs = append(errs, err) },
+		},
+		ConnectionString: connectionString,
+		ContainerName:    containerName,
+		Prefix:           "logs/",
+		ParallelFetch:    2,
+		IsOneTimeLoad:    false,
+	})
+	require.NoError(t, err)
+
+	// Wait for the first pass to ingest and delete the blobs.
+	deadline := time.Now().Add(20 * time.Second)
+	remaining := []string{}
+	for time.Now().Before(deadline) {
+		remaining = remaining[:0]
+		pager := client.NewListBlobsFlatPager(containerName, nil)
+		for pager.More() {
+			page, err := pager.NextPage(ctx)
+			require.NoError(t, err)
+			for _, b := range page.Segment.BlobItems {
+				remaining = append(remaining, *b.Name)
+			}
+		}
+		if len(remaining) == 1 {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	require.NoError(t, a.Close())
+	<-chStopped
+
+	assert.Empty(t, errs)
+	assert.Equal(t, []string{"other/3.json"}, remaining, "only blobs outside the prefix should remain")
+}
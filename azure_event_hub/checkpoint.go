@@ -0,0 +1,265 @@
+package usp_azure_event_hub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-event-hubs-go/v3/persist"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+)
+
+// checkpointStore is where the per-partition checkpoints are
+// persisted across restarts.
+type checkpointStore interface {
+	// Returns false if no checkpoint was ever stored for the key.
+	Read(key string) (persist.Checkpoint, bool, error)
+	Write(checkpoints map[string]persist.Checkpoint) error
+}
+
+// checkpointPersister implements the Event Hub CheckpointPersister.
+// The Event Hub receivers record a checkpoint after every event they
+// successfully handled, so they are kept in memory and only flushed
+// to the underlying store periodically. When no checkpoint exists
+// for a partition, receivers start from the configured position.
+type checkpointPersister struct {
+	store checkpointStore
+	start persist.Checkpoint
+
+	mu      sync.Mutex
+	current map[string]persist.Checkpoint
+	dirty   map[string]persist.Checkpoint
+
+	chStop  chan struct{}
+	wg      sync.WaitGroup
+	onError func(error)
+}
+
+func newCheckpointPersister(store checkpointStore, start persist.Checkpoint, interval time.Duration, onError func(error)) *checkpointPersister {
+	p := &checkpointPersister{
+		store:   store,
+		start:   start,
+		current: map[string]persist.Checkpoint{},
+		dirty:   map[string]persist.Checkpoint{},
+		chStop:  make(chan struct{}),
+		onError: onError,
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.chStop:
+				return
+			case <-ticker.C:
+			}
+			if err := p.Flush(); err != nil {
+				p.onError(fmt.Errorf("checkpoint flush: %v", err))
+			}
+		}
+	}()
+	return p
+}
+
+func checkpointKey(namespace, name, consumerGroup, partitionID string) string {
+	return path.Join(namespace, name, consumerGroup, partitionID)
+}
+
+func (p *checkpointPersister) Read(namespace, name, consumerGroup, partitionID string) (persist.Checkpoint, error) {
+	key := checkpointKey(namespace, name, consumerGroup, partitionID)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cp, ok := p.current[key]; ok {
+		return cp, nil
+	}
+	cp, ok, err := p.store.Read(key)
+	if err != nil {
+		return persist.Checkpoint{}, err
+	}
+	if !ok {
+		return p.start, nil
+	}
+	p.current[key] = cp
+	return cp, nil
+}
+
+func (p *checkpointPersister) Write(namespace, name, consumerGroup, partitionID string, checkpoint persist.Checkpoint) error {
+	// The receivers also write the position they were started
+	// at, we only care about the offsets of actual events.
+	if checkpoint.Offset == "" || checkpoint.Offset == persist.StartOfStream || checkpoint.Offset == persist.EndOfStream {
+		return nil
+	}
+	key := checkpointKey(namespace, name, consumerGroup, partitionID)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current[key] = checkpoint
+	p.dirty[key] = checkpoint
+	return nil
+}
+
+// Forget drops the checkpoint of a partition that is now owned
+// by another replica, it is read again from the store if needed.
+func (p *checkpointPersister) Forget(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.current, key)
+	delete(p.dirty, key)
+}
+
+// Flush writes the checkpoints that changed since the last flush.
+func (p *checkpointPersister) Flush() error {
+	p.mu.Lock()
+	if len(p.dirty) == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	dirty := p.dirty
+	p.dirty = map[string]persist.Checkpoint{}
+	p.mu.Unlock()
+
+	if err := p.store.Write(dirty); err != nil {
+		// Put them back so they get retried, unless
+		// they were superseded in the meantime.
+		p.mu.Lock()
+		for k, cp := range dirty {
+			if _, ok := p.dirty[k]; !ok {
+				p.dirty[k] = cp
+			}
+		}
+		p.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (p *checkpointPersister) Close() error {
+	close(p.chStop)
+	p.wg.Wait()
+	return p.Flush()
+}
+
+// fileCheckpointStore keeps all the checkpoints in a single
+// local JSON file.
+type fileCheckpointStore struct {
+	filePath string
+
+	mu          sync.Mutex
+	checkpoints map[string]persist.Checkpoint
+}
+
+func newFileCheckpointStore(filePath string) (*fileCheckpointStore, error) {
+	s := &fileCheckpointStore{
+		filePath:    filePath,
+		checkpoints: map[string]persist.Checkpoint{},
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &s.checkpoints); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint file %s: %v", filePath, err)
+	}
+	return s, nil
+}
+
+func (s *fileCheckpointStore) Read(key string) (persist.Checkpoint, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cp, ok := s.checkpoints[key]
+	return cp, ok, nil
+}
+
+func (s *fileCheckpointStore) Write(checkpoints map[string]persist.Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, cp := range checkpoints {
+		s.checkpoints[k] = cp
+	}
+	content, err := json.Marshal(s.checkpoints)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so that a crash
+	// never leaves us with a truncated checkpoint file.
+	tmpPath := s.filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.filePath)
+}
+
+// blobCheckpointStore keeps one blob per partition in an Azure
+// Storage container, which allows the adapter to run without
+// persistent local storage.
+type blobCheckpointStore struct {
+	ctx       context.Context
+	client    *azblob.Client
+	container string
+}
+
+func newBlobCheckpointStore(ctx context.Context, connectionString string, container string) (*blobCheckpointStore, error) {
+	client, err := azblob.NewClientFromConnectionString(connectionString, nil)
+	if err != nil {
+		return nil, fmt.Errorf("azblob.NewClientFromConnectionString(): %v", err)
+	}
+	if _, err := client.CreateContainer(ctx, container, nil); err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		return nil, fmt.Errorf("azblob.CreateContainer(%s): %v", container, err)
+	}
+	return &blobCheckpointStore{
+		ctx:       ctx,
+		client:    client,
+		container: container,
+	}, nil
+}
+
+func (s *blobCheckpointStore) blobName(key string) string {
+	return path.Join("checkpoints", key)
+}
+
+func (s *blobCheckpointStore) Read(key string) (persist.Checkpoint, bool, error) {
+	cp := persist.Checkpoint{}
+	resp, err := s.client.DownloadStream(s.ctx, s.container, s.blobName(key), nil)
+	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return cp, false, nil
+		}
+		return cp, false, fmt.Errorf("azblob.DownloadStream(%s): %v", key, err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return cp, false, fmt.Errorf("azblob.DownloadStream(%s): %v", key, err)
+	}
+	if err := json.Unmarshal(content, &cp); err != nil {
+		return cp, false, fmt.Errorf("invalid checkpoint %s: %v", key, err)
+	}
+	return cp, true, nil
+}
+
+func (s *blobCheckpointStore) Write(checkpoints map[string]persist.Checkpoint) error {
+	var errs []error
+	for k, cp := range checkpoints {
+		content, err := json.Marshal(cp)
+		if err != nil {
+			return err
+		}
+		if _, err := s.client.UploadBuffer(s.ctx, s.container, s.blobName(k), content, nil); err != nil {
+			errs = append(errs, fmt.Errorf("azblob.UploadBuffer(%s): %v", k, err))
+		}
+	}
+	return errors.Join(errs...)
+}
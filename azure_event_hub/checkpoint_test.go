@@ -0,0 +1,103 @@
+package usp_azure_event_hub
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-event-hubs-go/v3/persist"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStartPosition(t *testing.T) {
+	cp, err := parseStartPosition("")
+	require.NoError(t, err)
+	assert.Equal(t, persist.EndOfStream, cp.Offset)
+
+	cp, err = parseStartPosition("earliest")
+	require.NoError(t, err)
+	assert.Equal(t, persist.StartOfStream, cp.Offset)
+
+	cp, err = parseStartPosition("2024-01-02T03:04:05Z")
+	require.NoError(t, err)
+	assert.Equal(t, "", cp.Offset)
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), cp.EnqueueTime)
+
+	_, err = parseStartPosition("yesterday")
+	assert.Error(t, err)
+}
+
+func testCheckpointStore(t *testing.T, newStore func() checkpointStore) {
+	start := persist.NewCheckpointFromStartOfStream()
+	p := newCheckpointPersister(newStore(), start, time.Hour, func(err error) {
+		t.Errorf("unexpected error: %v", err)
+	})
+
+	// No checkpoint yet, we get the start position.
+	cp, err := p.Read("ns", "hub", "$Default", "0")
+	require.NoError(t, err)
+	assert.Equal(t, start, cp)
+
+	// Start positions written by the receivers are not persisted.
+	require.NoError(t, p.Write("ns", "hub", "$Default", "0", persist.NewCheckpointFromEndOfStream()))
+	cp, err = p.Read("ns", "hub", "$Default", "0")
+	require.NoError(t, err)
+	assert.Equal(t, start, cp)
+
+	enqueued := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, p.Write("ns", "hub", "$Default", "0", persist.NewCheckpoint("100", 5, enqueued)))
+	require.NoError(t, p.Write("ns", "hub", "$Default", "1", persist.NewCheckpoint("200", 7, enqueued)))
+	require.NoError(t, p.Write("ns", "hub", "$Default", "1", persist.NewCheckpoint("300", 8, enqueued)))
+	require.NoError(t, p.Close())
+
+	// A new persister over the same store resumes
+	// from the last checkpoints.
+	p = newCheckpointPersister(newStore(), start, time.Hour, func(err error) {
+		t.Errorf("unexpected error: %v", err)
+	})
+	defer p.Close()
+
+	cp, err = p.Read("ns", "hub", "$Default", "0")
+	require.NoError(t, err)
+	assert.Equal(t, "100", cp.Offset)
+	assert.Equal(t, int64(5), cp.SequenceNumber)
+
+	cp, err = p.Read("ns", "hub", "$Default", "1")
+	require.NoError(t, err)
+	assert.Equal(t, "300", cp.Offset)
+
+	// Other consumer groups are independent.
+	cp, err = p.Read("ns", "hub", "other", "1")
+	require.NoError(t, err)
+	assert.Equal(t, start, cp)
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "checkpoints.json")
+	testCheckpointStore(t, func() checkpointStore {
+		s, err := newFileCheckpointStore(filePath)
+		require.NoError(t, err)
+		return s
+	})
+}
+
+// The blob checkpoint store is tested against a local Azurite
+// emulator, for example:
+//
+//	docker run -p 10000:10000 mcr.microsoft.com/azure-storage/azurite azurite-blob --blobHost 0.0.0.0
+//	AZURITE_CONNECTION_STRING="DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;AccountKey=Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==;BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;" go test ./azure_event_hub/
+func TestBlobCheckpointStore(t *testing.T) {
+	connectionString := os.Getenv("AZURITE_CONNECTION_STRING")
+	if connectionString == "" {
+		t.Skip("AZURITE_CONNECTION_STRING not set")
+	}
+	container := fmt.Sprintf("test-checkpoints-%d", time.Now().UnixNano())
+	testCheckpointStore(t, func() checkpointStore {
+		s, err := newBlobCheckpointStore(t.Context(), connectionString, container)
+		require.NoError(t, err)
+		return s
+	})
+}
@@ -4,24 +4,42 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
+	"github.com/Azure/azure-amqp-common-go/v4/conn"
 	"github.com/Azure/azure-event-hubs-go/v3"
+	"github.com/Azure/azure-event-hubs-go/v3/persist"
 
 	"github.com/refractionPOINT/go-uspclient"
 	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/refractionPOINT/usp-adapters/utils"
 )
 
 const (
-	defaultWriteTimeout = 60 * 10
+	defaultWriteTimeout            = 60 * 10
+	defaultCheckpointIntervalSec   = 10
+	defaultCheckpointContainerName = "usp-adapter-checkpoints"
+
+	startPositionLatest   = "latest"
+	startPositionEarliest = "earliest"
 )
 
 type EventHubAdapter struct {
 	conf      EventHubConfig
-	uspClient *uspclient.Client
+	uspClient *utils.USPClient
+
+	hub         *eventhub.Hub
+	receiveOpts []eventhub.ReceiveOption
+	checkpoints *checkpointPersister
+	// Key of the partitions in the checkpoints, without the partition ID.
+	checkpointPrefix string
 
-	hub       *eventhub.Hub
-	listeners []*eventhub.ListenerHandle
+	mu        sync.Mutex
+	listeners map[string]*eventhub.ListenerHandle
+	isClosing bool
+	// Only set with the checkpoints in Azure Storage.
+	ownership *partitionOwnership
 
 	ctx       context.Context
 	chStopped chan struct{}
@@ -30,6 +48,25 @@ type EventHubAdapter struct {
 type EventHubConfig struct {
 	ClientOptions    uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
 	ConnectionString string                  `json:"connection_string" yaml:"connection_string"`
+	ConsumerGroup    string                  `json:"consumer_group,omitempty" yaml:"consumer_group,omitempty"`
+	// Where to start reading partitions that have no checkpoint:
+	// "latest" (default), "earliest" or an RFC3339 timestamp.
+	StartPosition string `json:"start_position,omitempty" yaml:"start_position,omitempty"`
+
+	// Optional checkpointing of the partition offsets, either to a local
+	// file or to an Azure Storage container. Without it, every restart
+	// starts again from the start_position.
+	//
+	// With an Azure Storage container, replicas of the adapter lease the
+	// partitions in it so each one is received by a single replica, the
+	// additional replicas are on standby. Otherwise, only run one replica
+	// per consumer group.
+	CheckpointFile                    string `json:"checkpoint_file,omitempty" yaml:"checkpoint_file,omitempty"`
+	CheckpointStorageConnectionString string `json:"checkpoint_storage_connection_string,omitempty" yaml:"checkpoint_storage_connection_string,omitempty"`
+	CheckpointContainer               string `json:"checkpoint_container,omitempty" yaml:"checkpoint_container,omitempty"`
+	CheckpointIntervalSec             int    `json:"checkpoint_interval_sec,omitempty" yaml:"checkpoint_interval_sec,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *EventHubConfig) Validate() error {
@@ -39,84 +76,264 @@ func (c *EventHubConfig) Validate() error {
 	if c.ConnectionString == "" {
 		return errors.New("missing connection_string")
 	}
+	if _, err := parseStartPosition(c.StartPosition); err != nil {
+		return err
+	}
+	if c.CheckpointFile != "" && c.CheckpointStorageConnectionString != "" {
+		return errors.New("only one of checkpoint_file or checkpoint_storage_connection_string can be set")
+	}
 	return nil
 }
 
+// parseStartPosition converts the start_position option to
+// the checkpoint a new partition receiver should start from.
+func parseStartPosition(position string) (persist.Checkpoint, error) {
+	switch position {
+	case "", startPositionLatest:
+		return persist.NewCheckpointFromEndOfStream(), nil
+	case startPositionEarliest:
+		return persist.NewCheckpointFromStartOfStream(), nil
+	}
+	t, err := time.Parse(time.RFC3339, position)
+	if err != nil {
+		return persist.Checkpoint{}, fmt.Errorf("invalid start_position, expected %q, %q or an RFC3339 timestamp: %s", startPositionLatest, startPositionEarliest, position)
+	}
+	return persist.NewCheckpoint("", 0, t), nil
+}
+
+func startPositionOption(start persist.Checkpoint) eventhub.ReceiveOption {
+	switch start.Offset {
+	case persist.EndOfStream:
+		return eventhub.ReceiveWithLatestOffset()
+	case "":
+		return eventhub.ReceiveFromTimestamp(start.EnqueueTime)
+	}
+	return eventhub.ReceiveWithStartingOffset(start.Offset)
+}
+
 func NewEventHubAdapter(ctx context.Context, conf EventHubConfig) (*EventHubAdapter, chan struct{}, error) {
+	if conf.ConsumerGroup == "" {
+		conf.ConsumerGroup = eventhub.DefaultConsumerGroup
+	}
+	if conf.CheckpointContainer == "" {
+		conf.CheckpointContainer = defaultCheckpointContainerName
+	}
+	if conf.CheckpointIntervalSec <= 0 {
+		conf.CheckpointIntervalSec = defaultCheckpointIntervalSec
+	}
+	start, err := parseStartPosition(conf.StartPosition)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	a := &EventHubAdapter{
 		conf: conf,
 		ctx:  context.Background(),
 	}
 
-	var err error
-	a.hub, err = eventhub.NewHubFromConnectionString(a.conf.ConnectionString)
+	var store checkpointStore
+	var blobStore *blobCheckpointStore
+	if conf.CheckpointFile != "" {
+		if store, err = newFileCheckpointStore(conf.CheckpointFile); err != nil {
+			return nil, nil, err
+		}
+	} else if conf.CheckpointStorageConnectionString != "" {
+		if blobStore, err = newBlobCheckpointStore(a.ctx, conf.CheckpointStorageConnectionString, conf.CheckpointContainer); err != nil {
+			return nil, nil, err
+		}
+		store = blobStore
+	}
+
+	hubOpts := []eventhub.HubOption{}
+	if store != nil {
+		a.checkpoints = newCheckpointPersister(store, start, time.Duration(conf.CheckpointIntervalSec)*time.Second, a.conf.ClientOptions.OnError)
+		hubOpts = append(hubOpts, eventhub.HubWithOffsetPersistence(a.checkpoints))
+	}
+
+	a.hub, err = eventhub.NewHubFromConnectionString(a.conf.ConnectionString, hubOpts...)
 	if err != nil {
+		a.closeCheckpoints()
 		return nil, nil, err
 	}
 
 	runtimeInfo, err := a.hub.GetRuntimeInformation(a.ctx)
 	if err != nil {
 		a.hub.Close(a.ctx)
+		a.closeCheckpoints()
 		return nil, nil, err
 	}
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewAckedUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		a.hub.Close(a.ctx)
+		a.closeCheckpoints()
 		return nil, nil, err
 	}
 
+	a.receiveOpts = []eventhub.ReceiveOption{
+		eventhub.ReceiveWithConsumerGroup(conf.ConsumerGroup),
+	}
+	if a.checkpoints == nil {
+		// With checkpointing, the persister provides the start
+		// position of partitions that have no checkpoint yet.
+		a.receiveOpts = append(a.receiveOpts, startPositionOption(start))
+	}
+
 	a.chStopped = make(chan struct{})
+	a.listeners = map[string]*eventhub.ListenerHandle{}
 
-	for _, partitionID := range runtimeInfo.PartitionIDs {
-		// Start receiving messages
-		//
-		// Receive blocks while attempting to connect to hub, then runs until listenerHandle.Close() is called
-		// <- listenerHandle.Done() signals listener has stopped
-		// listenerHandle.Err() provides the last error the receiver encountered
-		listenerHandle, err := a.hub.Receive(a.ctx, partitionID, a.processEvent, eventhub.ReceiveWithLatestOffset())
-		if err != nil {
-			for _, l := range a.listeners {
-				l.Close(a.ctx)
+	if blobStore == nil {
+		// Without shared checkpoints, a single replica
+		// receives from all the partitions.
+		for _, partitionID := range runtimeInfo.PartitionIDs {
+			if err := a.startReceiver(partitionID); err != nil {
+				a.closeListeners()
+				a.hub.Close(a.ctx)
+				a.uspClient.Close()
+				a.closeCheckpoints()
+				a.conf.ClientOptions.OnError(err)
+				return nil, nil, err
 			}
-			a.hub.Close(a.ctx)
-			a.uspClient.Close()
-			a.conf.ClientOptions.OnError(err)
-			return nil, nil, err
 		}
-		a.listeners = append(a.listeners, listenerHandle)
-
-		// Listen for termination of this handle. Whenever
-		// any of them fails, we will stop the client.
-		go func(h *eventhub.ListenerHandle) {
-			ch := h.Done()
-			<-ch
-			if err := h.Err(); err != nil && !errors.Is(err, context.Canceled) {
-				a.conf.ClientOptions.OnError(fmt.Errorf("ListenerHandle.Err(): %v", err))
-			}
-			a.chStopped <- struct{}{}
-		}(listenerHandle)
-		a.conf.ClientOptions.DebugLog(fmt.Sprintf("partition listener for %s started", partitionID))
+		return a, a.chStopped, nil
 	}
 
+	// Replicas sharing the checkpoints each receive
+	// from the partitions they own.
+	parsed, err := conn.ParsedConnectionFromStr(a.conf.ConnectionString)
+	if err != nil {
+		a.hub.Close(a.ctx)
+		a.uspClient.Close()
+		a.closeCheckpoints()
+		return nil, nil, err
+	}
+	a.checkpointPrefix = checkpointKey(parsed.Namespace, runtimeInfo.Path, conf.ConsumerGroup, "")
+	leaser := newBlobPartitionLeaser(a.ctx, blobStore.client, conf.CheckpointContainer, a.checkpointPrefix)
+	ownership := newPartitionOwnership(leaser, runtimeInfo.PartitionIDs, ownershipCheckInterval, a.startReceiver, a.stopReceiver, func(err error) {
+		a.conf.ClientOptions.OnWarning(err.Error())
+	})
+	a.mu.Lock()
+	a.ownership = ownership
+	a.mu.Unlock()
+
 	return a, a.chStopped, nil
 }
 
-func (a *EventHubAdapter) Close() error {
-	a.conf.ClientOptions.DebugLog("closing")
+// startReceiver starts receiving from the partition. When partitions
+// are owned, the receiver disconnects any receiver a previous owner
+// still has on the partition.
+func (a *EventHubAdapter) startReceiver(partitionID string) error {
+	opts := a.receiveOpts
+	if a.checkpointPrefix != "" {
+		opts = append(append([]eventhub.ReceiveOption{}, opts...), eventhub.ReceiveWithEpoch(time.Now().UnixMilli()))
+	}
+
+	// Receive blocks while attempting to connect to hub, then runs until listenerHandle.Close() is called
+	// <- listenerHandle.Done() signals listener has stopped
+	// listenerHandle.Err() provides the last error the receiver encountered
+	listenerHandle, err := a.hub.Receive(a.ctx, partitionID, a.processEvent, opts...)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.listeners[partitionID] = listenerHandle
+	a.mu.Unlock()
+
+	// Listen for termination of this handle. Whenever any of
+	// them fails, we stop the client, or give up the partition
+	// if it is owned.
+	go func() {
+		<-listenerHandle.Done()
+		a.mu.Lock()
+		isCurrent := a.listeners[partitionID] == listenerHandle
+		if isCurrent && !a.isClosing {
+			delete(a.listeners, partitionID)
+		}
+		isClosing := a.isClosing
+		ownership := a.ownership
+		a.mu.Unlock()
+		if !isCurrent {
+			// Stopped after the partition was lost.
+			return
+		}
+		if err := listenerHandle.Err(); err != nil && !errors.Is(err, context.Canceled) {
+			a.conf.ClientOptions.OnError(fmt.Errorf("ListenerHandle.Err(): %v", err))
+		}
+		if ownership != nil && !isClosing {
+			ownership.Release(partitionID)
+			return
+		}
+		a.chStopped <- struct{}{}
+	}()
+	a.conf.ClientOptions.DebugLog(fmt.Sprintf("partition listener for %s started (consumer group %s)", partitionID, a.conf.ConsumerGroup))
+	return nil
+}
+
+// stopReceiver stops receiving from a partition now owned by
+// another replica. Its checkpoint is not written anymore so
+// that it does not overwrite the ones of the new owner.
+func (a *EventHubAdapter) stopReceiver(partitionID string) {
+	a.mu.Lock()
+	listenerHandle := a.listeners[partitionID]
+	delete(a.listeners, partitionID)
+	a.mu.Unlock()
+	if listenerHandle != nil {
+		listenerHandle.Close(a.ctx)
+	}
+	if a.checkpoints != nil {
+		a.checkpoints.Forget(a.checkpointPrefix + "/" + partitionID)
+	}
+	a.conf.ClientOptions.DebugLog(fmt.Sprintf("partition listener for %s stopped", partitionID))
+}
+
+func (a *EventHubAdapter) closeListeners() {
+	a.mu.Lock()
+	a.isClosing = true
+	listeners := make([]*eventhub.ListenerHandle, 0, len(a.listeners))
 	for _, l := range a.listeners {
+		listeners = append(listeners, l)
+	}
+	a.mu.Unlock()
+	for _, l := range listeners {
 		l.Close(a.ctx)
 	}
+}
+
+func (a *EventHubAdapter) Close() error {
+	a.conf.ClientOptions.DebugLog("closing")
+	a.mu.Lock()
+	ownership := a.ownership
+	a.mu.Unlock()
+	if ownership != nil {
+		ownership.Stop()
+	}
+	a.closeListeners()
 	err1 := a.hub.Close(a.ctx)
 	err2 := a.uspClient.Drain(1 * time.Minute)
 	_, err3 := a.uspClient.Close()
+	// Only flush the final checkpoints once everything
+	// we received was shipped.
+	err4 := a.closeCheckpoints()
+	if ownership != nil {
+		ownership.Close()
+	}
 	if err1 != nil {
 		return err1
 	}
 	if err2 != nil {
 		return err2
 	}
-	return err3
+	if err3 != nil {
+		return err3
+	}
+	return err4
+}
+
+func (a *EventHubAdapter) closeCheckpoints() error {
+	if a.checkpoints == nil {
+		return nil
+	}
+	return a.checkpoints.Close()
 }
 
 func (a *EventHubAdapter) processEvent(ctx context.Context, message *eventhub.Event) error {
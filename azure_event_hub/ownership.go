@@ -0,0 +1,218 @@
+package usp_azure_event_hub
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/lease"
+	"github.com/google/uuid"
+)
+
+const (
+	leaseDurationSec       = 60
+	ownershipCheckInterval = 20 * time.Second
+)
+
+// partitionLeaser gives the ownership of a partition
+// to a single replica of the adapter at a time.
+type partitionLeaser interface {
+	// Returns false if another replica owns the partition.
+	Acquire(partitionID string) (bool, error)
+	// Returns an error if the partition is not owned anymore.
+	Renew(partitionID string) error
+	Release(partitionID string) error
+}
+
+// partitionOwnership periodically renews the partitions owned
+// and claims the ones no replica owns, like the partitions of a
+// replica that stopped. Replicas claim all the partitions they
+// can, so additional replicas are on standby.
+type partitionOwnership struct {
+	leaser       partitionLeaser
+	partitionIDs []string
+	// Start and stop receiving from a partition.
+	onAcquired func(partitionID string) error
+	onLost     func(partitionID string)
+	onError    func(error)
+
+	mu    sync.Mutex
+	owned map[string]struct{}
+
+	chStop chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newPartitionOwnership(leaser partitionLeaser, partitionIDs []string, interval time.Duration, onAcquired func(string) error, onLost func(string), onError func(error)) *partitionOwnership {
+	o := &partitionOwnership{
+		leaser:       leaser,
+		partitionIDs: partitionIDs,
+		onAcquired:   onAcquired,
+		onLost:       onLost,
+		onError:      onError,
+		owned:        map[string]struct{}{},
+		chStop:       make(chan struct{}),
+	}
+	o.update()
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-o.chStop:
+				return
+			case <-ticker.C:
+			}
+			o.update()
+		}
+	}()
+	return o
+}
+
+func (o *partitionOwnership) update() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, partitionID := range o.partitionIDs {
+		if _, ok := o.owned[partitionID]; ok {
+			if err := o.leaser.Renew(partitionID); err != nil {
+				o.onError(fmt.Errorf("partition %s lost: %v", partitionID, err))
+				delete(o.owned, partitionID)
+				o.onLost(partitionID)
+			}
+			continue
+		}
+		isAcquired, err := o.leaser.Acquire(partitionID)
+		if err != nil {
+			o.onError(fmt.Errorf("partition %s: %v", partitionID, err))
+			continue
+		}
+		if !isAcquired {
+			continue
+		}
+		if err := o.onAcquired(partitionID); err != nil {
+			o.onError(fmt.Errorf("partition %s: %v", partitionID, err))
+			o.leaser.Release(partitionID)
+			continue
+		}
+		o.owned[partitionID] = struct{}{}
+	}
+}
+
+// Release gives up a partition, for example if its receiver
+// failed, so that it can be claimed again.
+func (o *partitionOwnership) Release(partitionID string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.owned[partitionID]; !ok {
+		return
+	}
+	delete(o.owned, partitionID)
+	if err := o.leaser.Release(partitionID); err != nil {
+		o.onError(fmt.Errorf("partition %s: %v", partitionID, err))
+	}
+}
+
+// Stop stops claiming partitions, the owned partitions
+// are kept until Close.
+func (o *partitionOwnership) Stop() {
+	select {
+	case <-o.chStop:
+		return
+	default:
+	}
+	close(o.chStop)
+	o.wg.Wait()
+}
+
+// Close releases the owned partitions, once
+// their final checkpoints were written.
+func (o *partitionOwnership) Close() {
+	o.Stop()
+	o.mu.Lock()
+	owned := o.owned
+	o.owned = map[string]struct{}{}
+	o.mu.Unlock()
+	for partitionID := range owned {
+		if err := o.leaser.Release(partitionID); err != nil {
+			o.onError(fmt.Errorf("partition %s: %v", partitionID, err))
+		}
+	}
+}
+
+// blobPartitionLeaser owns partitions with leases on
+// blobs in the checkpoint container, one per partition.
+type blobPartitionLeaser struct {
+	ctx       context.Context
+	container *container.Client
+	prefix    string
+	leaseID   string
+}
+
+func newBlobPartitionLeaser(ctx context.Context, client *azblob.Client, containerName string, prefix string) *blobPartitionLeaser {
+	return &blobPartitionLeaser{
+		ctx:       ctx,
+		container: client.ServiceClient().NewContainerClient(containerName),
+		prefix:    path.Join("ownership", prefix),
+		leaseID:   uuid.NewString(),
+	}
+}
+
+func (l *blobPartitionLeaser) leaseClient(partitionID string) (*lease.BlobClient, error) {
+	return lease.NewBlobClient(l.container.NewBlockBlobClient(path.Join(l.prefix, partitionID)), &lease.BlobClientOptions{
+		LeaseID: &l.leaseID,
+	})
+}
+
+func (l *blobPartitionLeaser) Acquire(partitionID string) (bool, error) {
+	blobClient := l.container.NewBlockBlobClient(path.Join(l.prefix, partitionID))
+	if _, err := blobClient.GetProperties(l.ctx, nil); err != nil {
+		if !bloberror.HasCode(err, bloberror.BlobNotFound) {
+			return false, fmt.Errorf("azblob.GetProperties(): %v", err)
+		}
+		// Another replica creating and leasing
+		// the blob first makes the upload fail.
+		if _, err := blobClient.UploadBuffer(l.ctx, []byte{}, nil); err != nil && !bloberror.HasCode(err, bloberror.LeaseIDMissing) {
+			return false, fmt.Errorf("azblob.UploadBuffer(): %v", err)
+		}
+	}
+	leaseClient, err := l.leaseClient(partitionID)
+	if err != nil {
+		return false, err
+	}
+	if _, err := leaseClient.AcquireLease(l.ctx, leaseDurationSec, nil); err != nil {
+		if bloberror.HasCode(err, bloberror.LeaseAlreadyPresent) {
+			return false, nil
+		}
+		return false, fmt.Errorf("azblob.AcquireLease(): %v", err)
+	}
+	return true, nil
+}
+
+func (l *blobPartitionLeaser) Renew(partitionID string) error {
+	leaseClient, err := l.leaseClient(partitionID)
+	if err != nil {
+		return err
+	}
+	if _, err := leaseClient.RenewLease(l.ctx, nil); err != nil {
+		return fmt.Errorf("azblob.RenewLease(): %v", err)
+	}
+	return nil
+}
+
+func (l *blobPartitionLeaser) Release(partitionID string) error {
+	leaseClient, err := l.leaseClient(partitionID)
+	if err != nil {
+		return err
+	}
+	if _, err := leaseClient.ReleaseLease(l.ctx, nil); err != nil {
+		return fmt.Errorf("azblob.ReleaseLease(): %v", err)
+	}
+	return nil
+}
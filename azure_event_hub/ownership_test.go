@@ -0,0 +1,151 @@
+package usp_azure_event_hub
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryLeases are the leases of the partitions shared
+// by the replicas, expiring based on a fake clock.
+type memoryLeases struct {
+	mu      sync.Mutex
+	now     time.Time
+	owners  map[string]string
+	expires map[string]time.Time
+}
+
+func (m *memoryLeases) advance(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.now = m.now.Add(d)
+}
+
+type memoryLeaser struct {
+	leases  *memoryLeases
+	ownerID string
+}
+
+func (l *memoryLeaser) Acquire(partitionID string) (bool, error) {
+	m := l.leases
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if owner, ok := m.owners[partitionID]; ok && owner != l.ownerID && m.now.Before(m.expires[partitionID]) {
+		return false, nil
+	}
+	m.owners[partitionID] = l.ownerID
+	m.expires[partitionID] = m.now.Add(leaseDurationSec * time.Second)
+	return true, nil
+}
+
+func (l *memoryLeaser) Renew(partitionID string) error {
+	m := l.leases
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.owners[partitionID] != l.ownerID {
+		return errors.New("lease lost")
+	}
+	m.expires[partitionID] = m.now.Add(leaseDurationSec * time.Second)
+	return nil
+}
+
+func (l *memoryLeaser) Release(partitionID string) error {
+	m := l.leases
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.owners[partitionID] == l.ownerID {
+		delete(m.owners, partitionID)
+	}
+	return nil
+}
+
+// testConsumer records the partitions it receives from.
+type testConsumer struct {
+	mu        sync.Mutex
+	receiving map[string]bool
+}
+
+func (c *testConsumer) partitions() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	partitions := []string{}
+	for _, p := range []string{"0", "1", "2", "3"} {
+		if c.receiving[p] {
+			partitions = append(partitions, p)
+		}
+	}
+	return partitions
+}
+
+func newTestConsumer(leases *memoryLeases, ownerID string) (*partitionOwnership, *testConsumer) {
+	c := &testConsumer{receiving: map[string]bool{}}
+	o := newPartitionOwnership(&memoryLeaser{leases: leases, ownerID: ownerID}, []string{"0", "1", "2", "3"}, time.Hour, func(partitionID string) error {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.receiving[partitionID] = true
+		return nil
+	}, func(partitionID string) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.receiving[partitionID] = false
+	}, func(err error) {})
+	return o, c
+}
+
+func TestPartitionOwnership(t *testing.T) {
+	leases := &memoryLeases{
+		now:     time.Now(),
+		owners:  map[string]string{},
+		expires: map[string]time.Time{},
+	}
+
+	// The first consumer owns all the partitions,
+	// the second one is on standby.
+	o1, c1 := newTestConsumer(leases, "replica-1")
+	o2, c2 := newTestConsumer(leases, "replica-2")
+	defer o2.Close()
+	assert.Equal(t, []string{"0", "1", "2", "3"}, c1.partitions())
+	assert.Empty(t, c2.partitions())
+
+	// Leases are renewed while the owner runs.
+	for i := 0; i < 3; i++ {
+		leases.advance(ownershipCheckInterval)
+		o1.update()
+		o2.update()
+	}
+	assert.Len(t, c1.partitions(), 4)
+	assert.Empty(t, c2.partitions())
+
+	// A partition the first consumer failed to receive
+	// from is claimed by the second one.
+	o1.Release("2")
+	c1.mu.Lock()
+	c1.receiving["2"] = false
+	c1.mu.Unlock()
+	o2.update()
+	o1.update()
+	assert.Equal(t, []string{"0", "1", "3"}, c1.partitions())
+	assert.Equal(t, []string{"2"}, c2.partitions())
+
+	// The first consumer hangs, its leases expire and the
+	// second one takes over. Once back, it stops receiving.
+	o1.Stop()
+	leases.advance(2 * leaseDurationSec * time.Second)
+	o2.update()
+	assert.Equal(t, []string{"0", "1", "2", "3"}, c2.partitions())
+	o1.update()
+	assert.Empty(t, c1.partitions())
+	o1.Close()
+
+	// The partitions of a consumer closing are released.
+	o3, c3 := newTestConsumer(leases, "replica-3")
+	defer o3.Close()
+	assert.Empty(t, c3.partitions())
+	o2.Close()
+	o3.update()
+	require.Equal(t, []string{"0", "1", "2", "3"}, c3.partitions())
+}
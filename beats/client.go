@@ -0,0 +1,313 @@
+package usp_beats
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/refractionPOINT/usp-adapters/utils"
+)
+
+const (
+	defaultWriteTimeout = 60 * 10
+	// Beats reconnect and send the window again when
+	// they get no ack for 30 seconds by default.
+	keepaliveInterval = 5 * time.Second
+)
+
+type BeatsAdapter struct {
+	conf         BeatsConfig
+	listener     net.Listener
+	connMutex    sync.Mutex
+	wg           sync.WaitGroup
+	isRunning    uint32
+	uspClient    *utils.USPClient
+	writeTimeout time.Duration
+}
+
+type BeatsConfig struct {
+	ClientOptions     uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
+	Port              uint16                  `json:"port" yaml:"port"`
+	Interface         string                  `json:"iface" yaml:"iface"`
+	SslCertPath       string                  `json:"ssl_cert" yaml:"ssl_cert"`
+	SslKeyPath        string                  `json:"ssl_key" yaml:"ssl_key"`
+	MutualTlsCertPath string                  `json:"mutual_tls_cert,omitempty" yaml:"mutual_tls_cert,omitempty"`
+	WriteTimeoutSec   uint64                  `json:"write_timeout_sec,omitempty" yaml:"write_timeout_sec,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+}
+
+func (c *BeatsConfig) Validate() error {
+	if err := c.ClientOptions.Validate(); err != nil {
+		return fmt.Errorf("client_options: %v", err)
+	}
+	if c.Port == 0 {
+		return errors.New("missing port")
+	}
+	if (c.SslCertPath == "") != (c.SslKeyPath == "") {
+		return errors.New("ssl_cert and ssl_key must be set together")
+	}
+	return nil
+}
+
+func NewBeatsAdapter(ctx context.Context, conf BeatsConfig) (*BeatsAdapter, chan struct{}, error) {
+	a := &BeatsAdapter{
+		conf:      conf,
+		isRunning: 1,
+	}
+
+	if a.conf.WriteTimeoutSec == 0 {
+		a.conf.WriteTimeoutSec = defaultWriteTimeout
+	}
+	a.writeTimeout = time.Duration(a.conf.WriteTimeoutSec) * time.Second
+
+	addr := fmt.Sprintf("%s:%d", conf.Interface, conf.Port)
+	var l net.Listener
+	var err error
+	if conf.SslCertPath != "" && conf.SslKeyPath != "" {
+		var tlsConfig *tls.Config
+		tlsConfig, err = utils.LoadServerTLSConfig(conf.SslCertPath, conf.SslKeyPath, conf.MutualTlsCertPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		l, err = tls.Listen("tcp", addr, tlsConfig)
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	a.uspClient, err = utils.NewAckedUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
+	if err != nil {
+		l.Close()
+		return nil, nil, err
+	}
+
+	a.listener = l
+
+	chStopped := make(chan struct{})
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer close(chStopped)
+		a.handleConnections()
+	}()
+
+	return a, chStopped, nil
+}
+
+func (a *BeatsAdapter) Close() error {
+	a.conf.ClientOptions.DebugLog("closing")
+	atomic.StoreUint32(&a.isRunning, 0)
+	err1 := a.listener.Close()
+	err2 := a.uspClient.Drain(1 * time.Minute)
+	_, err3 := a.uspClient.Close()
+
+	if err1 != nil {
+		return err1
+	}
+
+	if err2 != nil {
+		return err2
+	}
+
+	return err3
+}
+
+func (a *BeatsAdapter) handleConnections() {
+	a.conf.ClientOptions.DebugLog(fmt.Sprintf("listening for connections on %s:%d", a.conf.Interface, a.conf.Port))
+
+	var err error
+
+	defer a.conf.ClientOptions.DebugLog(fmt.Sprintf("stopped listening for connections on %s:%d (%v)", a.conf.Interface, a.conf.Port, err))
+
+	for atomic.LoadUint32(&a.isRunning) == 1 {
+		var conn net.Conn
+		conn, err = a.listener.Accept()
+		if err != nil {
+			break
+		}
+		a.connMutex.Lock()
+		if atomic.LoadUint32(&a.isRunning) == 0 {
+			a.connMutex.Unlock()
+			conn.Close()
+			break
+		}
+		a.wg.Add(1)
+		a.connMutex.Unlock()
+		go func() {
+			defer a.wg.Done()
+			a.handleConnection(conn)
+		}()
+	}
+}
+
+func (a *BeatsAdapter) handleConnection(conn net.Conn) {
+	a.conf.ClientOptions.DebugLog(fmt.Sprintf("handling new connection from %+v", conn.RemoteAddr()))
+	defer func() {
+		a.conf.ClientOptions.DebugLog(fmt.Sprintf("connection from %+v leaving", conn.RemoteAddr()))
+		conn.Close()
+	}()
+
+	ka := newKeepalive(conn, keepaliveInterval)
+	defer ka.stop()
+
+	w := &window{}
+	r := bufio.NewReader(conn)
+	for atomic.LoadUint32(&a.isRunning) == 1 {
+		f, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, io.ErrUnexpectedEOF) {
+				a.conf.ClientOptions.OnWarning(fmt.Sprintf("invalid frame from %+v: %v", conn.RemoteAddr(), err))
+			}
+			return
+		}
+		if err := a.handleFrame(conn, ka, w, f); err != nil {
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("connection from %+v: %v", conn.RemoteAddr(), err))
+			return
+		}
+	}
+}
+
+// window tracks the events received since the
+// window size was set by the beat.
+type window struct {
+	size  uint32
+	count uint32
+	// Sequence of the last event shipped.
+	lastSeq uint32
+}
+
+func (a *BeatsAdapter) handleFrame(conn net.Conn, ka *keepalive, w *window, f frame) error {
+	switch f.kind {
+	case frameWindowSize:
+		w.size = f.windowSize
+		w.count = 0
+		w.lastSeq = 0
+	case frameCompressed:
+		for _, inner := range f.frames {
+			if err := a.handleFrame(conn, ka, w, inner); err != nil {
+				return err
+			}
+		}
+	case frameJSON, frameData:
+		// While shipping blocks, acks of the events already
+		// shipped keep the beat waiting for the window.
+		isShipped := ka.run(makeAck(f.version, w.lastSeq), func() bool {
+			return a.ship(f.event)
+		})
+		if !isShipped {
+			// Without the ack, the beat sends the
+			// window again on a new connection.
+			return errors.New("event not shipped")
+		}
+		w.lastSeq = f.seq
+		w.count++
+		// The ack covers all the events of the window up to the sequence.
+		if w.count >= w.size {
+			w.count = 0
+			if _, err := conn.Write(makeAck(f.version, f.seq)); err != nil {
+				return fmt.Errorf("ack: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// keepalive writes the ack of the events already shipped
+// while shipping an event blocks for longer than interval.
+// A single goroutine serves all the events of a connection.
+type keepalive struct {
+	conn     io.Writer
+	interval time.Duration
+	chStop   chan struct{}
+	wg       sync.WaitGroup
+
+	mu sync.Mutex
+	// Ack to write while an event is being shipped.
+	ack      []byte
+	since    time.Time
+	isBroken bool
+}
+
+func newKeepalive(conn io.Writer, interval time.Duration) *keepalive {
+	k := &keepalive{
+		conn:     conn,
+		interval: interval,
+		chStop:   make(chan struct{}),
+	}
+	k.wg.Add(1)
+	go k.loop()
+	return k
+}
+
+func (k *keepalive) loop() {
+	defer k.wg.Done()
+	// Ticking twice per interval keeps the first write
+	// at most 1.5 interval after the event started.
+	ticker := time.NewTicker(k.interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.chStop:
+			return
+		case now := <-ticker.C:
+			k.mu.Lock()
+			if k.ack != nil && !k.isBroken && now.Sub(k.since) >= k.interval {
+				if _, err := k.conn.Write(k.ack); err != nil {
+					k.isBroken = true
+				}
+				k.since = now
+			}
+			k.mu.Unlock()
+		}
+	}
+}
+
+// run runs f, writing the ack every interval once it blocks
+// for that long. Nothing is written to the connection after.
+func (k *keepalive) run(ack []byte, f func() bool) bool {
+	k.mu.Lock()
+	k.ack = ack
+	k.since = time.Now()
+	k.mu.Unlock()
+
+	isSuccess := f()
+
+	k.mu.Lock()
+	k.ack = nil
+	k.mu.Unlock()
+	return isSuccess
+}
+
+func (k *keepalive) stop() {
+	close(k.chStop)
+	k.wg.Wait()
+}
+
+func (a *BeatsAdapter) ship(event map[string]interface{}) bool {
+	msg := &protocol.DataMessage{
+		JsonPayload: event,
+		TimestampMs: eventTimestampMs(event),
+	}
+	err := a.uspClient.Ship(msg, a.writeTimeout)
+	if err == uspclient.ErrorBufferFull {
+		a.conf.ClientOptions.OnWarning("stream falling behind")
+		err = a.uspClient.Ship(msg, 1*time.Hour)
+	}
+	if err != nil {
+		a.conf.ClientOptions.OnError(fmt.Errorf("Ship(): %v", err))
+		return false
+	}
+	return true
+}
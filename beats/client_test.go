@@ -0,0 +1,175 @@
+package usp_beats
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func uint32Bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func windowFrame(size uint32) []byte {
+	return append([]byte("2W"), uint32Bytes(size)...)
+}
+
+func jsonFrame(seq uint32, data string) []byte {
+	b := append([]byte("2J"), uint32Bytes(seq)...)
+	b = append(b, uint32Bytes(uint32(len(data)))...)
+	return append(b, data...)
+}
+
+func compressedFrame(frames ...[]byte) []byte {
+	buf := bytes.Buffer{}
+	w := zlib.NewWriter(&buf)
+	for _, f := range frames {
+		w.Write(f)
+	}
+	w.Close()
+	b := append([]byte("2C"), uint32Bytes(uint32(buf.Len()))...)
+	return append(b, buf.Bytes()...)
+}
+
+func read(t *testing.T, data []byte) frame {
+	f, err := readFrame(bufio.NewReader(bytes.NewReader(data)))
+	require.NoError(t, err)
+	return f
+}
+
+func TestReadFrame(t *testing.T) {
+	f := read(t, windowFrame(2))
+	assert.Equal(t, frame{version: '2', kind: frameWindowSize, windowSize: 2}, f)
+
+	f = read(t, jsonFrame(1, `{"@timestamp":"2024-01-02T03:04:05.123Z","message":"hello","count":3}`))
+	assert.Equal(t, uint32(1), f.seq)
+	assert.Equal(t, map[string]interface{}{"@timestamp": "2024-01-02T03:04:05.123Z", "message": "hello", "count": uint64(3)}, f.event)
+	assert.Equal(t, uint64(1704164645123), eventTimestampMs(f.event))
+
+	data := append([]byte("1D"), uint32Bytes(7)...)
+	data = append(data, uint32Bytes(1)...)
+	data = append(data, uint32Bytes(4)...)
+	data = append(data, "line"...)
+	data = append(data, uint32Bytes(2)...)
+	data = append(data, "hi"...)
+	f = read(t, data)
+	assert.Equal(t, frame{version: '1', kind: frameData, seq: 7, event: map[string]interface{}{"line": "hi"}}, f)
+
+	f = read(t, compressedFrame(jsonFrame(1, `{"a":1}`), jsonFrame(2, `{"b":2}`)))
+	require.Len(t, f.frames, 2)
+	assert.Equal(t, uint32(2), f.frames[1].seq)
+	assert.Equal(t, map[string]interface{}{"b": uint64(2)}, f.frames[1].event)
+
+	for _, invalid := range [][]byte{
+		[]byte("3W\x00\x00\x00\x01"),
+		[]byte("2X"),
+		jsonFrame(1, `{"a":`),
+		append([]byte("2C"), uint32Bytes(3)...),
+		compressedFrame(compressedFrame(jsonFrame(1, `{}`))),
+		append(append([]byte("2J"), uint32Bytes(1)...), uint32Bytes(maxFrameSize+1)...),
+	} {
+		_, err := readFrame(bufio.NewReader(bytes.NewReader(invalid)))
+		assert.Error(t, err, "%q", invalid)
+	}
+}
+
+func TestWindowAck(t *testing.T) {
+	a, chStopped, err := NewBeatsAdapter(context.Background(), BeatsConfig{
+		ClientOptions: uspclient.ClientOptions{
+			TestSinkMode: true,
+			DebugLog:     func(msg string) {},
+			OnWarning:    func(msg string) {},
+			OnError:      func(err error) { t.Errorf("unexpected error: %v", err) },
+		},
+		Interface: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", a.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// A compressed window, as sent by the beats.
+	_, err = conn.Write(append(windowFrame(2), compressedFrame(jsonFrame(1, `{"a":1}`), jsonFrame(2, `{"b":2}`))...))
+	require.NoError(t, err)
+	ack := make([]byte, 6)
+	_, err = io.ReadFull(conn, ack)
+	require.NoError(t, err)
+	assert.Equal(t, makeAck('2', 2), ack)
+
+	// The ack is only sent once the window is complete.
+	_, err = conn.Write(append(windowFrame(2), jsonFrame(1, `{"a":1}`)...))
+	require.NoError(t, err)
+	_, err = conn.Write(jsonFrame(2, `{"b":2}`))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, ack)
+	require.NoError(t, err)
+	assert.Equal(t, makeAck('2', 2), ack)
+
+	require.NoError(t, a.Close())
+	select {
+	case <-chStopped:
+	case <-time.After(10 * time.Second):
+		t.Error("adapter did not stop")
+	}
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte{}, b.buf.Bytes()...)
+}
+
+func TestKeepalive(t *testing.T) {
+	ack := makeAck('2', 3)
+
+	// Shipping fast, no keepalive.
+	out := &syncBuffer{}
+	ka := newKeepalive(out, 20*time.Millisecond)
+	defer ka.stop()
+	for i := 0; i < 10; i++ {
+		assert.True(t, ka.run(ack, func() bool { return true }))
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, out.Bytes())
+
+	// Shipping blocks, the last ack is sent again until it returns.
+	assert.False(t, ka.run(ack, func() bool {
+		time.Sleep(110 * time.Millisecond)
+		return false
+	}))
+	sent := out.Bytes()
+	assert.GreaterOrEqual(t, len(sent)/len(ack), 3)
+	assert.LessOrEqual(t, len(sent)/len(ack), 5)
+	assert.Equal(t, 0, len(sent)%len(ack))
+	assert.Equal(t, ack, sent[:len(ack)])
+
+	// Nothing is written once it returned.
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, sent, out.Bytes())
+}
@@ -0,0 +1,185 @@
+package usp_beats
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/refractionPOINT/usp-adapters/utils"
+)
+
+// The Lumberjack protocol used by Beats to ship to Logstash:
+// https://github.com/elastic/go-lumber
+//
+// Every frame starts with the version and its type:
+//
+//	'W' window size: uint32 count of events before an ack.
+//	'C' compressed:  uint32 length, then zlib compressed frames.
+//	'J' JSON event:  uint32 sequence, uint32 length, then the JSON.
+//	'D' data event:  uint32 sequence, uint32 count, then count
+//	                 key and value pairs of uint32 length and data.
+//
+// The receiver acks with the version, 'A' and the uint32 sequence
+// of the last event processed.
+
+const (
+	versionV1 = '1'
+	versionV2 = '2'
+
+	frameWindowSize = 'W'
+	frameCompressed = 'C'
+	frameJSON       = 'J'
+	frameData       = 'D'
+	frameAck        = 'A'
+
+	// Limits the memory a frame can use.
+	maxFrameSize = 64 * 1024 * 1024
+)
+
+// frame is a decoded frame, compressed frames
+// are decoded into the frames they contain.
+type frame struct {
+	version    byte
+	kind       byte
+	windowSize uint32
+	seq        uint32
+	event      map[string]interface{}
+	frames     []frame
+}
+
+func readFrame(r *bufio.Reader) (frame, error) {
+	f := frame{}
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return f, err
+	}
+	f.version, f.kind = header[0], header[1]
+	if f.version != versionV1 && f.version != versionV2 {
+		return f, fmt.Errorf("unsupported version: %q", f.version)
+	}
+
+	var err error
+	switch f.kind {
+	case frameWindowSize:
+		f.windowSize, err = readUint32(r)
+	case frameCompressed:
+		var data []byte
+		if data, err = readBlock(r); err != nil {
+			return f, err
+		}
+		f.frames, err = readCompressedFrames(data)
+	case frameJSON:
+		if f.seq, err = readUint32(r); err != nil {
+			return f, err
+		}
+		var data []byte
+		if data, err = readBlock(r); err != nil {
+			return f, err
+		}
+		f.event, err = utils.UnmarshalCleanJSON(string(data))
+	case frameData:
+		if f.seq, err = readUint32(r); err != nil {
+			return f, err
+		}
+		f.event, err = readDataEvent(r)
+	default:
+		return f, fmt.Errorf("unsupported frame type: %q", f.kind)
+	}
+	return f, err
+}
+
+func readCompressedFrames(data []byte) ([]frame, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("zlib: %v", err)
+	}
+	defer zr.Close()
+	decompressed, err := io.ReadAll(io.LimitReader(zr, maxFrameSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("zlib: %v", err)
+	}
+	if len(decompressed) > maxFrameSize {
+		return nil, fmt.Errorf("decompressed frame larger than %d bytes", maxFrameSize)
+	}
+
+	frames := []frame{}
+	br := bufio.NewReader(bytes.NewReader(decompressed))
+	for {
+		if _, err := br.Peek(1); err == io.EOF {
+			return frames, nil
+		}
+		f, err := readFrame(br)
+		if err != nil {
+			return nil, err
+		}
+		if f.kind == frameCompressed {
+			return nil, errors.New("nested compressed frame")
+		}
+		frames = append(frames, f)
+	}
+}
+
+func readDataEvent(r io.Reader) (map[string]interface{}, error) {
+	nPairs, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	event := map[string]interface{}{}
+	for i := uint32(0); i < nPairs; i++ {
+		k, err := readBlock(r)
+		if err != nil {
+			return nil, err
+		}
+		v, err := readBlock(r)
+		if err != nil {
+			return nil, err
+		}
+		event[string(k)] = string(v)
+	}
+	return event, nil
+}
+
+func readUint32(r io.Reader) (uint32, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func readBlock(r io.Reader) ([]byte, error) {
+	size, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes larger than %d bytes", size, maxFrameSize)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func makeAck(version byte, seq uint32) []byte {
+	b := []byte{version, frameAck, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[2:], seq)
+	return b
+}
+
+// eventTimestampMs returns the @timestamp set by the
+// beat, or now if it is missing or invalid.
+func eventTimestampMs(event map[string]interface{}) uint64 {
+	if s, ok := event["@timestamp"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil && t.UnixMilli() > 0 {
+			return uint64(t.UnixMilli())
+		}
+	}
+	return uint64(time.Now().UnixNano() / int64(time.Millisecond))
+}
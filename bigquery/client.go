@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"github.com/refractionPOINT/go-uspclient"
 	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/refractionPOINT/usp-adapters/utils"
 	"strings"
 	"sync"
 	"time"
@@ -25,7 +26,7 @@ type BigQueryAdapter struct {
 	table     *bigquery.Table
 	isStop    uint32
 	wg        sync.WaitGroup
-	uspClient *uspclient.Client
+	uspClient *utils.USPClient
 	ctx       context.Context
 	cancel    context.CancelFunc
 }
@@ -81,7 +82,7 @@ func NewBigQueryAdapter(ctx context.Context, conf BigQueryConfig) (*BigQueryAdap
 	bq.dataset = bq.client.Dataset(bq.conf.DatasetName)
 	bq.table = bq.dataset.Table(bq.conf.TableName)
 
-	bq.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	bq.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
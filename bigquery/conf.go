@@ -2,6 +2,7 @@ package usp_bigquery
 
 import (
 	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/usp-adapters/utils"
 )
 
 type BigQueryConfig struct {
@@ -14,4 +15,6 @@ type BigQueryConfig struct {
 	SqlQuery            string                  `json:"sql_query" yaml:"sql_query"`
 	QueryInterval       string                  `json:"query_interval" yaml:"query_interval"`
 	IsOneTimeLoad       bool                    `json:"is_one_time_load" yaml:"is_one_time_load"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
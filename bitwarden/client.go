@@ -32,6 +32,8 @@ type BitwardenConfig struct {
 	Region           string                  `json:"region" yaml:"region"`                         // "us" or "eu", defaults to "us"
 	TokenEndpointURL string                  `json:"token_endpoint_url" yaml:"token_endpoint_url"` // Custom token endpoint URL for self-hosted instances
 	EventsBaseURL    string                  `json:"events_base_url" yaml:"events_base_url"`       // Custom events base URL for self-hosted instances
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *BitwardenConfig) Validate() error {
@@ -75,7 +77,7 @@ func (c *BitwardenConfig) Validate() error {
 
 type BitwardenAdapter struct {
 	conf          BitwardenConfig
-	uspClient     *uspclient.Client
+	uspClient     *utils.USPClient
 	httpClient    *http.Client
 	chStopped     chan struct{}
 	wgSenders     sync.WaitGroup
@@ -114,7 +116,7 @@ func NewBitwardenAdapter(ctx context.Context, conf BitwardenConfig) (*BitwardenA
 		a.tokenEndpoint = tokenEndpointUS
 	}
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -28,6 +28,8 @@ type BoxConfig struct {
 	ClientID      string                  `json:"client_id" yaml:"client_id"`
 	ClientSecret  string                  `json:"client_secret" yaml:"client_secret"`
 	SubjectID     string                  `json:"subject_id" yaml:"subject_id"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *BoxConfig) Validate() error {
@@ -43,7 +45,7 @@ func (c *BoxConfig) Validate() error {
 
 type BoxAdapter struct {
 	conf           BoxConfig
-	uspClient      *uspclient.Client
+	uspClient      *utils.USPClient
 	httpClient     *http.Client
 	chStopped      chan struct{}
 	wgSenders      sync.WaitGroup
@@ -65,7 +67,7 @@ func NewBoxAdapter(ctx context.Context, conf BoxConfig) (*BoxAdapter, chan struc
 		initialized:    false,
 	}
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -18,6 +18,7 @@ import (
 
 	"github.com/refractionPOINT/go-uspclient"
 	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/refractionPOINT/usp-adapters/utils"
 	"golang.org/x/net/context/ctxhttp"
 )
 
@@ -39,6 +40,8 @@ type CatoConfig struct {
 	WriteTimeoutSec uint64                  `json:"write_timeout_sec,omitempty" yaml:"write_timeout_sec,omitempty"`
 	ApiKey          string                  `json:"apikey" yaml:"apikey"`
 	AccountId       int                     `json:"accountid" yaml:"accountid"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *CatoConfig) Validate() error {
@@ -59,7 +62,7 @@ type CatoAdapter struct {
 	wg           sync.WaitGroup
 	isRunning    uint32
 	mRunning     sync.RWMutex
-	uspClient    *uspclient.Client
+	uspClient    *utils.USPClient
 	writeTimeout time.Duration
 
 	chStopped chan struct{}
@@ -80,7 +83,7 @@ func NewCatoAdapter(ctx context.Context, conf CatoConfig) (*CatoAdapter, chan st
 	a.writeTimeout = time.Duration(a.conf.WriteTimeoutSec) * time.Second
 
 	var err error
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -4,7 +4,9 @@ import (
 	usp_bigquery "github.com/refractionPOINT/usp-adapters/bigquery"
 
 	"github.com/refractionPOINT/usp-adapters/1password"
+	"github.com/refractionPOINT/usp-adapters/azure_blob"
 	"github.com/refractionPOINT/usp-adapters/azure_event_hub"
+	"github.com/refractionPOINT/usp-adapters/beats"
 	"github.com/refractionPOINT/usp-adapters/bitwarden"
 	"github.com/refractionPOINT/usp-adapters/box"
 	"github.com/refractionPOINT/usp-adapters/cato"
@@ -15,16 +17,22 @@ import (
 	"github.com/refractionPOINT/usp-adapters/evtx"
 	"github.com/refractionPOINT/usp-adapters/falconcloud"
 	"github.com/refractionPOINT/usp-adapters/file"
+	"github.com/refractionPOINT/usp-adapters/forward"
 	"github.com/refractionPOINT/usp-adapters/gcs"
+	"github.com/refractionPOINT/usp-adapters/http_poll"
 	"github.com/refractionPOINT/usp-adapters/hubspot"
 	"github.com/refractionPOINT/usp-adapters/imap"
 	"github.com/refractionPOINT/usp-adapters/itglue"
+	"github.com/refractionPOINT/usp-adapters/journald"
+	"github.com/refractionPOINT/usp-adapters/k8s_audit"
 	"github.com/refractionPOINT/usp-adapters/k8s_pods"
+	"github.com/refractionPOINT/usp-adapters/kafka"
 	"github.com/refractionPOINT/usp-adapters/mac_unified_logging"
 	"github.com/refractionPOINT/usp-adapters/mimecast"
 	"github.com/refractionPOINT/usp-adapters/ms_graph"
 	"github.com/refractionPOINT/usp-adapters/o365"
 	"github.com/refractionPOINT/usp-adapters/okta"
+	"github.com/refractionPOINT/usp-adapters/otlp"
 	"github.com/refractionPOINT/usp-adapters/pandadoc"
 	"github.com/refractionPOINT/usp-adapters/proofpoint_tap"
 	"github.com/refractionPOINT/usp-adapters/pubsub"
@@ -39,6 +47,7 @@ import (
 	"github.com/refractionPOINT/usp-adapters/sublime"
 	"github.com/refractionPOINT/usp-adapters/syslog"
 	"github.com/refractionPOINT/usp-adapters/trendmicro"
+	"github.com/refractionPOINT/usp-adapters/webhook"
 	"github.com/refractionPOINT/usp-adapters/wel"
 	"github.com/refractionPOINT/usp-adapters/wiz"
 	"github.com/refractionPOINT/usp-adapters/zendesk"
@@ -48,7 +57,12 @@ type GeneralConfigs struct {
 	Healthcheck int `json:"healthcheck" yaml:"healthcheck"`
 
 	Syslog            usp_syslog.SyslogConfig                         `json:"syslog" yaml:"syslog"`
+	Webhook           usp_webhook.WebhookConfig                       `json:"webhook" yaml:"webhook"`
+	OTLP              usp_otlp.OTLPConfig                             `json:"otlp" yaml:"otlp"`
+	Forward           usp_forward.ForwardConfig                       `json:"forward" yaml:"forward"`
+	Beats             usp_beats.BeatsConfig                           `json:"beats" yaml:"beats"`
 	PubSub            usp_pubsub.PubSubConfig                         `json:"pubsub" yaml:"pubsub"`
+	Kafka             usp_kafka.KafkaConfig                           `json:"kafka" yaml:"kafka"`
 	S3                usp_s3.S3Config                                 `json:"s3" yaml:"s3"`
 	Stdin             usp_stdin.StdinConfig                           `json:"stdin" yaml:"stdin"`
 	OnePassword       usp_1password.OnePasswordConfig                 `json:"1password" yaml:"1password"`
@@ -63,9 +77,11 @@ type GeneralConfigs struct {
 	Office365         usp_o365.Office365Config                        `json:"office365" yaml:"office365"`
 	Wel               usp_wel.WELConfig                               `json:"wel" yaml:"wel"`
 	MacUnifiedLogging usp_mac_unified_logging.MacUnifiedLoggingConfig `json:"mac_unified_logging" yaml:"mac_unified_logging"`
+	Journald          usp_journald.JournaldConfig                     `json:"journald" yaml:"journald"`
 	AzureEventHub     usp_azure_event_hub.EventHubConfig              `json:"azure_event_hub" yaml:"azure_event_hub"`
 	Duo               usp_duo.DuoConfig                               `json:"duo" yaml:"duo"`
 	Gcs               usp_gcs.GCSConfig                               `json:"gcs" yaml:"gcs"`
+	AzureBlob         usp_azure_blob.AzureBlobConfig                  `json:"azure_blob" yaml:"azure_blob"`
 	Slack             usp_slack.SlackConfig                           `json:"slack" yaml:"slack"`
 	Sqs               usp_sqs.SQSConfig                               `json:"sqs" yaml:"sqs"`
 	SqsFiles          usp_sqs_files.SQSFilesConfig                    `json:"sqs-files" yaml:"sqs-files"`
@@ -73,9 +89,11 @@ type GeneralConfigs struct {
 	File              usp_file.FileConfig                             `json:"file" yaml:"file"`
 	Evtx              usp_evtx.EVTXConfig                             `json:"evtx" yaml:"evtx"`
 	K8sPods           usp_k8s_pods.K8sPodsConfig                      `json:"k8s_pods" yaml:"k8s_pods"`
+	K8sAudit          usp_k8s_audit.K8sAuditConfig                    `json:"k8s_audit" yaml:"k8s_audit"`
 	BigQuery          usp_bigquery.BigQueryConfig                     `json:"bigquery" yaml:"bigquery"`
 	Imap              usp_imap.ImapConfig                             `json:"imap" yaml:"imap"`
 	HubSpot           usp_hubspot.HubSpotConfig                       `json:"hubspot" yaml:"hubspot"`
+	HTTPPoll          usp_http_poll.HTTPPollConfig                    `json:"http_poll" yaml:"http_poll"`
 	FalconCloud       usp_falconcloud.FalconCloudConfig               `json:"falconcloud" yaml:"falconcloud"`
 	Mimecast          usp_mimecast.MimecastConfig                     `json:"mimecast" yaml:"mimecast"`
 	MsGraph           usp_ms_graph.MsGraphConfig                      `json:"ms_graph" yaml:"ms_graph"`
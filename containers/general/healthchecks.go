@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net/http"
 	"time"
+
+	"github.com/refractionPOINT/usp-adapters/utils"
 )
 
 var healthCheckServer *http.Server
@@ -27,7 +29,8 @@ func startHealthChecks(port int) error {
 func healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	data := map[string]interface{}{
-		"status": "ok",
+		"status":    "ok",
+		"pipelines": utils.GetPipelineStats(),
 	}
 	d, err := json.Marshal(data)
 	if err != nil {
@@ -3,6 +3,297 @@
 
 package main
 
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/refractionPOINT/usp-adapters/utils"
+)
+
+const (
+	systemdUnitDir     = "/etc/systemd/system"
+	serviceUser        = "limacharlie"
+	serviceStateDirFmt = "limacharlie-adapter/%s"
+)
+
+var validServiceName = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// Groups that grant read access to logs on most distributions,
+// the service user is added to the ones that exist on this host.
+var serviceLogGroups = []string{"adm", "systemd-journal"}
+
 func serviceMode(thisExe string, action string, args []string) error {
+	components := strings.SplitN(action, ":", 2)
+	if len(components) < 2 {
+		return fmt.Errorf("usage: [-install:svcName | -remove:svcName | -run:svcName]")
+	}
+	action = components[0]
+	svcName := components[1]
+	if !validServiceName.MatchString(svcName) {
+		return fmt.Errorf("invalid service name: %s", svcName)
+	}
+
+	if action == "-run" {
+		runForeground(args)
+		return nil
+	} else if action == "-install" {
+		thisExe, err := filepath.Abs(thisExe)
+		if err != nil {
+			return err
+		}
+		return installService(thisExe, svcName, args)
+	} else if action == "-remove" {
+		return removeService(svcName)
+	} else {
+		return fmt.Errorf("unknown action: %s", action)
+	}
+}
+
+func unitPath(svcName string) string {
+	return filepath.Join(systemdUnitDir, svcName+".service")
+}
+
+func installService(thisExe string, svcName string, args []string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("installing a service requires root")
+	}
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return fmt.Errorf("systemd not found: %v", err)
+	}
+	if _, err := os.Stat(unitPath(svcName)); err == nil {
+		return fmt.Errorf("service %s already exists", svcName)
+	}
+
+	// The service does not run from the current directory
+	// so a config file needs to be referenced by absolute path.
+	if len(args) == 2 {
+		if info, err := os.Stat(args[1]); err == nil {
+			absPath, err := filepath.Abs(args[1])
+			if err != nil {
+				return err
+			}
+			args = []string{args[0], absPath}
+			if info.Mode().Perm()&0044 == 0 {
+				log("Make sure %s is readable by user %s.", absPath, serviceUser)
+			}
+		}
+	}
+
+	statePaths, err := serviceStatePaths(args)
+	if err != nil {
+		return err
+	}
+	for _, p := range statePaths {
+		if _, err := os.Stat(p); err != nil {
+			log("Make sure %s exists and is writable by user %s.", p, serviceUser)
+		}
+	}
+
+	groups, err := ensureServiceUser()
+	if err != nil {
+		return err
+	}
+
+	unit := generateUnit(thisExe, svcName, args, groups, statePaths)
+	// The unit may contain secrets like the installation
+	// key so it is not world readable.
+	if err := os.WriteFile(unitPath(svcName), []byte(unit), 0640); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	if err := systemctl("enable", "--now", svcName+".service"); err != nil {
+		return err
+	}
+	log("Service %s installed.", svcName)
+	return nil
+}
+
+func removeService(svcName string) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("removing a service requires root")
+	}
+	if _, err := os.Stat(unitPath(svcName)); err != nil {
+		return fmt.Errorf("service %s is not installed", svcName)
+	}
+	if err := systemctl("disable", "--now", svcName+".service"); err != nil {
+		logError("systemctl disable: %v", err)
+	}
+	if err := os.Remove(unitPath(svcName)); err != nil {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	// Clear any failed state left behind, this errors
+	// when there is none so the result is ignored.
+	systemctl("reset-failed", svcName+".service")
+	log("Service %s uninstalled.", svcName)
+	return nil
+}
+
+// ensureServiceUser creates the dedicated system user the adapters
+// run as and returns the log reading groups it should be a member of.
+func ensureServiceUser() ([]string, error) {
+	if _, err := user.Lookup(serviceUser); err != nil {
+		out, err := exec.Command("useradd", "--system", "--no-create-home", "--home-dir", "/nonexistent", "--shell", "/usr/sbin/nologin", serviceUser).CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("useradd: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+		log("Created user %s.", serviceUser)
+	}
+	groups := []string{}
+	for _, g := range serviceLogGroups {
+		if _, err := user.LookupGroup(g); err == nil {
+			groups = append(groups, g)
+		}
+	}
+	return groups, nil
+}
+
+// serviceStatePaths returns the directories outside of the state
+// directory that the adapters in the config persist state to.
+func serviceStatePaths(args []string) ([]string, error) {
+	if len(args) < 2 {
+		return nil, nil
+	}
+	_, configs, err := parseConfigs(args)
+	if err != nil {
+		return nil, err
+	}
+	dirs := map[string]struct{}{}
+	addDir := func(dir string) {
+		// Relative paths are in the working directory.
+		if dir != "" && filepath.IsAbs(dir) {
+			dirs[filepath.Clean(dir)] = struct{}{}
+		}
+	}
+	addFile := func(filePath string) {
+		// Files are replaced atomically with a
+		// temporary file in the same directory.
+		if filePath != "" {
+			addDir(filepath.Dir(filePath))
+		}
+	}
+	for _, c := range configs {
+		addFile(c.Journald.CursorFile)
+		addFile(c.Evtx.ProgressFile)
+		addFile(c.AzureEventHub.CheckpointFile)
+		// Any adapter can spool its events.
+		v := reflect.ValueOf(c.GeneralConfigs)
+		for i := 0; i < v.NumField(); i++ {
+			if v.Field(i).Kind() != reflect.Struct {
+				continue
+			}
+			if p, ok := v.Field(i).FieldByName("Pipeline").Interface().(utils.PipelineConfig); ok {
+				addDir(p.Spool.Directory)
+			}
+		}
+	}
+	paths := []string{}
+	for dir := range dirs {
+		paths = append(paths, dir)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func generateUnit(thisExe string, svcName string, args []string, groups []string, statePaths []string) string {
+	execStart := []string{quoteUnitArg(thisExe), quoteUnitArg(fmt.Sprintf("-run:%s", svcName))}
+	for _, a := range args {
+		execStart = append(execStart, quoteUnitArg(a))
+	}
+
+	lines := []string{
+		"[Unit]",
+		fmt.Sprintf("Description=LimaCharlie Adapter - %s", svcName),
+		"Wants=network-online.target",
+		"After=network-online.target",
+		"StartLimitIntervalSec=0",
+		"",
+		"[Service]",
+		"Type=simple",
+		fmt.Sprintf("ExecStart=%s", strings.Join(execStart, " ")),
+		"Restart=always",
+		"RestartSec=10",
+		fmt.Sprintf("User=%s", serviceUser),
+		fmt.Sprintf("Group=%s", serviceUser),
+	}
+	if len(groups) != 0 {
+		lines = append(lines, fmt.Sprintf("SupplementaryGroups=%s", strings.Join(groups, " ")))
+	}
+	stateDir := fmt.Sprintf(serviceStateDirFmt, svcName)
+	lines = append(lines,
+		// Adapters persisting state (cursors, checkpoints) with
+		// relative paths will write to the state directory.
+		fmt.Sprintf("StateDirectory=%s", stateDir),
+		fmt.Sprintf("WorkingDirectory=/var/lib/%s", stateDir),
+		// Allow receivers like syslog to listen on privileged ports.
+		"AmbientCapabilities=CAP_NET_BIND_SERVICE",
+		"CapabilityBoundingSet=CAP_NET_BIND_SERVICE",
+		"NoNewPrivileges=yes",
+		"ProtectSystem=strict",
+		"ProtectHome=read-only",
+	)
+	for _, p := range statePaths {
+		// Missing paths are ignored instead of
+		// failing the service.
+		lines = append(lines, fmt.Sprintf("ReadWritePaths=%s", quoteUnitPath("-"+p)))
+	}
+	lines = append(lines,
+		"PrivateTmp=yes",
+		"PrivateDevices=yes",
+		"ProtectKernelTunables=yes",
+		"ProtectKernelModules=yes",
+		"ProtectControlGroups=yes",
+		"RestrictSUIDSGID=yes",
+		"RestrictRealtime=yes",
+		"LockPersonality=yes",
+		"",
+		"[Install]",
+		"WantedBy=multi-user.target",
+		"",
+	)
+	return strings.Join(lines, "\n")
+}
+
+// quoteUnitArg quotes a command line argument for
+// use in the ExecStart of a systemd unit.
+func quoteUnitArg(arg string) string {
+	r := strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+		// Specifiers and environment variable expansion.
+		`%`, `%%`,
+		`$`, `$$`,
+	)
+	return `"` + r.Replace(arg) + `"`
+}
+
+// quoteUnitPath quotes a path for use in the
+// path settings of a systemd unit.
+func quoteUnitPath(p string) string {
+	r := strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		`%`, `%%`,
+	)
+	return `"` + r.Replace(p) + `"`
+}
+
+func systemctl(args ...string) error {
+	out, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
 	return nil
 }
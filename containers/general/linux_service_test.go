@@ -0,0 +1,155 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestQuoteUnitArg(t *testing.T) {
+	for _, tc := range []struct {
+		arg      string
+		expected string
+	}{
+		{"syslog", `"syslog"`},
+		{"", `""`},
+		{"with space", `"with space"`},
+		{`a"b`, `"a\"b"`},
+		{`C:\path`, `"C:\\path"`},
+		{"line1\nline2", `"line1\nline2"`},
+		{"100%", `"100%%"`},
+		{"%h", `"%%h"`},
+		{"$HOME", `"$$HOME"`},
+		{"${HOME}", `"$${HOME}"`},
+	} {
+		if got := quoteUnitArg(tc.arg); got != tc.expected {
+			t.Errorf("quoteUnitArg(%q): %s != %s", tc.arg, got, tc.expected)
+		}
+	}
+}
+
+func TestGenerateUnit(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		args       []string
+		groups     []string
+		statePaths []string
+		expected   []string
+		unexpected []string
+	}{
+		{
+			name: "config file",
+			args: []string{"syslog", "/etc/adapter.yaml"},
+			expected: []string{
+				"Description=LimaCharlie Adapter - test",
+				`ExecStart="/usr/bin/adapter" "-run:test" "syslog" "/etc/adapter.yaml"`,
+				"User=limacharlie",
+				"StateDirectory=limacharlie-adapter/test",
+				"WorkingDirectory=/var/lib/limacharlie-adapter/test",
+				"ProtectSystem=strict",
+			},
+			unexpected: []string{"SupplementaryGroups=", "ReadWritePaths="},
+		},
+		{
+			name:   "cli params",
+			args:   []string{"syslog", "client_options.identity.installation_key=a$b%c", "port=514"},
+			groups: []string{"adm", "systemd-journal"},
+			expected: []string{
+				`ExecStart="/usr/bin/adapter" "-run:test" "syslog" "client_options.identity.installation_key=a$$b%%c" "port=514"`,
+				"SupplementaryGroups=adm systemd-journal",
+			},
+		},
+		{
+			name:       "state paths",
+			args:       []string{"journald", "/etc/adapter.yaml"},
+			statePaths: []string{"/opt/adapter state", "/var/spool/100%"},
+			expected: []string{
+				`ReadWritePaths="-/opt/adapter state"`,
+				`ReadWritePaths="-/var/spool/100%%"`,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			unit := generateUnit("/usr/bin/adapter", "test", tc.args, tc.groups, tc.statePaths)
+			lines := strings.Split(unit, "\n")
+			if lines[0] != "[Unit]" || !strings.HasSuffix(unit, "WantedBy=multi-user.target\n") {
+				t.Errorf("unexpected unit:\n%s", unit)
+			}
+			for _, e := range tc.expected {
+				found := false
+				for _, l := range lines {
+					if l == e {
+						found = true
+						break
+					}
+				}
+				if !found {
+					t.Errorf("missing %q in unit:\n%s", e, unit)
+				}
+			}
+			for _, u := range tc.unexpected {
+				if strings.Contains(unit, u) {
+					t.Errorf("unexpected %q in unit:\n%s", u, unit)
+				}
+			}
+		})
+	}
+}
+
+func TestServiceStatePaths(t *testing.T) {
+	confPath := filepath.Join(t.TempDir(), "adapter.yaml")
+	conf := `
+journald:
+  cursor_file: /var/lib/journald/cursor
+evtx:
+  progress_file: progress.json
+azure_event_hub:
+  checkpoint_file: /var/lib/journald/checkpoints.json
+syslog:
+  pipeline:
+    spool:
+      directory: /var/spool/syslog/
+`
+	if err := os.WriteFile(confPath, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		args     []string
+		expected []string
+	}{
+		{
+			name: "no config",
+			args: []string{"syslog"},
+		},
+		{
+			name:     "config file",
+			args:     []string{"journald", confPath},
+			expected: []string{"/var/lib/journald", "/var/spool/syslog"},
+		},
+		{
+			name:     "cli params",
+			args:     []string{"journald", "cursor_file=/opt/lc/cursor", "pipeline.spool.directory=spool"},
+			expected: []string{"/opt/lc"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			paths, err := serviceStatePaths(tc.args)
+			if err != nil {
+				t.Fatalf("serviceStatePaths(): %v", err)
+			}
+			if len(paths) == 0 && len(tc.expected) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(paths, tc.expected) {
+				t.Errorf("unexpected paths: %v != %v", paths, tc.expected)
+			}
+		})
+	}
+}
@@ -17,7 +17,9 @@ import (
 
 	"github.com/refractionPOINT/go-limacharlie/limacharlie"
 	"github.com/refractionPOINT/usp-adapters/1password"
+	"github.com/refractionPOINT/usp-adapters/azure_blob"
 	"github.com/refractionPOINT/usp-adapters/azure_event_hub"
+	"github.com/refractionPOINT/usp-adapters/beats"
 	usp_bigquery "github.com/refractionPOINT/usp-adapters/bigquery"
 	"github.com/refractionPOINT/usp-adapters/bitwarden"
 	"github.com/refractionPOINT/usp-adapters/box"
@@ -29,16 +31,22 @@ import (
 	"github.com/refractionPOINT/usp-adapters/evtx"
 	"github.com/refractionPOINT/usp-adapters/falconcloud"
 	"github.com/refractionPOINT/usp-adapters/file"
+	"github.com/refractionPOINT/usp-adapters/forward"
 	"github.com/refractionPOINT/usp-adapters/gcs"
+	"github.com/refractionPOINT/usp-adapters/http_poll"
 	"github.com/refractionPOINT/usp-adapters/hubspot"
 	"github.com/refractionPOINT/usp-adapters/imap"
 	"github.com/refractionPOINT/usp-adapters/itglue"
+	"github.com/refractionPOINT/usp-adapters/journald"
+	"github.com/refractionPOINT/usp-adapters/k8s_audit"
 	"github.com/refractionPOINT/usp-adapters/k8s_pods"
+	"github.com/refractionPOINT/usp-adapters/kafka"
 	"github.com/refractionPOINT/usp-adapters/mac_unified_logging"
 	"github.com/refractionPOINT/usp-adapters/mimecast"
 	"github.com/refractionPOINT/usp-adapters/ms_graph"
 	"github.com/refractionPOINT/usp-adapters/o365"
 	"github.com/refractionPOINT/usp-adapters/okta"
+	"github.com/refractionPOINT/usp-adapters/otlp"
 	"github.com/refractionPOINT/usp-adapters/pandadoc"
 	"github.com/refractionPOINT/usp-adapters/proofpoint_tap"
 	"github.com/refractionPOINT/usp-adapters/pubsub"
@@ -53,6 +61,7 @@ import (
 	"github.com/refractionPOINT/usp-adapters/sublime"
 	"github.com/refractionPOINT/usp-adapters/syslog"
 	"github.com/refractionPOINT/usp-adapters/trendmicro"
+	"github.com/refractionPOINT/usp-adapters/webhook"
 	"github.com/refractionPOINT/usp-adapters/wel"
 	"github.com/refractionPOINT/usp-adapters/wiz"
 	"github.com/refractionPOINT/usp-adapters/zendesk"
@@ -148,7 +157,13 @@ func main() {
 		return
 	}
 
-	method, configsToRun, err := parseConfigs(os.Args[1:])
+	runForeground(os.Args[1:])
+}
+
+// runForeground runs the adapters described by the command
+// line arguments until they stop or we receive a signal.
+func runForeground(args []string) {
+	method, configsToRun, err := parseConfigs(args)
 	if err != nil {
 		printUsage()
 		logError("\nerror: %s", err)
@@ -291,16 +306,46 @@ func runAdapter(ctx context.Context, method string, configs Configuration, showC
 		configs.Syslog.ClientOptions.Architecture = "usp_adapter"
 		configToShow = configs.Syslog
 		client, chRunning, err = usp_syslog.NewSyslogAdapter(ctx, configs.Syslog)
+	} else if method == "webhook" {
+		configs.Webhook.ClientOptions = applyLogging(configs.Webhook.ClientOptions)
+		configs.Webhook.ClientOptions.Architecture = "usp_adapter"
+		configToShow = configs.Webhook
+		client, chRunning, err = usp_webhook.NewWebhookAdapter(ctx, configs.Webhook)
+	} else if method == "otlp" {
+		configs.OTLP.ClientOptions = applyLogging(configs.OTLP.ClientOptions)
+		configs.OTLP.ClientOptions.Architecture = "usp_adapter"
+		configToShow = configs.OTLP
+		client, chRunning, err = usp_otlp.NewOTLPAdapter(ctx, configs.OTLP)
+	} else if method == "forward" {
+		configs.Forward.ClientOptions = applyLogging(configs.Forward.ClientOptions)
+		configs.Forward.ClientOptions.Architecture = "usp_adapter"
+		configToShow = configs.Forward
+		client, chRunning, err = usp_forward.NewForwardAdapter(ctx, configs.Forward)
+	} else if method == "beats" {
+		configs.Beats.ClientOptions = applyLogging(configs.Beats.ClientOptions)
+		configs.Beats.ClientOptions.Architecture = "usp_adapter"
+		configToShow = configs.Beats
+		client, chRunning, err = usp_beats.NewBeatsAdapter(ctx, configs.Beats)
 	} else if method == "pubsub" {
 		configs.PubSub.ClientOptions = applyLogging(configs.PubSub.ClientOptions)
 		configs.PubSub.ClientOptions.Architecture = "usp_adapter"
 		configToShow = configs.PubSub
 		client, chRunning, err = usp_pubsub.NewPubSubAdapter(ctx, configs.PubSub)
+	} else if method == "kafka" {
+		configs.Kafka.ClientOptions = applyLogging(configs.Kafka.ClientOptions)
+		configs.Kafka.ClientOptions.Architecture = "usp_adapter"
+		configToShow = configs.Kafka
+		client, chRunning, err = usp_kafka.NewKafkaAdapter(ctx, configs.Kafka)
 	} else if method == "gcs" {
 		configs.Gcs.ClientOptions = applyLogging(configs.Gcs.ClientOptions)
 		configs.Gcs.ClientOptions.Architecture = "usp_adapter"
 		configToShow = configs.Gcs
 		client, chRunning, err = usp_gcs.NewGCSAdapter(ctx, configs.Gcs)
+	} else if method == "azure_blob" {
+		configs.AzureBlob.ClientOptions = applyLogging(configs.AzureBlob.ClientOptions)
+		configs.AzureBlob.ClientOptions.Architecture = "usp_adapter"
+		configToShow = configs.AzureBlob
+		client, chRunning, err = usp_azure_blob.NewAzureBlobAdapter(ctx, configs.AzureBlob)
 	} else if method == "s3" {
 		configs.S3.ClientOptions = applyLogging(configs.S3.ClientOptions)
 		configs.S3.ClientOptions.Architecture = "usp_adapter"
@@ -356,6 +401,11 @@ func runAdapter(ctx context.Context, method string, configs Configuration, showC
 		configs.MacUnifiedLogging.ClientOptions.Architecture = "usp_adapter"
 		configToShow = configs.MacUnifiedLogging
 		client, chRunning, err = usp_mac_unified_logging.NewMacUnifiedLoggingAdapter(ctx, configs.MacUnifiedLogging)
+	} else if method == "journald" {
+		configs.Journald.ClientOptions = applyLogging(configs.Journald.ClientOptions)
+		configs.Journald.ClientOptions.Architecture = "usp_adapter"
+		configToShow = configs.Journald
+		client, chRunning, err = usp_journald.NewJournaldAdapter(ctx, configs.Journald)
 	} else if method == "azure_event_hub" {
 		configs.AzureEventHub.ClientOptions = applyLogging(configs.AzureEventHub.ClientOptions)
 		configs.AzureEventHub.ClientOptions.Architecture = "usp_adapter"
@@ -421,6 +471,11 @@ func runAdapter(ctx context.Context, method string, configs Configuration, showC
 		configs.K8sPods.ClientOptions.Architecture = "usp_adapter"
 		configToShow = configs.K8sPods
 		client, chRunning, err = usp_k8s_pods.NewK8sPodsAdapter(ctx, configs.K8sPods)
+	} else if method == "k8s_audit" {
+		configs.K8sAudit.ClientOptions = applyLogging(configs.K8sAudit.ClientOptions)
+		configs.K8sAudit.ClientOptions.Architecture = "usp_adapter"
+		configToShow = configs.K8sAudit
+		client, chRunning, err = usp_k8s_audit.NewK8sAuditAdapter(ctx, configs.K8sAudit)
 	} else if method == "bigquery" {
 		configs.BigQuery.ClientOptions = applyLogging(configs.BigQuery.ClientOptions)
 		configs.BigQuery.ClientOptions.Architecture = "usp_adapter"
@@ -436,6 +491,11 @@ func runAdapter(ctx context.Context, method string, configs Configuration, showC
 		configs.HubSpot.ClientOptions.Architecture = "usp_adapter"
 		configToShow = configs.HubSpot
 		client, chRunning, err = usp_hubspot.NewHubSpotAdapter(ctx, configs.HubSpot)
+	} else if method == "http_poll" {
+		configs.HTTPPoll.ClientOptions = applyLogging(configs.HTTPPoll.ClientOptions)
+		configs.HTTPPoll.ClientOptions.Architecture = "usp_adapter"
+		configToShow = configs.HTTPPoll
+		client, chRunning, err = usp_http_poll.NewHTTPPollAdapter(ctx, configs.HTTPPoll)
 	} else if method == "falconcloud" {
 		configs.FalconCloud.ClientOptions = applyLogging(configs.FalconCloud.ClientOptions)
 		configs.FalconCloud.ClientOptions.Architecture = "usp_adapter"
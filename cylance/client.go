@@ -36,11 +36,13 @@ type CylanceConfig struct {
 	AppID          string                  `json:"app_id" yaml:"app_id"`
 	AppSecret      string                  `json:"app_secret" yaml:"app_secret"`
 	LoggingBaseURL string                  `json:"logging_base_url" yaml:"logging_base_url"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 type CylanceAdapter struct {
 	conf       CylanceConfig
-	uspClient  *uspclient.Client
+	uspClient  *utils.USPClient
 	httpClient *http.Client
 	chStopped  chan struct{}
 
@@ -74,7 +76,7 @@ func NewCylanceAdapter(ctx context.Context, conf CylanceConfig) (*CylanceAdapter
 	a.cancel = cancel
 
 	var err error
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -21,7 +21,7 @@ const (
 
 type DuoAdapter struct {
 	conf        DuoConfig
-	uspClient   *uspclient.Client
+	uspClient   *utils.USPClient
 	duoClient   *duoapi.DuoApi
 	adminClient *duoadmin.Client
 
@@ -37,6 +37,8 @@ type DuoConfig struct {
 	IntegrationKey string                  `json:"integration_key" yaml:"integration_key"`
 	SecretKey      string                  `json:"secret_key" yaml:"secret_key"`
 	APIHostname    string                  `json:"api_hostname" yaml:"api_hostname"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *DuoConfig) Validate() error {
@@ -63,7 +65,7 @@ func NewDuoAdapter(ctx context.Context, conf DuoConfig) (*DuoAdapter, chan struc
 		doStop: utils.NewEvent(),
 	}
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
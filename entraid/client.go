@@ -25,7 +25,7 @@ var URL = map[string]string{
 
 type EntraIDAdapter struct {
 	conf       EntraIDConfig
-	uspClient  *uspclient.Client
+	uspClient  *utils.USPClient
 	httpClient *http.Client
 
 	endpoint string
@@ -42,6 +42,8 @@ type EntraIDConfig struct {
 	TenantID      string                  `json:"tenant_id" yaml:"tenant_id"`
 	ClientID      string                  `json:"client_id" yaml:"client_id"`
 	ClientSecret  string                  `json:"client_secret" yaml:"client_secret"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *EntraIDConfig) Validate() error {
@@ -68,7 +70,7 @@ func NewEntraIDAdapter(ctx context.Context, conf EntraIDConfig) (*EntraIDAdapter
 		doStop: utils.NewEvent(),
 	}
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -2,37 +2,66 @@ package usp_evtx
 
 import (
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/refractionPOINT/go-uspclient"
 	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/refractionPOINT/usp-adapters/utils"
 
 	"github.com/refractionPOINT/evtx"
 )
 
 const (
-	defaultWriteTimeout = 60 * 10
+	defaultWriteTimeout  = 60 * 10
+	progressSaveInterval = 10 * time.Second
 )
 
 type EVTXAdapter struct {
 	conf         EVTXConfig
 	wg           sync.WaitGroup
-	uspClient    *uspclient.Client
+	isRunning    uint32
+	uspClient    *utils.USPClient
 	writeTimeout time.Duration
 
-	chEvents chan evtx.GeneratedEvent
-	fClose   func()
+	files    []string
+	progress *progressStore
+
+	includeIDs map[uint64]struct{}
+	excludeIDs map[uint64]struct{}
+
+	nEvents   uint64
+	nErrors   uint64
+	nFiltered uint64
 }
 
 type EVTXConfig struct {
 	ClientOptions   uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
 	WriteTimeoutSec uint64                  `json:"write_timeout_sec,omitempty" yaml:"write_timeout_sec,omitempty"`
-	FilePath        string                  `json:"file_path" yaml:"file_path"`
+	// A single file, a glob pattern like /triage/*/Security.evtx
+	// or a directory searched recursively for .evtx files.
+	FilePath string `json:"file_path" yaml:"file_path"`
+	// Where to record the progress of each file so that
+	// an interrupted ingestion resumes where it stopped.
+	ProgressFile string `json:"progress_file,omitempty" yaml:"progress_file,omitempty"`
+	// Flatten events into a stable schema and use
+	// their TimeCreated as the event timestamp.
+	IsNormalize bool `json:"normalize,omitempty" yaml:"normalize,omitempty"`
+	// Only ship events with these EventIDs.
+	IncludeEventIDs []uint64 `json:"include_event_ids,omitempty" yaml:"include_event_ids,omitempty"`
+	// Do not ship events with these EventIDs.
+	ExcludeEventIDs []uint64 `json:"exclude_event_ids,omitempty" yaml:"exclude_event_ids,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *EVTXConfig) Validate() error {
@@ -42,12 +71,16 @@ func (c *EVTXConfig) Validate() error {
 	if c.FilePath == "" {
 		return errors.New("file_path missing")
 	}
+	if len(c.IncludeEventIDs) != 0 && len(c.ExcludeEventIDs) != 0 {
+		return errors.New("only one of include_event_ids or exclude_event_ids can be set")
+	}
 	return nil
 }
 
 func NewEVTXAdapter(ctx context.Context, conf EVTXConfig) (*EVTXAdapter, chan struct{}, error) {
 	a := &EVTXAdapter{
-		conf: conf,
+		conf:      conf,
+		isRunning: 1,
 	}
 
 	if a.conf.WriteTimeoutSec == 0 {
@@ -55,18 +88,37 @@ func NewEVTXAdapter(ctx context.Context, conf EVTXConfig) (*EVTXAdapter, chan st
 	}
 	a.writeTimeout = time.Duration(a.conf.WriteTimeoutSec) * time.Second
 
-	fd, err := os.Open(a.conf.FilePath)
+	if len(a.conf.IncludeEventIDs) != 0 && len(a.conf.ExcludeEventIDs) != 0 {
+		return nil, nil, errors.New("only one of include_event_ids or exclude_event_ids can be set")
+	}
+	if len(a.conf.IncludeEventIDs) != 0 {
+		a.includeIDs = map[uint64]struct{}{}
+		for _, id := range a.conf.IncludeEventIDs {
+			a.includeIDs[id] = struct{}{}
+		}
+	}
+	if len(a.conf.ExcludeEventIDs) != 0 {
+		a.excludeIDs = map[uint64]struct{}{}
+		for _, id := range a.conf.ExcludeEventIDs {
+			a.excludeIDs[id] = struct{}{}
+		}
+	}
+
+	var err error
+	a.files, err = listEVTXFiles(a.conf.FilePath)
 	if err != nil {
 		return nil, nil, err
 	}
+	if len(a.files) == 0 {
+		return nil, nil, fmt.Errorf("no evtx files found at %s", a.conf.FilePath)
+	}
 
-	a.chEvents, a.fClose, err = evtx.GenerateEvents(fd)
-
+	a.progress, err = loadProgress(a.conf.ProgressFile)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, fmt.Errorf("progress_file: %v", err)
 	}
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewAckedUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -77,7 +129,7 @@ func NewEVTXAdapter(ctx context.Context, conf EVTXConfig) (*EVTXAdapter, chan st
 		defer a.wg.Done()
 		defer close(chStopped)
 		a.handleInput()
-		a.conf.ClientOptions.DebugLog("finished processing file, waiting to drain")
+		a.conf.ClientOptions.DebugLog(fmt.Sprintf("finished processing %d files (%d events, %d filtered, %d errors), waiting to drain", len(a.files), atomic.LoadUint64(&a.nEvents), atomic.LoadUint64(&a.nFiltered), atomic.LoadUint64(&a.nErrors)))
 		a.uspClient.Drain(10 * time.Minute)
 	}()
 
@@ -86,7 +138,8 @@ func NewEVTXAdapter(ctx context.Context, conf EVTXConfig) (*EVTXAdapter, chan st
 
 func (a *EVTXAdapter) Close() error {
 	a.conf.ClientOptions.DebugLog("closing")
-	a.fClose()
+	atomic.StoreUint32(&a.isRunning, 0)
+	a.wg.Wait()
 	err1 := a.uspClient.Drain(1 * time.Minute)
 	_, err2 := a.uspClient.Close()
 
@@ -98,16 +151,184 @@ func (a *EVTXAdapter) Close() error {
 }
 
 func (a *EVTXAdapter) handleInput() {
-	for rec := range a.chEvents {
-		if rec.Err != nil {
-			a.conf.ClientOptions.OnError(fmt.Errorf("evtx.Parse(): %v", rec.Err))
+	for _, filePath := range a.files {
+		if atomic.LoadUint32(&a.isRunning) != 1 {
+			return
+		}
+		if err := a.processFile(filePath); err != nil {
+			atomic.AddUint64(&a.nErrors, 1)
+			a.conf.ClientOptions.OnError(fmt.Errorf("%s: %v", filePath, err))
+		}
+	}
+}
+
+func (a *EVTXAdapter) processFile(filePath string) error {
+	if abs, err := filepath.Abs(filePath); err == nil {
+		filePath = abs
+	}
+	fd, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	fp := a.progress.get(filePath, info.Size())
+	if fp.IsDone {
+		a.conf.ClientOptions.DebugLog(fmt.Sprintf("skipping already ingested %s", filePath))
+		return nil
+	}
+	if fp.LastRecordID != 0 {
+		a.conf.ClientOptions.DebugLog(fmt.Sprintf("resuming %s after record %d", filePath, fp.LastRecordID))
+	} else {
+		a.conf.ClientOptions.DebugLog(fmt.Sprintf("processing %s", filePath))
+	}
+
+	header := evtx.EVTXHeader{}
+	if err := binary.Read(fd, binary.LittleEndian, &header); err != nil {
+		return fmt.Errorf("reading header: %v", err)
+	}
+	if string(header.Magic[:]) != evtx.EVTX_HEADER_MAGIC {
+		return errors.New("file is not an EVTX file (wrong magic)")
+	}
+
+	chunks, chunkErrors := readChunkHeaders(fd, int64(header.HeaderBlockSize), info.Size())
+	nErrors := len(chunkErrors)
+	for _, chunkErr := range chunkErrors {
+		// A corrupted chunk does not prevent
+		// the rest of the file from being read.
+		atomic.AddUint64(&a.nErrors, 1)
+		a.conf.ClientOptions.OnWarning(fmt.Sprintf("%s: skipping chunk at offset %d: %v", filePath, chunkErr.offset, chunkErr.err))
+	}
+
+	lastSave := time.Now()
+	for _, chunk := range chunks {
+		if atomic.LoadUint32(&a.isRunning) != 1 {
 			break
 		}
-		a.handleEvent(rec.Event)
+		if chunk.Header.LastEventRecID <= fp.LastRecordID {
+			continue
+		}
+		records, err := parseChunk(chunk, fp.LastRecordID+1)
+		if err != nil {
+			nErrors++
+			atomic.AddUint64(&a.nErrors, 1)
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("%s: skipping chunk at offset %d after %d records: %v", filePath, chunk.Offset, len(records), err))
+		}
+		for _, record := range records {
+			if record.Event == nil {
+				// The record could not be parsed.
+				nErrors++
+				atomic.AddUint64(&a.nErrors, 1)
+			} else {
+				a.handleEvent(record.Event)
+			}
+			if record.Header.RecordID > fp.LastRecordID {
+				fp.LastRecordID = record.Header.RecordID
+			}
+		}
+		if time.Since(lastSave) < progressSaveInterval {
+			continue
+		}
+		lastSave = time.Now()
+		if err := a.progress.set(filePath, fp); err != nil {
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("failed saving progress: %v", err))
+		}
+	}
+	if atomic.LoadUint32(&a.isRunning) != 1 {
+		if err := a.progress.set(filePath, fp); err != nil {
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("failed saving progress: %v", err))
+		}
+		return nil
+	}
+
+	fp.IsDone = true
+	if err := a.progress.set(filePath, fp); err != nil {
+		a.conf.ClientOptions.OnWarning(fmt.Sprintf("failed saving progress: %v", err))
+	}
+	a.conf.ClientOptions.DebugLog(fmt.Sprintf("finished %s with %d chunk errors", filePath, nErrors))
+	return nil
+}
+
+type chunkError struct {
+	offset int64
+	err    error
+}
+
+// readChunkHeaders returns the chunks of the file ordered by record
+// IDs, in a file that wrapped around the oldest chunks are not first.
+// Chunks with an invalid header are returned as errors.
+func readChunkHeaders(fd io.ReadSeeker, start int64, size int64) ([]*evtx.Chunk, []chunkError) {
+	chunks := []*evtx.Chunk{}
+	chunkErrors := []chunkError{}
+	for offset := start; offset+evtx.EVTX_CHUNK_SIZE <= size; offset += evtx.EVTX_CHUNK_SIZE {
+		chunk, err := evtx.NewChunk(fd, offset)
+		if err != nil {
+			chunkErrors = append(chunkErrors, chunkError{offset, err})
+			continue
+		}
+		if string(chunk.Header.Magic[:]) != evtx.EVTX_CHUNK_HEADER_MAGIC {
+			// Preallocated chunks not used yet are empty.
+			if chunk.Header.Magic != [8]byte{} {
+				chunkErrors = append(chunkErrors, chunkError{offset, errors.New("wrong chunk magic")})
+			}
+			continue
+		}
+		chunks = append(chunks, chunk)
 	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Header.FirstEventRecID < chunks[j].Header.FirstEventRecID
+	})
+	return chunks, chunkErrors
 }
 
-func (a *EVTXAdapter) handleEvent(event map[string]interface{}) {
+var errParserPanic = errors.New("panic")
+
+// parseChunk returns the records of the chunk starting at
+// startRecordID, records parsed before an error are returned.
+func parseChunk(chunk *evtx.Chunk, startRecordID uint64) ([]*evtx.EventRecord, error) {
+	nRecords := chunk.Header.LastEventRecNumber - chunk.Header.FirstEventRecNumber + 1
+	records, err := parseChunkRecords(chunk, nRecords, startRecordID)
+	if !errors.Is(err, errParserPanic) {
+		return records, err
+	}
+
+	// The records parsed before a panic are lost with it, so
+	// look for the most records parsed without panicking.
+	nGood, nBad := uint64(0), nRecords
+	for nBad-nGood > 1 {
+		n := nGood + (nBad-nGood)/2
+		if _, err := parseChunkRecords(chunk, n, startRecordID); errors.Is(err, errParserPanic) {
+			nBad = n
+		} else {
+			nGood = n
+		}
+	}
+	if nGood == 0 {
+		return nil, err
+	}
+	records, _ = parseChunkRecords(chunk, nGood, startRecordID)
+	return records, err
+}
+
+// parseChunkRecords parses the first nRecords records of the chunk.
+func parseChunkRecords(chunk *evtx.Chunk, nRecords uint64, startRecordID uint64) (records []*evtx.EventRecord, err error) {
+	// The parser can panic on malformed data.
+	defer func() {
+		if r := recover(); r != nil {
+			records = nil
+			err = fmt.Errorf("%w: %v", errParserPanic, r)
+		}
+	}()
+	c := *chunk
+	c.Header.LastEventRecNumber = c.Header.FirstEventRecNumber + nRecords - 1
+	return c.Parse(int(startRecordID))
+}
+
+func (a *EVTXAdapter) handleEvent(event interface{}) {
 	if event == nil {
 		return
 	}
@@ -121,10 +342,21 @@ func (a *EVTXAdapter) handleEvent(event map[string]interface{}) {
 	if err := json.Unmarshal(b, &m); err != nil {
 		return
 	}
+	if !a.isEventIDIncluded(utils.Dict(m)) {
+		atomic.AddUint64(&a.nFiltered, 1)
+		return
+	}
+	atomic.AddUint64(&a.nEvents, 1)
 	msg := &protocol.DataMessage{
 		JsonPayload: m,
 		TimestampMs: uint64(time.Now().UnixNano() / int64(time.Millisecond)),
 	}
+	if a.conf.IsNormalize {
+		if t, ok := timeCreated(utils.Dict(m)); ok {
+			msg.TimestampMs = uint64(t.UnixMilli())
+		}
+		msg.JsonPayload = normalizeEvent(utils.Dict(m))
+	}
 	err = a.uspClient.Ship(msg, a.writeTimeout)
 	if err == uspclient.ErrorBufferFull {
 		a.conf.ClientOptions.OnWarning("stream falling behind")
@@ -134,3 +366,20 @@ func (a *EVTXAdapter) handleEvent(event map[string]interface{}) {
 		a.conf.ClientOptions.OnError(fmt.Errorf("Ship(): %v", err))
 	}
 }
+
+func (a *EVTXAdapter) isEventIDIncluded(event utils.Dict) bool {
+	if a.includeIDs == nil && a.excludeIDs == nil {
+		return true
+	}
+	id, ok := eventID(event)
+	if !ok {
+		// Events without an EventID only match a deny list.
+		return a.includeIDs == nil
+	}
+	if a.includeIDs != nil {
+		_, ok := a.includeIDs[id]
+		return ok
+	}
+	_, ok = a.excludeIDs[id]
+	return !ok
+}
@@ -0,0 +1,204 @@
+package usp_evtx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/refractionPOINT/evtx"
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testdata/security_3_chunks.evtx.gz is the header and first 3
+// chunks (232 records) of the Security.evtx sample from the
+// github.com/refractionPOINT/evtx test data.
+const testRecordCount = 232
+
+func loadTestFile(t *testing.T) []byte {
+	f, err := os.Open("testdata/security_3_chunks.evtx.gz")
+	require.NoError(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	data, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	return data
+}
+
+func runAdapter(t *testing.T, conf EVTXConfig) (*EVTXAdapter, []string) {
+	warnings := []string{}
+	conf.ClientOptions = uspclient.ClientOptions{
+		TestSinkMode: true,
+		DebugLog:     func(msg string) {},
+		OnWarning:    func(msg string) { warnings = append(warnings, msg) },
+		OnError:      func(err error) { t.Errorf("unexpected error: %v", err) },
+	}
+	a, chStopped, err := NewEVTXAdapter(context.Background(), conf)
+	require.NoError(t, err)
+	<-chStopped
+	require.NoError(t, a.Close())
+	return a, warnings
+}
+
+func TestListEVTXFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, p := range []string{"host1/Security.evtx", "host1/System.EVTX", "host2/Security.evtx", "host2/notes.txt"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(p)), 0700))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, p), nil, 0600))
+	}
+
+	files, err := listEVTXFiles(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "host1/Security.evtx"),
+		filepath.Join(dir, "host1/System.EVTX"),
+		filepath.Join(dir, "host2/Security.evtx"),
+	}, files)
+
+	files, err = listEVTXFiles(filepath.Join(dir, "*", "Security.evtx"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, "host1/Security.evtx"),
+		filepath.Join(dir, "host2/Security.evtx"),
+	}, files)
+
+	files, err = listEVTXFiles(filepath.Join(dir, "host2/notes.txt"))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestCorruptedChunk(t *testing.T) {
+	data := loadTestFile(t)
+	header := evtx.EVTXHeader{}
+	require.NoError(t, readHeader(data, &header))
+
+	// Corrupt the second chunk and blank the third
+	// one as if it was preallocated and unused.
+	corrupted := append([]byte{}, data...)
+	second := int(header.HeaderBlockSize) + evtx.EVTX_CHUNK_SIZE
+	copy(corrupted[second:], []byte("garbage!"))
+	third := second + evtx.EVTX_CHUNK_SIZE
+	copy(corrupted[third:], make([]byte, evtx.EVTX_CHUNK_SIZE))
+
+	filePath := filepath.Join(t.TempDir(), "Security.evtx")
+	require.NoError(t, os.WriteFile(filePath, corrupted, 0600))
+
+	a, warnings := runAdapter(t, EVTXConfig{FilePath: filePath})
+	assert.Equal(t, uint64(1), a.nErrors)
+	assert.Len(t, warnings, 1)
+	assert.NotZero(t, a.nEvents)
+	assert.Less(t, a.nEvents, uint64(testRecordCount))
+}
+
+func TestParseChunkRecords(t *testing.T) {
+	data := loadTestFile(t)
+	header := evtx.EVTXHeader{}
+	require.NoError(t, readHeader(data, &header))
+	chunk, err := evtx.NewChunk(bytes.NewReader(data), int64(header.HeaderBlockSize))
+	require.NoError(t, err)
+
+	all, err := parseChunk(chunk, 0)
+	require.NoError(t, err)
+	require.Len(t, all, int(chunk.Header.LastEventRecNumber-chunk.Header.FirstEventRecNumber+1))
+
+	// Records before a panic are recovered by parsing the
+	// first records of the chunk only.
+	first, err := parseChunkRecords(chunk, 10, 0)
+	require.NoError(t, err)
+	require.Len(t, first, 10)
+	for i, r := range first {
+		assert.Equal(t, all[i].Header.RecordID, r.Header.RecordID)
+		assert.Equal(t, all[i].Event, r.Event)
+	}
+	// The chunk itself is left untouched.
+	assert.Equal(t, chunk.Header.LastEventRecNumber-chunk.Header.FirstEventRecNumber+1, uint64(len(all)))
+}
+
+func TestResume(t *testing.T) {
+	data := loadTestFile(t)
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.evtx"), data, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.evtx"), data, 0600))
+	progressFile := filepath.Join(t.TempDir(), "progress.json")
+
+	// Simulate an import interrupted in the middle of the first file.
+	absPath, err := filepath.Abs(filepath.Join(dir, "a.evtx"))
+	require.NoError(t, err)
+	firstID := firstRecordID(t, data)
+	p, err := loadProgress(progressFile)
+	require.NoError(t, err)
+	require.NoError(t, p.set(absPath, fileProgress{LastRecordID: firstID + 99, Size: int64(len(data))}))
+
+	a, _ := runAdapter(t, EVTXConfig{FilePath: dir, ProgressFile: progressFile})
+	assert.Equal(t, uint64(0), a.nErrors)
+	assert.Equal(t, uint64(testRecordCount*2-100), a.nEvents)
+
+	p, err = loadProgress(progressFile)
+	require.NoError(t, err)
+	assert.Len(t, p.Files, 2)
+	for _, fp := range p.Files {
+		assert.True(t, fp.IsDone)
+		assert.Equal(t, firstID+testRecordCount-1, fp.LastRecordID)
+	}
+
+	// Everything was ingested, nothing left to do.
+	a, _ = runAdapter(t, EVTXConfig{FilePath: dir, ProgressFile: progressFile})
+	assert.Equal(t, uint64(0), a.nEvents)
+}
+
+func readHeader(data []byte, header *evtx.EVTXHeader) error {
+	return binary.Read(bytes.NewReader(data), binary.LittleEndian, header)
+}
+
+func firstRecordID(t *testing.T, data []byte) uint64 {
+	header := evtx.EVTXHeader{}
+	require.NoError(t, readHeader(data, &header))
+	chunk, err := evtx.NewChunk(bytes.NewReader(data), int64(header.HeaderBlockSize))
+	require.NoError(t, err)
+	return chunk.Header.FirstEventRecID
+}
+
+func writeFile(dir string, name string, data []byte) error {
+	return os.WriteFile(filepath.Join(dir, name), data, 0600)
+}
+
+func TestWrappedFile(t *testing.T) {
+	data := loadTestFile(t)
+	header := evtx.EVTXHeader{}
+	require.NoError(t, readHeader(data, &header))
+
+	// Once full, the file wraps around and the newest chunk
+	// overwrites the oldest one, which is the first in the file.
+	start := int(header.HeaderBlockSize)
+	chunk := func(i int) []byte {
+		return data[start+i*evtx.EVTX_CHUNK_SIZE : start+(i+1)*evtx.EVTX_CHUNK_SIZE]
+	}
+	wrapped := append([]byte{}, data[:start]...)
+	wrapped = append(wrapped, chunk(2)...)
+	wrapped = append(wrapped, chunk(0)...)
+	wrapped = append(wrapped, chunk(1)...)
+
+	dir := t.TempDir()
+	require.NoError(t, writeFile(dir, "Security.evtx", wrapped))
+	a, _ := runAdapter(t, EVTXConfig{FilePath: filepath.Join(dir, "Security.evtx")})
+	assert.Equal(t, uint64(0), a.nErrors)
+	assert.Equal(t, uint64(testRecordCount), a.nEvents)
+
+	// Resuming in the middle of the oldest chunks.
+	absPath, err := filepath.Abs(filepath.Join(dir, "Security.evtx"))
+	require.NoError(t, err)
+	progressFile := filepath.Join(t.TempDir(), "progress.json")
+	p, err := loadProgress(progressFile)
+	require.NoError(t, err)
+	require.NoError(t, p.set(absPath, fileProgress{LastRecordID: firstRecordID(t, data) + 99, Size: int64(len(wrapped))}))
+
+	a, _ = runAdapter(t, EVTXConfig{FilePath: dir, ProgressFile: progressFile})
+	assert.Equal(t, uint64(testRecordCount-100), a.nEvents)
+}
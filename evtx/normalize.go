@@ -0,0 +1,126 @@
+package usp_evtx
+
+import (
+	"math"
+	"time"
+
+	"github.com/refractionPOINT/usp-adapters/utils"
+)
+
+// eventID returns the EventID of a raw event, it is either
+// a number or a dict with the value and its qualifiers.
+func eventID(event utils.Dict) (uint64, bool) {
+	system := event.FindOneDict("Event/System")
+	if system == nil {
+		return 0, false
+	}
+	if id, ok := system.GetInt("EventID"); ok {
+		return id, true
+	}
+	if d, ok := system.GetDict("EventID"); ok {
+		return d.GetInt("Value")
+	}
+	return 0, false
+}
+
+// timeCreated returns the creation time of a raw event,
+// stored as seconds since epoch with a fractional part.
+func timeCreated(event utils.Dict) (time.Time, bool) {
+	v := event.FindOneOpaque("Event/System/TimeCreated/SystemTime")
+	ts, ok := v.(float64)
+	if !ok {
+		sec, ok := utils.StandardInt(v)
+		if !ok {
+			return time.Time{}, false
+		}
+		ts = float64(sec)
+	}
+	if ts <= 0 {
+		return time.Time{}, false
+	}
+	sec, frac := math.Modf(ts)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC(), true
+}
+
+// normalizeEvent flattens a raw event into a stable schema
+// with the System fields at the top level and the named
+// fields of EventData or UserData under EventData.
+func normalizeEvent(event utils.Dict) utils.Dict {
+	out := utils.Dict{}
+	system := event.FindOneDict("Event/System")
+	if system == nil {
+		system = utils.Dict{}
+	}
+
+	if id, ok := eventID(event); ok {
+		out["EventID"] = id
+	}
+	if d, ok := system.GetDict("EventID"); ok {
+		if q, ok := d.GetInt("Qualifiers"); ok {
+			out["Qualifiers"] = q
+		}
+	}
+	if t, ok := timeCreated(event); ok {
+		out["TimeCreated"] = t.Format(time.RFC3339Nano)
+	}
+	if provider, ok := system.GetDict("Provider"); ok {
+		if name, ok := provider.GetString("Name"); ok {
+			out["Provider"] = name
+		}
+		if guid, ok := provider.GetString("Guid"); ok {
+			out["ProviderGuid"] = guid
+		}
+		if source, ok := provider.GetString("EventSourceName"); ok {
+			out["EventSourceName"] = source
+		}
+	}
+	for _, k := range []string{"Channel", "Computer"} {
+		if v, ok := system.GetString(k); ok {
+			out[k] = v
+		}
+	}
+	for _, k := range []string{"EventRecordID", "Version", "Level", "Task", "Opcode", "Keywords"} {
+		if v, ok := system.GetInt(k); ok {
+			out[k] = v
+		}
+	}
+	if execution, ok := system.GetDict("Execution"); ok {
+		for _, k := range []string{"ProcessID", "ThreadID"} {
+			if v, ok := execution.GetInt(k); ok {
+				out[k] = v
+			}
+		}
+	}
+	if correlation, ok := system.GetDict("Correlation"); ok {
+		for _, k := range []string{"ActivityID", "RelatedActivityID"} {
+			if v, ok := correlation.GetString(k); ok {
+				out[k] = v
+			}
+		}
+	}
+	if userID := system.FindOneString("Security/UserID"); userID != "" {
+		out["UserID"] = userID
+	}
+
+	data := utils.Dict{}
+	if eventData, ok := event.FindOneDict("Event").GetDict("EventData"); ok {
+		for k, v := range eventData {
+			data[k] = v
+		}
+	}
+	// UserData has a single element named after
+	// the event containing the actual fields.
+	if userData, ok := event.FindOneDict("Event").GetDict("UserData"); ok {
+		for _, v := range userData {
+			if d, ok := v.(map[string]interface{}); ok {
+				for k, v := range d {
+					data[k] = v
+				}
+			}
+		}
+	}
+	if len(data) != 0 {
+		out["EventData"] = data
+	}
+	return out
+}
@@ -0,0 +1,79 @@
+package usp_evtx
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/usp-adapters/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeEvent(t *testing.T) {
+	raw := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(`{"Event":{"System":{"Provider":{"Name":"Microsoft-Windows-Security-Auditing","Guid":"54849625-5478-4994-A5BA-3E3B0328C30D"},"EventID":{"Value":4624},"Version":2,"Level":0,"Task":12544,"Opcode":0,"TimeCreated":{"SystemTime":1549462715.946133},"EventRecordID":31880,"Correlation":{"ActivityID":"02277543-BEAA-0000-BB75-2702AABED401"},"Execution":{"ProcessID":676,"ThreadID":780},"Channel":"Security","Computer":"TestComputer","Security":{}},"EventData":{"SubjectUserName":"test","TargetUserName":"user","LogonType":2,"IpAddress":"::1"}}}`), &raw))
+	event := utils.Dict(raw)
+
+	id, ok := eventID(event)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(4624), id)
+
+	created, ok := timeCreated(event)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1549462715946), created.UnixMilli())
+
+	assert.Equal(t, utils.Dict{
+		"EventID":       uint64(4624),
+		"TimeCreated":   created.Format(time.RFC3339Nano),
+		"Provider":      "Microsoft-Windows-Security-Auditing",
+		"ProviderGuid":  "54849625-5478-4994-A5BA-3E3B0328C30D",
+		"Channel":       "Security",
+		"Computer":      "TestComputer",
+		"EventRecordID": uint64(31880),
+		"Version":       uint64(2),
+		"Level":         uint64(0),
+		"Task":          uint64(12544),
+		"Opcode":        uint64(0),
+		"ProcessID":     uint64(676),
+		"ThreadID":      uint64(780),
+		"ActivityID":    "02277543-BEAA-0000-BB75-2702AABED401",
+		"EventData": utils.Dict{
+			"SubjectUserName": "test",
+			"TargetUserName":  "user",
+			"LogonType":       float64(2),
+			"IpAddress":       "::1",
+		},
+	}, normalizeEvent(event))
+}
+
+func TestNormalizeUserData(t *testing.T) {
+	raw := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(`{"Event":{"System":{"Provider":{"Name":"Microsoft-Windows-Eventlog"},"EventID":1102,"Channel":"Security","Computer":"TestComputer","Security":{"UserID":"S-1-5-18"}},"UserData":{"LogFileCleared":{"SubjectUserName":"test","SubjectDomainName":"TESTCOMPUTER"}}}}`), &raw))
+	event := utils.Dict(raw)
+
+	n := normalizeEvent(event)
+	assert.Equal(t, uint64(1102), n["EventID"])
+	assert.Equal(t, "S-1-5-18", n["UserID"])
+	assert.Equal(t, utils.Dict{
+		"SubjectUserName":   "test",
+		"SubjectDomainName": "TESTCOMPUTER",
+	}, n["EventData"])
+	_, ok := n["TimeCreated"]
+	assert.False(t, ok)
+}
+
+func TestEventIDFilter(t *testing.T) {
+	data := loadTestFile(t)
+	dir := t.TempDir()
+	require.NoError(t, writeFile(dir, "Security.evtx", data))
+
+	a, _ := runAdapter(t, EVTXConfig{FilePath: dir, IncludeEventIDs: []uint64{4624}, IsNormalize: true})
+	assert.NotZero(t, a.nEvents)
+	assert.Equal(t, uint64(testRecordCount), a.nEvents+a.nFiltered)
+	included := a.nEvents
+
+	a, _ = runAdapter(t, EVTXConfig{FilePath: dir, ExcludeEventIDs: []uint64{4624}})
+	assert.Equal(t, included, a.nFiltered)
+	assert.Equal(t, uint64(testRecordCount)-included, a.nEvents)
+}
@@ -0,0 +1,115 @@
+package usp_evtx
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fileProgress records how far into an EVTX file
+// the ingestion went so it can be resumed.
+type fileProgress struct {
+	LastRecordID uint64 `json:"last_record_id"`
+	IsDone       bool   `json:"is_done"`
+	Size         int64  `json:"size"`
+}
+
+type progressStore struct {
+	filePath string
+	Files    map[string]fileProgress `json:"files"`
+}
+
+func loadProgress(filePath string) (*progressStore, error) {
+	p := &progressStore{
+		filePath: filePath,
+		Files:    map[string]fileProgress{},
+	}
+	if filePath == "" {
+		return p, nil
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, p); err != nil {
+		return nil, err
+	}
+	if p.Files == nil {
+		p.Files = map[string]fileProgress{}
+	}
+	return p, nil
+}
+
+// get returns the progress of a file, progress recorded
+// for a file that changed size since is ignored.
+func (p *progressStore) get(filePath string, size int64) fileProgress {
+	fp, ok := p.Files[filePath]
+	if !ok || fp.Size != size {
+		return fileProgress{Size: size}
+	}
+	return fp
+}
+
+func (p *progressStore) set(filePath string, fp fileProgress) error {
+	p.Files[filePath] = fp
+	return p.save()
+}
+
+func (p *progressStore) save() error {
+	if p.filePath == "" {
+		return nil
+	}
+	content, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	// Write and rename so that a crash while saving
+	// never leaves us with a truncated progress file.
+	tmpPath := p.filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, p.filePath)
+}
+
+// listEVTXFiles resolves the configured path which can be a
+// single file, a glob pattern or a directory searched recursively.
+func listEVTXFiles(path string) ([]string, error) {
+	files := []string{}
+	if info, err := os.Stat(path); err == nil {
+		if !info.IsDir() {
+			return []string{path}, nil
+		}
+		err := filepath.WalkDir(path, func(p string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type().IsRegular() && strings.EqualFold(filepath.Ext(p), ".evtx") {
+				files = append(files, p)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	} else {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			if info, err := os.Stat(m); err == nil && info.Mode().IsRegular() {
+				files = append(files, m)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
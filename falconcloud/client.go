@@ -11,6 +11,7 @@ import (
 	"github.com/google/uuid"
 	"github.com/refractionPOINT/go-uspclient"
 	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/refractionPOINT/usp-adapters/utils"
 
 	"github.com/crowdstrike/gofalcon/falcon"
 	"github.com/crowdstrike/gofalcon/falcon/client"
@@ -30,6 +31,8 @@ type FalconCloudConfig struct {
 	IsUsingOffset   bool                    `json:"is_using_offset" yaml:"is_using_offset"`
 	Offset          uint64                  `json:"offset" yaml:"offset"`
 	NotBefore       *time.Time              `json:"not_before,omitempty" yaml:"not_before,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *FalconCloudConfig) Validate() error {
@@ -49,7 +52,7 @@ type FalconCloudAdapter struct {
 	conf         FalconCloudConfig
 	isRunning    uint32
 	mRunning     sync.RWMutex
-	uspClient    *uspclient.Client
+	uspClient    *utils.USPClient
 	writeTimeout time.Duration
 
 	chStopped chan struct{}
@@ -71,7 +74,7 @@ func NewFalconCloudAdapter(ctx context.Context, conf FalconCloudConfig) (*Falcon
 	a.writeTimeout = time.Duration(a.conf.WriteTimeoutSec) * time.Second
 
 	var err error
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
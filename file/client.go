@@ -18,6 +18,7 @@ import (
 
 	"github.com/refractionPOINT/go-uspclient"
 	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/refractionPOINT/usp-adapters/utils"
 
 	"github.com/nxadm/tail"
 
@@ -56,7 +57,7 @@ type FileAdapter struct {
 	ctx                   context.Context
 	conf                  FileConfig
 	wg                    sync.WaitGroup
-	uspClient             *uspclient.Client
+	uspClient             *utils.USPClient
 	writeTimeout          time.Duration
 	tailFiles             map[string]*tailInfo
 	mu                    sync.Mutex
@@ -89,7 +90,7 @@ func NewFileAdapter(ctx context.Context, conf FileConfig) (*FileAdapter, chan st
 	a.writeTimeout = time.Duration(a.conf.WriteTimeoutSec) * time.Second
 
 	var err error
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
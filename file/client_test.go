@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/usp-adapters/utils"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
@@ -124,9 +125,9 @@ func TestPollSerialFiles(t *testing.T) {
 	debugReceived := []string{}
 
 	mockClientOptions := new(MockClientOptions)
-	dummyUSPClient, err := uspclient.NewClient(context.Background(), uspclient.ClientOptions{
+	dummyUSPClient, err := utils.NewUSPClient(context.Background(), uspclient.ClientOptions{
 		TestSinkMode: true,
-	})
+	}, utils.PipelineConfig{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -208,9 +209,9 @@ func TestTailActiveFile(t *testing.T) {
 	// Create channels to receive USP messages
 	receivedLines := make(chan string, 100)
 	mockClientOptions := new(MockClientOptions)
-	dummyUSPClient, err := uspclient.NewClient(context.Background(), uspclient.ClientOptions{
+	dummyUSPClient, err := utils.NewUSPClient(context.Background(), uspclient.ClientOptions{
 		TestSinkMode: true,
-	})
+	}, utils.PipelineConfig{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -315,9 +316,9 @@ func TestMultiLineJSON(t *testing.T) {
 	// Create channels to receive JSON messages
 	receivedJSON := make(chan string, 100)
 	mockClientOptions := new(MockClientOptions)
-	dummyUSPClient, err := uspclient.NewClient(context.Background(), uspclient.ClientOptions{
+	dummyUSPClient, err := utils.NewUSPClient(context.Background(), uspclient.ClientOptions{
 		TestSinkMode: true,
-	})
+	}, utils.PipelineConfig{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -435,9 +436,9 @@ func TestFileRotationDetection(t *testing.T) {
 	receivedLines := make(chan string, 100)
 
 	mockClientOptions := new(MockClientOptions)
-	dummyUSPClient, err := uspclient.NewClient(context.Background(), uspclient.ClientOptions{
+	dummyUSPClient, err := utils.NewUSPClient(context.Background(), uspclient.ClientOptions{
 		TestSinkMode: true,
-	})
+	}, utils.PipelineConfig{})
 	require.NoError(t, err)
 
 	adapter := &FileAdapter{
@@ -574,9 +575,9 @@ func TestFileRotationPreservesData(t *testing.T) {
 	logCapture := &LogCapture{}
 	receivedLines := make(chan string, 200)
 
-	dummyUSPClient, err := uspclient.NewClient(context.Background(), uspclient.ClientOptions{
+	dummyUSPClient, err := utils.NewUSPClient(context.Background(), uspclient.ClientOptions{
 		TestSinkMode: true,
-	})
+	}, utils.PipelineConfig{})
 	require.NoError(t, err)
 
 	adapter := &FileAdapter{
@@ -684,9 +685,9 @@ func TestMultipleFileRotations(t *testing.T) {
 	logCapture := &LogCapture{}
 	receivedLines := make(chan string, 50)
 
-	dummyUSPClient, err := uspclient.NewClient(context.Background(), uspclient.ClientOptions{
+	dummyUSPClient, err := utils.NewUSPClient(context.Background(), uspclient.ClientOptions{
 		TestSinkMode: true,
-	})
+	}, utils.PipelineConfig{})
 	require.NoError(t, err)
 
 	adapter := &FileAdapter{
@@ -789,9 +790,9 @@ func TestConcurrentFileRotations(t *testing.T) {
 	logCapture := &LogCapture{}
 	receivedLines := make(chan string, 50)
 
-	dummyUSPClient, err := uspclient.NewClient(context.Background(), uspclient.ClientOptions{
+	dummyUSPClient, err := utils.NewUSPClient(context.Background(), uspclient.ClientOptions{
 		TestSinkMode: true,
-	})
+	}, utils.PipelineConfig{})
 	require.NoError(t, err)
 
 	adapter := &FileAdapter{
@@ -2,6 +2,7 @@ package usp_file
 
 import (
 	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/usp-adapters/utils"
 )
 
 type FileConfig struct {
@@ -15,4 +16,6 @@ type FileConfig struct {
 	SerializeFiles        bool                    `json:"serialize_files" yaml:"serialize_files"`
 	Poll                  bool                    `json:"poll" yaml:"poll"`
 	MultiLineJSON         bool                    `json:"multi_line_json" yaml:"multi_line_json"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
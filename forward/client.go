@@ -0,0 +1,298 @@
+package usp_forward
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/refractionPOINT/usp-adapters/utils"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	defaultWriteTimeout = 60 * 10
+	handshakeTimeout    = 30 * time.Second
+)
+
+type ForwardAdapter struct {
+	conf         ForwardConfig
+	listener     net.Listener
+	connMutex    sync.Mutex
+	wg           sync.WaitGroup
+	isRunning    uint32
+	uspClient    *utils.USPClient
+	writeTimeout time.Duration
+}
+
+type ForwardConfig struct {
+	ClientOptions     uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
+	Port              uint16                  `json:"port" yaml:"port"`
+	Interface         string                  `json:"iface" yaml:"iface"`
+	SslCertPath       string                  `json:"ssl_cert" yaml:"ssl_cert"`
+	SslKeyPath        string                  `json:"ssl_key" yaml:"ssl_key"`
+	MutualTlsCertPath string                  `json:"mutual_tls_cert,omitempty" yaml:"mutual_tls_cert,omitempty"`
+	WriteTimeoutSec   uint64                  `json:"write_timeout_sec,omitempty" yaml:"write_timeout_sec,omitempty"`
+
+	// Clients must authenticate with this key in the
+	// handshake when set, like Fluentd's <security>.
+	SharedKey string `json:"shared_key,omitempty" yaml:"shared_key,omitempty"`
+	// Hostname the adapter identifies as in the
+	// handshake, defaults to the host's name.
+	SelfHostname string `json:"self_hostname,omitempty" yaml:"self_hostname,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+}
+
+func (c *ForwardConfig) Validate() error {
+	if err := c.ClientOptions.Validate(); err != nil {
+		return fmt.Errorf("client_options: %v", err)
+	}
+	if c.Port == 0 {
+		return errors.New("missing port")
+	}
+	if (c.SslCertPath == "") != (c.SslKeyPath == "") {
+		return errors.New("ssl_cert and ssl_key must be set together")
+	}
+	return nil
+}
+
+func NewForwardAdapter(ctx context.Context, conf ForwardConfig) (*ForwardAdapter, chan struct{}, error) {
+	a := &ForwardAdapter{
+		conf:      conf,
+		isRunning: 1,
+	}
+
+	if a.conf.WriteTimeoutSec == 0 {
+		a.conf.WriteTimeoutSec = defaultWriteTimeout
+	}
+	a.writeTimeout = time.Duration(a.conf.WriteTimeoutSec) * time.Second
+
+	if a.conf.SelfHostname == "" {
+		a.conf.SelfHostname, _ = os.Hostname()
+	}
+
+	addr := fmt.Sprintf("%s:%d", conf.Interface, conf.Port)
+	var l net.Listener
+	var err error
+	if conf.SslCertPath != "" && conf.SslKeyPath != "" {
+		var tlsConfig *tls.Config
+		tlsConfig, err = utils.LoadServerTLSConfig(conf.SslCertPath, conf.SslKeyPath, conf.MutualTlsCertPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		l, err = tls.Listen("tcp", addr, tlsConfig)
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	a.uspClient, err = utils.NewAckedUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
+	if err != nil {
+		l.Close()
+		return nil, nil, err
+	}
+
+	a.listener = l
+
+	chStopped := make(chan struct{})
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer close(chStopped)
+		a.handleConnections()
+	}()
+
+	return a, chStopped, nil
+}
+
+func (a *ForwardAdapter) Close() error {
+	a.conf.ClientOptions.DebugLog("closing")
+	atomic.StoreUint32(&a.isRunning, 0)
+	err1 := a.listener.Close()
+	err2 := a.uspClient.Drain(1 * time.Minute)
+	_, err3 := a.uspClient.Close()
+
+	if err1 != nil {
+		return err1
+	}
+
+	if err2 != nil {
+		return err2
+	}
+
+	return err3
+}
+
+func (a *ForwardAdapter) handleConnections() {
+	a.conf.ClientOptions.DebugLog(fmt.Sprintf("listening for connections on %s:%d", a.conf.Interface, a.conf.Port))
+
+	var err error
+
+	defer a.conf.ClientOptions.DebugLog(fmt.Sprintf("stopped listening for connections on %s:%d (%v)", a.conf.Interface, a.conf.Port, err))
+
+	for atomic.LoadUint32(&a.isRunning) == 1 {
+		var conn net.Conn
+		conn, err = a.listener.Accept()
+		if err != nil {
+			break
+		}
+		a.connMutex.Lock()
+		if atomic.LoadUint32(&a.isRunning) == 0 {
+			a.connMutex.Unlock()
+			conn.Close()
+			break
+		}
+		a.wg.Add(1)
+		a.connMutex.Unlock()
+		go func() {
+			defer a.wg.Done()
+			a.handleConnection(conn)
+		}()
+	}
+}
+
+func (a *ForwardAdapter) handleConnection(conn net.Conn) {
+	a.conf.ClientOptions.DebugLog(fmt.Sprintf("handling new connection from %+v", conn.RemoteAddr()))
+	defer func() {
+		a.conf.ClientOptions.DebugLog(fmt.Sprintf("connection from %+v leaving", conn.RemoteAddr()))
+		conn.Close()
+	}()
+
+	d := newDecoder(bufio.NewReader(conn))
+	e := msgpack.NewEncoder(conn)
+
+	if a.conf.SharedKey != "" {
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := a.handshake(d, e); err != nil {
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("handshake with %+v: %v", conn.RemoteAddr(), err))
+			return
+		}
+		conn.SetDeadline(time.Time{})
+	}
+
+	for atomic.LoadUint32(&a.isRunning) == 1 {
+		msg, err := decodeMessage(d)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, io.ErrUnexpectedEOF) {
+				a.conf.ClientOptions.OnWarning(fmt.Sprintf("invalid message from %+v: %v", conn.RemoteAddr(), err))
+			}
+			return
+		}
+		for _, evt := range msg.events {
+			if !a.ship(evt) {
+				// Without the ack, the client sends
+				// the chunk again on a new connection.
+				return
+			}
+		}
+		if msg.chunk == "" {
+			continue
+		}
+		if err := e.Encode(map[string]string{"ack": msg.chunk}); err != nil {
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("ack to %+v: %v", conn.RemoteAddr(), err))
+			return
+		}
+	}
+}
+
+// handshake authenticates the client with the shared key:
+//
+//	server: ["HELO", {"nonce": nonce, "auth": "", "keepalive": true}]
+//	client: ["PING", hostname, salt, sha512_hex(salt + hostname + nonce + key), "", ""]
+//	server: ["PONG", true, "", self_hostname, sha512_hex(salt + self_hostname + nonce + key)]
+func (a *ForwardAdapter) handshake(d *msgpack.Decoder, e *msgpack.Encoder) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if err := e.Encode([]interface{}{"HELO", map[string]interface{}{
+		"nonce":     nonce,
+		"auth":      "",
+		"keepalive": true,
+	}}); err != nil {
+		return err
+	}
+
+	v, err := d.DecodeInterfaceLoose()
+	if err != nil {
+		return err
+	}
+	ping, ok := v.([]interface{})
+	if !ok || len(ping) < 4 {
+		return errors.New("invalid PING")
+	}
+	fields := make([]string, 4)
+	for i := range fields {
+		if fields[i], ok = ping[i].(string); !ok {
+			return errors.New("invalid PING")
+		}
+	}
+	if fields[0] != "PING" {
+		return fmt.Errorf("expected PING, got %s", fields[0])
+	}
+	hostname, salt, digest := fields[1], fields[2], fields[3]
+
+	expected := sharedKeyDigest(salt, hostname, nonce, a.conf.SharedKey)
+	if subtle.ConstantTimeCompare([]byte(digest), []byte(expected)) != 1 {
+		e.Encode([]interface{}{"PONG", false, "shared_key mismatch", a.conf.SelfHostname, ""})
+		return fmt.Errorf("shared_key mismatch from %s", hostname)
+	}
+	return e.Encode([]interface{}{
+		"PONG",
+		true,
+		"",
+		a.conf.SelfHostname,
+		sharedKeyDigest(salt, a.conf.SelfHostname, nonce, a.conf.SharedKey),
+	})
+}
+
+func sharedKeyDigest(salt string, hostname string, nonce []byte, sharedKey string) string {
+	h := sha512.New()
+	h.Write([]byte(salt))
+	h.Write([]byte(hostname))
+	h.Write(nonce)
+	h.Write([]byte(sharedKey))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ship sends the event with its tag, returns
+// false if it could not be shipped.
+func (a *ForwardAdapter) ship(evt forwardEvent) bool {
+	ts := evt.timestampMs
+	if ts == 0 {
+		ts = uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	}
+	msg := &protocol.DataMessage{
+		JsonPayload: map[string]interface{}{
+			"tag":    evt.tag,
+			"record": evt.record,
+		},
+		TimestampMs: ts,
+	}
+	err := a.uspClient.Ship(msg, a.writeTimeout)
+	if err == uspclient.ErrorBufferFull {
+		a.conf.ClientOptions.OnWarning("stream falling behind")
+		err = a.uspClient.Ship(msg, 1*time.Hour)
+	}
+	if err != nil {
+		a.conf.ClientOptions.OnError(fmt.Errorf("Ship(): %v", err))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,169 @@
+package usp_forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func eventTime(sec uint32, nsec uint32) *msgpack.RawMessage {
+	b := []byte{0xd7, 0x00, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[2:], sec)
+	binary.BigEndian.PutUint32(b[6:], nsec)
+	r := msgpack.RawMessage(b)
+	return &r
+}
+
+func encode(t *testing.T, v interface{}) []byte {
+	b, err := msgpack.Marshal(v)
+	require.NoError(t, err)
+	return b
+}
+
+func decode(t *testing.T, data []byte) *forwardMessage {
+	msg, err := decodeMessage(newDecoder(bytes.NewReader(data)))
+	require.NoError(t, err)
+	return msg
+}
+
+func TestDecodeMessage(t *testing.T) {
+	record := map[string]interface{}{"log": "hello", "level": 3}
+	expected := map[string]interface{}{"log": "hello", "level": int64(3)}
+
+	// Message mode with an EventTime.
+	msg := decode(t, encode(t, []interface{}{"app.access", eventTime(1704164645, 123456789), record}))
+	require.Len(t, msg.events, 1)
+	assert.Equal(t, forwardEvent{tag: "app.access", timestampMs: 1704164645123, record: expected}, msg.events[0])
+	assert.Equal(t, "", msg.chunk)
+
+	// Forward mode with integer times and a chunk.
+	msg = decode(t, encode(t, []interface{}{
+		"app.access",
+		[]interface{}{
+			[]interface{}{1704164645, record},
+			[]interface{}{1704164646.5, map[string]interface{}{"log": []byte("bytes")}},
+		},
+		map[string]interface{}{"chunk": "abc"},
+	}))
+	require.Len(t, msg.events, 2)
+	assert.Equal(t, uint64(1704164645000), msg.events[0].timestampMs)
+	assert.Equal(t, uint64(1704164646500), msg.events[1].timestampMs)
+	assert.Equal(t, map[string]interface{}{"log": "bytes"}, msg.events[1].record)
+	assert.Equal(t, "abc", msg.chunk)
+
+	// PackedForward mode.
+	packed := append(encode(t, []interface{}{1704164645, record}), encode(t, []interface{}{eventTime(1704164646, 0), record})...)
+	msg = decode(t, encode(t, []interface{}{"app.access", packed}))
+	require.Len(t, msg.events, 2)
+	assert.Equal(t, uint64(1704164646000), msg.events[1].timestampMs)
+	assert.Equal(t, expected, msg.events[1].record)
+
+	// CompressedPackedForward mode, with one gzip member per entry.
+	gz := bytes.Buffer{}
+	for i := 0; i < 2; i++ {
+		w := gzip.NewWriter(&gz)
+		w.Write(encode(t, []interface{}{1704164645 + i, record}))
+		w.Close()
+	}
+	msg = decode(t, encode(t, []interface{}{"app.access", gz.Bytes(), map[string]interface{}{"compressed": "gzip", "chunk": "def"}}))
+	require.Len(t, msg.events, 2)
+	assert.Equal(t, uint64(1704164646000), msg.events[1].timestampMs)
+	assert.Equal(t, "def", msg.chunk)
+
+	for _, invalid := range []interface{}{
+		[]interface{}{"app.access"},
+		[]interface{}{"app.access", 1704164645},
+		[]interface{}{"app.access", 1704164645, "not a record"},
+		[]interface{}{"app.access", "x", map[string]interface{}{"compressed": "zstd"}},
+		[]interface{}{"app.access", []interface{}{[]interface{}{1704164645}}},
+		map[string]interface{}{"tag": "app.access"},
+	} {
+		_, err := decodeMessage(newDecoder(bytes.NewReader(encode(t, invalid))))
+		assert.Error(t, err, "%v", invalid)
+	}
+}
+
+func newTestAdapter(t *testing.T, sharedKey string) (*ForwardAdapter, chan struct{}) {
+	a, chStopped, err := NewForwardAdapter(context.Background(), ForwardConfig{
+		ClientOptions: uspclient.ClientOptions{
+			TestSinkMode: true,
+			DebugLog:     func(msg string) {},
+			OnWarning:    func(msg string) {},
+			OnError:      func(err error) { t.Errorf("unexpected error: %v", err) },
+		},
+		Interface:    "127.0.0.1",
+		SharedKey:    sharedKey,
+		SelfHostname: "collector",
+	})
+	require.NoError(t, err)
+	return a, chStopped
+}
+
+func dial(t *testing.T, a *ForwardAdapter) (net.Conn, *msgpack.Decoder, *msgpack.Encoder) {
+	conn, err := net.Dial("tcp", a.listener.Addr().String())
+	require.NoError(t, err)
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	d := msgpack.NewDecoder(conn)
+	d.UseLooseInterfaceDecoding(true)
+	return conn, d, msgpack.NewEncoder(conn)
+}
+
+func TestAck(t *testing.T) {
+	a, chStopped := newTestAdapter(t, "")
+	conn, d, e := dial(t, a)
+	defer conn.Close()
+
+	require.NoError(t, e.Encode([]interface{}{"app", 1704164645, map[string]interface{}{"log": "a"}}))
+	require.NoError(t, e.Encode([]interface{}{"app", 1704164645, map[string]interface{}{"log": "b"}, map[string]interface{}{"chunk": "c1"}}))
+	ack := map[string]interface{}{}
+	require.NoError(t, d.Decode(&ack))
+	assert.Equal(t, map[string]interface{}{"ack": "c1"}, ack)
+
+	require.NoError(t, a.Close())
+	select {
+	case <-chStopped:
+	case <-time.After(10 * time.Second):
+		t.Error("adapter did not stop")
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	a, _ := newTestAdapter(t, "secret")
+	defer a.Close()
+
+	handshake := func(key string) []interface{} {
+		conn, d, e := dial(t, a)
+		defer conn.Close()
+		helo, err := d.DecodeInterfaceLoose()
+		require.NoError(t, err)
+		require.Equal(t, "HELO", helo.([]interface{})[0])
+		nonce := []byte(helo.([]interface{})[1].(map[string]interface{})["nonce"].(string))
+
+		require.NoError(t, e.Encode([]interface{}{"PING", "client", "salt", sharedKeyDigest("salt", "client", nonce, key), "", ""}))
+		pong, err := d.DecodeInterfaceLoose()
+		require.NoError(t, err)
+		if pong.([]interface{})[1] == true {
+			assert.Equal(t, sharedKeyDigest("salt", "collector", nonce, "secret"), pong.([]interface{})[4])
+			require.NoError(t, e.Encode([]interface{}{"app", 1704164645, map[string]interface{}{"log": "a"}, map[string]interface{}{"chunk": "c1"}}))
+			ack := map[string]interface{}{}
+			require.NoError(t, d.Decode(&ack))
+			assert.Equal(t, "c1", ack["ack"])
+		}
+		return pong.([]interface{})
+	}
+
+	pong := handshake("secret")
+	assert.Equal(t, []interface{}{"PONG", true, "", "collector"}, pong[:4])
+
+	pong = handshake("wrong")
+	assert.Equal(t, false, pong[1])
+}
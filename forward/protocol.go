@@ -0,0 +1,229 @@
+package usp_forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// The Fluent Forward protocol v1:
+// https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1
+
+const (
+	eventTimeExtID = 0
+	// Limits the memory a PackedForward message can
+	// use once decompressed.
+	maxDecompressedSize = 64 * 1024 * 1024
+)
+
+// forwardEvent is an event received from a Fluent client.
+type forwardEvent struct {
+	tag         string
+	timestampMs uint64
+	record      map[string]interface{}
+}
+
+// forwardMessage is one of the messages of the protocol
+// with the chunk ID to acknowledge, if requested.
+type forwardMessage struct {
+	events []forwardEvent
+	chunk  string
+}
+
+func newDecoder(r io.Reader) *msgpack.Decoder {
+	d := msgpack.NewDecoder(r)
+	// Strings sent as binary are decoded as strings.
+	d.UseLooseInterfaceDecoding(true)
+	return d
+}
+
+// decodeMessage decodes a message in any of the modes:
+//
+//	Message:                 [tag, time, record, option?]
+//	Forward:                 [tag, [[time, record], ...], option?]
+//	PackedForward:           [tag, bin, option?]
+//	CompressedPackedForward: [tag, bin, {"compressed": "gzip"}]
+func decodeMessage(d *msgpack.Decoder) (*forwardMessage, error) {
+	n, err := d.DecodeArrayLen()
+	if err != nil {
+		return nil, err
+	}
+	if n < 2 || n > 4 {
+		return nil, fmt.Errorf("invalid message of %d elements", n)
+	}
+	tag, err := d.DecodeString()
+	if err != nil {
+		return nil, fmt.Errorf("tag: %v", err)
+	}
+	c, err := d.PeekCode()
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &forwardMessage{}
+	nOption := 3
+	var packed []byte
+	switch {
+	case msgpcode.IsFixedArray(c) || c == msgpcode.Array16 || c == msgpcode.Array32:
+		nEntries, err := d.DecodeArrayLen()
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < nEntries; i++ {
+			evt, err := decodeEntry(d, tag)
+			if err != nil {
+				return nil, err
+			}
+			msg.events = append(msg.events, evt)
+		}
+	case msgpcode.IsString(c) || msgpcode.IsBin(c):
+		if packed, err = d.DecodeBytes(); err != nil {
+			return nil, err
+		}
+	default:
+		if n < 3 {
+			return nil, errors.New("message without a record")
+		}
+		nOption = 4
+		evt := forwardEvent{tag: tag}
+		if evt.timestampMs, err = decodeTime(d); err != nil {
+			return nil, err
+		}
+		if evt.record, err = decodeRecord(d); err != nil {
+			return nil, err
+		}
+		msg.events = append(msg.events, evt)
+	}
+
+	option := map[string]interface{}{}
+	if n == nOption {
+		if option, err = decodeRecord(d); err != nil {
+			return nil, fmt.Errorf("option: %v", err)
+		}
+	} else if n > nOption {
+		return nil, fmt.Errorf("invalid message of %d elements", n)
+	}
+	msg.chunk, _ = option["chunk"].(string)
+
+	if packed != nil {
+		if compressed, _ := option["compressed"].(string); compressed != "" {
+			if compressed != "gzip" {
+				return nil, fmt.Errorf("unsupported compression: %s", compressed)
+			}
+			if packed, err = gunzip(packed); err != nil {
+				return nil, err
+			}
+		}
+		if msg.events, err = decodePackedEntries(packed, tag); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// decodePackedEntries decodes the [time, record]
+// entries concatenated in a PackedForward message.
+func decodePackedEntries(packed []byte, tag string) ([]forwardEvent, error) {
+	events := []forwardEvent{}
+	r := bytes.NewReader(packed)
+	d := newDecoder(r)
+	for r.Len() != 0 {
+		evt, err := decodeEntry(d, tag)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, evt)
+	}
+	return events, nil
+}
+
+func decodeEntry(d *msgpack.Decoder, tag string) (forwardEvent, error) {
+	evt := forwardEvent{tag: tag}
+	n, err := d.DecodeArrayLen()
+	if err != nil {
+		return evt, err
+	}
+	if n != 2 {
+		return evt, fmt.Errorf("invalid entry of %d elements", n)
+	}
+	if evt.timestampMs, err = decodeTime(d); err != nil {
+		return evt, err
+	}
+	if evt.record, err = decodeRecord(d); err != nil {
+		return evt, err
+	}
+	return evt, nil
+}
+
+// decodeTime decodes the time of an event, either an epoch in
+// seconds or an EventTime with the nanoseconds.
+func decodeTime(d *msgpack.Decoder) (uint64, error) {
+	c, err := d.PeekCode()
+	if err != nil {
+		return 0, err
+	}
+	if msgpcode.IsExt(c) || msgpcode.IsFixedExt(c) {
+		extID, extLen, err := d.DecodeExtHeader()
+		if err != nil {
+			return 0, err
+		}
+		if extID != eventTimeExtID || extLen != 8 {
+			return 0, fmt.Errorf("invalid time extension %d of %d bytes", extID, extLen)
+		}
+		b := make([]byte, 8)
+		if err := d.ReadFull(b); err != nil {
+			return 0, err
+		}
+		sec := binary.BigEndian.Uint32(b[:4])
+		nsec := binary.BigEndian.Uint32(b[4:])
+		return uint64(sec)*1000 + uint64(nsec)/uint64(time.Millisecond), nil
+	}
+	v, err := d.DecodeFloat64()
+	if err != nil {
+		return 0, fmt.Errorf("time: %v", err)
+	}
+	if v < 0 {
+		return 0, fmt.Errorf("invalid time: %v", v)
+	}
+	return uint64(v * 1000), nil
+}
+
+func decodeRecord(d *msgpack.Decoder) (map[string]interface{}, error) {
+	v, err := d.DecodeInterfaceLoose()
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return map[string]interface{}{}, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("record is a %T", v)
+	}
+	return m, nil
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	// Reads all the gzip members, clients can
+	// append a member per chunk of events.
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("gzip: %v", err)
+	}
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("gzip: %v", err)
+	}
+	if len(out) > maxDecompressedSize {
+		return nil, fmt.Errorf("decompressed message larger than %d bytes", maxDecompressedSize)
+	}
+	return out, nil
+}
@@ -19,11 +19,9 @@ import (
 	"github.com/refractionPOINT/usp-adapters/utils"
 )
 
-const maxObjectSize = 1024 * 1024 * 100 // 100 MB
-
 type GCSAdapter struct {
 	conf      GCSConfig
-	uspClient *uspclient.Client
+	uspClient *utils.USPClient
 
 	ctx context.Context
 
@@ -32,6 +30,9 @@ type GCSAdapter struct {
 
 	isStop uint32
 	wg     sync.WaitGroup
+
+	memBudget    *utils.MemoryBudget
+	streamBudget *utils.MemoryBudget
 }
 
 type GCSConfig struct {
@@ -41,6 +42,9 @@ type GCSConfig struct {
 	IsOneTimeLoad       bool                    `json:"single_load" yaml:"single_load"`
 	Prefix              string                  `json:"prefix" yaml:"prefix"`
 	ParallelFetch       int                     `json:"parallel_fetch" yaml:"parallel_fetch"`
+	MaxMemoryMB         int                     `json:"max_memory_mb,omitempty" yaml:"max_memory_mb,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *GCSConfig) Validate() error {
@@ -59,6 +63,8 @@ type gcsLocalFile struct {
 	Attrs        *storage.ObjectAttrs
 	Data         []byte
 	IsCompressed bool
+	IsStreamed   bool
+	Reserved     int64
 	Err          error
 }
 
@@ -66,10 +72,16 @@ func NewGCSAdapter(ctx context.Context, conf GCSConfig) (*GCSAdapter, chan struc
 	if conf.ParallelFetch <= 0 {
 		conf.ParallelFetch = 1
 	}
+	if conf.MaxMemoryMB <= 0 {
+		conf.MaxMemoryMB = utils.DefaultMaxMemoryMB
+	}
 	a := &GCSAdapter{
 		conf: conf,
 		ctx:  context.Background(),
 	}
+	// One chunk per fetcher, plus a budget for the
+	// file currently being streamed and shipped.
+	a.memBudget, a.streamBudget = utils.NewFetchMemoryBudgets(int64(conf.MaxMemoryMB)*1024*1024, conf.ParallelFetch)
 
 	var err error
 
@@ -93,7 +105,7 @@ func NewGCSAdapter(ctx context.Context, conf GCSConfig) (*GCSAdapter, chan struc
 
 	a.bucket = a.client.Bucket(conf.BucketName)
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewBundleUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -173,20 +185,31 @@ func (a *GCSAdapter) lookForFiles() (bool, error) {
 		attrs := e.(*storage.ObjectAttrs)
 		obj := a.bucket.Object(attrs.Name).ReadCompressed(true)
 
-		if attrs.Size > maxObjectSize {
-			a.conf.ClientOptions.OnWarning(fmt.Sprintf("file %s too large (%d)", attrs.Name, attrs.Size))
+		isCompressed := false
+
+		if strings.HasSuffix(attrs.Name, ".gz") || attrs.ContentEncoding == "gzip" {
+			isCompressed = true
+		}
+
+		if attrs.Size > a.memBudget.ChunkSize() {
+			// Too large to be held in memory, it will
+			// be streamed in chunks when its turn comes.
 			return &gcsLocalFile{
-				Obj:  obj,
-				Data: nil,
-				Err:  fmt.Errorf("file too large"),
+				Obj:          obj,
+				Attrs:        attrs,
+				IsCompressed: isCompressed,
+				IsStreamed:   true,
 			}
 		}
 
+		reserved := a.memBudget.Acquire(attrs.Size)
+
 		startTime := time.Now().UTC()
 		a.conf.ClientOptions.DebugLog(fmt.Sprintf("downloading file %s (%d)", attrs.Name, attrs.Size))
 
 		r, err := obj.NewReader(a.ctx)
 		if err != nil {
+			a.memBudget.Release(reserved)
 			a.conf.ClientOptions.OnWarning(fmt.Sprintf("gcs.NewReader(): %v", err))
 			return &gcsLocalFile{
 				Obj:  obj,
@@ -199,6 +222,7 @@ func (a *GCSAdapter) lookForFiles() (bool, error) {
 		r.Close()
 
 		if err != nil {
+			a.memBudget.Release(reserved)
 			a.conf.ClientOptions.OnWarning(fmt.Sprintf("gcs.Download(): %v", err))
 			return &gcsLocalFile{
 				Obj:  obj,
@@ -207,12 +231,6 @@ func (a *GCSAdapter) lookForFiles() (bool, error) {
 			}
 		}
 
-		isCompressed := false
-
-		if strings.HasSuffix(attrs.Name, ".gz") {
-			isCompressed = true
-		}
-
 		a.conf.ClientOptions.DebugLog(fmt.Sprintf("file %s downloaded in %v (%d)", attrs.Name, time.Since(startTime), attrs.Size))
 
 		return &gcsLocalFile{
@@ -220,6 +238,7 @@ func (a *GCSAdapter) lookForFiles() (bool, error) {
 			Attrs:        attrs,
 			Data:         objData,
 			IsCompressed: isCompressed,
+			Reserved:     reserved,
 		}
 	})
 
@@ -249,7 +268,15 @@ func (a *GCSAdapter) lookForFiles() (bool, error) {
 
 		startTime := time.Now().UTC()
 
-		if !a.processEvent(localFile.Data, localFile.IsCompressed) {
+		var isProcessed bool
+		if localFile.IsStreamed {
+			isProcessed = a.streamFile(localFile)
+		} else {
+			isProcessed = a.processEvent(localFile.Data, localFile.IsCompressed)
+			localFile.Data = nil
+			a.memBudget.Release(localFile.Reserved)
+		}
+		if !isProcessed {
 			a.conf.ClientOptions.OnWarning(fmt.Sprintf("file %s NOT processed in %v (%d)", localFile.Attrs.Name, time.Since(startTime), localFile.Attrs.Size))
 			continue
 		}
@@ -276,6 +303,39 @@ func (a *GCSAdapter) lookForFiles() (bool, error) {
 	return isDataFound, err
 }
 
+// streamFile downloads a large file and ships it in chunks
+// as it goes so that it never has to be fully held in memory.
+func (a *GCSAdapter) streamFile(localFile *gcsLocalFile) bool {
+	startTime := time.Now().UTC()
+	a.conf.ClientOptions.DebugLog(fmt.Sprintf("streaming file %s (%d)", localFile.Attrs.Name, localFile.Attrs.Size))
+
+	r, err := localFile.Obj.NewReader(a.ctx)
+	if err != nil {
+		a.conf.ClientOptions.OnWarning(fmt.Sprintf("gcs.NewReader(): %v", err))
+		return false
+	}
+	defer r.Close()
+
+	chunker := utils.ChunkStream
+	if localFile.IsCompressed {
+		chunker = utils.ChunkCompressedStream
+	}
+	nChunks := 0
+	if err := chunker(r, a.streamBudget, func(chunk []byte) error {
+		nChunks++
+		if !a.processEvent(chunk, false) {
+			return errors.New("failed to ship chunk")
+		}
+		return nil
+	}); err != nil {
+		a.conf.ClientOptions.OnError(fmt.Errorf("streaming %s: %v", localFile.Attrs.Name, err))
+		return false
+	}
+
+	a.conf.ClientOptions.DebugLog(fmt.Sprintf("file %s streamed in %v (%d chunks)", localFile.Attrs.Name, time.Since(startTime), nChunks))
+	return true
+}
+
 func (a *GCSAdapter) processEvent(data []byte, isCompressed bool) bool {
 	// Since we're dealing with files, we use the
 	// bundle payloads to avoid having to go through
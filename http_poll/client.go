@@ -0,0 +1,314 @@
+package usp_http_poll
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/refractionPOINT/usp-adapters/utils"
+)
+
+const (
+	defaultPollInterval = 60 * time.Second
+	defaultMaxPages     = 100
+	defaultDedupeTTL    = 24 * time.Hour
+	dedupeWindow        = 1 * time.Hour
+)
+
+type HTTPPollAdapter struct {
+	conf       HTTPPollConfig
+	uspClient  *utils.USPClient
+	httpClient *http.Client
+	deduper    utils.Deduper
+
+	chStopped chan struct{}
+	wgSenders sync.WaitGroup
+	doStop    *utils.Event
+}
+
+type HTTPPollConfig struct {
+	ClientOptions uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
+
+	// URL and body of the requests. They can contain {start_time}
+	// and {end_time}, replaced by the window of time polled. In
+	// the body, values are escaped for use within JSON strings.
+	URL     string            `json:"url" yaml:"url"`
+	Method  string            `json:"method,omitempty" yaml:"method,omitempty"`
+	Body    string            `json:"body,omitempty" yaml:"body,omitempty"`
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	// Format of the placeholder times: "rfc3339" (default),
+	// "unix", "unix_ms" or a Go time layout.
+	TimeFormat string `json:"time_format,omitempty" yaml:"time_format,omitempty"`
+
+	PollIntervalSec uint64 `json:"poll_interval_sec,omitempty" yaml:"poll_interval_sec,omitempty"`
+	// How far back the first poll goes, one poll interval by default.
+	InitialLookbackSec uint64 `json:"initial_lookback_sec,omitempty" yaml:"initial_lookback_sec,omitempty"`
+	// Each window starts this much before the end of the previous
+	// one to catch the events indexed late, the duplicates are
+	// dropped.
+	OverlapSec uint64 `json:"overlap_sec,omitempty" yaml:"overlap_sec,omitempty"`
+
+	Auth       HTTPPollAuth       `json:"auth,omitempty" yaml:"auth,omitempty"`
+	Pagination HTTPPollPagination `json:"pagination,omitempty" yaml:"pagination,omitempty"`
+
+	// Path of the list of events in the response, like "data/events".
+	// When empty the response is either the list or a single event.
+	ItemsPath string `json:"items_path,omitempty" yaml:"items_path,omitempty"`
+	// Path of the unique ID of an event used to drop duplicates,
+	// the whole event is used when empty.
+	IDPath       string `json:"id_path,omitempty" yaml:"id_path,omitempty"`
+	DedupeTTLSec uint64 `json:"dedupe_ttl_sec,omitempty" yaml:"dedupe_ttl_sec,omitempty"`
+	// Path and format of the time of an event, the time
+	// it was received is used when empty.
+	TimePath       string `json:"time_path,omitempty" yaml:"time_path,omitempty"`
+	ItemTimeFormat string `json:"item_time_format,omitempty" yaml:"item_time_format,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+}
+
+func (c *HTTPPollConfig) Validate() error {
+	if err := c.ClientOptions.Validate(); err != nil {
+		return fmt.Errorf("client_options: %v", err)
+	}
+	if c.URL == "" {
+		return errors.New("missing url")
+	}
+	switch strings.ToUpper(c.Method) {
+	case "", http.MethodGet, http.MethodPost:
+	default:
+		return fmt.Errorf("unsupported method: %s", c.Method)
+	}
+	if err := c.Auth.validate(); err != nil {
+		return fmt.Errorf("auth: %v", err)
+	}
+	if err := c.Pagination.validate(); err != nil {
+		return fmt.Errorf("pagination: %v", err)
+	}
+	return nil
+}
+
+func NewHTTPPollAdapter(ctx context.Context, conf HTTPPollConfig) (*HTTPPollAdapter, chan struct{}, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, nil, err
+	}
+	var err error
+	a := &HTTPPollAdapter{
+		conf:   conf,
+		doStop: utils.NewEvent(),
+	}
+
+	if a.conf.Method == "" {
+		a.conf.Method = http.MethodGet
+	}
+	a.conf.Method = strings.ToUpper(a.conf.Method)
+
+	dedupeTTL := defaultDedupeTTL
+	if a.conf.DedupeTTLSec != 0 {
+		dedupeTTL = time.Duration(a.conf.DedupeTTLSec) * time.Second
+	}
+	window := dedupeWindow
+	if window > dedupeTTL {
+		window = dedupeTTL
+	}
+	if a.deduper, err = utils.NewLocalDeduper(window, dedupeTTL); err != nil {
+		return nil, nil, err
+	}
+
+	a.httpClient = a.conf.Auth.newHTTPClient()
+
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
+	if err != nil {
+		a.deduper.Close()
+		return nil, nil, err
+	}
+
+	a.chStopped = make(chan struct{})
+
+	a.wgSenders.Add(1)
+	go a.fetchEvents()
+
+	go func() {
+		a.wgSenders.Wait()
+		close(a.chStopped)
+	}()
+
+	return a, a.chStopped, nil
+}
+
+func (a *HTTPPollAdapter) Close() error {
+	a.conf.ClientOptions.DebugLog("closing")
+	a.doStop.Set()
+	a.wgSenders.Wait()
+	a.deduper.Close()
+	err1 := a.uspClient.Drain(1 * time.Minute)
+	_, err2 := a.uspClient.Close()
+	a.httpClient.CloseIdleConnections()
+
+	if err1 != nil {
+		return err1
+	}
+
+	return err2
+}
+
+func (a *HTTPPollAdapter) fetchEvents() {
+	defer a.wgSenders.Done()
+	defer a.conf.ClientOptions.DebugLog(fmt.Sprintf("polling of %s exiting", a.conf.URL))
+
+	interval := defaultPollInterval
+	if a.conf.PollIntervalSec != 0 {
+		interval = time.Duration(a.conf.PollIntervalSec) * time.Second
+	}
+	lookback := interval
+	if a.conf.InitialLookbackSec != 0 {
+		lookback = time.Duration(a.conf.InitialLookbackSec) * time.Second
+	}
+	overlap := time.Duration(a.conf.OverlapSec) * time.Second
+
+	since := time.Now().Add(-lookback)
+	for {
+		end := time.Now()
+		// The window only moves forward once fully
+		// polled so a failure is retried next time.
+		isFatal, err := a.pollWindow(since.Add(-overlap), end)
+		if err == nil {
+			since = end
+		} else if isFatal {
+			a.conf.ClientOptions.OnError(err)
+			a.doStop.Set()
+			return
+		} else {
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("polling %s: %v", a.conf.URL, err))
+		}
+		if a.doStop.WaitFor(interval) {
+			return
+		}
+	}
+}
+
+// pollWindow ships the events of all the pages of a
+// window of time, returns if the error is fatal.
+func (a *HTTPPollAdapter) pollWindow(start time.Time, end time.Time) (bool, error) {
+	p := newPager(a.conf.Pagination)
+	for nPages := 0; ; nPages++ {
+		if a.doStop.IsSet() {
+			return false, errors.New("stopping")
+		}
+		req, err := a.newRequest(start, end, p)
+		if err != nil {
+			return true, err
+		}
+		resp, err := a.httpClient.Do(req)
+		if err != nil {
+			return false, err
+		}
+		items, body, err := a.readResponse(resp)
+		if err != nil {
+			return false, err
+		}
+		for _, item := range items {
+			if !a.ship(item) {
+				return true, errors.New("failed to ship events")
+			}
+		}
+		if !p.next(resp, body, len(items)) {
+			return false, nil
+		}
+		if nPages+1 >= a.conf.Pagination.maxPages() {
+			// The events already shipped are deduplicated
+			// when the window is polled again.
+			return false, fmt.Errorf("reached the maximum of %d pages, the window is polled again, increase max_pages if this persists", a.conf.Pagination.maxPages())
+		}
+	}
+}
+
+func (a *HTTPPollAdapter) readResponse(resp *http.Response) ([]utils.Dict, utils.Dict, error) {
+	defer resp.Body.Close()
+	data, err := readBody(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if len(data) > 512 {
+			data = data[:512]
+		}
+		return nil, nil, fmt.Errorf("%s: %s", resp.Status, string(data))
+	}
+	return parseItems(data, a.conf.ItemsPath)
+}
+
+// parseItems returns the events in a response body,
+// and the body, with the list at the root wrapped.
+func parseItems(data []byte, itemsPath string) ([]utils.Dict, utils.Dict, error) {
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return nil, utils.Dict{}, nil
+	}
+	// Wrap the body so a list at the root can
+	// be accessed like any other path.
+	body, err := utils.UnmarshalCleanJSON(`{"root":` + string(data) + `}`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid json: %v", err)
+	}
+	root := utils.Dict(body)
+	items := []utils.Dict{}
+	switch v := root.FindOneOpaque("root/" + itemsPath).(type) {
+	case []interface{}:
+		for _, e := range v {
+			if d, ok := e.(map[string]interface{}); ok {
+				items = append(items, d)
+			}
+		}
+	case map[string]interface{}:
+		if itemsPath == "" {
+			items = append(items, v)
+		}
+	}
+	rootDict, _ := root.GetDict("root")
+	return items, rootDict, nil
+}
+
+func (a *HTTPPollAdapter) ship(item utils.Dict) bool {
+	if a.isDuplicate(item) {
+		return true
+	}
+	msg := &protocol.DataMessage{
+		JsonPayload: item,
+		TimestampMs: uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+	}
+	if a.conf.TimePath != "" {
+		if t, ok := parseItemTime(item.FindOneOpaque(a.conf.TimePath), a.conf.ItemTimeFormat); ok {
+			msg.TimestampMs = uint64(t.UnixNano() / int64(time.Millisecond))
+		}
+	}
+	err := a.uspClient.Ship(msg, 10*time.Second)
+	if err == uspclient.ErrorBufferFull {
+		a.conf.ClientOptions.OnWarning("stream falling behind")
+		err = a.uspClient.Ship(msg, 1*time.Hour)
+	}
+	if err != nil {
+		a.conf.ClientOptions.OnError(fmt.Errorf("Ship(): %v", err))
+		return false
+	}
+	return true
+}
+
+func (a *HTTPPollAdapter) isDuplicate(item utils.Dict) bool {
+	if a.conf.IDPath != "" {
+		if id := item.FindOneOpaque(a.conf.IDPath); id != nil {
+			return a.deduper.CheckAndAdd(fmt.Sprintf("%v", id))
+		}
+	}
+	// Maps are serialized with sorted keys.
+	data, _ := json.Marshal(item)
+	h := sha256.Sum256(data)
+	return a.deduper.CheckAndAdd(hex.EncodeToString(h[:]))
+}
@@ -0,0 +1,267 @@
+package usp_http_poll
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/usp-adapters/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAdapter(t *testing.T, conf HTTPPollConfig) *HTTPPollAdapter {
+	conf.ClientOptions = uspclient.ClientOptions{
+		TestSinkMode: true,
+		DebugLog:     func(msg string) {},
+		OnWarning:    func(msg string) { t.Logf("warning: %s", msg) },
+		OnError:      func(err error) { t.Errorf("unexpected error: %v", err) },
+	}
+	require.NoError(t, conf.Validate())
+	if conf.Method == "" {
+		conf.Method = http.MethodGet
+	}
+	c, err := utils.NewUSPClient(context.Background(), conf.ClientOptions, conf.Pipeline)
+	require.NoError(t, err)
+	d, err := utils.NewLocalDeduper(time.Minute, time.Hour)
+	require.NoError(t, err)
+	t.Cleanup(d.Close)
+	return &HTTPPollAdapter{
+		conf:       conf,
+		uspClient:  c,
+		httpClient: conf.Auth.newHTTPClient(),
+		deduper:    d,
+		doStop:     utils.NewEvent(),
+	}
+}
+
+// eventPages serves 5 events, 2 per page.
+func eventPages(offset int) []map[string]interface{} {
+	events := []map[string]interface{}{}
+	for i := offset; i < offset+2 && i < 5; i++ {
+		events = append(events, map[string]interface{}{"id": i, "ts": 1704164645 + i})
+	}
+	return events
+}
+
+func TestPagination(t *testing.T) {
+	requests := []string{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.RequestURI())
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query()
+		offset := 0
+		switch r.URL.Path {
+		case "/link":
+			offset, _ = strconv.Atoi(q.Get("page"))
+			if offset+2 < 5 {
+				w.Header().Add("Link", fmt.Sprintf(`</link?page=%d>; rel="next", </link?page=4>; rel="last"`, offset+2))
+			}
+			json.NewEncoder(w).Encode(eventPages(offset))
+		case "/cursor":
+			if c := q.Get("after"); c != "" {
+				offset, _ = strconv.Atoi(c[1:])
+			}
+			resp := map[string]interface{}{"data": map[string]interface{}{"events": eventPages(offset)}}
+			if offset+2 < 5 {
+				resp["meta"] = map[string]interface{}{"next": fmt.Sprintf("c%d", offset+2)}
+			}
+			json.NewEncoder(w).Encode(resp)
+		case "/offset":
+			offset, _ = strconv.Atoi(q.Get("skip"))
+			json.NewEncoder(w).Encode(map[string]interface{}{"items": eventPages(offset)})
+		}
+	}))
+	defer s.Close()
+
+	start := time.Unix(1704164645, 0)
+	end := start.Add(time.Minute)
+	for _, test := range []struct {
+		conf     HTTPPollConfig
+		expected []string
+	}{
+		{
+			conf: HTTPPollConfig{
+				URL:        s.URL + "/link?from={start_time}",
+				Pagination: HTTPPollPagination{Type: "link_header"},
+			},
+			expected: []string{"/link?from=2024-01-02T03%3A04%3A05Z", "/link?page=2", "/link?page=4"},
+		},
+		{
+			conf: HTTPPollConfig{
+				URL:        s.URL + "/cursor?from={start_time}&to={end_time}",
+				TimeFormat: "unix",
+				ItemsPath:  "data/events",
+				Pagination: HTTPPollPagination{Type: "cursor", CursorPath: "meta/next", CursorParam: "after"},
+			},
+			expected: []string{"/cursor?from=1704164645&to=1704164705", "/cursor?after=c2&from=1704164645&to=1704164705", "/cursor?after=c4&from=1704164645&to=1704164705"},
+		},
+		{
+			conf: HTTPPollConfig{
+				URL:        s.URL + "/offset",
+				ItemsPath:  "items",
+				Pagination: HTTPPollPagination{Type: "offset", OffsetParam: "skip", LimitParam: "limit", PageSize: 2},
+			},
+			expected: []string{"/offset?limit=2&skip=0", "/offset?limit=2&skip=2", "/offset?limit=2&skip=4"},
+		},
+	} {
+		requests = []string{}
+		test.conf.Auth = HTTPPollAuth{Type: "bearer", Token: "token"}
+		a := newTestAdapter(t, test.conf)
+		isFatal, err := a.pollWindow(start, end)
+		require.NoError(t, err, test.conf.URL)
+		assert.False(t, isFatal)
+		assert.Equal(t, test.expected, requests)
+	}
+
+	a := newTestAdapter(t, HTTPPollConfig{URL: s.URL + "/link"})
+	isFatal, err := a.pollWindow(start, end)
+	assert.Error(t, err)
+	assert.False(t, isFatal)
+
+	// A window with more pages is polled again.
+	requests = []string{}
+	a = newTestAdapter(t, HTTPPollConfig{
+		URL:        s.URL + "/offset",
+		ItemsPath:  "items",
+		Auth:       HTTPPollAuth{Type: "bearer", Token: "token"},
+		Pagination: HTTPPollPagination{Type: "offset", OffsetParam: "skip", PageSize: 2, MaxPages: 2},
+	})
+	isFatal, err = a.pollWindow(start, end)
+	assert.Error(t, err)
+	assert.False(t, isFatal)
+	assert.Equal(t, []string{"/offset?skip=0", "/offset?skip=2"}, requests)
+}
+
+func TestRequestBody(t *testing.T) {
+	a := newTestAdapter(t, HTTPPollConfig{
+		URL:        "https://api.example.com/search",
+		Method:     http.MethodPost,
+		Body:       `{"from":"{start_time}","after":"{cursor}"}`,
+		Pagination: HTTPPollPagination{Type: "cursor", CursorPath: "next"},
+	})
+	p := newPager(a.conf.Pagination)
+	p.cursor = `a"b\c` + "\n"
+	req, err := a.newRequest(time.Unix(1704164645, 0), time.Unix(1704164705, 0), p)
+	require.NoError(t, err)
+	body := map[string]string{}
+	require.NoError(t, json.NewDecoder(req.Body).Decode(&body))
+	assert.Equal(t, map[string]string{
+		"from":  "2024-01-02T03:04:05Z",
+		"after": p.cursor,
+	}, body)
+}
+
+func TestParseItems(t *testing.T) {
+	items, _, err := parseItems([]byte(`[{"a":1},{"a":2}]`), "")
+	require.NoError(t, err)
+	assert.Len(t, items, 2)
+
+	items, _, err = parseItems([]byte(`{"a":1}`), "")
+	require.NoError(t, err)
+	assert.Len(t, items, 1)
+
+	items, body, err := parseItems([]byte(`{"result":{"logs":[{"a":1}]},"next":"x"}`), "result/logs")
+	require.NoError(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, "x", body.FindOneString("next"))
+
+	items, _, err = parseItems([]byte(`{"result":{}}`), "result/logs")
+	require.NoError(t, err)
+	assert.Empty(t, items)
+
+	_, _, err = parseItems([]byte(`{"a":`), "")
+	assert.Error(t, err)
+}
+
+func TestDedupe(t *testing.T) {
+	a := newTestAdapter(t, HTTPPollConfig{URL: "http://localhost", IDPath: "id"})
+	assert.False(t, a.isDuplicate(utils.Dict{"id": uint64(1)}))
+	assert.True(t, a.isDuplicate(utils.Dict{"id": uint64(1), "other": "value"}))
+	// Events without an ID are compared whole.
+	assert.False(t, a.isDuplicate(utils.Dict{"a": "b"}))
+	assert.True(t, a.isDuplicate(utils.Dict{"a": "b"}))
+	assert.False(t, a.isDuplicate(utils.Dict{"a": "c"}))
+}
+
+func TestAuth(t *testing.T) {
+	tokenRequests := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			tokenRequests++
+			r.ParseForm()
+			assert.Equal(t, "client_credentials", r.Form.Get("grant_type"))
+			assert.Equal(t, "logs", r.Form.Get("audience"))
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token":"oauth-token","token_type":"Bearer","expires_in":3600}`))
+		case "/logs":
+			assert.Equal(t, "Bearer oauth-token", r.Header.Get("Authorization"))
+			w.Write([]byte(`[]`))
+		case "/key":
+			assert.Equal(t, "key", r.Header.Get("X-Custom-Key"))
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer s.Close()
+
+	a := newTestAdapter(t, HTTPPollConfig{
+		URL: s.URL + "/logs",
+		Auth: HTTPPollAuth{
+			Type:           "oauth2",
+			TokenURL:       s.URL + "/token",
+			ClientID:       "id",
+			ClientSecret:   "secret",
+			EndpointParams: map[string]string{"audience": "logs"},
+		},
+	})
+	for i := 0; i < 2; i++ {
+		_, err := a.pollWindow(time.Now(), time.Now())
+		require.NoError(t, err)
+	}
+	// The token is reused until it expires.
+	assert.Equal(t, 1, tokenRequests)
+
+	a = newTestAdapter(t, HTTPPollConfig{
+		URL:  s.URL + "/key",
+		Auth: HTTPPollAuth{Type: "api_key", APIKey: "key", HeaderName: "X-Custom-Key"},
+	})
+	_, err := a.pollWindow(time.Now(), time.Now())
+	require.NoError(t, err)
+
+	assert.Error(t, (&HTTPPollConfig{URL: "x", Auth: HTTPPollAuth{Type: "digest"}}).Validate())
+	assert.Error(t, (&HTTPPollConfig{URL: "x", Auth: HTTPPollAuth{Type: "oauth2"}}).Validate())
+	assert.Error(t, (&HTTPPollConfig{URL: "x", Pagination: HTTPPollPagination{Type: "offset"}}).Validate())
+}
+
+func TestParseItemTime(t *testing.T) {
+	for _, test := range []struct {
+		value    interface{}
+		format   string
+		expected int64
+	}{
+		{"2024-01-02T03:04:05.5Z", "", 1704164645500},
+		{uint64(1704164645), "", 1704164645000},
+		{uint64(1704164645123), "", 1704164645123},
+		{"1704164645", "unix", 1704164645000},
+		{1704164645.25, "", 1704164645250},
+		{"02/01/2024 03:04:05", "02/01/2006 15:04:05", 1704164645000},
+	} {
+		ts, ok := parseItemTime(test.value, test.format)
+		require.True(t, ok, test.value)
+		assert.Equal(t, test.expected, ts.UnixMilli(), test.value)
+	}
+	_, ok := parseItemTime("yesterday", "")
+	assert.False(t, ok)
+	_, ok = parseItemTime(nil, "")
+	assert.False(t, ok)
+}
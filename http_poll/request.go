@@ -0,0 +1,372 @@
+package usp_http_poll
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/refractionPOINT/usp-adapters/utils"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const (
+	requestTimeout      = 30 * time.Second
+	maxResponseSize     = 64 * 1024 * 1024
+	defaultAPIKeyHeader = "X-API-Key"
+)
+
+type HTTPPollAuth struct {
+	// "bearer", "basic", "api_key" or "oauth2", none when empty.
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+
+	Token    string `json:"token,omitempty" yaml:"token,omitempty"`
+	Username string `json:"username,omitempty" yaml:"username,omitempty"`
+	Password string `json:"password,omitempty" yaml:"password,omitempty"`
+
+	APIKey     string `json:"api_key,omitempty" yaml:"api_key,omitempty"`
+	HeaderName string `json:"header_name,omitempty" yaml:"header_name,omitempty"`
+
+	// OAuth2 client credentials grant.
+	TokenURL       string            `json:"token_url,omitempty" yaml:"token_url,omitempty"`
+	ClientID       string            `json:"client_id,omitempty" yaml:"client_id,omitempty"`
+	ClientSecret   string            `json:"client_secret,omitempty" yaml:"client_secret,omitempty"`
+	Scopes         []string          `json:"scopes,omitempty" yaml:"scopes,omitempty"`
+	EndpointParams map[string]string `json:"endpoint_params,omitempty" yaml:"endpoint_params,omitempty"`
+}
+
+type HTTPPollPagination struct {
+	// "link_header" follows the rel="next" Link header, "next_url"
+	// the URL at next_url_path, "cursor" passes the value at
+	// cursor_path and "offset" counts the events received.
+	// No pagination when empty.
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+
+	NextURLPath string `json:"next_url_path,omitempty" yaml:"next_url_path,omitempty"`
+
+	// The cursor and offset are set as the cursor_param and offset_param
+	// query parameters, or replace {cursor} and {offset} in the
+	// url and body.
+	CursorPath  string `json:"cursor_path,omitempty" yaml:"cursor_path,omitempty"`
+	CursorParam string `json:"cursor_param,omitempty" yaml:"cursor_param,omitempty"`
+	OffsetParam string `json:"offset_param,omitempty" yaml:"offset_param,omitempty"`
+	// Size of the pages, set as the limit_param query parameter. With
+	// offset pagination, a shorter page is the last one.
+	LimitParam string `json:"limit_param,omitempty" yaml:"limit_param,omitempty"`
+	PageSize   int    `json:"page_size,omitempty" yaml:"page_size,omitempty"`
+
+	// Pages polled per window, defaults to 100. The window is
+	// polled again from its start when it has more pages.
+	MaxPages int `json:"max_pages,omitempty" yaml:"max_pages,omitempty"`
+}
+
+func (a HTTPPollAuth) validate() error {
+	switch strings.ToLower(a.Type) {
+	case "", "none":
+	case "bearer":
+		if a.Token == "" {
+			return errors.New("missing token")
+		}
+	case "basic":
+		if a.Username == "" {
+			return errors.New("missing username")
+		}
+	case "api_key":
+		if a.APIKey == "" {
+			return errors.New("missing api_key")
+		}
+	case "oauth2":
+		if a.TokenURL == "" || a.ClientID == "" || a.ClientSecret == "" {
+			return errors.New("token_url, client_id and client_secret required")
+		}
+	default:
+		return fmt.Errorf("unsupported type: %s", a.Type)
+	}
+	return nil
+}
+
+func (a HTTPPollAuth) newHTTPClient() *http.Client {
+	client := &http.Client{
+		Timeout: requestTimeout,
+	}
+	if strings.ToLower(a.Type) != "oauth2" {
+		return client
+	}
+	conf := &clientcredentials.Config{
+		ClientID:       a.ClientID,
+		ClientSecret:   a.ClientSecret,
+		TokenURL:       a.TokenURL,
+		Scopes:         a.Scopes,
+		EndpointParams: url.Values{},
+	}
+	for k, v := range a.EndpointParams {
+		conf.EndpointParams.Set(k, v)
+	}
+	// The token requests use the client with the timeout too.
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, client)
+	oauthClient := conf.Client(ctx)
+	oauthClient.Timeout = requestTimeout
+	return oauthClient
+}
+
+// apply sets the authentication headers, OAuth2 is
+// handled by the HTTP client.
+func (a HTTPPollAuth) apply(req *http.Request) {
+	switch strings.ToLower(a.Type) {
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+	case "basic":
+		req.SetBasicAuth(a.Username, a.Password)
+	case "api_key":
+		header := a.HeaderName
+		if header == "" {
+			header = defaultAPIKeyHeader
+		}
+		req.Header.Set(header, a.APIKey)
+	}
+}
+
+func (p HTTPPollPagination) validate() error {
+	switch strings.ToLower(p.Type) {
+	case "", "none", "link_header":
+	case "next_url":
+		if p.NextURLPath == "" {
+			return errors.New("missing next_url_path")
+		}
+	case "cursor":
+		if p.CursorPath == "" {
+			return errors.New("missing cursor_path")
+		}
+	case "offset":
+		if p.PageSize <= 0 {
+			return errors.New("offset pagination requires page_size")
+		}
+	default:
+		return fmt.Errorf("unsupported type: %s", p.Type)
+	}
+	if p.PageSize < 0 || p.MaxPages < 0 {
+		return errors.New("invalid page_size or max_pages")
+	}
+	return nil
+}
+
+func (p HTTPPollPagination) maxPages() int {
+	if p.MaxPages == 0 {
+		return defaultMaxPages
+	}
+	return p.MaxPages
+}
+
+// pager tracks the position within the pages of a window.
+type pager struct {
+	conf    HTTPPollPagination
+	nextURL string
+	cursor  string
+	offset  int
+}
+
+func newPager(conf HTTPPollPagination) *pager {
+	return &pager{
+		conf: conf,
+	}
+}
+
+// next moves to the page after the response,
+// returns false if it was the last one.
+func (p *pager) next(resp *http.Response, body utils.Dict, nItems int) bool {
+	switch strings.ToLower(p.conf.Type) {
+	case "link_header":
+		p.nextURL = nextLink(resp.Header.Values("Link"))
+		return p.nextURL != ""
+	case "next_url":
+		p.nextURL = body.FindOneString(p.conf.NextURLPath)
+		return p.nextURL != "" && nItems != 0
+	case "cursor":
+		cursor := fmt.Sprintf("%v", body.FindOneOpaque(p.conf.CursorPath))
+		if cursor == "" || cursor == "<nil>" || cursor == p.cursor || nItems == 0 {
+			return false
+		}
+		p.cursor = cursor
+		return true
+	case "offset":
+		p.offset += nItems
+		return nItems >= p.conf.PageSize
+	}
+	return false
+}
+
+// nextLink returns the URL of the rel="next" link in Link headers like:
+//
+//	<https://api.example.com/logs?page=2>; rel="next", <...>; rel="last"
+func nextLink(headers []string) string {
+	for _, header := range headers {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			if len(parts) < 2 {
+				continue
+			}
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				param = strings.ReplaceAll(strings.TrimSpace(param), " ", "")
+				if param == `rel="next"` || param == "rel=next" {
+					return target[1 : len(target)-1]
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func (a *HTTPPollAdapter) newRequest(start time.Time, end time.Time, p *pager) (*http.Request, error) {
+	values := map[string]string{
+		"{start_time}": formatTime(start, a.conf.TimeFormat),
+		"{end_time}":   formatTime(end, a.conf.TimeFormat),
+		"{cursor}":     p.cursor,
+		"{offset}":     strconv.Itoa(p.offset),
+	}
+
+	var u *url.URL
+	var err error
+	if p.nextURL != "" {
+		// Next page URLs can be relative.
+		base, err := url.Parse(a.conf.URL)
+		if err != nil {
+			return nil, err
+		}
+		if u, err = base.Parse(p.nextURL); err != nil {
+			return nil, err
+		}
+	} else {
+		rawURL := a.conf.URL
+		for k, v := range values {
+			rawURL = strings.ReplaceAll(rawURL, k, url.QueryEscape(v))
+		}
+		if u, err = url.Parse(rawURL); err != nil {
+			return nil, err
+		}
+		q := u.Query()
+		if p.conf.CursorParam != "" && p.cursor != "" {
+			q.Set(p.conf.CursorParam, p.cursor)
+		}
+		if p.conf.OffsetParam != "" {
+			q.Set(p.conf.OffsetParam, strconv.Itoa(p.offset))
+		}
+		if p.conf.LimitParam != "" && p.conf.PageSize != 0 {
+			q.Set(p.conf.LimitParam, strconv.Itoa(p.conf.PageSize))
+		}
+		u.RawQuery = q.Encode()
+	}
+
+	var body io.Reader
+	if a.conf.Body != "" {
+		b := a.conf.Body
+		for k, v := range values {
+			b = strings.ReplaceAll(b, k, jsonEscape(v))
+		}
+		body = strings.NewReader(b)
+	}
+	req, err := http.NewRequest(a.conf.Method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range a.conf.Headers {
+		req.Header.Set(k, v)
+	}
+	a.conf.Auth.apply(req)
+	return req, nil
+}
+
+// jsonEscape escapes a value for use within
+// a string of the JSON body.
+func jsonEscape(v string) string {
+	b, _ := json.Marshal(v)
+	return string(b[1 : len(b)-1])
+}
+
+func readBody(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxResponseSize {
+		return nil, fmt.Errorf("response larger than %d bytes", maxResponseSize)
+	}
+	return data, nil
+}
+
+func formatTime(t time.Time, format string) string {
+	switch strings.ToLower(format) {
+	case "", "rfc3339":
+		return t.UTC().Format(time.RFC3339)
+	case "unix":
+		return strconv.FormatInt(t.Unix(), 10)
+	case "unix_ms":
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	}
+	return t.UTC().Format(format)
+}
+
+// parseItemTime parses the time of an event, epochs are
+// in seconds or milliseconds depending on their size
+// unless the format says.
+func parseItemTime(v interface{}, format string) (time.Time, bool) {
+	var epoch float64
+	switch t := v.(type) {
+	case string:
+		switch strings.ToLower(format) {
+		case "", "rfc3339":
+			parsed, err := time.Parse(time.RFC3339Nano, t)
+			if err == nil {
+				return parsed, true
+			}
+			if epoch, err = strconv.ParseFloat(t, 64); err != nil {
+				return time.Time{}, false
+			}
+		case "unix", "unix_ms":
+			var err error
+			if epoch, err = strconv.ParseFloat(t, 64); err != nil {
+				return time.Time{}, false
+			}
+		default:
+			parsed, err := time.Parse(format, t)
+			return parsed, err == nil
+		}
+	case uint64:
+		epoch = float64(t)
+	case int64:
+		epoch = float64(t)
+	case float64:
+		epoch = t
+	default:
+		return time.Time{}, false
+	}
+	if epoch <= 0 {
+		return time.Time{}, false
+	}
+	isMs := epoch > 1e11
+	switch strings.ToLower(format) {
+	case "unix":
+		isMs = false
+	case "unix_ms":
+		isMs = true
+	}
+	if !isMs {
+		epoch *= 1000
+	}
+	return time.UnixMilli(int64(math.Round(epoch))), true
+}
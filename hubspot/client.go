@@ -29,7 +29,7 @@ type opRequest struct {
 
 type HubSpotAdapter struct {
 	conf       HubSpotConfig
-	uspClient  *uspclient.Client
+	uspClient  *utils.USPClient
 	httpClient *http.Client
 
 	chStopped chan struct{}
@@ -44,6 +44,8 @@ type HubSpotAdapter struct {
 type HubSpotConfig struct {
 	ClientOptions uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
 	AccessToken   string                  `json:"access_token" yaml:"access_token"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *HubSpotConfig) Validate() error {
@@ -65,7 +67,7 @@ func NewHubSpotAdapter(ctx context.Context, conf HubSpotConfig) (*HubSpotAdapter
 		dedupe: make(map[string]int64),
 	}
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
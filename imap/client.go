@@ -19,6 +19,7 @@ import (
 	"github.com/refractionPOINT/go-limacharlie/limacharlie"
 	"github.com/refractionPOINT/go-uspclient"
 	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/refractionPOINT/usp-adapters/utils"
 )
 
 var (
@@ -27,7 +28,7 @@ var (
 
 type IMAPAdapter struct {
 	conf      ImapConfig
-	uspClient *uspclient.Client
+	uspClient *utils.USPClient
 
 	imapClient *client.Client
 	chStop     chan struct{}
@@ -51,6 +52,8 @@ type ImapConfig struct {
 	MaxBodySize             int                     `json:"max_body_size" yaml:"max_body_size"`
 	AttachmentIngestKey     string                  `json:"attachment_ingest_key" yaml:"attachment_ingest_key"`
 	AttachmentRetentionDays int                     `json:"attachment_retention_days" yaml:"attachment_retention_days"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *ImapConfig) Validate() error {
@@ -126,7 +129,7 @@ func NewImapAdapter(ctx context.Context, conf ImapConfig) (*IMAPAdapter, chan st
 	}
 
 	// Create the USP client to ship to LC
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		a.imapClient.Logout()
 		a.imapClient.Close()
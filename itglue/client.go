@@ -29,7 +29,7 @@ type opRequest struct {
 
 type ITGlueAdapter struct {
 	conf       ITGlueConfig
-	uspClient  *uspclient.Client
+	uspClient  *utils.USPClient
 	httpClient *http.Client
 
 	chStopped chan struct{}
@@ -42,6 +42,8 @@ type ITGlueAdapter struct {
 type ITGlueConfig struct {
 	ClientOptions uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
 	Token         string                  `json:"token" yaml:"token"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *ITGlueConfig) Validate() error {
@@ -62,7 +64,7 @@ func NewITGlueAdapter(ctx context.Context, conf ITGlueConfig) (*ITGlueAdapter, c
 		doStop: utils.NewEvent(),
 	}
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -0,0 +1,206 @@
+//go:build linux
+// +build linux
+
+package usp_journald
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/refractionPOINT/usp-adapters/utils"
+)
+
+const (
+	defaultWriteTimeout   = 60 * 10
+	defaultJournalctlPath = "journalctl"
+	cursorSaveInterval    = 5 * time.Second
+)
+
+type JournaldAdapter struct {
+	conf         JournaldConfig
+	wg           sync.WaitGroup
+	isRunning    uint32
+	uspClient    *utils.USPClient
+	writeTimeout time.Duration
+
+	cmd *exec.Cmd
+
+	mCursor       sync.Mutex
+	cursor        string
+	isCursorDirty bool
+
+	chStop chan struct{}
+}
+
+func NewJournaldAdapter(ctx context.Context, conf JournaldConfig) (*JournaldAdapter, chan struct{}, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, nil, err
+	}
+	a := &JournaldAdapter{
+		conf:      conf,
+		isRunning: 1,
+		chStop:    make(chan struct{}),
+	}
+
+	if a.conf.WriteTimeoutSec == 0 {
+		a.conf.WriteTimeoutSec = defaultWriteTimeout
+	}
+	a.writeTimeout = time.Duration(a.conf.WriteTimeoutSec) * time.Second
+	if a.conf.JournalctlPath == "" {
+		a.conf.JournalctlPath = defaultJournalctlPath
+	}
+
+	if a.conf.CursorFile != "" {
+		content, err := os.ReadFile(a.conf.CursorFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, fmt.Errorf("cursor_file: %v", err)
+		}
+		a.cursor = strings.TrimSpace(string(content))
+	}
+	if a.cursor != "" {
+		a.conf.ClientOptions.DebugLog(fmt.Sprintf("resuming journal after cursor %s", a.cursor))
+	}
+
+	a.cmd = exec.Command(a.conf.JournalctlPath, a.conf.journalctlArgs(a.cursor)...)
+	a.cmd.Stderr = os.Stderr
+	stdout, err := a.cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	a.uspClient, err = utils.NewAckedUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := a.cmd.Start(); err != nil {
+		a.uspClient.Close()
+		return nil, nil, fmt.Errorf("%s: %v", a.conf.JournalctlPath, err)
+	}
+
+	chStopped := make(chan struct{})
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer close(chStopped)
+		a.handleInput(stdout)
+		if err := a.cmd.Wait(); err != nil && atomic.LoadUint32(&a.isRunning) == 1 {
+			a.conf.ClientOptions.OnError(fmt.Errorf("%s exited: %v", a.conf.JournalctlPath, err))
+		}
+	}()
+
+	if a.conf.CursorFile != "" {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			a.saveCursorPeriodically()
+		}()
+	}
+
+	return a, chStopped, nil
+}
+
+func (a *JournaldAdapter) Close() error {
+	a.conf.ClientOptions.DebugLog("closing")
+	atomic.StoreUint32(&a.isRunning, 0)
+	a.cmd.Process.Signal(syscall.SIGTERM)
+	close(a.chStop)
+	a.wg.Wait()
+	err1 := a.uspClient.Drain(1 * time.Minute)
+	_, err2 := a.uspClient.Close()
+	err3 := a.saveCursor()
+
+	if err1 != nil {
+		return err1
+	}
+	if err2 != nil {
+		return err2
+	}
+	return err3
+}
+
+func (a *JournaldAdapter) handleInput(stdout io.Reader) {
+	r := newExportReader(stdout)
+	for atomic.LoadUint32(&a.isRunning) == 1 {
+		entry, err := r.Next()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && atomic.LoadUint32(&a.isRunning) == 1 {
+				a.conf.ClientOptions.OnError(fmt.Errorf("journal export: %v", err))
+			}
+			return
+		}
+
+		timestamp := entry.TimestampMs
+		if timestamp == 0 {
+			timestamp = uint64(time.Now().UnixNano() / int64(time.Millisecond))
+		}
+		msg := &protocol.DataMessage{
+			JsonPayload: entry.Fields,
+			TimestampMs: timestamp,
+		}
+		err = a.uspClient.Ship(msg, a.writeTimeout)
+		if err == uspclient.ErrorBufferFull {
+			a.conf.ClientOptions.OnWarning("stream falling behind")
+			err = a.uspClient.Ship(msg, 1*time.Hour)
+		}
+		if err != nil {
+			a.conf.ClientOptions.OnError(fmt.Errorf("Ship(): %v", err))
+			continue
+		}
+
+		if entry.Cursor != "" {
+			a.mCursor.Lock()
+			a.cursor = entry.Cursor
+			a.isCursorDirty = true
+			a.mCursor.Unlock()
+		}
+	}
+}
+
+func (a *JournaldAdapter) saveCursorPeriodically() {
+	ticker := time.NewTicker(cursorSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.chStop:
+			return
+		case <-ticker.C:
+		}
+		if err := a.saveCursor(); err != nil {
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("failed saving cursor: %v", err))
+		}
+	}
+}
+
+func (a *JournaldAdapter) saveCursor() error {
+	if a.conf.CursorFile == "" {
+		return nil
+	}
+	a.mCursor.Lock()
+	defer a.mCursor.Unlock()
+	if !a.isCursorDirty {
+		return nil
+	}
+	// Write to a temporary file first so that a crash
+	// never leaves us with a truncated cursor.
+	tmpPath := a.conf.CursorFile + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(a.cursor), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, a.conf.CursorFile); err != nil {
+		return err
+	}
+	a.isCursorDirty = false
+	return nil
+}
@@ -0,0 +1,71 @@
+package usp_journald
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/usp-adapters/utils"
+)
+
+type JournaldConfig struct {
+	ClientOptions   uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
+	WriteTimeoutSec uint64                  `json:"write_timeout_sec,omitempty" yaml:"write_timeout_sec,omitempty"`
+
+	// Only include entries from these systemd units.
+	Units []string `json:"units,omitempty" yaml:"units,omitempty"`
+	// Maximum priority to include, like "warning" or "0..4".
+	Priority string `json:"priority,omitempty" yaml:"priority,omitempty"`
+	// Journal field matches like "_COMM=sshd", see journalctl(1).
+	Matches []string `json:"matches,omitempty" yaml:"matches,omitempty"`
+
+	// Read the journal files in this directory instead of the
+	// system journal, like a journal copied from another host.
+	Directory string `json:"directory,omitempty" yaml:"directory,omitempty"`
+	// File where the position in the journal is saved so that
+	// we resume where we left off after a restart.
+	CursorFile string `json:"cursor_file,omitempty" yaml:"cursor_file,omitempty"`
+	// Without a saved cursor, start from the oldest entry
+	// instead of only new entries.
+	IsFromStart bool `json:"from_start,omitempty" yaml:"from_start,omitempty"`
+
+	JournalctlPath string `json:"journalctl_path,omitempty" yaml:"journalctl_path,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+}
+
+func (c *JournaldConfig) Validate() error {
+	if err := c.ClientOptions.Validate(); err != nil {
+		return fmt.Errorf("client_options: %v", err)
+	}
+	for _, m := range c.Matches {
+		if m != "+" && !strings.Contains(m, "=") {
+			return fmt.Errorf("invalid match, expected FIELD=value: %s", m)
+		}
+	}
+	return nil
+}
+
+// journalctlArgs generates the journalctl command line
+// following the journal from the cursor provided.
+func (c *JournaldConfig) journalctlArgs(cursor string) []string {
+	args := []string{"--output=export", "--follow", "--no-pager", "--quiet"}
+	if c.Directory != "" {
+		args = append(args, "--directory="+c.Directory)
+	}
+	if cursor != "" {
+		args = append(args, "--after-cursor="+cursor)
+	} else if c.IsFromStart {
+		args = append(args, "--no-tail")
+	} else {
+		args = append(args, "--lines=0")
+	}
+	for _, u := range c.Units {
+		args = append(args, "--unit="+u)
+	}
+	if c.Priority != "" {
+		args = append(args, "--priority="+c.Priority)
+	}
+	args = append(args, c.Matches...)
+	return args
+}
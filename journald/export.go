@@ -0,0 +1,152 @@
+package usp_journald
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Fields of the export format that are used internally and
+// not included in the events shipped.
+const (
+	fieldCursor    = "__CURSOR"
+	fieldRealtime  = "__REALTIME_TIMESTAMP"
+	fieldMonotonic = "__MONOTONIC_TIMESTAMP"
+	fieldSeqnum    = "__SEQNUM"
+	fieldSeqnumID  = "__SEQNUM_ID"
+)
+
+// Largest binary field value we accept, protects against
+// a corrupted stream making us allocate huge buffers.
+const maxFieldSize = 1024 * 1024 * 64
+
+type journalEntry struct {
+	Cursor      string
+	TimestampMs uint64
+	Fields      map[string]interface{}
+}
+
+// exportReader decodes the journal export format as output
+// by `journalctl -o export`, see:
+// https://systemd.io/JOURNAL_EXPORT_FORMATS/
+//
+// Entries are a series of fields terminated by an empty line.
+// Text fields are written as "FIELD=value\n" while fields that
+// contain binary data or newlines are written as "FIELD\n"
+// followed by the 64 bit little endian size of the value,
+// the value itself and a "\n".
+type exportReader struct {
+	r *bufio.Reader
+}
+
+func newExportReader(r io.Reader) *exportReader {
+	return &exportReader{
+		r: bufio.NewReaderSize(r, 1024*64),
+	}
+}
+
+// Next returns the next entry in the stream, or io.EOF
+// once the stream ended cleanly.
+func (e *exportReader) Next() (*journalEntry, error) {
+	entry := &journalEntry{
+		Fields: map[string]interface{}{},
+	}
+	nFields := 0
+	for {
+		line, err := e.r.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF && len(line) == 0 && nFields == 0 {
+				return nil, io.EOF
+			}
+			if err == io.EOF {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = line[:len(line)-1]
+
+		if len(line) == 0 {
+			if nFields == 0 {
+				// Tolerate extra empty lines between entries.
+				continue
+			}
+			return entry, nil
+		}
+
+		var name string
+		var value []byte
+		if i := bytes.IndexByte(line, '='); i != -1 {
+			name = string(line[:i])
+			value = line[i+1:]
+		} else {
+			name = string(line)
+			if value, err = e.readBinaryValue(); err != nil {
+				return nil, fmt.Errorf("field %s: %v", name, err)
+			}
+		}
+		nFields++
+		entry.addField(name, value)
+	}
+}
+
+func (e *exportReader) readBinaryValue() ([]byte, error) {
+	sizeBytes := [8]byte{}
+	if _, err := io.ReadFull(e.r, sizeBytes[:]); err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint64(sizeBytes[:])
+	if size > maxFieldSize {
+		return nil, fmt.Errorf("field too large: %d", size)
+	}
+	value := make([]byte, size+1)
+	if _, err := io.ReadFull(e.r, value); err != nil {
+		return nil, err
+	}
+	if value[size] != '\n' {
+		return nil, errors.New("missing newline after binary field")
+	}
+	return value[:size], nil
+}
+
+func (j *journalEntry) addField(name string, value []byte) {
+	switch name {
+	case fieldCursor:
+		j.Cursor = string(value)
+		return
+	case fieldRealtime:
+		if usec, err := strconv.ParseUint(string(value), 10, 64); err == nil {
+			j.TimestampMs = usec / 1000
+		}
+		return
+	case fieldMonotonic, fieldSeqnum, fieldSeqnumID:
+		return
+	}
+
+	// Values that are not valid text are kept as
+	// bytes, which get base64 encoded in JSON.
+	var v interface{}
+	if utf8.Valid(value) {
+		v = string(value)
+	} else {
+		b := make([]byte, len(value))
+		copy(b, value)
+		v = b
+	}
+
+	// A field can appear multiple times in the same entry.
+	existing, ok := j.Fields[name]
+	if !ok {
+		j.Fields[name] = v
+		return
+	}
+	if l, ok := existing.([]interface{}); ok {
+		j.Fields[name] = append(l, v)
+		return
+	}
+	j.Fields[name] = []interface{}{existing, v}
+}
@@ -0,0 +1,87 @@
+package usp_journald
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func binaryField(name string, value []byte) []byte {
+	b := bytes.Buffer{}
+	b.WriteString(name)
+	b.WriteByte('\n')
+	size := [8]byte{}
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+	b.Write(size[:])
+	b.Write(value)
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+func TestExportReader(t *testing.T) {
+	stream := bytes.Buffer{}
+	stream.WriteString("__CURSOR=s=abc;i=1\n__REALTIME_TIMESTAMP=1700000000123456\n__MONOTONIC_TIMESTAMP=42\n_BOOT_ID=b1\n_SYSTEMD_UNIT=sshd.service\n_PID=123\n_COMM=sshd\nPRIORITY=6\nMESSAGE=Accepted publickey for root\n\n")
+	stream.WriteString("__CURSOR=s=abc;i=2\n__REALTIME_TIMESTAMP=1700000001000000\n")
+	stream.Write(binaryField("MESSAGE", []byte("line 1\nline 2")))
+	stream.Write(binaryField("BLOB", []byte{0xff, 0x00, 0xfe}))
+	stream.WriteString("TAG=a\nTAG=b\nTAG=c\n\n")
+
+	r := newExportReader(&stream)
+
+	e, err := r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "s=abc;i=1", e.Cursor)
+	assert.Equal(t, uint64(1700000000123), e.TimestampMs)
+	assert.Equal(t, map[string]interface{}{
+		"_BOOT_ID":      "b1",
+		"_SYSTEMD_UNIT": "sshd.service",
+		"_PID":          "123",
+		"_COMM":         "sshd",
+		"PRIORITY":      "6",
+		"MESSAGE":       "Accepted publickey for root",
+	}, e.Fields)
+
+	e, err = r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, "s=abc;i=2", e.Cursor)
+	assert.Equal(t, "line 1\nline 2", e.Fields["MESSAGE"])
+	assert.Equal(t, []byte{0xff, 0x00, 0xfe}, e.Fields["BLOB"])
+	assert.Equal(t, []interface{}{"a", "b", "c"}, e.Fields["TAG"])
+
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestExportReaderTruncated(t *testing.T) {
+	r := newExportReader(strings.NewReader("__CURSOR=s=abc;i=1\nMESSAGE=partial"))
+	_, err := r.Next()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	stream := bytes.Buffer{}
+	stream.WriteString("MESSAGE\n")
+	stream.Write([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	r = newExportReader(&stream)
+	_, err = r.Next()
+	assert.Error(t, err)
+}
+
+func TestJournalctlArgs(t *testing.T) {
+	c := JournaldConfig{
+		Units:    []string{"sshd.service", "cron.service"},
+		Priority: "warning",
+		Matches:  []string{"_UID=0"},
+	}
+	assert.Equal(t, []string{"--output=export", "--follow", "--no-pager", "--quiet", "--lines=0", "--unit=sshd.service", "--unit=cron.service", "--priority=warning", "_UID=0"}, c.journalctlArgs(""))
+
+	c = JournaldConfig{
+		Directory:   "/var/log/journal/remote",
+		IsFromStart: true,
+	}
+	assert.Equal(t, []string{"--output=export", "--follow", "--no-pager", "--quiet", "--directory=/var/log/journal/remote", "--no-tail"}, c.journalctlArgs(""))
+	assert.Equal(t, []string{"--output=export", "--follow", "--no-pager", "--quiet", "--directory=/var/log/journal/remote", "--after-cursor=s=abc"}, c.journalctlArgs("s=abc"))
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package usp_journald
+
+import (
+	"context"
+	"errors"
+)
+
+// Dummy noop file to build when the platform
+// is _not_ Linux since journald is only
+// available on Linux.
+
+type JournaldAdapter struct{}
+
+func NewJournaldAdapter(ctx context.Context, conf JournaldConfig) (*JournaldAdapter, chan struct{}, error) {
+	return nil, nil, errors.New("journald collection not supported outside of Linux")
+}
+
+func (a *JournaldAdapter) Close() error {
+	return nil
+}
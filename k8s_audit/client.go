@@ -0,0 +1,272 @@
+package usp_k8s_audit
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/refractionPOINT/usp-adapters/utils"
+)
+
+const (
+	defaultWriteTimeout = 60 * 10
+	// The API server retries a batch that was not
+	// accepted, so we do not wait long for buffer space.
+	webhookShipTimeout = 10 * time.Second
+	maxRequestSize     = 64 * 1024 * 1024
+
+	auditEventType = "k8s_audit"
+	eventEventType = "k8s_event"
+)
+
+type K8sAuditAdapter struct {
+	conf         K8sAuditConfig
+	wg           sync.WaitGroup
+	isRunning    uint32
+	uspClient    *utils.USPClient
+	writeTimeout time.Duration
+
+	server     *http.Server
+	listener   net.Listener
+	api        *apiClient
+	ctx        context.Context
+	fCtxCancel context.CancelFunc
+}
+
+type K8sAuditConfig struct {
+	ClientOptions   uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
+	WriteTimeoutSec uint64                  `json:"write_timeout_sec,omitempty" yaml:"write_timeout_sec,omitempty"`
+
+	// Audit webhook receiver, enabled when a port is set.
+	Port              uint16 `json:"port,omitempty" yaml:"port,omitempty"`
+	Interface         string `json:"iface,omitempty" yaml:"iface,omitempty"`
+	SslCertPath       string `json:"ssl_cert,omitempty" yaml:"ssl_cert,omitempty"`
+	SslKeyPath        string `json:"ssl_key,omitempty" yaml:"ssl_key,omitempty"`
+	MutualTlsCertPath string `json:"mutual_tls_cert,omitempty" yaml:"mutual_tls_cert,omitempty"`
+	// Bearer token the API server must present, set in the
+	// user of the audit webhook kubeconfig.
+	AuthToken string `json:"auth_token,omitempty" yaml:"auth_token,omitempty"`
+
+	// Watch the Events API.
+	IsWatchEvents bool `json:"watch_events,omitempty" yaml:"watch_events,omitempty"`
+	// Namespace to watch the Events of, all namespaces if empty.
+	EventsNamespace string `json:"events_namespace,omitempty" yaml:"events_namespace,omitempty"`
+	// The API server is the in-cluster one with the pod's
+	// service account unless specified.
+	APIServerURL string `json:"api_server_url,omitempty" yaml:"api_server_url,omitempty"`
+	APITokenFile string `json:"api_token_file,omitempty" yaml:"api_token_file,omitempty"`
+	APICAFile    string `json:"api_ca_file,omitempty" yaml:"api_ca_file,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+}
+
+func (c *K8sAuditConfig) Validate() error {
+	if err := c.ClientOptions.Validate(); err != nil {
+		return fmt.Errorf("client_options: %v", err)
+	}
+	if c.Port == 0 && !c.IsWatchEvents {
+		return errors.New("port or watch_events required")
+	}
+	if (c.SslCertPath == "") != (c.SslKeyPath == "") {
+		return errors.New("ssl_cert and ssl_key must be set together")
+	}
+	return nil
+}
+
+// auditEventList is what the API server audit webhook backend posts.
+type auditEventList struct {
+	Kind  string                   `json:"kind"`
+	Items []map[string]interface{} `json:"items"`
+}
+
+func NewK8sAuditAdapter(ctx context.Context, conf K8sAuditConfig) (*K8sAuditAdapter, chan struct{}, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, nil, err
+	}
+	a := &K8sAuditAdapter{
+		conf:      conf,
+		isRunning: 1,
+	}
+
+	if a.conf.WriteTimeoutSec == 0 {
+		a.conf.WriteTimeoutSec = defaultWriteTimeout
+	}
+	a.writeTimeout = time.Duration(a.conf.WriteTimeoutSec) * time.Second
+
+	var err error
+	if a.conf.IsWatchEvents {
+		if a.api, err = newAPIClient(a.conf); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if a.conf.Port != 0 {
+		addr := fmt.Sprintf("%s:%d", a.conf.Interface, a.conf.Port)
+		if a.listener, err = net.Listen("tcp", addr); err != nil {
+			return nil, nil, err
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", a.handleAudit)
+		a.server = &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 30 * time.Second,
+		}
+		if a.conf.SslCertPath != "" {
+			if a.server.TLSConfig, err = utils.LoadServerTLSConfig(a.conf.SslCertPath, a.conf.SslKeyPath, a.conf.MutualTlsCertPath); err != nil {
+				a.listener.Close()
+				return nil, nil, err
+			}
+		}
+	}
+
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
+	if err != nil {
+		if a.listener != nil {
+			a.listener.Close()
+		}
+		return nil, nil, err
+	}
+
+	a.ctx, a.fCtxCancel = context.WithCancel(context.Background())
+
+	if a.server != nil {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			a.conf.ClientOptions.DebugLog(fmt.Sprintf("listening for audit events on %s", a.listener.Addr()))
+			var err error
+			if a.server.TLSConfig != nil {
+				err = a.server.ServeTLS(a.listener, "", "")
+			} else {
+				err = a.server.Serve(a.listener)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				a.conf.ClientOptions.OnError(fmt.Errorf("http.Serve(): %v", err))
+			}
+		}()
+	}
+	if a.api != nil {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			a.watchEvents()
+		}()
+	}
+
+	chStopped := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(chStopped)
+	}()
+
+	return a, chStopped, nil
+}
+
+func (a *K8sAuditAdapter) Close() error {
+	a.conf.ClientOptions.DebugLog("closing")
+	atomic.StoreUint32(&a.isRunning, 0)
+	a.fCtxCancel()
+	if a.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		a.server.Shutdown(ctx)
+		cancel()
+	}
+	a.wg.Wait()
+	err1 := a.uspClient.Drain(1 * time.Minute)
+	_, err2 := a.uspClient.Close()
+
+	if err1 != nil {
+		return err1
+	}
+
+	return err2
+}
+
+func (a *K8sAuditAdapter) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if a.conf.AuthToken != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.conf.AuthToken)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	list := auditEventList{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&list); err != nil {
+		a.conf.ClientOptions.OnWarning(fmt.Sprintf("invalid audit request from %s: %v", r.RemoteAddr, err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if list.Kind != "EventList" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	for _, item := range list.Items {
+		msg := &protocol.DataMessage{
+			JsonPayload: item,
+			EventType:   auditEventType,
+			TimestampMs: auditTimestamp(item),
+		}
+		err := a.uspClient.Ship(msg, webhookShipTimeout)
+		if err == uspclient.ErrorBufferFull {
+			// The API server will retry the whole batch, which
+			// may duplicate the events shipped before this one.
+			a.conf.ClientOptions.OnWarning("stream falling behind, rejecting audit batch")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			a.conf.ClientOptions.OnError(fmt.Errorf("Ship(): %v", err))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// auditTimestamp returns the time the request was received.
+func auditTimestamp(item utils.Dict) uint64 {
+	for _, k := range []string{"requestReceivedTimestamp", "stageTimestamp"} {
+		if ts, ok := parseTimestamp(item.FindOneString(k)); ok {
+			return ts
+		}
+	}
+	return uint64(time.Now().UnixNano() / int64(time.Millisecond))
+}
+
+func parseTimestamp(s string) (uint64, bool) {
+	if s == "" {
+		return 0, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil || t.IsZero() {
+		return 0, false
+	}
+	return uint64(t.UnixMilli()), true
+}
+
+func (a *K8sAuditAdapter) ship(msg *protocol.DataMessage) {
+	err := a.uspClient.Ship(msg, a.writeTimeout)
+	if err == uspclient.ErrorBufferFull {
+		a.conf.ClientOptions.OnWarning("stream falling behind")
+		err = a.uspClient.Ship(msg, 1*time.Hour)
+	}
+	if err != nil {
+		a.conf.ClientOptions.OnError(fmt.Errorf("Ship(): %v", err))
+	}
+}
@@ -0,0 +1,153 @@
+package usp_k8s_audit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/usp-adapters/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testAuditEventList = `{
+	"kind": "EventList",
+	"apiVersion": "audit.k8s.io/v1",
+	"items": [{
+		"kind": "Event",
+		"level": "Metadata",
+		"auditID": "0b0d2f4e-8d0a-4c4e-9a44-0c1b3b0d3b1a",
+		"stage": "ResponseComplete",
+		"verb": "get",
+		"requestURI": "/api/v1/namespaces/default/secrets/db",
+		"user": {"username": "system:serviceaccount:default:web"},
+		"requestReceivedTimestamp": "2024-01-02T03:04:05.123456Z",
+		"stageTimestamp": "2024-01-02T03:04:05.200000Z"
+	}]
+}`
+
+const testWatchStream = `{"type":"ADDED","object":{"kind":"Event","metadata":{"name":"web.17a","namespace":"prod","resourceVersion":"101"},"reason":"BackOff","lastTimestamp":"2024-01-02T03:04:05Z"}}
+{"type":"BOOKMARK","object":{"kind":"Event","metadata":{"resourceVersion":"105"}}}
+{"type":"MODIFIED","object":{"kind":"Event","metadata":{"name":"web.17a","namespace":"prod","resourceVersion":"110"},"reason":"BackOff","count":2}}
+`
+
+func newTestAdapter(t *testing.T, conf K8sAuditConfig) *K8sAuditAdapter {
+	conf.ClientOptions = uspclient.ClientOptions{
+		TestSinkMode: true,
+		DebugLog:     func(msg string) {},
+		OnWarning:    func(msg string) {},
+		OnError:      func(err error) { t.Errorf("unexpected error: %v", err) },
+	}
+	c, err := utils.NewUSPClient(context.Background(), conf.ClientOptions, conf.Pipeline)
+	require.NoError(t, err)
+	a := &K8sAuditAdapter{
+		conf:         conf,
+		isRunning:    1,
+		uspClient:    c,
+		writeTimeout: defaultWriteTimeout,
+	}
+	a.ctx, a.fCtxCancel = context.WithCancel(context.Background())
+	t.Cleanup(a.fCtxCancel)
+	return a
+}
+
+func TestHandleAudit(t *testing.T) {
+	a := newTestAdapter(t, K8sAuditConfig{Port: 1, AuthToken: "secret"})
+
+	post := func(token string, body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		a.handleAudit(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, post("secret", testAuditEventList))
+	assert.Equal(t, http.StatusUnauthorized, post("", testAuditEventList))
+	assert.Equal(t, http.StatusUnauthorized, post("wrong", testAuditEventList))
+	assert.Equal(t, http.StatusBadRequest, post("secret", "{"))
+	assert.Equal(t, http.StatusBadRequest, post("secret", `{"kind":"Pod"}`))
+
+	w := httptest.NewRecorder()
+	a.handleAudit(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestTimestamps(t *testing.T) {
+	assert.Equal(t, uint64(1704164645123), auditTimestamp(map[string]interface{}{
+		"requestReceivedTimestamp": "2024-01-02T03:04:05.123456Z",
+		"stageTimestamp":           "2024-01-02T03:04:06Z",
+	}))
+	assert.Equal(t, uint64(1704164646000), auditTimestamp(map[string]interface{}{
+		"stageTimestamp": "2024-01-02T03:04:06Z",
+	}))
+	assert.Equal(t, uint64(1704164645000), eventTimestamp(map[string]interface{}{
+		"eventTime":     nil,
+		"lastTimestamp": "2024-01-02T03:04:05Z",
+		"metadata":      map[string]interface{}{"creationTimestamp": "2024-01-01T00:00:00Z"},
+	}))
+	assert.Equal(t, uint64(1704067200000), eventTimestamp(map[string]interface{}{
+		"metadata": map[string]interface{}{"creationTimestamp": "2024-01-01T00:00:00Z"},
+	}))
+}
+
+func TestWatchEvents(t *testing.T) {
+	requests := []string{}
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/v1/namespaces/prod/events" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		q := r.URL.Query()
+		requests = append(requests, q.Get("resourceVersion"))
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case q.Get("watch") != "true":
+			w.Write([]byte(`{"kind":"EventList","metadata":{"resourceVersion":"100"},"items":[]}`))
+		case q.Get("resourceVersion") == "100":
+			w.Write([]byte(testWatchStream))
+		default:
+			w.Write([]byte(`{"type":"ERROR","object":{"kind":"Status","status":"Failure","reason":"Expired","code":410}}` + "\n"))
+		}
+	}))
+	defer s.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("test-token\n"), 0600))
+	conf := K8sAuditConfig{
+		IsWatchEvents:   true,
+		EventsNamespace: "prod",
+		APIServerURL:    s.URL,
+		APITokenFile:    tokenFile,
+	}
+	a := newTestAdapter(t, conf)
+	var err error
+	a.api, err = newAPIClient(conf)
+	require.NoError(t, err)
+	// The test server's certificate is self-signed.
+	a.api.httpClient = s.Client()
+
+	rv, err := a.currentResourceVersion()
+	require.NoError(t, err)
+	assert.Equal(t, "100", rv)
+
+	// Resumes from the last event or bookmark.
+	rv, err = a.watchFrom(rv)
+	require.NoError(t, err)
+	assert.Equal(t, "110", rv)
+
+	_, err = a.watchFrom(rv)
+	assert.Equal(t, errResourceExpired, err)
+	assert.Equal(t, []string{"", "100", "110"}, requests)
+}
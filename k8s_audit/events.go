@@ -0,0 +1,244 @@
+package usp_k8s_audit
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/refractionPOINT/usp-adapters/utils"
+)
+
+const (
+	defaultTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	defaultCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	watchTimeoutSec  = 300
+	watchRetryDelay  = 5 * time.Second
+)
+
+// errResourceExpired is returned when the resource version we
+// watch from is too old and we need to list again.
+var errResourceExpired = errors.New("resource version expired")
+
+type apiClient struct {
+	baseURL    string
+	tokenFile  string
+	httpClient *http.Client
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type objectMeta struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	// Set when the watch reports an error Status.
+	Code int `json:"code"`
+}
+
+// newAPIClient returns a client for the API server, defaulting
+// to the in-cluster service account configuration.
+func newAPIClient(conf K8sAuditConfig) (*apiClient, error) {
+	baseURL := conf.APIServerURL
+	if baseURL == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("api_server_url not set and not running in a cluster")
+		}
+		baseURL = "https://" + net.JoinHostPort(host, port)
+	}
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("api_server_url: %v", err)
+	}
+	c := &apiClient{
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		tokenFile: conf.APITokenFile,
+	}
+	if c.tokenFile == "" && conf.APIServerURL == "" {
+		c.tokenFile = defaultTokenFile
+	}
+
+	caFile := conf.APICAFile
+	if caFile == "" && conf.APIServerURL == "" {
+		caFile = defaultCAFile
+	}
+	tlsConfig := &tls.Config{}
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("api_ca_file: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("api_ca_file: no certificate found")
+		}
+	}
+	// No client timeout, watches are long lived and
+	// bounded by timeoutSeconds instead.
+	c.httpClient = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+			Proxy:           http.ProxyFromEnvironment,
+		},
+	}
+	return c, nil
+}
+
+func (c *apiClient) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// The token is read every time since projected
+	// service account tokens are rotated.
+	if c.tokenFile != "" {
+		token, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, errResourceExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+func (a *K8sAuditAdapter) eventsPath() string {
+	if a.conf.EventsNamespace != "" {
+		return fmt.Sprintf("/api/v1/namespaces/%s/events", url.PathEscape(a.conf.EventsNamespace))
+	}
+	return "/api/v1/events"
+}
+
+// currentResourceVersion lists the Events to get the resource
+// version to watch from, existing Events are not shipped.
+func (a *K8sAuditAdapter) currentResourceVersion() (string, error) {
+	resp, err := a.api.get(a.ctx, a.eventsPath(), url.Values{"limit": []string{"1"}})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	list := objectMeta{}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return "", err
+	}
+	return list.Metadata.ResourceVersion, nil
+}
+
+func (a *K8sAuditAdapter) watchEvents() {
+	a.conf.ClientOptions.DebugLog("watching events")
+	defer a.conf.ClientOptions.DebugLog("stopped watching events")
+
+	resourceVersion := ""
+	for atomic.LoadUint32(&a.isRunning) == 1 {
+		var err error
+		if resourceVersion == "" {
+			resourceVersion, err = a.currentResourceVersion()
+		}
+		if err == nil {
+			resourceVersion, err = a.watchFrom(resourceVersion)
+		}
+		if atomic.LoadUint32(&a.isRunning) != 1 {
+			return
+		}
+		if err == errResourceExpired {
+			a.conf.ClientOptions.OnWarning("events resource version expired, some events may have been missed")
+			resourceVersion = ""
+			continue
+		}
+		if err != nil {
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("watching events: %v", err))
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-time.After(watchRetryDelay):
+			}
+		}
+	}
+}
+
+// watchFrom ships the Events until the watch ends and returns
+// the resource version to resume watching from.
+func (a *K8sAuditAdapter) watchFrom(resourceVersion string) (string, error) {
+	resp, err := a.api.get(a.ctx, a.eventsPath(), url.Values{
+		"watch":               []string{"true"},
+		"resourceVersion":     []string{resourceVersion},
+		"allowWatchBookmarks": []string{"true"},
+		"timeoutSeconds":      []string{fmt.Sprintf("%d", watchTimeoutSec)},
+	})
+	if err != nil {
+		return resourceVersion, err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		evt := watchEvent{}
+		if err := decoder.Decode(&evt); err != nil {
+			if err == io.EOF {
+				// The server ended the watch after its timeout.
+				return resourceVersion, nil
+			}
+			return resourceVersion, err
+		}
+		meta := objectMeta{}
+		if err := json.Unmarshal(evt.Object, &meta); err != nil {
+			return resourceVersion, err
+		}
+		switch evt.Type {
+		case "ERROR":
+			if meta.Code == http.StatusGone {
+				return "", errResourceExpired
+			}
+			return resourceVersion, fmt.Errorf("watch error: %s", string(evt.Object))
+		case "ADDED", "MODIFIED":
+			event := utils.Dict{}
+			if err := json.Unmarshal(evt.Object, &event); err != nil {
+				return resourceVersion, err
+			}
+			a.ship(&protocol.DataMessage{
+				JsonPayload: event,
+				EventType:   eventEventType,
+				TimestampMs: eventTimestamp(event),
+			})
+		}
+		if meta.Metadata.ResourceVersion != "" {
+			resourceVersion = meta.Metadata.ResourceVersion
+		}
+	}
+}
+
+// eventTimestamp returns the last time the Event was observed.
+func eventTimestamp(event utils.Dict) uint64 {
+	for _, path := range []string{"series/lastObservedTime", "lastTimestamp", "eventTime", "metadata/creationTimestamp"} {
+		if ts, ok := parseTimestamp(event.FindOneString(path)); ok {
+			return ts
+		}
+	}
+	return uint64(time.Now().UnixNano() / int64(time.Millisecond))
+}
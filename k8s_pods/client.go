@@ -22,7 +22,7 @@ const (
 
 type K8sPodsAdapter struct {
 	conf         K8sPodsConfig
-	uspClient    *uspclient.Client
+	uspClient    *utils.USPClient
 	writeTimeout time.Duration
 	wg           sync.WaitGroup
 
@@ -32,8 +32,12 @@ type K8sPodsAdapter struct {
 }
 
 type runtimeOptions struct {
-	includePods *regexp.Regexp
-	excludePods *regexp.Regexp
+	includePods       *regexp.Regexp
+	excludePods       *regexp.Regexp
+	includeNamespaces map[string]struct{}
+	excludeNamespaces map[string]struct{}
+	labelSelector     labelSelector
+	metadata          *podMetadataCache
 }
 
 func (c *K8sPodsConfig) Validate() error {
@@ -43,6 +47,14 @@ func (c *K8sPodsConfig) Validate() error {
 	if c.Root == "" {
 		return errors.New("file_path missing")
 	}
+	if c.LabelSelector != "" {
+		if !c.IsEnrichMetadata {
+			return errors.New("label_selector requires enrich_metadata")
+		}
+		if _, err := parseLabelSelector(c.LabelSelector); err != nil {
+			return fmt.Errorf("label_selector: %v", err)
+		}
+	}
 	return nil
 }
 
@@ -68,7 +80,35 @@ func NewK8sPodsAdapter(ctx context.Context, conf K8sPodsConfig) (*K8sPodsAdapter
 		}
 	}
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	if len(a.conf.IncludeNamespaces) != 0 {
+		a.rtOptions.includeNamespaces = map[string]struct{}{}
+		for _, ns := range a.conf.IncludeNamespaces {
+			a.rtOptions.includeNamespaces[ns] = struct{}{}
+		}
+	}
+	if len(a.conf.ExcludeNamespaces) != 0 {
+		a.rtOptions.excludeNamespaces = map[string]struct{}{}
+		for _, ns := range a.conf.ExcludeNamespaces {
+			a.rtOptions.excludeNamespaces[ns] = struct{}{}
+		}
+	}
+	if a.conf.LabelSelector != "" {
+		if !a.conf.IsEnrichMetadata {
+			return nil, nil, errors.New("label_selector requires enrich_metadata")
+		}
+		if a.rtOptions.labelSelector, err = parseLabelSelector(a.conf.LabelSelector); err != nil {
+			return nil, nil, fmt.Errorf("label_selector: %v", err)
+		}
+	}
+	if a.conf.IsEnrichMetadata {
+		apiClient, err := newK8sAPIClient(a.conf)
+		if err != nil {
+			return nil, nil, err
+		}
+		a.rtOptions.metadata = newPodMetadataCache(apiClient, time.Duration(a.conf.MetadataCacheTTLSec)*time.Second)
+	}
+
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -108,11 +148,30 @@ func (a *K8sPodsAdapter) consumeLogs() {
 	defer a.wg.Done()
 
 	for line := range a.engine.Lines() {
+		rec := logRecord{
+			Timestamp: line.Timestamp,
+			Stream:    line.Stream,
+			Message:   line.Line,
+		}
+		payload := utils.Dict{
+			"metadata": line.Entity.toDict(),
+			"message":  line.Line,
+		}
+		if m, ok := rec.JSONMessage(); ok {
+			payload["message"] = m
+		}
+		if line.Stream != "" {
+			payload["stream"] = line.Stream
+		}
+		if line.Timestamp != "" {
+			payload["timestamp"] = line.Timestamp
+		}
 		msg := &protocol.DataMessage{
-			JsonPayload: utils.Dict{
-				"metadata": line.Entity,
-				"message":  line.Line,
-			},
+			JsonPayload: payload,
+			TimestampMs: rec.TimestampMs(),
+		}
+		if msg.TimestampMs == 0 {
+			msg.TimestampMs = uint64(time.Now().UnixNano() / int64(time.Millisecond))
 		}
 		if err := a.uspClient.Ship(msg, 10*time.Second); err != nil {
 			if err == uspclient.ErrorBufferFull {
@@ -2,6 +2,7 @@ package usp_k8s_pods
 
 import (
 	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/usp-adapters/utils"
 )
 
 type K8sPodsConfig struct {
@@ -10,4 +11,23 @@ type K8sPodsConfig struct {
 	Root            string                  `json:"root" yaml:"root"`
 	IncludePodsRE   string                  `json:"include_pods_re" yaml:"include_pods_re"`
 	ExcludePodsRE   string                  `json:"exclude_pods_re" yaml:"exclude_pods_re"`
+
+	IncludeNamespaces []string `json:"include_namespaces,omitempty" yaml:"include_namespaces,omitempty"`
+	ExcludeNamespaces []string `json:"exclude_namespaces,omitempty" yaml:"exclude_namespaces,omitempty"`
+	// Only collect pods matching this label selector, like
+	// "app=web,tier in (frontend,backend)". Requires enrich_metadata.
+	// Pods are only collected once their labels could be fetched.
+	LabelSelector string `json:"label_selector,omitempty" yaml:"label_selector,omitempty"`
+
+	// Add the pod labels, annotations, node, owner workload
+	// and container image from the Kubernetes API.
+	IsEnrichMetadata bool `json:"enrich_metadata,omitempty" yaml:"enrich_metadata,omitempty"`
+	// The API server is the in-cluster one with the pod's
+	// service account unless specified.
+	APIServerURL        string `json:"api_server_url,omitempty" yaml:"api_server_url,omitempty"`
+	APITokenFile        string `json:"api_token_file,omitempty" yaml:"api_token_file,omitempty"`
+	APICAFile           string `json:"api_ca_file,omitempty" yaml:"api_ca_file,omitempty"`
+	MetadataCacheTTLSec uint64 `json:"metadata_cache_ttl_sec,omitempty" yaml:"metadata_cache_ttl_sec,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
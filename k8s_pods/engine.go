@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/usp-adapters/utils"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/nxadm/tail"
@@ -46,11 +47,57 @@ type K8sEntity struct {
 	PodName       string `json:"pod_name" msgpack:"pod_name"`
 	PodID         string `json:"pod_id" msgpack:"pod_id"`
 	ContainerName string `json:"container_name" msgpack:"container_name"`
+
+	// Metadata from the Kubernetes API when enabled.
+	Labels      map[string]string `json:"labels,omitempty" msgpack:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty" msgpack:"annotations,omitempty"`
+	NodeName    string            `json:"node_name,omitempty" msgpack:"node_name,omitempty"`
+	OwnerKind   string            `json:"owner_kind,omitempty" msgpack:"owner_kind,omitempty"`
+	OwnerName   string            `json:"owner_name,omitempty" msgpack:"owner_name,omitempty"`
+	Image       string            `json:"image,omitempty" msgpack:"image,omitempty"`
+}
+
+// toDict returns the entity as plain JSON values so
+// that the pipeline can access all of its fields.
+func (e K8sEntity) toDict() utils.Dict {
+	d := utils.Dict{
+		"namespace":      e.Namespace,
+		"pod_name":       e.PodName,
+		"pod_id":         e.PodID,
+		"container_name": e.ContainerName,
+	}
+	if len(e.Labels) != 0 {
+		d["labels"] = stringsToDict(e.Labels)
+	}
+	if len(e.Annotations) != 0 {
+		d["annotations"] = stringsToDict(e.Annotations)
+	}
+	for k, v := range map[string]string{
+		"node_name":  e.NodeName,
+		"owner_kind": e.OwnerKind,
+		"owner_name": e.OwnerName,
+		"image":      e.Image,
+	} {
+		if v != "" {
+			d[k] = v
+		}
+	}
+	return d
+}
+
+func stringsToDict(m map[string]string) map[string]interface{} {
+	d := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		d[k] = v
+	}
+	return d
 }
 
 type K8sLogLine struct {
-	Entity K8sEntity `json:"entity" msgpack:"entity"`
-	Line   string    `json:"line" msgpack:"line"`
+	Entity    K8sEntity `json:"entity" msgpack:"entity"`
+	Line      string    `json:"line" msgpack:"line"`
+	Stream    string    `json:"stream,omitempty" msgpack:"stream,omitempty"`
+	Timestamp string    `json:"timestamp,omitempty" msgpack:"timestamp,omitempty"`
 }
 
 func NewK8sLogProcessor(root string, cOpt uspclient.ClientOptions, rtOptions runtimeOptions) (*K8sLogProcessor, error) {
@@ -94,6 +141,12 @@ func (klp *K8sLogProcessor) watchForPods() {
 	defer klp.wg.Done()
 	defer klp.options.DebugLog("k8s root watcher stopped")
 
+	// Pods the label selector could not be evaluated
+	// for yet, they are checked again periodically.
+	pending := map[string]struct{}{}
+	retryTicker := time.NewTicker(metadataErrorCacheTTL)
+	defer retryTicker.Stop()
+
 	// Initialize all containers already present.
 	running := map[string]chan struct{}{}
 	if files, err := os.ReadDir(klp.root); err == nil {
@@ -105,34 +158,7 @@ func (klp *K8sLogProcessor) watchForPods() {
 			if _, ok := running[podPath]; ok {
 				continue
 			}
-			components := k8sPodPattern.FindStringSubmatch(podPath)
-			if len(components) != 4 {
-				klp.options.DebugLog("k8s existing pod name does not match pattern: " + podPath)
-				continue
-			}
-			mtd := k8sFileMtd{
-				FileName: podPath,
-				Entity: K8sEntity{
-					Namespace: components[1],
-					PodName:   components[2],
-					PodID:     components[3],
-				},
-			}
-			if mtd.Entity.Namespace == "" || mtd.Entity.PodName == "" || mtd.Entity.PodID == "" {
-				klp.options.DebugLog("k8s existing pod name does not match pattern: " + podPath)
-				continue
-			}
-
-			// If user-supplied filters were supplied, apply them here.
-			if klp.rtOptions.includePods != nil && !klp.rtOptions.includePods.MatchString(mtd.Entity.PodName) {
-				continue
-			}
-			if klp.rtOptions.excludePods != nil && klp.rtOptions.excludePods.MatchString(mtd.Entity.PodName) {
-				continue
-			}
-
-			klp.wg.Add(1)
-			go klp.watchPod(mtd)
+			klp.startPod(podPath, pending)
 		}
 	}
 
@@ -148,34 +174,16 @@ func (klp *K8sLogProcessor) watchForPods() {
 			if _, ok := running[event.Name]; ok {
 				continue
 			}
-			components := k8sPodPattern.FindStringSubmatch(event.Name)
-			if len(components) != 4 {
-				klp.options.DebugLog("k8s pod name does not match pattern: " + event.Name)
-				continue
-			}
-			mtd := k8sFileMtd{
-				FileName: event.Name,
-				Entity: K8sEntity{
-					Namespace: components[1],
-					PodName:   components[2],
-					PodID:     components[3],
-				},
-			}
-			if mtd.Entity.Namespace == "" || mtd.Entity.PodName == "" || mtd.Entity.PodID == "" {
-				klp.options.DebugLog("k8s pod name does not match pattern: " + event.Name)
-				continue
-			}
-
-			// If user-supplied filters were supplied, apply them here.
-			if klp.rtOptions.includePods != nil && !klp.rtOptions.includePods.MatchString(mtd.Entity.PodName) {
-				continue
-			}
-			if klp.rtOptions.excludePods != nil && klp.rtOptions.excludePods.MatchString(mtd.Entity.PodName) {
-				continue
+			klp.startPod(event.Name, pending)
+		case <-retryTicker.C:
+			for podPath := range pending {
+				if _, err := os.Stat(podPath); err != nil {
+					klp.options.DebugLog("k8s pending pod removed: " + podPath)
+					delete(pending, podPath)
+					continue
+				}
+				klp.startPod(podPath, pending)
 			}
-
-			klp.wg.Add(1)
-			go klp.watchPod(mtd)
 		case err, ok := <-klp.rootWatcher.Errors:
 			klp.options.DebugLog("k8s root watcher error: " + err.Error())
 			if !ok {
@@ -189,6 +197,95 @@ func (klp *K8sLogProcessor) watchForPods() {
 	}
 }
 
+// startPod starts watching the pod unless it is filtered out. Pods
+// that cannot be filtered yet are added to pending.
+func (klp *K8sLogProcessor) startPod(podPath string, pending map[string]struct{}) {
+	mtd, ok, err := klp.newPodMtd(podPath)
+	if err != nil {
+		if _, ok := pending[podPath]; !ok {
+			klp.options.OnWarning(fmt.Sprintf("pod %s is not collected until its metadata is available: %v", podPath, err))
+		}
+		pending[podPath] = struct{}{}
+		return
+	}
+	delete(pending, podPath)
+	if !ok {
+		return
+	}
+	klp.wg.Add(1)
+	go klp.watchPod(mtd)
+}
+
+// newPodMtd parses the pod directory name and applies the
+// user-supplied filters, it returns false if the pod is skipped
+// and an error if the filters cannot be applied yet.
+func (klp *K8sLogProcessor) newPodMtd(podPath string) (k8sFileMtd, bool, error) {
+	components := k8sPodPattern.FindStringSubmatch(podPath)
+	if len(components) != 4 {
+		klp.options.DebugLog("k8s pod name does not match pattern: " + podPath)
+		return k8sFileMtd{}, false, nil
+	}
+	mtd := k8sFileMtd{
+		FileName: podPath,
+		Entity: K8sEntity{
+			Namespace: components[1],
+			PodName:   components[2],
+			PodID:     components[3],
+		},
+	}
+	if mtd.Entity.Namespace == "" || mtd.Entity.PodName == "" || mtd.Entity.PodID == "" {
+		klp.options.DebugLog("k8s pod name does not match pattern: " + podPath)
+		return k8sFileMtd{}, false, nil
+	}
+
+	// If user-supplied filters were supplied, apply them here.
+	if klp.rtOptions.includePods != nil && !klp.rtOptions.includePods.MatchString(mtd.Entity.PodName) {
+		return k8sFileMtd{}, false, nil
+	}
+	if klp.rtOptions.excludePods != nil && klp.rtOptions.excludePods.MatchString(mtd.Entity.PodName) {
+		return k8sFileMtd{}, false, nil
+	}
+	if klp.rtOptions.includeNamespaces != nil {
+		if _, ok := klp.rtOptions.includeNamespaces[mtd.Entity.Namespace]; !ok {
+			return k8sFileMtd{}, false, nil
+		}
+	}
+	if _, ok := klp.rtOptions.excludeNamespaces[mtd.Entity.Namespace]; ok {
+		return k8sFileMtd{}, false, nil
+	}
+
+	if klp.rtOptions.metadata == nil {
+		return mtd, true, nil
+	}
+	podMtd, err := klp.rtOptions.metadata.Get(mtd.Entity)
+	if err != nil {
+		if klp.rtOptions.labelSelector != nil {
+			// Without the labels the selector cannot be evaluated.
+			return k8sFileMtd{}, false, err
+		}
+		klp.options.OnWarning(fmt.Sprintf("failed getting metadata of pod %s/%s: %v", mtd.Entity.Namespace, mtd.Entity.PodName, err))
+		return mtd, true, nil
+	}
+	if klp.rtOptions.labelSelector != nil && !klp.rtOptions.labelSelector.Matches(podMtd.labels) {
+		return k8sFileMtd{}, false, nil
+	}
+	podMtd.enrich(&mtd.Entity)
+	return mtd, true, nil
+}
+
+// containerMtd returns the metadata of a container of the pod.
+func (klp *K8sLogProcessor) containerMtd(mtd k8sFileMtd, containerPath string, containerName string) k8sFileMtd {
+	newMtd := mtd
+	newMtd.FileName = containerPath
+	newMtd.Entity.ContainerName = containerName
+	if klp.rtOptions.metadata != nil {
+		if podMtd, err := klp.rtOptions.metadata.Get(mtd.Entity); err == nil {
+			podMtd.enrich(&newMtd.Entity)
+		}
+	}
+	return newMtd
+}
+
 func (klp *K8sLogProcessor) watchPod(mtd k8sFileMtd) {
 	defer klp.wg.Done()
 	defer klp.options.DebugLog("k8s pod watcher stopped: " + mtd.FileName)
@@ -225,9 +322,7 @@ func (klp *K8sLogProcessor) watchPod(mtd k8sFileMtd) {
 				continue
 			}
 			nameComponents := strings.Split(file.Name(), "/")
-			newMtd := mtd
-			newMtd.FileName = containerPath
-			newMtd.Entity.ContainerName = nameComponents[len(nameComponents)-1]
+			newMtd := klp.containerMtd(mtd, containerPath, nameComponents[len(nameComponents)-1])
 
 			running[containerPath] = make(chan struct{})
 			klp.wg.Add(1)
@@ -263,9 +358,7 @@ func (klp *K8sLogProcessor) watchPod(mtd k8sFileMtd) {
 			}
 
 			nameComponents := strings.Split(event.Name, "/")
-			newMtd := mtd
-			newMtd.FileName = containerPath
-			newMtd.Entity.ContainerName = nameComponents[len(nameComponents)-1]
+			newMtd := klp.containerMtd(mtd, containerPath, nameComponents[len(nameComponents)-1])
 
 			running[containerPath] = make(chan struct{})
 			klp.wg.Add(1)
@@ -413,14 +506,21 @@ func (klp *K8sLogProcessor) processFile(mtd k8sFileMtd, file *tail.Tail) {
 
 	klp.options.DebugLog("k8s processing file started: " + mtd.FileName)
 
+	decoder := newLogDecoder()
 	for line := range file.Lines {
 		if line.Err != nil {
 			klp.options.OnError(line.Err)
 			return
 		}
+		rec, ok := decoder.Decode(line.Text)
+		if !ok {
+			continue
+		}
 		klp.chLines <- K8sLogLine{
-			Entity: mtd.Entity,
-			Line:   line.Text,
+			Entity:    mtd.Entity,
+			Line:      rec.Message,
+			Stream:    rec.Stream,
+			Timestamp: rec.Timestamp,
 		}
 	}
 }
@@ -0,0 +1,155 @@
+//go:build windows || darwin || linux || solaris || netbsd || openbsd || freebsd
+// +build windows darwin linux solaris netbsd openbsd freebsd
+
+package usp_k8s_pods
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const (
+	// Partial lines are flushed as they are beyond this
+	// size to bound the memory used by a noisy container.
+	maxPartialSize = 1024 * 1024
+
+	criPartialTag = "P"
+	criFullTag    = "F"
+)
+
+// logRecord is a log line decoded from the container
+// runtime format it was written in.
+type logRecord struct {
+	Timestamp string
+	Stream    string
+	Message   string
+}
+
+type dockerLine struct {
+	Log    string `json:"log"`
+	Stream string `json:"stream"`
+	Time   string `json:"time"`
+}
+
+// logDecoder decodes the lines of a single container log file.
+// Both the CRI format used by containerd and CRI-O:
+//
+//	2024-01-02T03:04:05.123456789Z stdout F message
+//
+// and the Docker json-file format are supported:
+//
+//	{"log":"message\n","stream":"stdout","time":"2024-01-02T03:04:05.123456789Z"}
+//
+// Lines in neither format are reported as-is. Long messages split
+// by the runtime into multiple lines are reassembled.
+type logDecoder struct {
+	partials map[string]*logRecord
+}
+
+func newLogDecoder() *logDecoder {
+	return &logDecoder{
+		partials: map[string]*logRecord{},
+	}
+}
+
+// Decode returns the record completed by the line, if any.
+func (d *logDecoder) Decode(line string) (logRecord, bool) {
+	if rec, isPartial, ok := parseCRILine(line); ok {
+		return d.assemble(rec, isPartial)
+	}
+	if rec, isPartial, ok := parseDockerLine(line); ok {
+		return d.assemble(rec, isPartial)
+	}
+	return logRecord{Message: line}, true
+}
+
+func (d *logDecoder) assemble(rec logRecord, isPartial bool) (logRecord, bool) {
+	// Partials are tracked per stream since the
+	// runtime interleaves stdout and stderr.
+	if prev, ok := d.partials[rec.Stream]; ok {
+		prev.Message += rec.Message
+		if isPartial && len(prev.Message) < maxPartialSize {
+			return logRecord{}, false
+		}
+		delete(d.partials, rec.Stream)
+		return *prev, true
+	}
+	if isPartial && len(rec.Message) < maxPartialSize {
+		// The timestamp of a record is the one
+		// of its first fragment.
+		d.partials[rec.Stream] = &rec
+		return logRecord{}, false
+	}
+	return rec, true
+}
+
+func parseCRILine(line string) (logRecord, bool, bool) {
+	components := strings.SplitN(line, " ", 4)
+	if len(components) < 3 {
+		return logRecord{}, false, false
+	}
+	if components[1] != "stdout" && components[1] != "stderr" {
+		return logRecord{}, false, false
+	}
+	if components[2] != criPartialTag && components[2] != criFullTag {
+		return logRecord{}, false, false
+	}
+	if _, err := time.Parse(time.RFC3339Nano, components[0]); err != nil {
+		return logRecord{}, false, false
+	}
+	rec := logRecord{
+		Timestamp: components[0],
+		Stream:    components[1],
+	}
+	if len(components) == 4 {
+		rec.Message = components[3]
+	}
+	return rec, components[2] == criPartialTag, true
+}
+
+func parseDockerLine(line string) (logRecord, bool, bool) {
+	if !strings.HasPrefix(line, "{") {
+		return logRecord{}, false, false
+	}
+	dl := dockerLine{}
+	if err := json.Unmarshal([]byte(line), &dl); err != nil || dl.Stream == "" || dl.Time == "" {
+		return logRecord{}, false, false
+	}
+	// Docker splits long lines into chunks and only
+	// the last one ends with the newline.
+	isPartial := !strings.HasSuffix(dl.Log, "\n")
+	rec := logRecord{
+		Timestamp: dl.Time,
+		Stream:    dl.Stream,
+		Message:   strings.TrimSuffix(strings.TrimSuffix(dl.Log, "\n"), "\r"),
+	}
+	return rec, isPartial, true
+}
+
+// TimestampMs returns the time the runtime received the
+// record, or 0 if the format does not have it.
+func (r logRecord) TimestampMs() uint64 {
+	if r.Timestamp == "" {
+		return 0
+	}
+	t, err := time.Parse(time.RFC3339Nano, r.Timestamp)
+	if err != nil {
+		return 0
+	}
+	return uint64(t.UnixMilli())
+}
+
+// JSONMessage returns the message parsed as a
+// JSON object if it is one.
+func (r logRecord) JSONMessage() (map[string]interface{}, bool) {
+	msg := strings.TrimSpace(r.Message)
+	if !strings.HasPrefix(msg, "{") || !strings.HasSuffix(msg, "}") {
+		return nil, false
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(msg), &m); err != nil {
+		return nil, false
+	}
+	return m, true
+}
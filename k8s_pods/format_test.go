@@ -0,0 +1,76 @@
+//go:build windows || darwin || linux || solaris || netbsd || openbsd || freebsd
+// +build windows darwin linux solaris netbsd openbsd freebsd
+
+package usp_k8s_pods
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeAll(lines []string) []logRecord {
+	d := newLogDecoder()
+	out := []logRecord{}
+	for _, l := range lines {
+		if rec, ok := d.Decode(l); ok {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+func TestDecodeCRI(t *testing.T) {
+	out := decodeAll([]string{
+		"2024-01-02T03:04:05.123456789Z stdout F hello world",
+		"2024-01-02T03:04:06.000000000Z stdout P first ",
+		"2024-01-02T03:04:06.100000000Z stderr F an error",
+		"2024-01-02T03:04:06.200000000Z stdout P second ",
+		"2024-01-02T03:04:06.300000000Z stdout F third",
+		"2024-01-02T03:04:07Z stdout F",
+	})
+	assert.Equal(t, []logRecord{
+		{Timestamp: "2024-01-02T03:04:05.123456789Z", Stream: "stdout", Message: "hello world"},
+		{Timestamp: "2024-01-02T03:04:06.100000000Z", Stream: "stderr", Message: "an error"},
+		{Timestamp: "2024-01-02T03:04:06.000000000Z", Stream: "stdout", Message: "first second third"},
+		{Timestamp: "2024-01-02T03:04:07Z", Stream: "stdout", Message: ""},
+	}, out)
+	assert.Equal(t, uint64(1704164645123), out[0].TimestampMs())
+}
+
+func TestDecodeDocker(t *testing.T) {
+	out := decodeAll([]string{
+		`{"log":"hello world\n","stream":"stdout","time":"2024-01-02T03:04:05.123456789Z"}`,
+		`{"log":"part 1 ","stream":"stderr","time":"2024-01-02T03:04:06Z"}`,
+		`{"log":"part 2\r\n","stream":"stderr","time":"2024-01-02T03:04:06.5Z"}`,
+	})
+	assert.Equal(t, []logRecord{
+		{Timestamp: "2024-01-02T03:04:05.123456789Z", Stream: "stdout", Message: "hello world"},
+		{Timestamp: "2024-01-02T03:04:06Z", Stream: "stderr", Message: "part 1 part 2"},
+	}, out)
+}
+
+func TestDecodeRaw(t *testing.T) {
+	out := decodeAll([]string{
+		"plain line",
+		`{"not":"docker"}`,
+		"yesterday stdout F not a timestamp",
+	})
+	assert.Equal(t, []logRecord{
+		{Message: "plain line"},
+		{Message: `{"not":"docker"}`},
+		{Message: "yesterday stdout F not a timestamp"},
+	}, out)
+	assert.Equal(t, uint64(0), out[0].TimestampMs())
+}
+
+func TestJSONMessage(t *testing.T) {
+	m, ok := logRecord{Message: ` {"level":"info","msg":"started"} `}.JSONMessage()
+	assert.True(t, ok)
+	assert.Equal(t, map[string]interface{}{"level": "info", "msg": "started"}, m)
+
+	_, ok = logRecord{Message: `level=info msg=started`}.JSONMessage()
+	assert.False(t, ok)
+	_, ok = logRecord{Message: `{"truncated":`}.JSONMessage()
+	assert.False(t, ok)
+}
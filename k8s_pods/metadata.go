@@ -0,0 +1,248 @@
+//go:build windows || darwin || linux || solaris || netbsd || openbsd || freebsd
+// +build windows darwin linux solaris netbsd openbsd freebsd
+
+package usp_k8s_pods
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTokenFile        = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	defaultCAFile           = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	defaultMetadataCacheTTL = 5 * time.Minute
+	// Failed lookups are cached for less time so a
+	// transient API error is not remembered for long.
+	metadataErrorCacheTTL = 30 * time.Second
+	apiRequestTimeout     = 10 * time.Second
+)
+
+// podMetadata is the information about a pod fetched from the API.
+type podMetadata struct {
+	labels      map[string]string
+	annotations map[string]string
+	nodeName    string
+	ownerKind   string
+	ownerName   string
+	images      map[string]string
+}
+
+type apiPod struct {
+	Metadata struct {
+		UID             string            `json:"uid"`
+		Labels          map[string]string `json:"labels"`
+		Annotations     map[string]string `json:"annotations"`
+		OwnerReferences []struct {
+			Kind       string `json:"kind"`
+			Name       string `json:"name"`
+			Controller bool   `json:"controller"`
+		} `json:"ownerReferences"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName       string         `json:"nodeName"`
+		Containers     []apiContainer `json:"containers"`
+		InitContainers []apiContainer `json:"initContainers"`
+	} `json:"spec"`
+}
+
+type apiContainer struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+}
+
+type k8sAPIClient struct {
+	baseURL    string
+	tokenFile  string
+	httpClient *http.Client
+}
+
+// newK8sAPIClient returns a client for the API server, defaulting
+// to the in-cluster service account configuration.
+func newK8sAPIClient(conf K8sPodsConfig) (*k8sAPIClient, error) {
+	baseURL := conf.APIServerURL
+	if baseURL == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("api_server_url not set and not running in a cluster")
+		}
+		baseURL = "https://" + net.JoinHostPort(host, port)
+	}
+	if _, err := url.Parse(baseURL); err != nil {
+		return nil, fmt.Errorf("api_server_url: %v", err)
+	}
+	c := &k8sAPIClient{
+		baseURL:   strings.TrimSuffix(baseURL, "/"),
+		tokenFile: conf.APITokenFile,
+	}
+	if c.tokenFile == "" && conf.APIServerURL == "" {
+		c.tokenFile = defaultTokenFile
+	}
+
+	caFile := conf.APICAFile
+	if caFile == "" && conf.APIServerURL == "" {
+		caFile = defaultCAFile
+	}
+	tlsConfig := &tls.Config{}
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("api_ca_file: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("api_ca_file: no certificate found")
+		}
+	}
+	c.httpClient = &http.Client{
+		Timeout: apiRequestTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: tlsConfig,
+			Proxy:           http.ProxyFromEnvironment,
+		},
+	}
+	return c, nil
+}
+
+func (c *k8sAPIClient) getPod(namespace string, name string) (*apiPod, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/v1/namespaces/%s/pods/%s", c.baseURL, url.PathEscape(namespace), url.PathEscape(name)), nil)
+	if err != nil {
+		return nil, err
+	}
+	// The token is read every time since projected
+	// service account tokens are rotated.
+	if c.tokenFile != "" {
+		token, err := os.ReadFile(c.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET pod %s/%s: %s", namespace, name, resp.Status)
+	}
+	pod := &apiPod{}
+	if err := json.NewDecoder(resp.Body).Decode(pod); err != nil {
+		return nil, err
+	}
+	return pod, nil
+}
+
+type cachedMetadata struct {
+	mtd    *podMetadata
+	err    error
+	expiry time.Time
+}
+
+// podMetadataCache caches the metadata of pods by pod UID.
+type podMetadataCache struct {
+	client *k8sAPIClient
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedMetadata
+}
+
+func newPodMetadataCache(client *k8sAPIClient, ttl time.Duration) *podMetadataCache {
+	if ttl == 0 {
+		ttl = defaultMetadataCacheTTL
+	}
+	return &podMetadataCache{
+		client: client,
+		ttl:    ttl,
+		cache:  map[string]cachedMetadata{},
+	}
+}
+
+func (c *podMetadataCache) Get(entity K8sEntity) (*podMetadata, error) {
+	now := time.Now()
+	c.mu.Lock()
+	if e, ok := c.cache[entity.PodID]; ok && now.Before(e.expiry) {
+		c.mu.Unlock()
+		return e.mtd, e.err
+	}
+	c.mu.Unlock()
+
+	mtd, err := c.fetch(entity)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Drop the expired entries while we hold the lock.
+	for k, e := range c.cache {
+		if now.After(e.expiry) {
+			delete(c.cache, k)
+		}
+	}
+	ttl := c.ttl
+	if err != nil {
+		ttl = metadataErrorCacheTTL
+	}
+	c.cache[entity.PodID] = cachedMetadata{
+		mtd:    mtd,
+		err:    err,
+		expiry: now.Add(ttl),
+	}
+	return mtd, err
+}
+
+func (c *podMetadataCache) fetch(entity K8sEntity) (*podMetadata, error) {
+	pod, err := c.client.getPod(entity.Namespace, entity.PodName)
+	if err != nil {
+		return nil, err
+	}
+	if pod.Metadata.UID != "" && pod.Metadata.UID != entity.PodID {
+		// A newer pod with the same name.
+		return nil, fmt.Errorf("pod %s/%s has uid %s, expected %s", entity.Namespace, entity.PodName, pod.Metadata.UID, entity.PodID)
+	}
+	mtd := &podMetadata{
+		labels:      pod.Metadata.Labels,
+		annotations: pod.Metadata.Annotations,
+		nodeName:    pod.Spec.NodeName,
+		images:      map[string]string{},
+	}
+	for _, o := range pod.Metadata.OwnerReferences {
+		if !o.Controller {
+			continue
+		}
+		mtd.ownerKind = o.Kind
+		mtd.ownerName = o.Name
+		// Report the Deployment rather than its current ReplicaSet.
+		if hash, ok := mtd.labels["pod-template-hash"]; ok && o.Kind == "ReplicaSet" && strings.HasSuffix(o.Name, "-"+hash) {
+			mtd.ownerKind = "Deployment"
+			mtd.ownerName = strings.TrimSuffix(o.Name, "-"+hash)
+		}
+		break
+	}
+	for _, c := range append(pod.Spec.Containers, pod.Spec.InitContainers...) {
+		mtd.images[c.Name] = c.Image
+	}
+	return mtd, nil
+}
+
+// enrich adds the pod metadata to the entity of one of its containers.
+func (m *podMetadata) enrich(entity *K8sEntity) {
+	entity.Labels = m.labels
+	entity.Annotations = m.annotations
+	entity.NodeName = m.nodeName
+	entity.OwnerKind = m.ownerKind
+	entity.OwnerName = m.ownerName
+	if entity.ContainerName != "" {
+		entity.Image = m.images[entity.ContainerName]
+	}
+}
@@ -0,0 +1,271 @@
+//go:build windows || darwin || linux || solaris || netbsd || openbsd || freebsd
+// +build windows darwin linux solaris netbsd openbsd freebsd
+
+package usp_k8s_pods
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPodJSON = `{
+	"kind": "Pod",
+	"apiVersion": "v1",
+	"metadata": {
+		"name": "web-7d4b9c8f6-x2x9k",
+		"namespace": "prod",
+		"uid": "5fd1df1d-b484-435d-b497-deb676db1614",
+		"labels": {"app": "web", "tier": "frontend", "pod-template-hash": "7d4b9c8f6"},
+		"annotations": {"team": "platform"},
+		"ownerReferences": [{"apiVersion": "apps/v1", "kind": "ReplicaSet", "name": "web-7d4b9c8f6", "controller": true}]
+	},
+	"spec": {
+		"nodeName": "node-1",
+		"containers": [{"name": "nginx", "image": "nginx:1.25"}, {"name": "sidecar", "image": "envoy:1.29"}]
+	}
+}`
+
+// newFakeAPIServer serves the test pod and
+// counts the requests it received.
+func newFakeAPIServer(t *testing.T, nRequests *uint32) *httptest.Server {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(nRequests, 1)
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/v1/namespaces/prod/pods/web-7d4b9c8f6-x2x9k" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testPodJSON))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func newTestAPIClient(t *testing.T, s *httptest.Server) *k8sAPIClient {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("test-token\n"), 0600))
+	c, err := newK8sAPIClient(K8sPodsConfig{
+		APIServerURL: s.URL,
+		APITokenFile: tokenFile,
+	})
+	require.NoError(t, err)
+	// The test server's certificate is self-signed.
+	c.httpClient = s.Client()
+	return c
+}
+
+func TestMetadataCache(t *testing.T) {
+	nRequests := uint32(0)
+	s := newFakeAPIServer(t, &nRequests)
+	cache := newPodMetadataCache(newTestAPIClient(t, s), 0)
+
+	entity := K8sEntity{
+		Namespace:     "prod",
+		PodName:       "web-7d4b9c8f6-x2x9k",
+		PodID:         "5fd1df1d-b484-435d-b497-deb676db1614",
+		ContainerName: "sidecar",
+	}
+	mtd, err := cache.Get(entity)
+	require.NoError(t, err)
+	mtd.enrich(&entity)
+	assert.Equal(t, map[string]string{"app": "web", "tier": "frontend", "pod-template-hash": "7d4b9c8f6"}, entity.Labels)
+	assert.Equal(t, map[string]string{"team": "platform"}, entity.Annotations)
+	assert.Equal(t, "node-1", entity.NodeName)
+	assert.Equal(t, "Deployment", entity.OwnerKind)
+	assert.Equal(t, "web", entity.OwnerName)
+	assert.Equal(t, "envoy:1.29", entity.Image)
+
+	// Shipped as plain JSON values, like the entity.
+	d := entity.toDict()
+	assert.Equal(t, map[string]interface{}{"team": "platform"}, d["annotations"])
+	expected, err := json.Marshal(entity)
+	require.NoError(t, err)
+	actual, err := json.Marshal(d)
+	require.NoError(t, err)
+	assert.JSONEq(t, string(expected), string(actual))
+
+	// Served from the cache.
+	_, err = cache.Get(entity)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&nRequests))
+
+	// A pod replaced by a new one with the same name.
+	_, err = cache.Get(K8sEntity{Namespace: "prod", PodName: "web-7d4b9c8f6-x2x9k", PodID: "other"})
+	assert.Error(t, err)
+
+	// Errors are cached too.
+	_, err = cache.Get(K8sEntity{Namespace: "prod", PodName: "missing", PodID: "1"})
+	assert.Error(t, err)
+	_, err = cache.Get(K8sEntity{Namespace: "prod", PodName: "missing", PodID: "1"})
+	assert.Error(t, err)
+	assert.Equal(t, uint32(3), atomic.LoadUint32(&nRequests))
+}
+
+func TestPodFilters(t *testing.T) {
+	nRequests := uint32(0)
+	s := newFakeAPIServer(t, &nRequests)
+	apiClient := newTestAPIClient(t, s)
+
+	podPath := "/var/log/pods/prod_web-7d4b9c8f6-x2x9k_5fd1df1d-b484-435d-b497-deb676db1614"
+	newEngine := func(opts runtimeOptions) *K8sLogProcessor {
+		return &K8sLogProcessor{
+			options: uspclient.ClientOptions{
+				DebugLog:  func(msg string) {},
+				OnWarning: func(msg string) {},
+				OnError:   func(err error) { t.Errorf("unexpected error: %v", err) },
+			},
+			rtOptions: opts,
+		}
+	}
+
+	mtd, ok, err := newEngine(runtimeOptions{}).newPodMtd(podPath)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "prod", mtd.Entity.Namespace)
+	assert.Nil(t, mtd.Entity.Labels)
+
+	_, ok, _ = newEngine(runtimeOptions{includeNamespaces: map[string]struct{}{"dev": {}}}).newPodMtd(podPath)
+	assert.False(t, ok)
+	_, ok, _ = newEngine(runtimeOptions{excludeNamespaces: map[string]struct{}{"prod": {}}}).newPodMtd(podPath)
+	assert.False(t, ok)
+
+	for selector, expected := range map[string]bool{
+		"app=web":                       true,
+		"app==web,tier in (frontend,x)": true,
+		"app!=web":                      false,
+		"tier notin (frontend)":         false,
+		"!canary":                       true,
+		"canary":                        false,
+	} {
+		ls, err := parseLabelSelector(selector)
+		require.NoError(t, err, selector)
+		klp := newEngine(runtimeOptions{
+			labelSelector: ls,
+			metadata:      newPodMetadataCache(apiClient, 0),
+		})
+		mtd, ok, err := klp.newPodMtd(podPath)
+		require.NoError(t, err, selector)
+		assert.Equal(t, expected, ok, selector)
+		if ok {
+			assert.Equal(t, "node-1", mtd.Entity.NodeName)
+			assert.Equal(t, "nginx:1.25", klp.containerMtd(mtd, podPath+"/nginx", "nginx").Entity.Image)
+		}
+	}
+}
+
+func TestPodFiltersWithoutMetadata(t *testing.T) {
+	isAvailable := uint32(0)
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadUint32(&isAvailable) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(testPodJSON))
+	}))
+	t.Cleanup(s.Close)
+	apiClient := newTestAPIClient(t, s)
+
+	podPath := filepath.Join(t.TempDir(), "prod_web-7d4b9c8f6-x2x9k_5fd1df1d-b484-435d-b497-deb676db1614")
+	require.NoError(t, os.Mkdir(podPath, 0700))
+	nWarnings := 0
+	isStarted := uint32(0)
+	newEngine := func(selector string) *K8sLogProcessor {
+		opts := runtimeOptions{
+			metadata: newPodMetadataCache(apiClient, 0),
+		}
+		if selector != "" {
+			ls, err := parseLabelSelector(selector)
+			require.NoError(t, err)
+			opts.labelSelector = ls
+		}
+		return &K8sLogProcessor{
+			options: uspclient.ClientOptions{
+				DebugLog: func(msg string) {
+					if strings.HasPrefix(msg, "k8s pod watcher started") {
+						atomic.StoreUint32(&isStarted, 1)
+					}
+				},
+				OnWarning: func(msg string) { nWarnings++ },
+				OnError:   func(err error) { t.Errorf("unexpected error: %v", err) },
+			},
+			rtOptions: opts,
+			chStop:    make(chan struct{}),
+		}
+	}
+
+	// Without a selector, the pod is collected without metadata.
+	mtd, ok, err := newEngine("").newPodMtd(podPath)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Nil(t, mtd.Entity.Labels)
+
+	// With a selector, it is not collected until the
+	// metadata is available and the selector matches.
+	for selector, expected := range map[string]bool{
+		"app=web":  true,
+		"app!=web": false,
+	} {
+		nWarnings = 0
+		atomic.StoreUint32(&isStarted, 0)
+		atomic.StoreUint32(&isAvailable, 0)
+		klp := newEngine(selector)
+		pending := map[string]struct{}{}
+		klp.startPod(podPath, pending)
+		klp.startPod(podPath, pending)
+		assert.Contains(t, pending, podPath, selector)
+		assert.Equal(t, 1, nWarnings, selector)
+		assert.Equal(t, uint32(0), atomic.LoadUint32(&isStarted), selector)
+
+		// Errors are cached, until they expire.
+		atomic.StoreUint32(&isAvailable, 1)
+		klp.startPod(podPath, pending)
+		assert.Contains(t, pending, podPath, selector)
+		klp.rtOptions.metadata.cache = map[string]cachedMetadata{}
+
+		klp.startPod(podPath, pending)
+		assert.Empty(t, pending, selector)
+		close(klp.chStop)
+		isStopped := make(chan struct{})
+		go func() {
+			klp.wg.Wait()
+			close(isStopped)
+		}()
+		select {
+		case <-isStopped:
+		case <-time.After(5 * time.Second):
+			t.Fatal("pod watcher not stopped")
+		}
+		assert.Equal(t, expected, atomic.LoadUint32(&isStarted) == 1, selector)
+	}
+}
+
+func TestParseLabelSelector(t *testing.T) {
+	ls, err := parseLabelSelector("a=1, b in (x, y),!c,d notin (z),e")
+	require.NoError(t, err)
+	assert.Len(t, ls, 5)
+	assert.True(t, ls.Matches(map[string]string{"a": "1", "b": "y", "e": ""}))
+	assert.False(t, ls.Matches(map[string]string{"a": "1", "b": "y", "d": "z", "e": ""}))
+	assert.False(t, ls.Matches(map[string]string{"a": "1", "b": "y", "c": "", "e": ""}))
+
+	for _, invalid := range []string{"!", "=x", "a in x", "a between (1,2)", "a b"} {
+		_, err := parseLabelSelector(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
@@ -0,0 +1,152 @@
+//go:build windows || darwin || linux || solaris || netbsd || openbsd || freebsd
+// +build windows darwin linux solaris netbsd openbsd freebsd
+
+package usp_k8s_pods
+
+import (
+	"fmt"
+	"strings"
+)
+
+type selectorOp int
+
+const (
+	opEquals selectorOp = iota
+	opNotEquals
+	opIn
+	opNotIn
+	opExists
+	opNotExists
+)
+
+type selectorRequirement struct {
+	key    string
+	op     selectorOp
+	values []string
+}
+
+// labelSelector is a Kubernetes label selector like
+// "app=web,tier in (frontend,backend),!canary".
+type labelSelector []selectorRequirement
+
+func parseLabelSelector(selector string) (labelSelector, error) {
+	ls := labelSelector{}
+	for _, term := range splitSelector(selector) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		req, err := parseRequirement(term)
+		if err != nil {
+			return nil, err
+		}
+		ls = append(ls, req)
+	}
+	return ls, nil
+}
+
+// splitSelector splits on the commas not within parentheses.
+func splitSelector(selector string) []string {
+	terms := []string{}
+	depth := 0
+	start := 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(terms, selector[start:])
+}
+
+func parseRequirement(term string) (selectorRequirement, error) {
+	if strings.HasPrefix(term, "!") {
+		key := strings.TrimSpace(term[1:])
+		if key == "" {
+			return selectorRequirement{}, fmt.Errorf("invalid selector: %s", term)
+		}
+		return selectorRequirement{key: key, op: opNotExists}, nil
+	}
+	if i := strings.Index(term, "!="); i != -1 {
+		return newValueRequirement(term[:i], opNotEquals, term[i+2:])
+	}
+	if i := strings.Index(term, "=="); i != -1 {
+		return newValueRequirement(term[:i], opEquals, term[i+2:])
+	}
+	if i := strings.Index(term, "="); i != -1 {
+		return newValueRequirement(term[:i], opEquals, term[i+1:])
+	}
+	fields := strings.Fields(term)
+	if len(fields) == 1 {
+		return selectorRequirement{key: fields[0], op: opExists}, nil
+	}
+	if len(fields) < 3 {
+		return selectorRequirement{}, fmt.Errorf("invalid selector: %s", term)
+	}
+	op := opIn
+	switch strings.ToLower(fields[1]) {
+	case "in":
+	case "notin":
+		op = opNotIn
+	default:
+		return selectorRequirement{}, fmt.Errorf("invalid selector operator: %s", term)
+	}
+	set := strings.TrimSpace(strings.Join(fields[2:], " "))
+	if !strings.HasPrefix(set, "(") || !strings.HasSuffix(set, ")") {
+		return selectorRequirement{}, fmt.Errorf("invalid selector set: %s", term)
+	}
+	req := selectorRequirement{key: fields[0], op: op}
+	for _, v := range strings.Split(set[1:len(set)-1], ",") {
+		req.values = append(req.values, strings.TrimSpace(v))
+	}
+	return req, nil
+}
+
+func newValueRequirement(key string, op selectorOp, value string) (selectorRequirement, error) {
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return selectorRequirement{}, fmt.Errorf("invalid selector: missing key")
+	}
+	return selectorRequirement{key: key, op: op, values: []string{strings.TrimSpace(value)}}, nil
+}
+
+func (ls labelSelector) Matches(labels map[string]string) bool {
+	for _, req := range ls {
+		v, exists := labels[req.key]
+		switch req.op {
+		case opExists:
+			if !exists {
+				return false
+			}
+		case opNotExists:
+			if exists {
+				return false
+			}
+		case opEquals, opIn:
+			if !exists || !contains(req.values, v) {
+				return false
+			}
+		case opNotEquals, opNotIn:
+			if exists && contains(req.values, v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func contains(values []string, v string) bool {
+	for _, e := range values {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
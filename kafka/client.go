@@ -0,0 +1,330 @@
+package usp_kafka
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/refractionPOINT/usp-adapters/utils"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+const (
+	// Shipping blocks the poll loop, which blocks the rebalances
+	// of the group, so it stays well below the rebalance timeout.
+	defaultWriteTimeout = 10
+	maxWriteTimeout     = 30
+	commitTimeout       = 30 * time.Second
+	shipRetryDelay      = 5 * time.Second
+)
+
+type KafkaAdapter struct {
+	conf         KafkaConfig
+	wg           sync.WaitGroup
+	isRunning    uint32
+	uspClient    *utils.USPClient
+	kClient      *kgo.Client
+	writeTimeout time.Duration
+
+	ctx        context.Context
+	fCtxCancel context.CancelFunc
+}
+
+type KafkaConfig struct {
+	ClientOptions uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
+	// How long shipping a record can wait when falling behind before
+	// its partition is rewound and polled again, at most 30.
+	WriteTimeoutSec uint64 `json:"write_timeout_sec,omitempty" yaml:"write_timeout_sec,omitempty"`
+
+	Brokers       []string `json:"brokers" yaml:"brokers"`
+	Topics        []string `json:"topics" yaml:"topics"`
+	ConsumerGroup string   `json:"consumer_group" yaml:"consumer_group"`
+	// Where to start consuming a partition the consumer group
+	// has no offset for: "latest" (default) or "earliest".
+	StartPosition string `json:"start_position,omitempty" yaml:"start_position,omitempty"`
+
+	// SASL mechanism: "plain", "scram-sha-256" or "scram-sha-512".
+	SaslMechanism string `json:"sasl_mechanism,omitempty" yaml:"sasl_mechanism,omitempty"`
+	SaslUsername  string `json:"sasl_username,omitempty" yaml:"sasl_username,omitempty"`
+	SaslPassword  string `json:"sasl_password,omitempty" yaml:"sasl_password,omitempty"`
+
+	IsTLS                   bool   `json:"tls,omitempty" yaml:"tls,omitempty"`
+	TlsCACertPath           string `json:"tls_ca_cert,omitempty" yaml:"tls_ca_cert,omitempty"`
+	TlsCertPath             string `json:"tls_cert,omitempty" yaml:"tls_cert,omitempty"`
+	TlsKeyPath              string `json:"tls_key,omitempty" yaml:"tls_key,omitempty"`
+	IsTlsInsecureSkipVerify bool   `json:"tls_insecure_skip_verify,omitempty" yaml:"tls_insecure_skip_verify,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+}
+
+func (c *KafkaConfig) Validate() error {
+	if err := c.ClientOptions.Validate(); err != nil {
+		return fmt.Errorf("client_options: %v", err)
+	}
+	if len(c.Brokers) == 0 {
+		return errors.New("missing brokers")
+	}
+	if len(c.Topics) == 0 {
+		return errors.New("missing topics")
+	}
+	if c.ConsumerGroup == "" {
+		return errors.New("missing consumer_group")
+	}
+	switch strings.ToLower(c.StartPosition) {
+	case "", "latest", "earliest":
+	default:
+		return fmt.Errorf("invalid start_position: %s", c.StartPosition)
+	}
+	if _, err := c.saslMechanism(); err != nil {
+		return err
+	}
+	if (c.TlsCertPath == "") != (c.TlsKeyPath == "") {
+		return errors.New("tls_cert and tls_key must be set together")
+	}
+	if c.WriteTimeoutSec > maxWriteTimeout {
+		return fmt.Errorf("write_timeout_sec must be at most %d", maxWriteTimeout)
+	}
+	return nil
+}
+
+func (c *KafkaConfig) saslMechanism() (sasl.Mechanism, error) {
+	if c.SaslMechanism == "" {
+		return nil, nil
+	}
+	if c.SaslUsername == "" || c.SaslPassword == "" {
+		return nil, errors.New("sasl_username and sasl_password required")
+	}
+	switch strings.ToLower(c.SaslMechanism) {
+	case "plain":
+		return plain.Auth{User: c.SaslUsername, Pass: c.SaslPassword}.AsMechanism(), nil
+	case "scram-sha-256":
+		return scram.Auth{User: c.SaslUsername, Pass: c.SaslPassword}.AsSha256Mechanism(), nil
+	case "scram-sha-512":
+		return scram.Auth{User: c.SaslUsername, Pass: c.SaslPassword}.AsSha512Mechanism(), nil
+	}
+	return nil, fmt.Errorf("unsupported sasl_mechanism: %s", c.SaslMechanism)
+}
+
+func (c *KafkaConfig) tlsConfig() (*tls.Config, error) {
+	if !c.IsTLS {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.IsTlsInsecureSkipVerify,
+	}
+	if c.TlsCACertPath != "" {
+		ca, err := os.ReadFile(c.TlsCACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("tls_ca_cert: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("tls_ca_cert: no certificate found")
+		}
+	}
+	if c.TlsCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(c.TlsCertPath, c.TlsKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("tls_cert: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func (c *KafkaConfig) clientOptions() ([]kgo.Opt, error) {
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(c.Brokers...),
+		kgo.ConsumerGroup(c.ConsumerGroup),
+		kgo.ConsumeTopics(c.Topics...),
+		// Offsets are committed once the records are shipped, and
+		// rebalances wait for that between polls, so shipping is
+		// bounded by the write timeout.
+		kgo.DisableAutoCommit(),
+		kgo.BlockRebalanceOnPoll(),
+	}
+	if strings.ToLower(c.StartPosition) == "earliest" {
+		opts = append(opts, kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()))
+	} else {
+		opts = append(opts, kgo.ConsumeResetOffset(kgo.NewOffset().AtEnd()))
+	}
+	mechanism, err := c.saslMechanism()
+	if err != nil {
+		return nil, err
+	}
+	if mechanism != nil {
+		opts = append(opts, kgo.SASL(mechanism))
+	}
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts = append(opts, kgo.DialTLSConfig(tlsConfig))
+	}
+	return opts, nil
+}
+
+func NewKafkaAdapter(ctx context.Context, conf KafkaConfig) (*KafkaAdapter, chan struct{}, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, nil, err
+	}
+	a := &KafkaAdapter{
+		conf:      conf,
+		isRunning: 1,
+	}
+
+	if a.conf.WriteTimeoutSec == 0 {
+		a.conf.WriteTimeoutSec = defaultWriteTimeout
+	}
+	a.writeTimeout = time.Duration(a.conf.WriteTimeoutSec) * time.Second
+
+	opts, err := a.conf.clientOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+	if a.kClient, err = kgo.NewClient(opts...); err != nil {
+		return nil, nil, err
+	}
+
+	a.uspClient, err = utils.NewAckedUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
+	if err != nil {
+		a.kClient.Close()
+		return nil, nil, err
+	}
+
+	a.ctx, a.fCtxCancel = context.WithCancel(context.Background())
+
+	chStopped := make(chan struct{})
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer close(chStopped)
+		a.consume()
+	}()
+
+	return a, chStopped, nil
+}
+
+func (a *KafkaAdapter) Close() error {
+	a.conf.ClientOptions.DebugLog("closing")
+	atomic.StoreUint32(&a.isRunning, 0)
+	a.fCtxCancel()
+	a.wg.Wait()
+	// Leaves the consumer group.
+	a.kClient.Close()
+	err1 := a.uspClient.Drain(1 * time.Minute)
+	_, err2 := a.uspClient.Close()
+
+	if err1 != nil {
+		return err1
+	}
+
+	return err2
+}
+
+func (a *KafkaAdapter) consume() {
+	a.conf.ClientOptions.DebugLog(fmt.Sprintf("consuming %v as %s", a.conf.Topics, a.conf.ConsumerGroup))
+	defer a.conf.ClientOptions.DebugLog("stopped consuming")
+
+	for atomic.LoadUint32(&a.isRunning) == 1 {
+		fetches := a.kClient.PollFetches(a.ctx)
+		if fetches.IsClientClosed() {
+			return
+		}
+		fetches.EachError(func(topic string, partition int32, err error) {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("fetch %s/%d: %v", topic, partition, err))
+		})
+
+		shipped, rewinds := processFetches(fetches, a.ship)
+		if len(rewinds) != 0 {
+			// The records after a failed one are fetched again.
+			a.kClient.SetOffsets(rewinds)
+		}
+		if len(shipped) != 0 {
+			// Committed even when closing, so the
+			// shipped records are not consumed twice.
+			ctx, cancel := context.WithTimeout(context.Background(), commitTimeout)
+			if err := a.kClient.CommitRecords(ctx, shipped...); err != nil {
+				a.conf.ClientOptions.OnWarning(fmt.Sprintf("CommitRecords(): %v", err))
+			}
+			cancel()
+		}
+		a.kClient.AllowRebalance()
+
+		if len(rewinds) != 0 {
+			select {
+			case <-a.ctx.Done():
+			case <-time.After(shipRetryDelay):
+			}
+		}
+	}
+}
+
+// processFetches ships the fetched records and returns the ones
+// shipped, and the offsets to rewind the partitions to. Once a record
+// fails to ship, the following records of all the partitions are not
+// shipped so that the poll loop does not keep waiting on them.
+func processFetches(fetches kgo.Fetches, ship func(*kgo.Record) bool) ([]*kgo.Record, map[string]map[int32]kgo.EpochOffset) {
+	shipped := []*kgo.Record{}
+	rewinds := map[string]map[int32]kgo.EpochOffset{}
+	isFailed := false
+	fetches.EachPartition(func(p kgo.FetchTopicPartition) {
+		for _, r := range p.Records {
+			if isFailed || !ship(r) {
+				isFailed = true
+				if _, ok := rewinds[r.Topic]; !ok {
+					rewinds[r.Topic] = map[int32]kgo.EpochOffset{}
+				}
+				rewinds[r.Topic][r.Partition] = kgo.EpochOffset{
+					Epoch:  r.LeaderEpoch,
+					Offset: r.Offset,
+				}
+				return
+			}
+			shipped = append(shipped, r)
+		}
+	})
+	return shipped, rewinds
+}
+
+// ship waits at most the write timeout, records failing to ship are
+// polled again after the rebalances blocked during the poll ran.
+func (a *KafkaAdapter) ship(r *kgo.Record) bool {
+	if len(r.Value) == 0 {
+		// Tombstones of compacted topics.
+		return true
+	}
+	if a.ctx.Err() != nil {
+		return false
+	}
+	msg := &protocol.DataMessage{
+		TextPayload: string(r.Value),
+		TimestampMs: uint64(r.Timestamp.UnixNano() / int64(time.Millisecond)),
+	}
+	err := a.uspClient.Ship(msg, a.writeTimeout)
+	if err == uspclient.ErrorBufferFull {
+		a.conf.ClientOptions.OnWarning("stream falling behind")
+		return false
+	}
+	if err != nil {
+		a.conf.ClientOptions.OnError(fmt.Errorf("Ship(): %v", err))
+		return false
+	}
+	return true
+}
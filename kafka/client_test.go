@@ -0,0 +1,101 @@
+package usp_kafka
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestValidate(t *testing.T) {
+	valid := KafkaConfig{
+		Brokers:       []string{"localhost:9092"},
+		Topics:        []string{"logs"},
+		ConsumerGroup: "lc",
+	}
+	require.NoError(t, valid.Validate())
+
+	for name, update := range map[string]func(c *KafkaConfig){
+		"no brokers":         func(c *KafkaConfig) { c.Brokers = nil },
+		"no topics":          func(c *KafkaConfig) { c.Topics = nil },
+		"no group":           func(c *KafkaConfig) { c.ConsumerGroup = "" },
+		"bad start position": func(c *KafkaConfig) { c.StartPosition = "middle" },
+		"bad sasl":           func(c *KafkaConfig) { c.SaslMechanism = "gssapi"; c.SaslUsername = "u"; c.SaslPassword = "p" },
+		"no sasl password":   func(c *KafkaConfig) { c.SaslMechanism = "plain"; c.SaslUsername = "u" },
+		"cert without key":   func(c *KafkaConfig) { c.TlsCertPath = "cert.pem" },
+		"long write timeout": func(c *KafkaConfig) { c.WriteTimeoutSec = 600 },
+	} {
+		c := valid
+		update(&c)
+		assert.Error(t, c.Validate(), name)
+	}
+
+	for _, mechanism := range []string{"plain", "SCRAM-SHA-256", "scram-sha-512"} {
+		c := valid
+		c.SaslMechanism = mechanism
+		c.SaslUsername = "u"
+		c.SaslPassword = "p"
+		c.StartPosition = "earliest"
+		c.IsTLS = true
+		require.NoError(t, c.Validate(), mechanism)
+		_, err := c.clientOptions()
+		require.NoError(t, err, mechanism)
+	}
+
+	c := valid
+	c.IsTLS = true
+	c.TlsCACertPath = "missing.pem"
+	_, err := c.clientOptions()
+	assert.Error(t, err)
+}
+
+func TestProcessFetches(t *testing.T) {
+	records := func(topic string, partition int32, offsets ...int64) []*kgo.Record {
+		rs := []*kgo.Record{}
+		for _, o := range offsets {
+			rs = append(rs, &kgo.Record{Topic: topic, Partition: partition, Offset: o, LeaderEpoch: 3, Value: []byte("v")})
+		}
+		return rs
+	}
+	fetches := kgo.Fetches{{
+		Topics: []kgo.FetchTopic{
+			{
+				Topic: "a",
+				Partitions: []kgo.FetchPartition{
+					{Partition: 0, Records: records("a", 0, 10, 11, 12)},
+					{Partition: 1, Records: records("a", 1, 20, 21)},
+				},
+			},
+			{
+				Topic: "b",
+				Partitions: []kgo.FetchPartition{
+					{Partition: 0, Records: records("b", 0, 5)},
+				},
+			},
+		},
+	}}
+
+	// Partition a/0 fails at offset 11, the records after
+	// it are rewound without trying to ship them.
+	nShipped := 0
+	shipped, rewinds := processFetches(fetches, func(r *kgo.Record) bool {
+		nShipped++
+		return !(r.Topic == "a" && r.Partition == 0 && r.Offset == 11)
+	})
+	committed := []string{}
+	for _, r := range shipped {
+		committed = append(committed, fmt.Sprintf("%s/%d@%d", r.Topic, r.Partition, r.Offset))
+	}
+	assert.Equal(t, []string{"a/0@10"}, committed)
+	assert.Equal(t, 2, nShipped)
+	assert.Equal(t, map[string]map[int32]kgo.EpochOffset{
+		"a": {0: {Epoch: 3, Offset: 11}, 1: {Epoch: 3, Offset: 20}},
+		"b": {0: {Epoch: 3, Offset: 5}},
+	}, rewinds)
+
+	shipped, rewinds = processFetches(fetches, func(r *kgo.Record) bool { return true })
+	assert.Len(t, shipped, 6)
+	assert.Empty(t, rewinds)
+}
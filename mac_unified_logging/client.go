@@ -15,6 +15,7 @@ import (
 
 	"github.com/refractionPOINT/go-uspclient"
 	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/refractionPOINT/usp-adapters/utils"
 )
 
 const (
@@ -26,7 +27,7 @@ type MacUnifiedLoggingAdapter struct {
 	wg           sync.WaitGroup
 	isRunning    uint32
 	mRunning     sync.RWMutex
-	uspClient    *uspclient.Client
+	uspClient    *utils.USPClient
 	writeTimeout time.Duration
 
 	chStopped chan struct{}
@@ -47,7 +48,7 @@ func NewMacUnifiedLoggingAdapter(ctx context.Context, conf MacUnifiedLoggingConf
 	a.writeTimeout = time.Duration(a.conf.WriteTimeoutSec) * time.Second
 
 	var err error
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -4,12 +4,15 @@ import (
 	"fmt"
 
 	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/usp-adapters/utils"
 )
 
 type MacUnifiedLoggingConfig struct {
 	ClientOptions   uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
 	WriteTimeoutSec uint64                  `json:"write_timeout_sec,omitempty" yaml:"write_timeout_sec,omitempty"`
 	Predicate       string                  `json:"predicate,omitempty" yaml:"predicate,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 // Validate validates the Mac Unified Logging adapter configuration.
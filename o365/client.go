@@ -62,7 +62,7 @@ var ResourceScope = map[string]string{
 
 type Office365Adapter struct {
 	conf       Office365Config
-	uspClient  *uspclient.Client
+	uspClient  *utils.USPClient
 	httpClient *http.Client
 
 	endpoint     string
@@ -87,6 +87,8 @@ type Office365Config struct {
 	StartTime     string                  `json:"start_time" yaml:"start_time"`
 
 	Deduper utils.Deduper `json:"-" yaml:"-"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *Office365Config) Validate() error {
@@ -145,7 +147,7 @@ func NewOffice365Adapter(ctx context.Context, conf Office365Config) (*Office365A
 		return nil, nil, fmt.Errorf("not a valid api endpoint: %s", conf.Endpoint)
 	}
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
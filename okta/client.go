@@ -29,7 +29,7 @@ type opRequest struct {
 
 type OktaAdapter struct {
 	conf       OktaConfig
-	uspClient  *uspclient.Client
+	uspClient  *utils.USPClient
 	httpClient *http.Client
 
 	chStopped chan struct{}
@@ -45,6 +45,8 @@ type OktaConfig struct {
 	ClientOptions uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
 	ApiKey        string                  `json:"apikey" yaml:"apikey"`
 	URL           string                  `json:"url" yaml:"url"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *OktaConfig) Validate() error {
@@ -69,7 +71,7 @@ func NewOktaAdapter(ctx context.Context, conf OktaConfig) (*OktaAdapter, chan st
 		dedupe: make(map[string]int64),
 	}
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
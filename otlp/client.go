@@ -0,0 +1,394 @@
+package usp_otlp
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/refractionPOINT/usp-adapters/utils"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	logsPath           = "/v1/logs"
+	maxRequestSize     = 64 * 1024 * 1024
+	defaultMaxServices = 100
+	// Exporters retry the requests we reject, so we do
+	// not hold them for long waiting for buffer space.
+	receiverShipTimeout = 10 * time.Second
+	retryAfterSec       = "10"
+
+	contentTypeProtobuf = "application/x-protobuf"
+	contentTypeJSON     = "application/json"
+)
+
+var errBufferFull = errors.New("buffer full")
+
+type OTLPAdapter struct {
+	conf OTLPConfig
+	ctx  context.Context
+	wg   sync.WaitGroup
+
+	httpServer   *http.Server
+	httpListener net.Listener
+	grpcServer   *grpc.Server
+	grpcListener net.Listener
+
+	uspClient *utils.USPClient
+	// Clients by service.name when routing by service.
+	mClients       sync.Mutex
+	serviceClients map[string]*serviceClient
+	isFullWarned   bool
+
+	collogspb.UnimplementedLogsServiceServer
+}
+
+// serviceClient is the client of a service, the requests
+// of the service wait for it while it connects.
+type serviceClient struct {
+	chReady chan struct{}
+	client  *utils.USPClient
+	err     error
+}
+
+type OTLPConfig struct {
+	ClientOptions uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
+	// OTLP/HTTP on /v1/logs, usually 4318, and
+	// OTLP/gRPC, usually 4317. At least one is required.
+	HTTPPort          uint16 `json:"http_port,omitempty" yaml:"http_port,omitempty"`
+	GRPCPort          uint16 `json:"grpc_port,omitempty" yaml:"grpc_port,omitempty"`
+	Interface         string `json:"iface,omitempty" yaml:"iface,omitempty"`
+	SslCertPath       string `json:"ssl_cert,omitempty" yaml:"ssl_cert,omitempty"`
+	SslKeyPath        string `json:"ssl_key,omitempty" yaml:"ssl_key,omitempty"`
+	MutualTlsCertPath string `json:"mutual_tls_cert,omitempty" yaml:"mutual_tls_cert,omitempty"`
+
+	// Ship the logs of each service.name as a sensor with that
+	// hostname, up to max_services after which the logs go to
+	// the client_options hostname. The sensors of the services
+	// use "<sensor_seed_key>/<service.name>" as seed key.
+	IsRouteByServiceName bool `json:"route_by_service_name,omitempty" yaml:"route_by_service_name,omitempty"`
+	MaxServices          int  `json:"max_services,omitempty" yaml:"max_services,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+}
+
+func (c *OTLPConfig) Validate() error {
+	if err := c.ClientOptions.Validate(); err != nil {
+		return fmt.Errorf("client_options: %v", err)
+	}
+	if c.HTTPPort == 0 && c.GRPCPort == 0 {
+		return errors.New("http_port or grpc_port required")
+	}
+	if c.HTTPPort != 0 && c.HTTPPort == c.GRPCPort {
+		return errors.New("http_port and grpc_port must be different")
+	}
+	if (c.SslCertPath == "") != (c.SslKeyPath == "") {
+		return errors.New("ssl_cert and ssl_key must be set together")
+	}
+	if c.MaxServices < 0 {
+		return fmt.Errorf("invalid max_services: %d", c.MaxServices)
+	}
+	return nil
+}
+
+func NewOTLPAdapter(ctx context.Context, conf OTLPConfig) (*OTLPAdapter, chan struct{}, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, nil, err
+	}
+	a := &OTLPAdapter{
+		conf:           conf,
+		ctx:            ctx,
+		serviceClients: map[string]*serviceClient{},
+	}
+	if a.conf.MaxServices == 0 {
+		a.conf.MaxServices = defaultMaxServices
+	}
+
+	var tlsConfig *tls.Config
+	var err error
+	if conf.SslCertPath != "" {
+		if tlsConfig, err = utils.LoadServerTLSConfig(conf.SslCertPath, conf.SslKeyPath, conf.MutualTlsCertPath); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if conf.HTTPPort != 0 {
+		if a.httpListener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", conf.Interface, conf.HTTPPort)); err != nil {
+			return nil, nil, err
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc(logsPath, a.handleHTTP)
+		a.httpServer = &http.Server{
+			Handler:           mux,
+			TLSConfig:         tlsConfig,
+			ReadHeaderTimeout: 30 * time.Second,
+		}
+	}
+	if conf.GRPCPort != 0 {
+		if a.grpcListener, err = net.Listen("tcp", fmt.Sprintf("%s:%d", conf.Interface, conf.GRPCPort)); err != nil {
+			a.closeListeners()
+			return nil, nil, err
+		}
+		opts := []grpc.ServerOption{
+			grpc.MaxRecvMsgSize(maxRequestSize),
+		}
+		if tlsConfig != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		a.grpcServer = grpc.NewServer(opts...)
+		collogspb.RegisterLogsServiceServer(a.grpcServer, a)
+	}
+
+	a.uspClient, err = utils.NewAckedUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
+	if err != nil {
+		a.closeListeners()
+		return nil, nil, err
+	}
+
+	if a.httpServer != nil {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			a.conf.ClientOptions.DebugLog(fmt.Sprintf("listening for OTLP/HTTP on %s", a.httpListener.Addr()))
+			var err error
+			if tlsConfig != nil {
+				err = a.httpServer.ServeTLS(a.httpListener, "", "")
+			} else {
+				err = a.httpServer.Serve(a.httpListener)
+			}
+			if err != nil && err != http.ErrServerClosed {
+				a.conf.ClientOptions.OnError(fmt.Errorf("http.Serve(): %v", err))
+			}
+		}()
+	}
+	if a.grpcServer != nil {
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			a.conf.ClientOptions.DebugLog(fmt.Sprintf("listening for OTLP/gRPC on %s", a.grpcListener.Addr()))
+			if err := a.grpcServer.Serve(a.grpcListener); err != nil {
+				a.conf.ClientOptions.OnError(fmt.Errorf("grpc.Serve(): %v", err))
+			}
+		}()
+	}
+
+	chStopped := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(chStopped)
+	}()
+
+	return a, chStopped, nil
+}
+
+func (a *OTLPAdapter) closeListeners() {
+	if a.httpListener != nil {
+		a.httpListener.Close()
+	}
+	if a.grpcListener != nil {
+		a.grpcListener.Close()
+	}
+}
+
+func (a *OTLPAdapter) Close() error {
+	a.conf.ClientOptions.DebugLog("closing")
+	if a.httpServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		a.httpServer.Shutdown(ctx)
+		cancel()
+	}
+	if a.grpcServer != nil {
+		a.grpcServer.GracefulStop()
+	}
+	a.wg.Wait()
+
+	a.mClients.Lock()
+	services := make([]*serviceClient, 0, len(a.serviceClients))
+	for _, sc := range a.serviceClients {
+		services = append(services, sc)
+	}
+	a.mClients.Unlock()
+	clients := []*utils.USPClient{a.uspClient}
+	for _, sc := range services {
+		<-sc.chReady
+		if sc.client != nil {
+			clients = append(clients, sc.client)
+		}
+	}
+
+	var err error
+	for _, c := range clients {
+		if err1 := c.Drain(1 * time.Minute); err1 != nil && err == nil {
+			err = err1
+		}
+		if _, err1 := c.Close(); err1 != nil && err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+// Export implements the OTLP/gRPC logs service.
+func (a *OTLPAdapter) Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	if err := a.shipLogs(req); err != nil {
+		if err == errBufferFull {
+			// UNAVAILABLE is retried by the exporters.
+			return nil, status.Error(codes.Unavailable, "stream falling behind")
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &collogspb.ExportLogsServiceResponse{}, nil
+}
+
+func (a *OTLPAdapter) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != contentTypeProtobuf && contentType != contentTypeJSON {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = io.LimitReader(gz, maxRequestSize)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := &collogspb.ExportLogsServiceRequest{}
+	if contentType == contentTypeJSON {
+		req, err = unmarshalJSONRequest(data)
+	} else {
+		err = proto.Unmarshal(data, req)
+	}
+	if err != nil {
+		a.conf.ClientOptions.OnWarning(fmt.Sprintf("invalid OTLP request from %s: %v", r.RemoteAddr, err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := a.shipLogs(req); err != nil {
+		if err == errBufferFull {
+			w.Header().Set("Retry-After", retryAfterSec)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	// The response is encoded like the request.
+	resp := []byte("{}")
+	if contentType == contentTypeProtobuf {
+		resp, _ = proto.Marshal(&collogspb.ExportLogsServiceResponse{})
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
+
+func (a *OTLPAdapter) shipLogs(req *collogspb.ExportLogsServiceRequest) error {
+	for _, evt := range convertLogs(req) {
+		msg := &protocol.DataMessage{
+			JsonPayload: evt.payload,
+			TimestampMs: evt.timestampMs,
+		}
+		if msg.TimestampMs == 0 {
+			msg.TimestampMs = uint64(time.Now().UnixNano() / int64(time.Millisecond))
+		}
+		c, err := a.clientFor(evt.serviceName)
+		if err != nil {
+			a.conf.ClientOptions.OnError(fmt.Errorf("uspclient.NewClient(%s): %v", evt.serviceName, err))
+			return err
+		}
+		err = c.Ship(msg, receiverShipTimeout)
+		if err == uspclient.ErrorBufferFull {
+			// The exporter will retry the whole request, which
+			// may duplicate the events shipped before this one.
+			a.conf.ClientOptions.OnWarning("stream falling behind, rejecting request")
+			return errBufferFull
+		}
+		if err != nil {
+			a.conf.ClientOptions.OnError(fmt.Errorf("Ship(): %v", err))
+			return err
+		}
+	}
+	return nil
+}
+
+// clientFor returns the client to ship the logs of a service with.
+func (a *OTLPAdapter) clientFor(serviceName string) (*utils.USPClient, error) {
+	if !a.conf.IsRouteByServiceName || serviceName == "" {
+		return a.uspClient, nil
+	}
+	a.mClients.Lock()
+	if sc, ok := a.serviceClients[serviceName]; ok {
+		a.mClients.Unlock()
+		<-sc.chReady
+		return sc.client, sc.err
+	}
+	if len(a.serviceClients) >= a.conf.MaxServices {
+		if !a.isFullWarned {
+			a.isFullWarned = true
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("more than %d services, the logs of new ones are not routed", a.conf.MaxServices))
+		}
+		a.mClients.Unlock()
+		return a.uspClient, nil
+	}
+	sc := &serviceClient{
+		chReady: make(chan struct{}),
+	}
+	a.serviceClients[serviceName] = sc
+	a.mClients.Unlock()
+
+	// Connecting does not block the other services.
+	sc.client, sc.err = utils.NewAckedUSPClient(a.ctx, a.serviceClientOptions(serviceName), a.conf.Pipeline)
+	if sc.err != nil {
+		// The next request tries again.
+		a.mClients.Lock()
+		delete(a.serviceClients, serviceName)
+		a.mClients.Unlock()
+	} else {
+		a.conf.ClientOptions.DebugLog(fmt.Sprintf("routing the logs of service %s", serviceName))
+	}
+	close(sc.chReady)
+	return sc.client, sc.err
+}
+
+// serviceClientOptions returns the options of the client of a
+// service, a separate sensor with its own seed key.
+func (a *OTLPAdapter) serviceClientOptions(serviceName string) uspclient.ClientOptions {
+	opts := a.conf.ClientOptions
+	opts.Hostname = serviceName
+	opts.SensorSeedKey = a.conf.ClientOptions.SensorSeedKey + "/" + serviceName
+	return opts
+}
@@ -0,0 +1,237 @@
+package usp_otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/usp-adapters/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+)
+
+const testJSONRequest = `{
+	"resourceLogs": [{
+		"resource": {"attributes": [
+			{"key": "service.name", "value": {"stringValue": "checkout"}},
+			{"key": "host.name", "value": {"stringValue": "web-1"}}
+		]},
+		"scopeLogs": [{
+			"scope": {"name": "checkout.logger", "version": "1.2.0"},
+			"logRecords": [{
+				"timeUnixNano": "1704164645123456789",
+				"severityNumber": 17,
+				"severityText": "ERROR",
+				"body": {"stringValue": "payment failed"},
+				"attributes": [
+					{"key": "order.id", "value": {"intValue": "42"}},
+					{"key": "retry", "value": {"boolValue": true}},
+					{"key": "tags", "value": {"arrayValue": {"values": [{"stringValue": "a"}, {"doubleValue": 1.5}]}}}
+				],
+				"traceId": "5b8efff798038103d269b633813fc60c",
+				"spanId": "eee19b7ec3c1b174"
+			}, {
+				"observedTimeUnixNano": "1704164646000000000",
+				"body": {"kvlistValue": {"values": [{"key": "msg", "value": {"stringValue": "hi"}}]}}
+			}]
+		}]
+	}]
+}`
+
+func testRequest() *collogspb.ExportLogsServiceRequest {
+	str := func(s string) *commonpb.AnyValue {
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: s}}
+	}
+	return &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{{Key: "service.name", Value: str("billing")}}},
+			ScopeLogs: []*logspb.ScopeLogs{{
+				LogRecords: []*logspb.LogRecord{{TimeUnixNano: 1704164645000000000, Body: str("invoice sent")}},
+			}},
+		}},
+	}
+}
+
+func newTestAdapter(t *testing.T, conf OTLPConfig) *OTLPAdapter {
+	conf.ClientOptions = uspclient.ClientOptions{
+		TestSinkMode: true,
+		Hostname:     "otlp",
+		DebugLog:     func(msg string) {},
+		OnWarning:    func(msg string) {},
+		OnError:      func(err error) { t.Errorf("unexpected error: %v", err) },
+	}
+	if conf.HTTPPort == 0 && conf.GRPCPort == 0 {
+		conf.HTTPPort = 1
+	}
+	require.NoError(t, conf.Validate())
+	if conf.MaxServices == 0 {
+		conf.MaxServices = defaultMaxServices
+	}
+	c, err := utils.NewUSPClient(context.Background(), conf.ClientOptions, conf.Pipeline)
+	require.NoError(t, err)
+	return &OTLPAdapter{
+		conf:           conf,
+		ctx:            context.Background(),
+		uspClient:      c,
+		serviceClients: map[string]*serviceClient{},
+	}
+}
+
+func TestConvertJSON(t *testing.T) {
+	req, err := unmarshalJSONRequest([]byte(testJSONRequest))
+	require.NoError(t, err)
+	events := convertLogs(req)
+	require.Len(t, events, 2)
+
+	evt := events[0]
+	assert.Equal(t, "checkout", evt.serviceName)
+	assert.Equal(t, uint64(1704164645123), evt.timestampMs)
+	assert.Equal(t, map[string]interface{}{
+		"resource":        map[string]interface{}{"service.name": "checkout", "host.name": "web-1"},
+		"scope":           map[string]interface{}{"name": "checkout.logger", "version": "1.2.0"},
+		"time_unix_nano":  uint64(1704164645123456789),
+		"severity_number": int32(17),
+		"severity_text":   "ERROR",
+		"body":            "payment failed",
+		"attributes":      map[string]interface{}{"order.id": int64(42), "retry": true, "tags": []interface{}{"a", 1.5}},
+		"trace_id":        "5b8efff798038103d269b633813fc60c",
+		"span_id":         "eee19b7ec3c1b174",
+	}, evt.payload)
+
+	// Falls back to the observed time.
+	assert.Equal(t, uint64(1704164646000), events[1].timestampMs)
+	assert.Equal(t, map[string]interface{}{"msg": "hi"}, events[1].payload["body"])
+
+	_, err = unmarshalJSONRequest([]byte(`{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"traceId":"zz"}]}]}]}`))
+	assert.Error(t, err)
+}
+
+func TestHTTP(t *testing.T) {
+	a := newTestAdapter(t, OTLPConfig{})
+	post := func(contentType string, encoding string, body []byte) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, logsPath, bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		if encoding != "" {
+			r.Header.Set("Content-Encoding", encoding)
+		}
+		w := httptest.NewRecorder()
+		a.handleHTTP(w, r)
+		return w
+	}
+
+	w := post("application/json", "", []byte(testJSONRequest))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "{}", w.Body.String())
+
+	data, err := proto.Marshal(testRequest())
+	require.NoError(t, err)
+	w = post("application/x-protobuf", "", data)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/x-protobuf", w.Header().Get("Content-Type"))
+
+	gz := bytes.Buffer{}
+	gw := gzip.NewWriter(&gz)
+	gw.Write(data)
+	gw.Close()
+	assert.Equal(t, http.StatusOK, post("application/x-protobuf", "gzip", gz.Bytes()).Code)
+
+	assert.Equal(t, http.StatusBadRequest, post("application/x-protobuf", "", []byte("not protobuf")).Code)
+	assert.Equal(t, http.StatusBadRequest, post("application/json", "", []byte(`{"resourceLogs":`)).Code)
+	assert.Equal(t, http.StatusUnsupportedMediaType, post("text/plain", "", []byte("x")).Code)
+}
+
+func TestGRPC(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	a, chStopped, err := NewOTLPAdapter(context.Background(), OTLPConfig{
+		ClientOptions: uspclient.ClientOptions{
+			TestSinkMode: true,
+			DebugLog:     func(msg string) {},
+			OnWarning:    func(msg string) {},
+			OnError:      func(err error) { t.Errorf("unexpected error: %v", err) },
+		},
+		GRPCPort:  uint16(port),
+		Interface: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = collogspb.NewLogsServiceClient(conn).Export(ctx, testRequest())
+	require.NoError(t, err)
+
+	require.NoError(t, a.Close())
+	select {
+	case <-chStopped:
+	case <-time.After(10 * time.Second):
+		t.Error("adapter did not stop")
+	}
+}
+
+func TestRouteByServiceName(t *testing.T) {
+	a := newTestAdapter(t, OTLPConfig{IsRouteByServiceName: true, MaxServices: 2})
+	for _, service := range []string{"a", "b", "a", "c", ""} {
+		_, err := a.clientFor(service)
+		require.NoError(t, err)
+	}
+	assert.Len(t, a.serviceClients, 2)
+	c, err := a.clientFor("c")
+	require.NoError(t, err)
+	assert.Equal(t, a.uspClient, c)
+	c, err = a.clientFor("a")
+	require.NoError(t, err)
+	assert.Equal(t, a.serviceClients["a"].client, c)
+
+	// Concurrent requests of a service share its client.
+	a = newTestAdapter(t, OTLPConfig{IsRouteByServiceName: true})
+	clients := make([]*utils.USPClient, 10)
+	wg := sync.WaitGroup{}
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clients[i], _ = a.clientFor(fmt.Sprintf("service-%d", i%2))
+		}(i)
+	}
+	wg.Wait()
+	assert.Len(t, a.serviceClients, 2)
+	for i, c := range clients {
+		assert.Equal(t, a.serviceClients[fmt.Sprintf("service-%d", i%2)].client, c)
+	}
+
+	// Each service is a separate sensor.
+	a.conf.ClientOptions.SensorSeedKey = "otlp-seed"
+	opts := a.serviceClientOptions("checkout")
+	assert.Equal(t, "checkout", opts.Hostname)
+	assert.Equal(t, "otlp-seed/checkout", opts.SensorSeedKey)
+	assert.Equal(t, "otlp-seed", a.conf.ClientOptions.SensorSeedKey)
+
+	a = newTestAdapter(t, OTLPConfig{})
+	c, err = a.clientFor("a")
+	require.NoError(t, err)
+	assert.Equal(t, a.uspClient, c)
+
+	assert.Error(t, (&OTLPConfig{}).Validate())
+	assert.Error(t, (&OTLPConfig{HTTPPort: 4318, GRPCPort: 4318}).Validate())
+}
@@ -0,0 +1,186 @@
+package usp_otlp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const serviceNameAttribute = "service.name"
+
+// logEvent is a log record with the resource
+// and scope it was emitted by.
+type logEvent struct {
+	serviceName string
+	timestampMs uint64
+	payload     map[string]interface{}
+}
+
+// convertLogs flattens an export request into one
+// event per log record.
+func convertLogs(req *collogspb.ExportLogsServiceRequest) []logEvent {
+	events := []logEvent{}
+	for _, rl := range req.GetResourceLogs() {
+		resource := attributesToMap(rl.GetResource().GetAttributes())
+		serviceName, _ := resource[serviceNameAttribute].(string)
+		for _, sl := range rl.GetScopeLogs() {
+			scope := map[string]interface{}{}
+			if s := sl.GetScope(); s != nil {
+				if s.GetName() != "" {
+					scope["name"] = s.GetName()
+				}
+				if s.GetVersion() != "" {
+					scope["version"] = s.GetVersion()
+				}
+				if len(s.GetAttributes()) != 0 {
+					scope["attributes"] = attributesToMap(s.GetAttributes())
+				}
+			}
+			for _, lr := range sl.GetLogRecords() {
+				events = append(events, logEvent{
+					serviceName: serviceName,
+					timestampMs: recordTimestampMs(lr),
+					payload:     recordToMap(lr, resource, scope),
+				})
+			}
+		}
+	}
+	return events
+}
+
+func recordToMap(lr *logspb.LogRecord, resource map[string]interface{}, scope map[string]interface{}) map[string]interface{} {
+	m := map[string]interface{}{
+		"resource": resource,
+	}
+	if len(scope) != 0 {
+		m["scope"] = scope
+	}
+	if lr.GetTimeUnixNano() != 0 {
+		m["time_unix_nano"] = lr.GetTimeUnixNano()
+	}
+	if lr.GetObservedTimeUnixNano() != 0 {
+		m["observed_time_unix_nano"] = lr.GetObservedTimeUnixNano()
+	}
+	if lr.GetSeverityNumber() != logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED {
+		m["severity_number"] = int32(lr.GetSeverityNumber())
+	}
+	if lr.GetSeverityText() != "" {
+		m["severity_text"] = lr.GetSeverityText()
+	}
+	if lr.GetBody() != nil {
+		m["body"] = anyValueToInterface(lr.GetBody())
+	}
+	if len(lr.GetAttributes()) != 0 {
+		m["attributes"] = attributesToMap(lr.GetAttributes())
+	}
+	if len(lr.GetTraceId()) != 0 {
+		m["trace_id"] = hex.EncodeToString(lr.GetTraceId())
+	}
+	if len(lr.GetSpanId()) != 0 {
+		m["span_id"] = hex.EncodeToString(lr.GetSpanId())
+	}
+	if lr.GetFlags() != 0 {
+		m["flags"] = lr.GetFlags()
+	}
+	if lr.GetEventName() != "" {
+		m["event_name"] = lr.GetEventName()
+	}
+	return m
+}
+
+// recordTimestampMs returns the time of the event, or when
+// it was observed if the source did not have one.
+func recordTimestampMs(lr *logspb.LogRecord) uint64 {
+	if ts := lr.GetTimeUnixNano(); ts != 0 {
+		return ts / 1000000
+	}
+	return lr.GetObservedTimeUnixNano() / 1000000
+}
+
+func attributesToMap(attributes []*commonpb.KeyValue) map[string]interface{} {
+	m := make(map[string]interface{}, len(attributes))
+	for _, kv := range attributes {
+		m[kv.GetKey()] = anyValueToInterface(kv.GetValue())
+	}
+	return m
+}
+
+func anyValueToInterface(v *commonpb.AnyValue) interface{} {
+	switch val := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return val.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return val.BoolValue
+	case *commonpb.AnyValue_IntValue:
+		return val.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		return val.DoubleValue
+	case *commonpb.AnyValue_BytesValue:
+		return base64.StdEncoding.EncodeToString(val.BytesValue)
+	case *commonpb.AnyValue_ArrayValue:
+		l := make([]interface{}, 0, len(val.ArrayValue.GetValues()))
+		for _, e := range val.ArrayValue.GetValues() {
+			l = append(l, anyValueToInterface(e))
+		}
+		return l
+	case *commonpb.AnyValue_KvlistValue:
+		return attributesToMap(val.KvlistValue.GetValues())
+	}
+	return nil
+}
+
+// unmarshalJSONRequest decodes an OTLP/JSON request, where
+// unlike the protobuf JSON mapping the trace and span IDs
+// are hex rather than base64.
+func unmarshalJSONRequest(data []byte) (*collogspb.ExportLogsServiceRequest, error) {
+	raw := map[string]interface{}{}
+	// Numbers are kept as-is since timestamps can
+	// be larger than a float64 can represent.
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+	resourceLogs, _ := raw["resourceLogs"].([]interface{})
+	for _, rl := range resourceLogs {
+		rlm, _ := rl.(map[string]interface{})
+		scopeLogs, _ := rlm["scopeLogs"].([]interface{})
+		for _, sl := range scopeLogs {
+			slm, _ := sl.(map[string]interface{})
+			records, _ := slm["logRecords"].([]interface{})
+			for _, r := range records {
+				rm, ok := r.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				for _, k := range []string{"traceId", "spanId"} {
+					id, ok := rm[k].(string)
+					if !ok || id == "" {
+						continue
+					}
+					b, err := hex.DecodeString(id)
+					if err != nil {
+						return nil, fmt.Errorf("invalid %s: %v", k, err)
+					}
+					rm[k] = base64.StdEncoding.EncodeToString(b)
+				}
+			}
+		}
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	req := &collogspb.ExportLogsServiceRequest{}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal(data, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
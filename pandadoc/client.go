@@ -29,7 +29,7 @@ type opRequest struct {
 
 type PandaDocAdapter struct {
 	conf       PandaDocConfig
-	uspClient  *uspclient.Client
+	uspClient  *utils.USPClient
 	httpClient *http.Client
 
 	chStopped chan struct{}
@@ -44,6 +44,8 @@ type PandaDocAdapter struct {
 type PandaDocConfig struct {
 	ClientOptions uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
 	ApiKey        string                  `json:"api_key" yaml:"api_key"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *PandaDocConfig) Validate() error {
@@ -66,7 +68,7 @@ func NewPandaDocAdapter(ctx context.Context, conf PandaDocConfig) (*PandaDocAdap
 		dedupe: make(map[string]int64),
 	}
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -24,7 +24,7 @@ const (
 
 type ProofpointTapAdapter struct {
 	conf       ProofpointTapConfig
-	uspClient  *uspclient.Client
+	uspClient  *utils.USPClient
 	httpClient *http.Client
 
 	chStopped chan struct{}
@@ -39,6 +39,8 @@ type ProofpointTapConfig struct {
 	ClientOptions uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
 	Principal     string                  `json:"principal" yaml:"principal"`
 	Secret        string                  `json:"secret" yaml:"secret"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *ProofpointTapConfig) Validate() error {
@@ -67,7 +69,7 @@ func NewProofpointTapAdapter(ctx context.Context, conf ProofpointTapConfig) (*Pr
 	}
 	var err error
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
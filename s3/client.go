@@ -56,11 +56,9 @@ func (r connResetRetryer) ShouldRetry(req *request.Request) bool {
 	return false
 }
 
-const maxObjectSize = 1024 * 1024 * 100 // 100 MB
-
 type S3Adapter struct {
 	conf      S3Config
-	uspClient *uspclient.Client
+	uspClient *utils.USPClient
 
 	ctx context.Context
 
@@ -73,6 +71,9 @@ type S3Adapter struct {
 	wg     sync.WaitGroup
 
 	region string
+
+	memBudget    *utils.MemoryBudget
+	streamBudget *utils.MemoryBudget
 }
 
 type S3Config struct {
@@ -84,6 +85,9 @@ type S3Config struct {
 	Prefix        string                  `json:"prefix" yaml:"prefix"`
 	ParallelFetch int                     `json:"parallel_fetch" yaml:"parallel_fetch"`
 	Region        string                  `json:"region" yaml:"region"`
+	MaxMemoryMB   int                     `json:"max_memory_mb,omitempty" yaml:"max_memory_mb,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *S3Config) Validate() error {
@@ -106,6 +110,8 @@ type s3LocalFile struct {
 	Obj          *s3Record
 	Data         []byte
 	IsCompressed bool
+	IsStreamed   bool
+	Reserved     int64
 	Err          error
 }
 
@@ -118,10 +124,16 @@ func NewS3Adapter(ctx context.Context, conf S3Config) (*S3Adapter, chan struct{}
 	if conf.ParallelFetch <= 0 {
 		conf.ParallelFetch = 1
 	}
+	if conf.MaxMemoryMB <= 0 {
+		conf.MaxMemoryMB = utils.DefaultMaxMemoryMB
+	}
 	a := &S3Adapter{
 		conf: conf,
 		ctx:  ctx,
 	}
+	// One chunk per fetcher, plus a budget for the
+	// file currently being streamed and shipped.
+	a.memBudget, a.streamBudget = utils.NewFetchMemoryBudgets(int64(conf.MaxMemoryMB)*1024*1024, conf.ParallelFetch)
 
 	var err error
 	var region string
@@ -175,7 +187,7 @@ func NewS3Adapter(ctx context.Context, conf S3Config) (*S3Adapter, chan struct{}
 	a.awsS3 = s3.New(a.awsSession)
 	a.awsDownloader = s3manager.NewDownloader(a.awsSession)
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewBundleUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -310,24 +322,34 @@ func (a *S3Adapter) lookForFiles() (bool, error) {
 	}, a.conf.ParallelFetch, func(e utils.Element) utils.Element {
 		item := e.(*s3Record)
 
-		if item.Size > maxObjectSize {
-			a.conf.ClientOptions.OnWarning(fmt.Sprintf("file %s too large (%d)", item.Key, item.Size))
+		isCompressed := false
+
+		if strings.HasSuffix(item.Key, ".gz") {
+			isCompressed = true
+		}
+
+		if item.Size > a.memBudget.ChunkSize() {
+			// Too large to be held in memory, it will
+			// be streamed in chunks when its turn comes.
 			return &s3LocalFile{
-				Obj:  item,
-				Data: nil,
-				Err:  fmt.Errorf("file too large"),
+				Obj:          item,
+				IsCompressed: isCompressed,
+				IsStreamed:   true,
 			}
 		}
 
+		reserved := a.memBudget.Acquire(item.Size)
+
 		startTime := time.Now().UTC()
 		a.conf.ClientOptions.DebugLog(fmt.Sprintf("downloading file %s (%d)", item.Key, item.Size))
 
-		writerAt := aws.NewWriteAtBuffer([]byte{})
+		writerAt := aws.NewWriteAtBuffer(make([]byte, 0, item.Size))
 
 		if _, err := a.awsDownloader.Download(writerAt, &s3.GetObjectInput{
 			Bucket: aws.String(a.conf.BucketName),
 			Key:    aws.String(item.Key),
 		}); err != nil {
+			a.memBudget.Release(reserved)
 			a.conf.ClientOptions.OnError(fmt.Errorf("s3.Download() @ %s: %v", a.region, err))
 			return &s3LocalFile{
 				Obj:  item,
@@ -336,18 +358,13 @@ func (a *S3Adapter) lookForFiles() (bool, error) {
 			}
 		}
 
-		isCompressed := false
-
-		if strings.HasSuffix(item.Key, ".gz") {
-			isCompressed = true
-		}
-
 		a.conf.ClientOptions.DebugLog(fmt.Sprintf("file %s downloaded in %v (%d)", item.Key, time.Since(startTime), item.Size))
 
 		return &s3LocalFile{
 			Obj:          item,
 			Data:         writerAt.Bytes(),
 			IsCompressed: isCompressed,
+			Reserved:     reserved,
 		}
 	})
 
@@ -385,7 +402,15 @@ func (a *S3Adapter) lookForFiles() (bool, error) {
 
 		startTime := time.Now().UTC()
 
-		if !a.processEvent(localFile.Data, localFile.IsCompressed) {
+		var isProcessed bool
+		if localFile.IsStreamed {
+			isProcessed = a.streamFile(localFile)
+		} else {
+			isProcessed = a.processEvent(localFile.Data, localFile.IsCompressed)
+			localFile.Data = nil
+			a.memBudget.Release(localFile.Reserved)
+		}
+		if !isProcessed {
 			a.conf.ClientOptions.OnWarning(fmt.Sprintf("file %s NOT processed in %v (%d)", localFile.Obj.Key, time.Since(startTime), localFile.Obj.Size))
 			continue
 		}
@@ -440,6 +465,42 @@ func (a *S3Adapter) lookForFiles() (bool, error) {
 	return isDataFound, err
 }
 
+// streamFile downloads a large file and ships it in chunks
+// as it goes so that it never has to be fully held in memory.
+func (a *S3Adapter) streamFile(localFile *s3LocalFile) bool {
+	startTime := time.Now().UTC()
+	a.conf.ClientOptions.DebugLog(fmt.Sprintf("streaming file %s (%d)", localFile.Obj.Key, localFile.Obj.Size))
+
+	resp, err := a.awsS3.GetObjectWithContext(a.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(a.conf.BucketName),
+		Key:    aws.String(localFile.Obj.Key),
+	})
+	if err != nil {
+		a.conf.ClientOptions.OnError(fmt.Errorf("s3.GetObject() @ %s: %v", a.region, err))
+		return false
+	}
+	defer resp.Body.Close()
+
+	chunker := utils.ChunkStream
+	if localFile.IsCompressed {
+		chunker = utils.ChunkCompressedStream
+	}
+	nChunks := 0
+	if err := chunker(resp.Body, a.streamBudget, func(chunk []byte) error {
+		nChunks++
+		if !a.processEvent(chunk, false) {
+			return errors.New("failed to ship chunk")
+		}
+		return nil
+	}); err != nil {
+		a.conf.ClientOptions.OnError(fmt.Errorf("streaming %s: %v", localFile.Obj.Key, err))
+		return false
+	}
+
+	a.conf.ClientOptions.DebugLog(fmt.Sprintf("file %s streamed in %v (%d chunks)", localFile.Obj.Key, time.Since(startTime), nChunks))
+	return true
+}
+
 func (a *S3Adapter) processEvent(data []byte, isCompressed bool) bool {
 	// Since we're dealing with files, we use the
 	// bundle payloads to avoid having to go through
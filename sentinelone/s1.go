@@ -64,7 +64,7 @@ func isTransientError(err error) bool {
 
 type SentinelOneAdapter struct {
 	conf       SentinelOneConfig
-	uspClient  *uspclient.Client
+	uspClient  *utils.USPClient
 	httpClient *http.Client
 	s1Client   *SentinelOneClient
 	urls       []string
@@ -86,6 +86,8 @@ type SentinelOneConfig struct {
 	RetryBaseDelay      time.Duration           `json:"retry_base_delay" yaml:"retry_base_delay"`
 	MaxRetryDelay       time.Duration           `json:"max_retry_delay" yaml:"max_retry_delay"`
 	MaxRetryAttempts    int                     `json:"max_retry_attempts" yaml:"max_retry_attempts"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *SentinelOneConfig) Validate() error {
@@ -140,7 +142,7 @@ func NewSentinelOneAdapter(ctx context.Context, conf SentinelOneConfig) (*Sentin
 	}
 
 	var err error
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1,11 +1,17 @@
 package usp_simulator
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,18 +24,27 @@ import (
 const (
 	defaultWriteTimeout = 60 * 10
 	sleepDelta          = 1 * time.Second
+	tsFormat            = "2006-01-02 15:04:05"
 )
 
 type SimulatorAdapter struct {
 	conf         SimulatorConfig
 	wg           sync.WaitGroup
 	isRunning    uint32
-	uspClient    *uspclient.Client
+	uspClient    *utils.USPClient
 	writeTimeout time.Duration
-	dataReader   io.ReadCloser
+	filePaths    []string
+
+	mReader    sync.Mutex
+	dataReader io.ReadCloser
 
 	lastEventTime int64
 	lastSentTime  int64
+
+	// Used to rewrite timestamps relative
+	// to the start of the current loop.
+	loopStartTime      int64
+	loopFirstEventTime int64
 }
 
 type SimulatorConfig struct {
@@ -37,6 +52,22 @@ type SimulatorConfig struct {
 	Reader         io.ReadCloser           `json:"-" yaml:"-"`
 	FilePath       string                  `json:"file_path" yaml:"file_path"`
 	IsReplayTiming bool                    `json:"is_replay_timing" yaml:"is_replay_timing"`
+
+	// Directory of capture files replayed in name order,
+	// files ending in .gz are decompressed.
+	DirectoryPath string `json:"directory_path,omitempty" yaml:"directory_path,omitempty"`
+	// Multiplier applied to the replay timing, 2 replays
+	// twice as fast, 0.5 at half speed. 0 is real time.
+	Speed float64 `json:"speed,omitempty" yaml:"speed,omitempty"`
+	// Number of times the captures are replayed, -1 loops forever.
+	LoopCount int `json:"loop_count,omitempty" yaml:"loop_count,omitempty"`
+	// Rewrite routing.event_time and ts so replayed events appear current.
+	IsRewriteTimestamps bool `json:"is_rewrite_timestamps,omitempty" yaml:"is_rewrite_timestamps,omitempty"`
+
+	// Generate synthetic events from templates instead of replaying.
+	Generator *GeneratorConfig `json:"generator,omitempty" yaml:"generator,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 type basicLCEvent struct {
@@ -49,6 +80,31 @@ func (c *SimulatorConfig) Validate() error {
 	if err := c.ClientOptions.Validate(); err != nil {
 		return fmt.Errorf("client_options: %v", err)
 	}
+	if c.Generator != nil {
+		if c.FilePath != "" || c.DirectoryPath != "" {
+			return errors.New("generator cannot be used with file_path or directory_path")
+		}
+		if err := c.Generator.Validate(); err != nil {
+			return fmt.Errorf("generator: %v", err)
+		}
+		return nil
+	}
+	return c.validateReplay()
+}
+
+func (c *SimulatorConfig) validateReplay() error {
+	if c.FilePath != "" && c.DirectoryPath != "" {
+		return errors.New("only one of file_path or directory_path can be set")
+	}
+	if c.Speed < 0 {
+		return fmt.Errorf("invalid speed: %v", c.Speed)
+	}
+	if c.LoopCount < -1 {
+		return fmt.Errorf("invalid loop_count: %d", c.LoopCount)
+	}
+	if c.FilePath == "" && c.DirectoryPath == "" && c.Reader != nil && (c.LoopCount < 0 || c.LoopCount > 1) {
+		return errors.New("looping requires a file_path or directory_path")
+	}
 	return nil
 }
 
@@ -60,18 +116,38 @@ func NewSimulatorAdapter(ctx context.Context, conf SimulatorConfig) (*SimulatorA
 
 	a.writeTimeout = defaultWriteTimeout
 
-	if conf.FilePath != "" {
-		f, err := os.Open(conf.FilePath)
+	var generator *eventGenerator
+	if conf.Generator != nil {
+		if conf.FilePath != "" || conf.DirectoryPath != "" {
+			return nil, nil, errors.New("generator cannot be used with file_path or directory_path")
+		}
+		var err error
+		generator, err = newEventGenerator(*conf.Generator)
+		if err != nil {
+			return nil, nil, fmt.Errorf("generator: %v", err)
+		}
+	} else if err := conf.validateReplay(); err != nil {
+		return nil, nil, err
+	} else if conf.FilePath != "" {
+		if _, err := os.Stat(conf.FilePath); err != nil {
+			return nil, nil, err
+		}
+		a.filePaths = []string{conf.FilePath}
+	} else if conf.DirectoryPath != "" {
+		var err error
+		a.filePaths, err = listCaptureFiles(conf.DirectoryPath)
 		if err != nil {
 			return nil, nil, err
 		}
-		a.dataReader = f
-	} else {
-		a.dataReader = conf.Reader
+		if len(a.filePaths) == 0 {
+			return nil, nil, fmt.Errorf("no files found in %s", conf.DirectoryPath)
+		}
+	} else if conf.Reader == nil {
+		return nil, nil, errors.New("file_path, directory_path or reader required")
 	}
 
 	var err error
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -81,6 +157,10 @@ func NewSimulatorAdapter(ctx context.Context, conf SimulatorConfig) (*SimulatorA
 	go func() {
 		defer a.wg.Done()
 		defer close(chStopped)
+		if generator != nil {
+			a.handleGenerator(generator)
+			return
+		}
 		a.handleInput()
 	}()
 
@@ -90,7 +170,11 @@ func NewSimulatorAdapter(ctx context.Context, conf SimulatorConfig) (*SimulatorA
 func (a *SimulatorAdapter) Close() error {
 	a.conf.ClientOptions.DebugLog("closing")
 	atomic.StoreUint32(&a.isRunning, 0)
-	a.dataReader.Close()
+	a.mReader.Lock()
+	if a.dataReader != nil {
+		a.dataReader.Close()
+	}
+	a.mReader.Unlock()
 	a.wg.Wait()
 	err1 := a.uspClient.Drain(1 * time.Minute)
 	_, err2 := a.uspClient.Close()
@@ -102,7 +186,108 @@ func (a *SimulatorAdapter) Close() error {
 	return err2
 }
 
+func listCaptureFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		files = append(files, filepath.Join(dir, e.Name()))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
+
+func openCaptureFile(filePath string) (io.ReadCloser, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(filePath, ".gz") {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &gzipFile{gz, f}, nil
+}
+
 func (a *SimulatorAdapter) handleInput() {
+	for loop := 0; a.conf.LoopCount < 0 || loop < a.conf.LoopCount || loop == 0; loop++ {
+		if atomic.LoadUint32(&a.isRunning) != 1 {
+			return
+		}
+		if loop != 0 {
+			a.conf.ClientOptions.DebugLog(fmt.Sprintf("starting replay loop %d", loop+1))
+		}
+
+		// Each loop replays the captures from the
+		// beginning as if it was the first time.
+		a.lastEventTime = 0
+		a.lastSentTime = 0
+		a.loopStartTime = time.Now().UnixMilli()
+		a.loopFirstEventTime = 0
+
+		if len(a.filePaths) == 0 {
+			a.replayReader(a.conf.Reader)
+			return
+		}
+
+		nOpened := 0
+		for _, filePath := range a.filePaths {
+			r, err := openCaptureFile(filePath)
+			if err != nil {
+				a.conf.ClientOptions.OnError(fmt.Errorf("open(%s): %v", filePath, err))
+				continue
+			}
+			nOpened++
+			if !a.replayReader(r) {
+				return
+			}
+		}
+		if nOpened == 0 {
+			// Avoid spinning on captures that are all gone.
+			a.conf.ClientOptions.OnError(errors.New("no capture file could be opened"))
+			return
+		}
+	}
+}
+
+// replayReader ships all the lines from the reader and
+// closes it, it returns false if the adapter is stopping.
+func (a *SimulatorAdapter) replayReader(r io.ReadCloser) bool {
+	a.mReader.Lock()
+	if atomic.LoadUint32(&a.isRunning) != 1 {
+		a.mReader.Unlock()
+		r.Close()
+		return false
+	}
+	a.dataReader = r
+	a.mReader.Unlock()
+
+	defer func() {
+		a.mReader.Lock()
+		a.dataReader = nil
+		a.mReader.Unlock()
+		r.Close()
+	}()
+
 	readBufferSize := 1024 * 16
 	st := utils.StreamTokenizer{
 		ExpectedSize: readBufferSize * 2,
@@ -111,12 +296,14 @@ func (a *SimulatorAdapter) handleInput() {
 
 	readBuffer := make([]byte, readBufferSize)
 	for atomic.LoadUint32(&a.isRunning) == 1 {
-		sizeRead, err := a.dataReader.Read(readBuffer)
-		if err != nil {
-			if err != io.EOF {
+		sizeRead, err := r.Read(readBuffer)
+		if sizeRead == 0 && err != nil {
+			if err != io.EOF && atomic.LoadUint32(&a.isRunning) == 1 {
 				a.conf.ClientOptions.OnError(fmt.Errorf("io.Read(): %v", err))
 			}
-			return
+			// Flush a last line without a trailing newline.
+			a.handleLine(st.Flush())
+			return atomic.LoadUint32(&a.isRunning) == 1
 		}
 
 		data := readBuffer[:sizeRead]
@@ -129,6 +316,7 @@ func (a *SimulatorAdapter) handleInput() {
 			a.handleLine(chunk)
 		}
 	}
+	return false
 }
 
 func (a *SimulatorAdapter) handleLine(line []byte) {
@@ -141,7 +329,15 @@ func (a *SimulatorAdapter) handleLine(line []byte) {
 	if a.conf.IsReplayTiming {
 		a.replayTimedEvent(line)
 	}
+	if a.conf.IsRewriteTimestamps {
+		if rewritten, ok := a.rewriteTimestamps(line); ok {
+			line = rewritten
+		}
+	}
+	a.shipLine(line)
+}
 
+func (a *SimulatorAdapter) shipLine(line []byte) {
 	msg := &protocol.DataMessage{
 		TextPayload: string(line),
 		TimestampMs: uint64(time.Now().UnixNano() / int64(time.Millisecond)),
@@ -166,6 +362,9 @@ func (a *SimulatorAdapter) replayTimedEvent(line []byte) bool {
 		return false
 	}
 	evtDelta := evt.Routing.EventTime - a.lastEventTime
+	if a.lastEventTime != 0 && a.conf.Speed > 0 {
+		evtDelta = int64(float64(evtDelta) / a.conf.Speed)
+	}
 	now := time.Now().UnixMilli()
 	clockDelta := now - a.lastSentTime
 	if clockDelta < evtDelta {
@@ -181,6 +380,45 @@ func (a *SimulatorAdapter) replayTimedEvent(line []byte) bool {
 		}
 	}
 	a.lastEventTime = evt.Routing.EventTime
-	a.lastSentTime = now
+	// The time spent sleeping counts toward the next delta.
+	a.lastSentTime = time.Now().UnixMilli()
 	return true
 }
+
+// rewriteTimestamps moves the event times of the line to
+// the present, keeping the relative spacing between events
+// of the same loop when the timing is replayed.
+func (a *SimulatorAdapter) rewriteTimestamps(line []byte) ([]byte, bool) {
+	evt := map[string]interface{}{}
+	d := json.NewDecoder(bytes.NewReader(line))
+	d.UseNumber()
+	if err := d.Decode(&evt); err != nil {
+		return nil, false
+	}
+	routing, ok := evt["routing"].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	newTime := time.Now().UnixMilli()
+	if n, ok := routing["event_time"].(json.Number); ok && a.conf.IsReplayTiming {
+		if eventTime, err := n.Int64(); err == nil {
+			if a.loopFirstEventTime == 0 {
+				a.loopFirstEventTime = eventTime
+			}
+			offset := eventTime - a.loopFirstEventTime
+			if a.conf.Speed > 0 {
+				offset = int64(float64(offset) / a.conf.Speed)
+			}
+			newTime = a.loopStartTime + offset
+		}
+	}
+	routing["event_time"] = newTime
+	if _, ok := evt["ts"]; ok {
+		evt["ts"] = time.UnixMilli(newTime).UTC().Format(tsFormat)
+	}
+	rewritten, err := json.Marshal(evt)
+	if err != nil {
+		return nil, false
+	}
+	return rewritten, true
+}
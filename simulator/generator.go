@@ -0,0 +1,240 @@
+package usp_simulator
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	generatorTickInterval = 10 * time.Millisecond
+)
+
+var defaultUsernames = []string{
+	"alice", "bob", "carol", "dave", "eve", "mallory", "trent", "peggy", "victor", "admin", "root", "svc_backup",
+}
+
+// GeneratorConfig produces synthetic events from templates
+// instead of replaying captured events.
+type GeneratorConfig struct {
+	// Events per second generated across all templates.
+	EPS float64 `json:"eps" yaml:"eps"`
+	// Stop after this many events, 0 generates forever.
+	MaxEvents uint64          `json:"max_events,omitempty" yaml:"max_events,omitempty"`
+	Templates []EventTemplate `json:"templates" yaml:"templates"`
+	// Usernames picked by randUser, a default list is used if empty.
+	Usernames []string `json:"usernames,omitempty" yaml:"usernames,omitempty"`
+	// Seed of the random generator, 0 uses the current time.
+	Seed int64 `json:"seed,omitempty" yaml:"seed,omitempty"`
+}
+
+// EventTemplate is a Go text/template rendering one event,
+// templates are picked proportionally to their weight.
+type EventTemplate struct {
+	Template string `json:"template" yaml:"template"`
+	Weight   int    `json:"weight,omitempty" yaml:"weight,omitempty"`
+}
+
+func (c *GeneratorConfig) Validate() error {
+	if c.EPS <= 0 {
+		return errors.New("eps must be positive")
+	}
+	if len(c.Templates) == 0 {
+		return errors.New("at least one template required")
+	}
+	for i, t := range c.Templates {
+		if t.Weight < 0 {
+			return fmt.Errorf("template %d: negative weight", i)
+		}
+	}
+	return nil
+}
+
+type eventGenerator struct {
+	conf      GeneratorConfig
+	rnd       *rand.Rand
+	templates []*template.Template
+	weights   []int
+	total     int
+	buf       bytes.Buffer
+}
+
+func newEventGenerator(conf GeneratorConfig) (*eventGenerator, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	seed := conf.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	if len(conf.Usernames) == 0 {
+		conf.Usernames = defaultUsernames
+	}
+	g := &eventGenerator{
+		conf: conf,
+		rnd:  rand.New(rand.NewSource(seed)),
+	}
+	for i, t := range conf.Templates {
+		tmpl, err := template.New(fmt.Sprintf("template_%d", i)).Funcs(g.funcs()).Parse(t.Template)
+		if err != nil {
+			return nil, fmt.Errorf("template %d: %v", i, err)
+		}
+		w := t.Weight
+		if w == 0 {
+			w = 1
+		}
+		g.templates = append(g.templates, tmpl)
+		g.weights = append(g.weights, w)
+		g.total += w
+	}
+	return g, nil
+}
+
+func (g *eventGenerator) funcs() template.FuncMap {
+	return template.FuncMap{
+		"randIP":        g.randIP,
+		"randPrivateIP": g.randPrivateIP,
+		"randUser":      func() string { return g.conf.Usernames[g.rnd.Intn(len(g.conf.Usernames))] },
+		"randMD5":       func() string { return g.randHex(16) },
+		"randSHA1":      func() string { return g.randHex(20) },
+		"randSHA256":    func() string { return g.randHex(32) },
+		"randUUID": func() string {
+			u := uuid.UUID{}
+			g.rnd.Read(u[:])
+			u[6] = (u[6] & 0x0f) | 0x40
+			u[8] = (u[8] & 0x3f) | 0x80
+			return u.String()
+		},
+		"randInt": func(min int, max int) int {
+			if max <= min {
+				return min
+			}
+			return min + g.rnd.Intn(max-min+1)
+		},
+		"choice": func(options ...string) string {
+			if len(options) == 0 {
+				return ""
+			}
+			return options[g.rnd.Intn(len(options))]
+		},
+		"weighted": g.weighted,
+		"nowMs":    func() int64 { return time.Now().UnixMilli() },
+		"now": func(layout string) string {
+			return time.Now().UTC().Format(layout)
+		},
+		// Timestamps in the recent past, up to the given number of seconds ago.
+		"pastMs": func(maxSec int) int64 {
+			return time.Now().UnixMilli() - g.rnd.Int63n(int64(maxSec)*1000+1)
+		},
+	}
+}
+
+func (g *eventGenerator) randIP() string {
+	for {
+		ip := [4]byte{}
+		g.rnd.Read(ip[:])
+		// Skip the reserved, private and multicast ranges.
+		if ip[0] == 0 || ip[0] == 10 || ip[0] == 127 || ip[0] >= 224 ||
+			(ip[0] == 169 && ip[1] == 254) ||
+			(ip[0] == 172 && ip[1]&0xf0 == 16) ||
+			(ip[0] == 192 && ip[1] == 168) ||
+			(ip[0] == 100 && ip[1]&0xc0 == 64) {
+			continue
+		}
+		return fmt.Sprintf("%d.%d.%d.%d", ip[0], ip[1], ip[2], ip[3])
+	}
+}
+
+func (g *eventGenerator) randPrivateIP() string {
+	switch g.rnd.Intn(3) {
+	case 0:
+		return fmt.Sprintf("10.%d.%d.%d", g.rnd.Intn(256), g.rnd.Intn(256), 1+g.rnd.Intn(254))
+	case 1:
+		return fmt.Sprintf("172.%d.%d.%d", 16+g.rnd.Intn(16), g.rnd.Intn(256), 1+g.rnd.Intn(254))
+	default:
+		return fmt.Sprintf("192.168.%d.%d", g.rnd.Intn(256), 1+g.rnd.Intn(254))
+	}
+}
+
+func (g *eventGenerator) randHex(size int) string {
+	b := make([]byte, size)
+	g.rnd.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// weighted takes pairs of value and weight: weighted "GET" 80 "POST" 20
+func (g *eventGenerator) weighted(pairs ...interface{}) (string, error) {
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return "", errors.New("weighted expects value and weight pairs")
+	}
+	total := 0
+	for i := 1; i < len(pairs); i += 2 {
+		w, ok := pairs[i].(int)
+		if !ok || w < 0 {
+			return "", fmt.Errorf("invalid weight: %v", pairs[i])
+		}
+		total += w
+	}
+	if total == 0 {
+		return "", errors.New("weights sum to 0")
+	}
+	n := g.rnd.Intn(total)
+	for i := 0; i < len(pairs); i += 2 {
+		w := pairs[i+1].(int)
+		if n < w {
+			return fmt.Sprint(pairs[i]), nil
+		}
+		n -= w
+	}
+	return "", nil
+}
+
+func (g *eventGenerator) next() ([]byte, error) {
+	n := g.rnd.Intn(g.total)
+	tmpl := g.templates[0]
+	for i, w := range g.weights {
+		if n < w {
+			tmpl = g.templates[i]
+			break
+		}
+		n -= w
+	}
+	g.buf.Reset()
+	if err := tmpl.Execute(&g.buf, nil); err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimSpace(g.buf.String())), nil
+}
+
+func (a *SimulatorAdapter) handleGenerator(g *eventGenerator) {
+	start := time.Now()
+	sent := uint64(0)
+	for atomic.LoadUint32(&a.isRunning) == 1 {
+		// Generate whatever is due to keep up with the
+		// rate, this keeps high EPS from sleeping per event.
+		due := uint64(time.Since(start).Seconds() * g.conf.EPS)
+		if g.conf.MaxEvents != 0 && due > g.conf.MaxEvents {
+			due = g.conf.MaxEvents
+		}
+		for ; sent < due && atomic.LoadUint32(&a.isRunning) == 1; sent++ {
+			evt, err := g.next()
+			if err != nil {
+				a.conf.ClientOptions.OnError(fmt.Errorf("template: %v", err))
+				continue
+			}
+			a.shipLine(evt)
+		}
+		if g.conf.MaxEvents != 0 && sent >= g.conf.MaxEvents {
+			return
+		}
+		time.Sleep(generatorTickInterval)
+	}
+}
@@ -0,0 +1,152 @@
+package usp_simulator
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+)
+
+func TestGeneratorTemplates(t *testing.T) {
+	g, err := newEventGenerator(GeneratorConfig{
+		EPS:       1,
+		Seed:      42,
+		Usernames: []string{"jdoe"},
+		Templates: []EventTemplate{{
+			Template: `{"src": "{{ randIP }}", "dst": "{{ randPrivateIP }}", "user": "{{ randUser }}", "md5": "{{ randMD5 }}", "sha1": "{{ randSHA1 }}", "sha256": "{{ randSHA256 }}", "id": "{{ randUUID }}", "port": {{ randInt 1024 1030 }}, "method": "{{ weighted "GET" 1 "POST" 0 }}", "proto": "{{ choice "tcp" }}", "ts": {{ nowMs }}, "past": {{ pastMs 60 }}}`,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		out, err := g.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		evt := struct {
+			Src    string `json:"src"`
+			Dst    string `json:"dst"`
+			User   string `json:"user"`
+			MD5    string `json:"md5"`
+			SHA1   string `json:"sha1"`
+			SHA256 string `json:"sha256"`
+			ID     string `json:"id"`
+			Port   int    `json:"port"`
+			Method string `json:"method"`
+			Proto  string `json:"proto"`
+			TS     int64  `json:"ts"`
+			Past   int64  `json:"past"`
+		}{}
+		if err := json.Unmarshal(out, &evt); err != nil {
+			t.Fatalf("invalid json %s: %v", out, err)
+		}
+		if ip := net.ParseIP(evt.Src); ip == nil || ip.IsPrivate() || ip.IsLoopback() {
+			t.Errorf("unexpected public ip: %s", evt.Src)
+		}
+		if ip := net.ParseIP(evt.Dst); ip == nil || !ip.IsPrivate() {
+			t.Errorf("unexpected private ip: %s", evt.Dst)
+		}
+		if evt.User != "jdoe" || evt.Method != "GET" || evt.Proto != "tcp" {
+			t.Errorf("unexpected values: %s", out)
+		}
+		if len(evt.MD5) != 32 || len(evt.SHA1) != 40 || len(evt.SHA256) != 64 {
+			t.Errorf("unexpected hashes: %s", out)
+		}
+		if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(evt.ID) {
+			t.Errorf("unexpected uuid: %s", evt.ID)
+		}
+		if evt.Port < 1024 || evt.Port > 1030 {
+			t.Errorf("unexpected port: %d", evt.Port)
+		}
+		if evt.Past > evt.TS || evt.TS-evt.Past > 60*1000 {
+			t.Errorf("unexpected past timestamp: %d", evt.Past)
+		}
+	}
+
+	// The same seed generates the same events.
+	g1, _ := newEventGenerator(GeneratorConfig{EPS: 1, Seed: 7, Templates: []EventTemplate{{Template: `{{ randSHA256 }}`}}})
+	g2, _ := newEventGenerator(GeneratorConfig{EPS: 1, Seed: 7, Templates: []EventTemplate{{Template: `{{ randSHA256 }}`}}})
+	e1, _ := g1.next()
+	e2, _ := g2.next()
+	if string(e1) != string(e2) {
+		t.Errorf("seeded generators differ: %s != %s", e1, e2)
+	}
+}
+
+func TestGeneratorWeights(t *testing.T) {
+	g, err := newEventGenerator(GeneratorConfig{
+		EPS:  1,
+		Seed: 1,
+		Templates: []EventTemplate{
+			{Template: "a", Weight: 9},
+			{Template: "b", Weight: 1},
+			{Template: "c", Weight: 0},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for i := 0; i < 11000; i++ {
+		out, err := g.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[string(out)]++
+	}
+	// A weight of 0 defaults to 1.
+	if counts["a"] < 8500 || counts["b"] < 700 || counts["c"] < 700 {
+		t.Errorf("unexpected distribution: %v", counts)
+	}
+
+	if _, err := g.weighted("x", "y"); err == nil {
+		t.Error("invalid weight should fail")
+	}
+	if _, err := newEventGenerator(GeneratorConfig{EPS: 1, Templates: []EventTemplate{{Template: "{{ unknown }}"}}}); err == nil {
+		t.Error("invalid template should fail")
+	}
+	if _, err := newEventGenerator(GeneratorConfig{Templates: []EventTemplate{{Template: "a"}}}); err == nil {
+		t.Error("missing eps should fail")
+	}
+}
+
+func TestGeneratorRate(t *testing.T) {
+	errs := []error{}
+	start := time.Now()
+	a, chStopped, err := NewSimulatorAdapter(context.Background(), SimulatorConfig{
+		ClientOptions: uspclient.ClientOptions{
+			TestSinkMode: true,
+			DebugLog:     func(msg string) {},
+			OnWarning:    func(msg string) {},
+			OnError:      func(err error) { errs = append(errs, err) },
+		},
+		Generator: &GeneratorConfig{
+			EPS:       100,
+			MaxEvents: 50,
+			Templates: []EventTemplate{{Template: `{"user": "{{ randUser }}"}`}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-chStopped:
+	case <-time.After(10 * time.Second):
+		t.Error("generator did not stop")
+	}
+	elapsed := time.Since(start)
+	a.Close()
+	if len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	// 50 events at 100 EPS.
+	if elapsed < 450*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("unexpected generation duration: %v", elapsed)
+	}
+}
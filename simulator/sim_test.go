@@ -1,6 +1,17 @@
 package usp_simulator
 
-import "testing"
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+)
 
 func TestSim(t *testing.T) {
 	lines := []string{
@@ -19,3 +30,104 @@ func TestSim(t *testing.T) {
 		}
 	}
 }
+
+func TestReplaySpeed(t *testing.T) {
+	a := SimulatorAdapter{isRunning: 1}
+	a.conf.Speed = 10
+	start := time.Now()
+	for _, eventTime := range []int64{1662775559000, 1662775560000, 1662775561000} {
+		line := fmt.Sprintf(`{"routing": {"event_time": %d}}`, eventTime)
+		if !a.replayTimedEvent([]byte(line)) {
+			t.Errorf("event not replayed: %s", line)
+		}
+	}
+	// 2 seconds of events at 10x.
+	elapsed := time.Since(start)
+	if elapsed < 150*time.Millisecond || elapsed > 1*time.Second {
+		t.Errorf("unexpected replay duration: %v", elapsed)
+	}
+}
+
+func TestRewriteTimestamps(t *testing.T) {
+	a := SimulatorAdapter{}
+	a.conf.IsReplayTiming = true
+	a.conf.Speed = 2
+	a.loopStartTime = 1700000000000
+
+	out, ok := a.rewriteTimestamps([]byte(`{"event": {"n": 12345678901234}, "routing": {"event_time": 1662775559000}, "ts": "2022-09-10 02:05:59"}`))
+	if !ok {
+		t.Fatal("rewrite failed")
+	}
+	expected := `{"event":{"n":12345678901234},"routing":{"event_time":1700000000000},"ts":"2023-11-14 22:13:20"}`
+	if string(out) != expected {
+		t.Errorf("unexpected rewrite: %s != %s", out, expected)
+	}
+
+	out, ok = a.rewriteTimestamps([]byte(`{"routing": {"event_time": 1662775561000}}`))
+	if !ok {
+		t.Fatal("rewrite failed")
+	}
+	expected = `{"routing":{"event_time":1700000001000}}`
+	if string(out) != expected {
+		t.Errorf("unexpected rewrite: %s != %s", out, expected)
+	}
+
+	if _, ok := a.rewriteTimestamps([]byte(`not json`)); ok {
+		t.Error("non-json line should not be rewritten")
+	}
+}
+
+func TestReplayDirectoryLoop(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "1.json"), []byte("{\"routing\": {\"event_time\": 1}}\n{\"routing\": {\"event_time\": 2}}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	compressed := bytes.Buffer{}
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("{\"routing\": {\"event_time\": 3}}"))
+	gz.Close()
+	if err := os.WriteFile(filepath.Join(dir, "2.json.gz"), compressed.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := listCaptureFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || filepath.Base(files[0]) != "1.json" || filepath.Base(files[1]) != "2.json.gz" {
+		t.Errorf("unexpected files: %v", files)
+	}
+
+	errs := []error{}
+	a, chStopped, err := NewSimulatorAdapter(context.Background(), SimulatorConfig{
+		ClientOptions: uspclient.ClientOptions{
+			TestSinkMode: true,
+			DebugLog:     func(msg string) {},
+			OnWarning:    func(msg string) {},
+			OnError:      func(err error) { errs = append(errs, err) },
+		},
+		DirectoryPath:       dir,
+		IsReplayTiming:      true,
+		IsRewriteTimestamps: true,
+		LoopCount:           3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-chStopped:
+	case <-time.After(10 * time.Second):
+		t.Error("replay did not complete")
+	}
+	a.Close()
+	if len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	if a.lastEventTime != 3 {
+		t.Errorf("last loop did not reach the last event: %d", a.lastEventTime)
+	}
+
+	if _, _, err := NewSimulatorAdapter(context.Background(), SimulatorConfig{DirectoryPath: t.TempDir()}); err == nil {
+		t.Error("empty directory should fail")
+	}
+}
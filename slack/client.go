@@ -23,7 +23,7 @@ const (
 
 type SlackAdapter struct {
 	conf       SlackConfig
-	uspClient  *uspclient.Client
+	uspClient  *utils.USPClient
 	httpClient *http.Client
 
 	chStopped chan struct{}
@@ -43,6 +43,8 @@ type slackResponse struct {
 type SlackConfig struct {
 	ClientOptions uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
 	Token         string                  `json:"token" yaml:"token"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *SlackConfig) Validate() error {
@@ -63,7 +65,7 @@ func NewSlackAdapter(ctx context.Context, conf SlackConfig) (*SlackAdapter, chan
 		doStop: utils.NewEvent(),
 	}
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
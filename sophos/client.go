@@ -30,7 +30,7 @@ type opRequest struct {
 
 type SophosAdapter struct {
 	conf       SophosConfig
-	uspClient  *uspclient.Client
+	uspClient  *utils.USPClient
 	httpClient *http.Client
 
 	chStopped chan struct{}
@@ -46,6 +46,8 @@ type SophosConfig struct {
 	ClientSecret  string                  `json:"clientsecret" yaml:"clientsecret"`
 	TenantId      string                  `json:"tenantid" yaml:"tenantid"`
 	URL           string                  `json:"url" yaml:"url"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *SophosConfig) Validate() error {
@@ -75,7 +77,7 @@ func NewSophosAdapter(ctx context.Context, conf SophosConfig) (*SophosAdapter, c
 		doStop: utils.NewEvent(),
 	}
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
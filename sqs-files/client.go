@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/url"
 	"strings"
 	"sync"
@@ -16,6 +17,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 
 	"github.com/refractionPOINT/go-uspclient"
 	"github.com/refractionPOINT/go-uspclient/protocol"
@@ -23,26 +25,31 @@ import (
 )
 
 const (
-	defaultWriteTimeout = 60 * 10
+	defaultWriteTimeout      = 60 * 10
+	defaultVisibilityTimeout = 60
 )
 
 type SQSFilesAdapter struct {
 	conf      SQSFilesConfig
-	uspClient *uspclient.Client
+	uspClient *utils.USPClient
 
 	chFiles chan fileInfo
 
+	visibilityTimeout time.Duration
+
 	// SQS
 	awsConfig  *aws.Config
 	awsSession *session.Session
-	sqsClient  *sqs.SQS
+	sqsClient  sqsiface.SQSAPI
+
+	// S3 clients of the buckets and of their regions,
+	// the notifications may be about several buckets.
+	s3Mutex       sync.Mutex
+	s3Clients     map[string]*s3.S3
+	regionClients map[string]*s3.S3
+	bucketRegion  func(bucket string) (string, error)
 
-	// S3
-	isS3Inited    bool
-	awsS3Config   *aws.Config
-	awsS3Session  *session.Session
-	awsS3         *s3.S3
-	awsDownloader *s3manager.Downloader
+	memBudget *utils.MemoryBudget
 
 	ctx    context.Context
 	isStop bool
@@ -60,16 +67,33 @@ type SQSFilesConfig struct {
 
 	// S3 specific
 	ParallelFetch     int    `json:"parallel_fetch" yaml:"parallel_fetch"`
+	MaxMemoryMB       int    `json:"max_memory_mb,omitempty" yaml:"max_memory_mb,omitempty"`
 	BucketPath        string `json:"bucket_path,omitempty" yaml:"bucket_path,omitempty"`
 	FilePath          string `json:"file_path,omitempty" yaml:"file_path,omitempty"`
 	IsDecodeObjectKey bool   `json:"is_decode_object_key,omitempty" yaml:"is_decode_object_key,omitempty"`
 	// Optional: alternative to BucketPath
 	Bucket string `json:"bucket,omitempty" yaml:"bucket,omitempty"`
+	// Optional: native S3 event notification parsing, one of
+	// "s3", "sns", "eventbridge" or "auto". When set, the
+	// BucketPath, FilePath, IsDecodeObjectKey and Bucket
+	// options are ignored.
+	NotificationFormat string `json:"notification_format,omitempty" yaml:"notification_format,omitempty"`
+
+	// Delivery semantics. Messages that fail processing are
+	// redelivered until they were received max_receive_count
+	// times, or indefinitely (until the retention period of the
+	// queue expires) if it is not set.
+	VisibilityTimeoutSec int    `json:"visibility_timeout_sec,omitempty" yaml:"visibility_timeout_sec,omitempty"`
+	MaxReceiveCount      int    `json:"max_receive_count,omitempty" yaml:"max_receive_count,omitempty"`
+	DeadLetterQueueURL   string `json:"dlq_url,omitempty" yaml:"dlq_url,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 type fileInfo struct {
 	bucket string
 	path   string
+	msg    *sqsMessage
 }
 
 func (c *SQSFilesConfig) Validate() error {
@@ -88,6 +112,12 @@ func (c *SQSFilesConfig) Validate() error {
 	if c.QueueURL == "" {
 		return errors.New("missing queue_url")
 	}
+	if !isValidNotificationFormat(c.NotificationFormat) {
+		return fmt.Errorf("invalid notification_format: %s", c.NotificationFormat)
+	}
+	if c.DeadLetterQueueURL != "" && c.MaxReceiveCount <= 0 {
+		return errors.New("dlq_url requires max_receive_count")
+	}
 	return nil
 }
 
@@ -101,11 +131,25 @@ func NewSQSFilesAdapter(ctx context.Context, conf SQSFilesConfig) (*SQSFilesAdap
 	if conf.FilePath == "" {
 		conf.FilePath = "files/path"
 	}
+	if !isValidNotificationFormat(conf.NotificationFormat) {
+		return nil, nil, fmt.Errorf("invalid notification_format: %s", conf.NotificationFormat)
+	}
+	if conf.VisibilityTimeoutSec <= 0 {
+		conf.VisibilityTimeoutSec = defaultVisibilityTimeout
+	}
+	if conf.MaxMemoryMB <= 0 {
+		conf.MaxMemoryMB = utils.DefaultMaxMemoryMB
+	}
 
 	a := &SQSFilesAdapter{
-		conf: conf,
-		ctx:  context.Background(),
+		conf:              conf,
+		ctx:               context.Background(),
+		visibilityTimeout: time.Duration(conf.VisibilityTimeoutSec) * time.Second,
+		memBudget:         utils.NewMemoryBudget(int64(conf.MaxMemoryMB)*1024*1024, conf.ParallelFetch),
+		s3Clients:         map[string]*s3.S3{},
+		regionClients:     map[string]*s3.S3{},
 	}
+	a.bucketRegion = a.getBucketRegion
 
 	var err error
 
@@ -121,13 +165,12 @@ func NewSQSFilesAdapter(ctx context.Context, conf SQSFilesConfig) (*SQSFilesAdap
 
 	a.sqsClient = sqs.New(a.awsSession)
 
-	// The S3 SDK will be initialized at run-time
-	// once we get the first file from an SQS event.
-	a.isS3Inited = false
+	// The S3 clients will be initialized at run-time
+	// once we get the files of a bucket from an SQS event.
 
 	a.chFiles = make(chan fileInfo)
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewBundleUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -170,26 +213,37 @@ func (a *SQSFilesAdapter) Close() error {
 	return nil
 }
 
-func (a *SQSFilesAdapter) initS3SDKs(bucket string) error {
-	if a.isS3Inited {
-		return nil
+// s3ClientFor returns the client of the region of the bucket.
+func (a *SQSFilesAdapter) s3ClientFor(bucket string) (*s3.S3, error) {
+	a.s3Mutex.Lock()
+	client, ok := a.s3Clients[bucket]
+	a.s3Mutex.Unlock()
+	if ok {
+		return client, nil
 	}
-	region, err := a.getBucketRegion(bucket)
+
+	// Looked up outside of the lock, concurrent
+	// lookups of a new bucket agree anyway.
+	region, err := a.bucketRegion(bucket)
 	if err != nil {
-		return fmt.Errorf("s3.Region: %v", err)
-	}
-	a.awsS3Config = &aws.Config{
-		Region:      aws.String(region),
-		Credentials: credentials.NewStaticCredentials(a.conf.AccessKey, a.conf.SecretKey, ""),
+		return nil, fmt.Errorf("s3.Region(%s): %v", bucket, err)
 	}
 
-	if a.awsS3Session, err = session.NewSession(a.awsS3Config); err != nil {
-		return fmt.Errorf("s3.NewSession(): %v", err)
+	a.s3Mutex.Lock()
+	defer a.s3Mutex.Unlock()
+	if client = a.regionClients[region]; client == nil {
+		sess, err := session.NewSession(&aws.Config{
+			Region:      aws.String(region),
+			Credentials: credentials.NewStaticCredentials(a.conf.AccessKey, a.conf.SecretKey, ""),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("s3.NewSession(): %v", err)
+		}
+		client = s3.New(sess)
+		a.regionClients[region] = client
 	}
-
-	a.awsS3 = s3.New(a.awsSession)
-	a.awsDownloader = s3manager.NewDownloader(a.awsS3Session)
-	return nil
+	a.s3Clients[bucket] = client
+	return client, nil
 }
 
 func (a *SQSFilesAdapter) getBucketRegion(bucket string) (string, error) {
@@ -201,108 +255,151 @@ func (a *SQSFilesAdapter) receiveEvents() error {
 
 	for !a.isStop {
 		result, err := a.sqsClient.ReceiveMessage(&sqs.ReceiveMessageInput{
-			AttributeNames:        []*string{},
+			AttributeNames: []*string{
+				aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount),
+			},
 			MessageAttributeNames: []*string{},
 			QueueUrl:              &a.conf.QueueURL,
 			MaxNumberOfMessages:   aws.Int64(10),
-			VisibilityTimeout:     aws.Int64(60), // 60 seconds
+			VisibilityTimeout:     aws.Int64(int64(a.conf.VisibilityTimeoutSec)),
 			WaitTimeSeconds:       aws.Int64(5),
 		})
 		if err != nil {
 			a.conf.ClientOptions.OnError(fmt.Errorf("sqsClient.ReceiveMessage: %v", err))
 			return err
 		}
-		delRequest := &sqs.DeleteMessageBatchInput{
-			Entries:  make([]*sqs.DeleteMessageBatchRequestEntry, 0, len(result.Messages)),
-			QueueUrl: &a.conf.QueueURL,
-		}
-		if len(result.Messages) == 0 {
-			continue
-		}
 		for _, msg := range result.Messages {
-			delRequest.Entries = append(delRequest.Entries, &sqs.DeleteMessageBatchRequestEntry{
-				Id:            msg.MessageId,
-				ReceiptHandle: msg.ReceiptHandle,
-			})
-
-			d := utils.Dict{}
-			if err := json.Unmarshal([]byte(*msg.Body), &d); err != nil {
-				a.conf.ClientOptions.OnError(fmt.Errorf("sqsClient.Message.Json: %v", err))
-				continue
-			}
-
-			bucket := a.conf.Bucket
-			if bucket == "" {
-				bucket = d.ExpandableFindOneString(a.conf.BucketPath)
-			}
-			filePaths := d.ExpandableFindString(a.conf.FilePath)
+			m := newSQSMessage(msg)
 
-			if bucket == "" {
-				a.conf.ClientOptions.OnError(errors.New("sqsClient.Message: missing bucket"))
+			files, err := a.filesFromMessage(m.body)
+			if err != nil {
+				a.conf.ClientOptions.OnError(fmt.Errorf("sqsClient.Message: %v", err))
+				a.completeMessage(m, false)
 				continue
 			}
-			if len(filePaths) == 0 {
+			if len(files) == 0 {
+				// Nothing to fetch, like an s3:TestEvent.
+				a.completeMessage(m, true)
 				continue
 			}
-			if err := a.initS3SDKs(bucket); err != nil {
-				a.conf.ClientOptions.OnError(err)
-				return err
+			m.nPending = int32(len(files))
+			a.startHeartbeat(m)
+			for _, f := range files {
+				f.msg = m
+				a.chFiles <- f
 			}
-
-			for _, p := range filePaths {
-				a.chFiles <- fileInfo{
-					bucket: bucket,
-					path:   p,
-				}
-			}
-
-		}
-		delRes, err := a.sqsClient.DeleteMessageBatch(delRequest)
-		if err != nil {
-			return err
-		}
-		if len(delRes.Failed) != 0 {
-			return errors.New("sqsClient.DeleteMessageBatch: failed to delete some messages")
 		}
 	}
 	return nil
 }
 
-func (a *SQSFilesAdapter) processFiles() error {
-	for f := range a.chFiles {
-		path := f.path
+func (a *SQSFilesAdapter) filesFromMessage(body string) ([]fileInfo, error) {
+	if a.conf.NotificationFormat != notificationFormatCustom {
+		return parseNotification(a.conf.NotificationFormat, []byte(body))
+	}
+
+	d := utils.Dict{}
+	if err := json.Unmarshal([]byte(body), &d); err != nil {
+		return nil, fmt.Errorf("json: %v", err)
+	}
+
+	bucket := a.conf.Bucket
+	if bucket == "" {
+		bucket = d.ExpandableFindOneString(a.conf.BucketPath)
+	}
+	if bucket == "" {
+		return nil, errors.New("missing bucket")
+	}
+
+	files := []fileInfo{}
+	for _, p := range d.ExpandableFindString(a.conf.FilePath) {
 		if a.conf.IsDecodeObjectKey {
 			// URL Decode the path
 			var err error
-			path, err = url.QueryUnescape(path)
+			p, err = url.QueryUnescape(p)
 			if err != nil {
 				a.conf.ClientOptions.OnError(fmt.Errorf("url.QueryUnescape(): %v", err))
 				continue
 			}
 		}
-		startTime := time.Now().UTC()
-		a.conf.ClientOptions.DebugLog(fmt.Sprintf("downloading file %s", path))
+		files = append(files, fileInfo{
+			bucket: bucket,
+			path:   p,
+		})
+	}
+	return files, nil
+}
 
-		writerAt := aws.NewWriteAtBuffer([]byte{})
+func (a *SQSFilesAdapter) processFiles() error {
+	for f := range a.chFiles {
+		a.fileDone(f.msg, a.processFile(f))
+	}
+	return nil
+}
 
-		if _, err := a.awsDownloader.Download(writerAt, &s3.GetObjectInput{
-			Bucket: aws.String(f.bucket),
-			Key:    aws.String(path),
-		}); err != nil {
-			a.conf.ClientOptions.OnError(fmt.Errorf("s3.Download(): %v", err))
-			return err
-		}
-		isCompressed := false
+// processFile downloads and ships a single file. Files that fit
+// in a chunk of the memory budget are shipped as a single bundle,
+// larger ones are streamed and shipped in chunks as they are read.
+func (a *SQSFilesAdapter) processFile(f fileInfo) bool {
+	path := f.path
+	startTime := time.Now().UTC()
+	a.conf.ClientOptions.DebugLog(fmt.Sprintf("downloading file %s", path))
 
-		if strings.HasSuffix(path, ".gz") {
-			isCompressed = true
+	client, err := a.s3ClientFor(f.bucket)
+	if err != nil {
+		a.conf.ClientOptions.OnError(err)
+		return false
+	}
+
+	resp, err := client.GetObjectWithContext(a.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(f.bucket),
+		Key:    aws.String(path),
+	})
+	if err != nil {
+		a.conf.ClientOptions.OnError(fmt.Errorf("s3.GetObject(%s): %v", path, err))
+		return false
+	}
+	defer resp.Body.Close()
+
+	isCompressed := false
+
+	if strings.HasSuffix(path, ".gz") {
+		isCompressed = true
+	}
+
+	size := aws.Int64Value(resp.ContentLength)
+	if size > a.memBudget.ChunkSize() {
+		chunker := utils.ChunkStream
+		if isCompressed {
+			chunker = utils.ChunkCompressedStream
+		}
+		nChunks := 0
+		if err := chunker(resp.Body, a.memBudget, func(chunk []byte) error {
+			nChunks++
+			if !a.processEvent(chunk, false) {
+				return errors.New("failed to ship chunk")
+			}
+			return nil
+		}); err != nil {
+			a.conf.ClientOptions.OnError(fmt.Errorf("streaming %s: %v", path, err))
+			return false
 		}
+		a.conf.ClientOptions.DebugLog(fmt.Sprintf("file %s streamed in %v (%d chunks)", path, time.Since(startTime), nChunks))
+		return true
+	}
 
-		a.conf.ClientOptions.DebugLog(fmt.Sprintf("file %s downloaded in %v", path, time.Since(startTime)))
+	reserved := a.memBudget.Acquire(size)
+	defer a.memBudget.Release(reserved)
 
-		a.processEvent(writerAt.Bytes(), isCompressed)
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		a.conf.ClientOptions.OnError(fmt.Errorf("s3.Download(%s): %v", path, err))
+		return false
 	}
-	return nil
+
+	a.conf.ClientOptions.DebugLog(fmt.Sprintf("file %s downloaded in %v", path, time.Since(startTime)))
+
+	return a.processEvent(data, isCompressed)
 }
 
 func (a *SQSFilesAdapter) processEvent(data []byte, isCompressed bool) bool {
@@ -0,0 +1,52 @@
+package usp_sqs_files
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3ClientFor(t *testing.T) {
+	regions := map[string]string{
+		"bucket-1": "us-east-1",
+		"bucket-2": "eu-west-1",
+		"bucket-3": "us-east-1",
+	}
+	nLookups := 0
+	a := &SQSFilesAdapter{
+		s3Clients:     map[string]*s3.S3{},
+		regionClients: map[string]*s3.S3{},
+		bucketRegion: func(bucket string) (string, error) {
+			nLookups++
+			if r, ok := regions[bucket]; ok {
+				return r, nil
+			}
+			return "", errors.New("no such bucket")
+		},
+	}
+
+	c1, err := a.s3ClientFor("bucket-1")
+	require.NoError(t, err)
+	assert.Equal(t, "us-east-1", aws.StringValue(c1.Config.Region))
+	c2, err := a.s3ClientFor("bucket-2")
+	require.NoError(t, err)
+	assert.Equal(t, "eu-west-1", aws.StringValue(c2.Config.Region))
+	c3, err := a.s3ClientFor("bucket-3")
+	require.NoError(t, err)
+	assert.Same(t, c1, c3)
+
+	c, err := a.s3ClientFor("bucket-2")
+	require.NoError(t, err)
+	assert.Same(t, c2, c)
+	assert.Equal(t, 3, nLookups)
+
+	_, err = a.s3ClientFor("bucket-4")
+	assert.Error(t, err)
+	_, err = a.s3ClientFor("bucket-4")
+	assert.Error(t, err)
+	assert.Equal(t, 5, nLookups)
+}
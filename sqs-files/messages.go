@@ -0,0 +1,122 @@
+package usp_sqs_files
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// sqsMessage tracks an SQS message while the files it references
+// are being downloaded and shipped. The message is only deleted
+// from the queue once every one of its files was shipped, which
+// gives us at-least-once semantics: if we crash or fail to ship
+// a file, the message becomes visible again and gets redelivered.
+type sqsMessage struct {
+	id            string
+	receiptHandle string
+	body          string
+	receiveCount  int
+
+	nPending int32
+	isFailed uint32
+
+	stopOnce    sync.Once
+	chHeartbeat chan struct{}
+}
+
+func newSQSMessage(msg *sqs.Message) *sqsMessage {
+	m := &sqsMessage{
+		id:            aws.StringValue(msg.MessageId),
+		receiptHandle: aws.StringValue(msg.ReceiptHandle),
+		body:          aws.StringValue(msg.Body),
+		chHeartbeat:   make(chan struct{}),
+	}
+	if c, ok := msg.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]; ok {
+		m.receiveCount, _ = strconv.Atoi(aws.StringValue(c))
+	}
+	return m
+}
+
+// startHeartbeat keeps extending the visibility timeout of the
+// message for as long as its files are being processed so that
+// large downloads do not cause the message to be redelivered
+// to another consumer while we are still working on it.
+func (a *SQSFilesAdapter) startHeartbeat(m *sqsMessage) {
+	go func() {
+		ticker := time.NewTicker(a.visibilityTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.chHeartbeat:
+				return
+			case <-ticker.C:
+			}
+			if _, err := a.sqsClient.ChangeMessageVisibility(&sqs.ChangeMessageVisibilityInput{
+				QueueUrl:          &a.conf.QueueURL,
+				ReceiptHandle:     aws.String(m.receiptHandle),
+				VisibilityTimeout: aws.Int64(int64(a.visibilityTimeout / time.Second)),
+			}); err != nil {
+				a.conf.ClientOptions.OnWarning(fmt.Sprintf("sqsClient.ChangeMessageVisibility(%s): %v", m.id, err))
+			}
+		}
+	}()
+}
+
+// fileDone records the outcome of processing one of the files
+// of a message and completes the message once all are done.
+func (a *SQSFilesAdapter) fileDone(m *sqsMessage, isSuccess bool) {
+	if !isSuccess {
+		atomic.StoreUint32(&m.isFailed, 1)
+	}
+	if atomic.AddInt32(&m.nPending, -1) != 0 {
+		return
+	}
+	a.completeMessage(m, atomic.LoadUint32(&m.isFailed) == 0)
+}
+
+// completeMessage deletes a message that was fully processed. Failed
+// messages are left in the queue for redelivery until they reach the
+// configured max_receive_count, after which they are moved to the
+// dead letter queue (or dropped if none is configured).
+func (a *SQSFilesAdapter) completeMessage(m *sqsMessage, isSuccess bool) {
+	m.stopOnce.Do(func() {
+		close(m.chHeartbeat)
+	})
+
+	if !isSuccess {
+		if a.conf.MaxReceiveCount == 0 {
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("message %s failed processing, leaving for redelivery (receive count %d, no max_receive_count so it is retried until it expires from the queue)", m.id, m.receiveCount))
+			return
+		}
+		if m.receiveCount < a.conf.MaxReceiveCount {
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("message %s failed processing, leaving for redelivery (receive count %d of %d)", m.id, m.receiveCount, a.conf.MaxReceiveCount))
+			return
+		}
+		if a.conf.DeadLetterQueueURL == "" {
+			a.conf.ClientOptions.OnError(fmt.Errorf("message %s failed processing %d times, dropping it: %s", m.id, m.receiveCount, m.body))
+		} else {
+			if _, err := a.sqsClient.SendMessage(&sqs.SendMessageInput{
+				QueueUrl:    &a.conf.DeadLetterQueueURL,
+				MessageBody: aws.String(m.body),
+			}); err != nil {
+				a.conf.ClientOptions.OnError(fmt.Errorf("sqsClient.SendMessage(dlq): %v", err))
+				return
+			}
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("message %s failed processing %d times, moved to dead letter queue", m.id, m.receiveCount))
+		}
+	}
+
+	if _, err := a.sqsClient.DeleteMessage(&sqs.DeleteMessageInput{
+		QueueUrl:      &a.conf.QueueURL,
+		ReceiptHandle: aws.String(m.receiptHandle),
+	}); err != nil {
+		// The message will be redelivered and its
+		// files ingested again.
+		a.conf.ClientOptions.OnError(fmt.Errorf("sqsClient.DeleteMessage(%s): %v", m.id, err))
+	}
+}
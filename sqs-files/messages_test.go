@@ -0,0 +1,206 @@
+package usp_sqs_files
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockSQS struct {
+	sqsiface.SQSAPI
+
+	mu             sync.Mutex
+	nHeartbeats    int
+	deleted        []string
+	sentToDLQ      []string
+	sendMessageErr error
+}
+
+func (m *mockSQS) ChangeMessageVisibility(in *sqs.ChangeMessageVisibilityInput) (*sqs.ChangeMessageVisibilityOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nHeartbeats++
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func (m *mockSQS) DeleteMessage(in *sqs.DeleteMessageInput) (*sqs.DeleteMessageOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleted = append(m.deleted, aws.StringValue(in.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (m *mockSQS) SendMessage(in *sqs.SendMessageInput) (*sqs.SendMessageOutput, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sendMessageErr != nil {
+		return nil, m.sendMessageErr
+	}
+	m.sentToDLQ = append(m.sentToDLQ, aws.StringValue(in.MessageBody))
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func (m *mockSQS) heartbeats() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.nHeartbeats
+}
+
+type testLogs struct {
+	mu       sync.Mutex
+	warnings []string
+	errors   []error
+}
+
+func newTestAdapter(conf SQSFilesConfig, client *mockSQS, logs *testLogs) *SQSFilesAdapter {
+	conf.QueueURL = "https://sqs.us-east-1.amazonaws.com/123/queue"
+	conf.ClientOptions = uspclient.ClientOptions{
+		OnWarning: func(msg string) {
+			logs.mu.Lock()
+			defer logs.mu.Unlock()
+			logs.warnings = append(logs.warnings, msg)
+		},
+		OnError: func(err error) {
+			logs.mu.Lock()
+			defer logs.mu.Unlock()
+			logs.errors = append(logs.errors, err)
+		},
+	}
+	return &SQSFilesAdapter{
+		conf:              conf,
+		sqsClient:         client,
+		visibilityTimeout: 20 * time.Millisecond,
+	}
+}
+
+func newTestMessage(receiveCount string, nFiles int32) *sqsMessage {
+	m := newSQSMessage(&sqs.Message{
+		MessageId:     aws.String("id"),
+		ReceiptHandle: aws.String("handle"),
+		Body:          aws.String("body"),
+		Attributes: map[string]*string{
+			sqs.MessageSystemAttributeNameApproximateReceiveCount: aws.String(receiveCount),
+		},
+	})
+	m.nPending = nFiles
+	return m
+}
+
+func TestCompleteMessage(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		conf         SQSFilesConfig
+		receiveCount string
+		results      []bool
+		dlqErr       error
+
+		isDeleted   bool
+		isSentToDLQ bool
+		nWarnings   int
+		nErrors     int
+		warning     string
+	}{
+		{
+			name:         "success",
+			receiveCount: "1",
+			results:      []bool{true, true},
+			isDeleted:    true,
+		},
+		{
+			name:         "failed without max receive count",
+			receiveCount: "50",
+			results:      []bool{true, false},
+			nWarnings:    1,
+			warning:      "retried until it expires",
+		},
+		{
+			name:         "failed below max receive count",
+			conf:         SQSFilesConfig{MaxReceiveCount: 3},
+			receiveCount: "2",
+			results:      []bool{false, true},
+			nWarnings:    1,
+		},
+		{
+			name:         "failed too many times without dlq",
+			conf:         SQSFilesConfig{MaxReceiveCount: 3},
+			receiveCount: "3",
+			results:      []bool{false},
+			isDeleted:    true,
+			nErrors:      1,
+		},
+		{
+			name:         "failed too many times with dlq",
+			conf:         SQSFilesConfig{MaxReceiveCount: 3, DeadLetterQueueURL: "https://sqs.us-east-1.amazonaws.com/123/dlq"},
+			receiveCount: "4",
+			results:      []bool{true, false, true},
+			isDeleted:    true,
+			isSentToDLQ:  true,
+			nWarnings:    1,
+		},
+		{
+			name:         "dlq send failure",
+			conf:         SQSFilesConfig{MaxReceiveCount: 3, DeadLetterQueueURL: "https://sqs.us-east-1.amazonaws.com/123/dlq"},
+			receiveCount: "3",
+			results:      []bool{false},
+			dlqErr:       errors.New("access denied"),
+			nErrors:      1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := &mockSQS{sendMessageErr: tc.dlqErr}
+			logs := &testLogs{}
+			a := newTestAdapter(tc.conf, client, logs)
+			m := newTestMessage(tc.receiveCount, int32(len(tc.results)))
+
+			for i, isSuccess := range tc.results {
+				a.fileDone(m, isSuccess)
+				if i != len(tc.results)-1 {
+					// Not completed while files are pending.
+					assert.Empty(t, client.deleted)
+					assert.Empty(t, logs.warnings)
+				}
+			}
+
+			if tc.isDeleted {
+				assert.Equal(t, []string{"handle"}, client.deleted)
+			} else {
+				assert.Empty(t, client.deleted)
+			}
+			if tc.isSentToDLQ {
+				assert.Equal(t, []string{"body"}, client.sentToDLQ)
+			} else {
+				assert.Empty(t, client.sentToDLQ)
+			}
+			assert.Len(t, logs.warnings, tc.nWarnings)
+			if tc.warning != "" {
+				assert.Contains(t, logs.warnings[0], tc.warning)
+			}
+			assert.Len(t, logs.errors, tc.nErrors)
+		})
+	}
+}
+
+func TestMessageHeartbeat(t *testing.T) {
+	client := &mockSQS{}
+	a := newTestAdapter(SQSFilesConfig{}, client, &testLogs{})
+	m := newTestMessage("1", 1)
+
+	// The visibility is extended while the files are processed.
+	a.startHeartbeat(m)
+	assert.Eventually(t, func() bool { return client.heartbeats() >= 2 }, 5*time.Second, 5*time.Millisecond)
+
+	// And no longer once the message is completed.
+	a.fileDone(m, true)
+	time.Sleep(20 * time.Millisecond)
+	n := client.heartbeats()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, n, client.heartbeats())
+	assert.Equal(t, []string{"handle"}, client.deleted)
+}
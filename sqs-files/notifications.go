@@ -0,0 +1,129 @@
+package usp_sqs_files
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/refractionPOINT/usp-adapters/utils"
+)
+
+// Supported values for the `notification_format` option.
+// When empty, the `bucket_path` and `file_path` JSON paths
+// are used to find the files in the SQS message.
+const (
+	notificationFormatCustom      = ""
+	notificationFormatS3          = "s3"
+	notificationFormatSNS         = "sns"
+	notificationFormatEventBridge = "eventbridge"
+	notificationFormatAuto        = "auto"
+)
+
+func isValidNotificationFormat(format string) bool {
+	switch format {
+	case notificationFormatCustom, notificationFormatS3, notificationFormatSNS, notificationFormatEventBridge, notificationFormatAuto:
+		return true
+	}
+	return false
+}
+
+// parseNotification extracts the objects referenced by an S3 event
+// notification. The format describes how the notification was delivered
+// to the queue: directly by S3, wrapped in an SNS envelope or as an
+// EventBridge event. Messages that are valid but do not reference any
+// new object (like the s3:TestEvent sent when configuring a bucket or
+// non-creation events) return no files and no error.
+func parseNotification(format string, body []byte) ([]fileInfo, error) {
+	d := utils.Dict{}
+	if err := json.Unmarshal(body, &d); err != nil {
+		return nil, fmt.Errorf("invalid json: %v", err)
+	}
+
+	switch format {
+	case notificationFormatS3:
+		return parseS3Notification(d)
+	case notificationFormatSNS:
+		return parseSNSNotification(d)
+	case notificationFormatEventBridge:
+		return parseEventBridgeNotification(d)
+	case notificationFormatAuto:
+		if msgType, _ := d.GetString("Type"); msgType == "Notification" {
+			return parseSNSNotification(d)
+		}
+		if _, ok := d.GetDict("detail"); ok {
+			return parseEventBridgeNotification(d)
+		}
+		return parseS3Notification(d)
+	}
+	return nil, fmt.Errorf("unsupported notification format: %s", format)
+}
+
+func parseS3Notification(d utils.Dict) ([]fileInfo, error) {
+	if evt, _ := d.GetString("Event"); evt == "s3:TestEvent" {
+		return nil, nil
+	}
+	records, ok := d.GetListOfDict("Records")
+	if !ok {
+		return nil, errors.New("missing Records")
+	}
+	files := []fileInfo{}
+	for _, record := range records {
+		if eventName, _ := record.GetString("eventName"); eventName != "" && !strings.HasPrefix(eventName, "ObjectCreated:") {
+			continue
+		}
+		bucket := record.FindOneString("s3/bucket/name")
+		key := record.FindOneString("s3/object/key")
+		if bucket == "" || key == "" {
+			return nil, errors.New("record missing bucket or key")
+		}
+		// Object keys in S3 notifications are URL encoded,
+		// with spaces encoded as "+".
+		decodedKey, err := url.QueryUnescape(key)
+		if err != nil {
+			return nil, fmt.Errorf("url.QueryUnescape(): %v", err)
+		}
+		files = append(files, fileInfo{
+			bucket: bucket,
+			path:   decodedKey,
+		})
+	}
+	return files, nil
+}
+
+func parseSNSNotification(d utils.Dict) ([]fileInfo, error) {
+	message, ok := d.GetString("Message")
+	if !ok {
+		return nil, errors.New("missing sns Message")
+	}
+	inner := utils.Dict{}
+	if err := json.Unmarshal([]byte(message), &inner); err != nil {
+		return nil, fmt.Errorf("invalid sns Message json: %v", err)
+	}
+	return parseS3Notification(inner)
+}
+
+func parseEventBridgeNotification(d utils.Dict) ([]fileInfo, error) {
+	if source, _ := d.GetString("source"); source != "" && source != "aws.s3" {
+		return nil, nil
+	}
+	if detailType, _ := d.GetString("detail-type"); detailType != "" && detailType != "Object Created" {
+		return nil, nil
+	}
+	bucket := d.FindOneString("detail/bucket/name")
+	key := d.FindOneString("detail/object/key")
+	if bucket == "" || key == "" {
+		return nil, errors.New("event missing bucket or key")
+	}
+	// EventBridge uses the same key encoding as
+	// S3 event notifications.
+	decodedKey, err := url.QueryUnescape(key)
+	if err != nil {
+		return nil, fmt.Errorf("url.QueryUnescape(): %v", err)
+	}
+	return []fileInfo{{
+		bucket: bucket,
+		path:   decodedKey,
+	}}, nil
+}
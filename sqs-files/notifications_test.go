@@ -0,0 +1,62 @@
+package usp_sqs_files
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testS3Notification = `{"Records":[{"eventVersion":"2.1","eventSource":"aws:s3","awsRegion":"us-east-1","eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"my-logs"},"object":{"key":"AWSLogs/my+file%3D1.json.gz","size":1024}}},{"eventVersion":"2.1","eventSource":"aws:s3","eventName":"ObjectCreated:CompleteMultipartUpload","s3":{"bucket":{"name":"my-logs"},"object":{"key":"AWSLogs/other.json"}}},{"eventVersion":"2.1","eventSource":"aws:s3","eventName":"ObjectRemoved:Delete","s3":{"bucket":{"name":"my-logs"},"object":{"key":"AWSLogs/deleted.json"}}}]}`
+
+func TestParseS3Notification(t *testing.T) {
+	files, err := parseNotification(notificationFormatS3, []byte(testS3Notification))
+	require.NoError(t, err)
+	assert.Equal(t, []fileInfo{
+		{bucket: "my-logs", path: "AWSLogs/my file=1.json.gz"},
+		{bucket: "my-logs", path: "AWSLogs/other.json"},
+	}, files)
+}
+
+func TestParseS3TestEvent(t *testing.T) {
+	files, err := parseNotification(notificationFormatS3, []byte(`{"Service":"Amazon S3","Event":"s3:TestEvent","Time":"2024-01-01T00:00:00.000Z","Bucket":"my-logs"}`))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestParseSNSNotification(t *testing.T) {
+	body := `{"Type":"Notification","MessageId":"1","TopicArn":"arn:aws:sns:us-east-1:123:topic","Subject":"Amazon S3 Notification","Message":"{\"Records\":[{\"eventName\":\"ObjectCreated:Put\",\"s3\":{\"bucket\":{\"name\":\"my-logs\"},\"object\":{\"key\":\"a%2Fb.log\"}}}]}"}`
+	files, err := parseNotification(notificationFormatSNS, []byte(body))
+	require.NoError(t, err)
+	assert.Equal(t, []fileInfo{{bucket: "my-logs", path: "a/b.log"}}, files)
+
+	files, err = parseNotification(notificationFormatAuto, []byte(body))
+	require.NoError(t, err)
+	assert.Equal(t, []fileInfo{{bucket: "my-logs", path: "a/b.log"}}, files)
+}
+
+func TestParseEventBridgeNotification(t *testing.T) {
+	body := `{"version":"0","id":"1","detail-type":"Object Created","source":"aws.s3","account":"123","region":"us-east-1","detail":{"version":"0","bucket":{"name":"my-logs"},"object":{"key":"flow/log+1.gz","size":10}}}`
+	files, err := parseNotification(notificationFormatEventBridge, []byte(body))
+	require.NoError(t, err)
+	assert.Equal(t, []fileInfo{{bucket: "my-logs", path: "flow/log 1.gz"}}, files)
+
+	files, err = parseNotification(notificationFormatAuto, []byte(body))
+	require.NoError(t, err)
+	assert.Equal(t, []fileInfo{{bucket: "my-logs", path: "flow/log 1.gz"}}, files)
+
+	files, err = parseNotification(notificationFormatEventBridge, []byte(`{"detail-type":"Object Deleted","source":"aws.s3","detail":{"bucket":{"name":"my-logs"},"object":{"key":"x"}}}`))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestParseInvalidNotification(t *testing.T) {
+	_, err := parseNotification(notificationFormatS3, []byte(`not json`))
+	assert.Error(t, err)
+
+	_, err = parseNotification(notificationFormatS3, []byte(`{"foo":"bar"}`))
+	assert.Error(t, err)
+
+	_, err = parseNotification(notificationFormatSNS, []byte(`{"Type":"Notification","Message":"nope"}`))
+	assert.Error(t, err)
+}
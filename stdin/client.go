@@ -1,10 +1,14 @@
 package usp_stdin
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,28 +20,70 @@ import (
 
 const (
 	defaultWriteTimeout = 60 * 10
+	defaultMaxJSONSize  = 1024 * 1024 * 100 // 100 MB
 )
 
 type StdinAdapter struct {
 	conf         StdinConfig
 	wg           sync.WaitGroup
 	isRunning    uint32
-	uspClient    *uspclient.Client
+	uspClient    *utils.USPClient
 	writeTimeout time.Duration
 }
 
 type StdinConfig struct {
 	ClientOptions   uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
 	WriteTimeoutSec uint64                  `json:"write_timeout_sec,omitempty" yaml:"write_timeout_sec,omitempty"`
+	// Record delimiter: newline (default), crlf, nul, a single
+	// character or a byte in hex like 0x1e.
+	Delimiter string `json:"delimiter,omitempty" yaml:"delimiter,omitempty"`
+	// Records larger than this many bytes are dropped, 0 is unlimited.
+	// In JSON mode, applies to each top level object or array, and 0
+	// is 100MB.
+	MaxRecordSize int `json:"max_record_size,omitempty" yaml:"max_record_size,omitempty"`
+	// Decode the input as a stream of JSON objects, with or
+	// without delimiters, instead of delimited text records.
+	IsJSON bool `json:"is_json,omitempty" yaml:"is_json,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *StdinConfig) Validate() error {
 	if err := c.ClientOptions.Validate(); err != nil {
 		return fmt.Errorf("client_options: %v", err)
 	}
+	if _, _, err := parseDelimiter(c.Delimiter); err != nil {
+		return err
+	}
+	if c.MaxRecordSize < 0 {
+		return fmt.Errorf("invalid max_record_size: %d", c.MaxRecordSize)
+	}
 	return nil
 }
 
+// parseDelimiter returns the token records are split on and
+// whether a carriage return before it should be trimmed.
+func parseDelimiter(delimiter string) (byte, bool, error) {
+	switch strings.ToLower(delimiter) {
+	case "", "newline", "lf":
+		return '\n', false, nil
+	case "crlf":
+		return '\n', true, nil
+	case "nul", "null":
+		return 0x00, false, nil
+	}
+	if len(delimiter) == 1 {
+		return delimiter[0], false, nil
+	}
+	if strings.HasPrefix(strings.ToLower(delimiter), "0x") {
+		b, err := strconv.ParseUint(delimiter[2:], 16, 8)
+		if err == nil {
+			return byte(b), false, nil
+		}
+	}
+	return 0, false, fmt.Errorf("invalid delimiter: %s", delimiter)
+}
+
 func NewStdinAdapter(ctx context.Context, conf StdinConfig) (*StdinAdapter, chan struct{}, error) {
 	a := &StdinAdapter{
 		conf:      conf,
@@ -49,8 +95,15 @@ func NewStdinAdapter(ctx context.Context, conf StdinConfig) (*StdinAdapter, chan
 	}
 	a.writeTimeout = time.Duration(a.conf.WriteTimeoutSec) * time.Second
 
-	var err error
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	token, isCRLF, err := parseDelimiter(conf.Delimiter)
+	if err != nil {
+		return nil, nil, err
+	}
+	if conf.MaxRecordSize < 0 {
+		return nil, nil, fmt.Errorf("invalid max_record_size: %d", conf.MaxRecordSize)
+	}
+
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -60,7 +113,15 @@ func NewStdinAdapter(ctx context.Context, conf StdinConfig) (*StdinAdapter, chan
 	go func() {
 		defer a.wg.Done()
 		defer close(chStopped)
-		a.handleInput()
+		var err error
+		if a.conf.IsJSON {
+			err = decodeJSONRecords(os.Stdin, a.conf.MaxRecordSize, &a.isRunning, a.handleJSON, a.conf.ClientOptions.OnWarning)
+		} else {
+			err = readRecords(os.Stdin, token, isCRLF, a.conf.MaxRecordSize, &a.isRunning, a.handleLine, a.conf.ClientOptions.OnWarning)
+		}
+		if err != nil {
+			a.conf.ClientOptions.OnError(err)
+		}
 	}()
 
 	return a, chStopped, nil
@@ -79,43 +140,200 @@ func (a *StdinAdapter) Close() error {
 	return err2
 }
 
-func (a *StdinAdapter) handleInput() {
+// readRecords calls cb with every record read from r
+// until EOF or isRunning is cleared.
+func readRecords(r io.Reader, token byte, isCRLF bool, maxSize int, isRunning *uint32, cb func([]byte), onWarning func(string)) error {
 	readBufferSize := 1024 * 16
 	st := utils.StreamTokenizer{
 		ExpectedSize: readBufferSize * 2,
-		Token:        0x0a,
+		Token:        token,
+		MaxSize:      maxSize,
+	}
+	emit := func(record []byte) {
+		if isCRLF {
+			record = bytes.TrimSuffix(record, []byte{'\r'})
+		}
+		cb(record)
 	}
 
 	readBuffer := make([]byte, readBufferSize)
-	for atomic.LoadUint32(&a.isRunning) == 1 {
-		sizeRead, err := os.Stdin.Read(readBuffer)
-		if err != nil {
+	for atomic.LoadUint32(isRunning) == 1 {
+		sizeRead, err := r.Read(readBuffer)
+		if sizeRead == 0 && err != nil {
+			// The input may not end with a delimiter.
+			emit(st.Flush())
 			if err != io.EOF {
-				a.conf.ClientOptions.OnError(fmt.Errorf("os.Stdin.Read(): %v", err))
+				return fmt.Errorf("os.Stdin.Read(): %v", err)
 			}
-			return
+			return nil
 		}
 
 		data := readBuffer[:sizeRead]
 
 		chunks, err := st.Add(data)
-		if err != nil {
-			a.conf.ClientOptions.OnError(fmt.Errorf("tokenizer: %v", err))
+		if err == utils.ErrorTooLarge {
+			onWarning(fmt.Sprintf("dropping record larger than %d bytes", maxSize))
 		}
 		for _, chunk := range chunks {
-			a.handleLine(chunk)
+			emit(chunk)
 		}
 	}
+	return nil
+}
+
+// decodeJSONRecords calls cb with every JSON object decoded
+// from r, objects in top level arrays are reported individually.
+// Invalid or too large values are dropped and decoding resumes
+// with the next value.
+func decodeJSONRecords(r io.Reader, maxSize int, isRunning *uint32, cb func(map[string]interface{}), onWarning func(string)) error {
+	if maxSize == 0 {
+		// An unbalanced value would otherwise
+		// be buffered until the end of the input.
+		maxSize = defaultMaxJSONSize
+	}
+	s := jsonSplitter{
+		maxSize: maxSize,
+	}
+	emit := func(data []byte) {
+		var value interface{}
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		if err := d.Decode(&value); err != nil {
+			onWarning(fmt.Sprintf("dropping invalid JSON: %v", err))
+			return
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			cb(v)
+		case []interface{}:
+			nDropped := 0
+			for _, e := range v {
+				if m, ok := e.(map[string]interface{}); ok {
+					cb(m)
+				} else {
+					nDropped++
+				}
+			}
+			if nDropped != 0 {
+				onWarning(fmt.Sprintf("dropping %d JSON array elements which are not objects", nDropped))
+			}
+		}
+	}
+
+	readBuffer := make([]byte, 1024*16)
+	for atomic.LoadUint32(isRunning) == 1 {
+		sizeRead, err := r.Read(readBuffer)
+		if sizeRead == 0 && err != nil {
+			if s.isPending() {
+				onWarning("dropping incomplete JSON at the end of the input")
+			}
+			if err != io.EOF {
+				return fmt.Errorf("os.Stdin.Read(): %v", err)
+			}
+			return nil
+		}
+
+		values, err := s.Add(readBuffer[:sizeRead])
+		if err == utils.ErrorTooLarge {
+			onWarning(fmt.Sprintf("dropping JSON larger than %d bytes", maxSize))
+		}
+		for _, v := range values {
+			emit(v)
+		}
+	}
+	return nil
+}
+
+// jsonSplitter splits a stream into its top level JSON objects
+// and arrays. Anything between them, like delimiters or invalid
+// input, is skipped.
+type jsonSplitter struct {
+	maxSize int
+
+	current      []byte
+	depth        int
+	isInString   bool
+	isEscaped    bool
+	isDiscarding bool
+}
+
+func (s *jsonSplitter) reset() {
+	s.current = nil
+	s.depth = 0
+	s.isInString = false
+	s.isEscaped = false
+	s.isDiscarding = false
+}
+
+func (s *jsonSplitter) isPending() bool {
+	return len(s.current) != 0
+}
+
+// Add returns the values completed by data. A value larger than
+// maxSize is discarded up to its end and reported as ErrorTooLarge
+// along with the other complete values.
+func (s *jsonSplitter) Add(data []byte) ([][]byte, error) {
+	values := [][]byte{}
+	var err error
+	for _, c := range data {
+		if s.depth == 0 && c != '{' && c != '[' {
+			continue
+		}
+		if !s.isDiscarding {
+			s.current = append(s.current, c)
+		}
+		if s.isInString {
+			if s.isEscaped {
+				s.isEscaped = false
+			} else if c == '\\' {
+				s.isEscaped = true
+			} else if c == '"' {
+				s.isInString = false
+			}
+		} else {
+			switch c {
+			case '"':
+				s.isInString = true
+			case '{', '[':
+				s.depth++
+			case '}', ']':
+				s.depth--
+			}
+		}
+		if s.maxSize != 0 && len(s.current) > s.maxSize {
+			err = utils.ErrorTooLarge
+			s.current = nil
+			s.isDiscarding = true
+		}
+		if s.depth == 0 {
+			if !s.isDiscarding {
+				values = append(values, s.current)
+			}
+			s.current = nil
+			s.isDiscarding = false
+		}
+	}
+	return values, err
+}
+
+func (a *StdinAdapter) handleJSON(record map[string]interface{}) {
+	a.ship(&protocol.DataMessage{
+		JsonPayload: record,
+		TimestampMs: uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+	})
 }
 
 func (a *StdinAdapter) handleLine(line []byte) {
 	if len(line) == 0 {
 		return
 	}
-	msg := &protocol.DataMessage{
+	a.ship(&protocol.DataMessage{
 		TextPayload: string(line),
 		TimestampMs: uint64(time.Now().UnixNano() / int64(time.Millisecond)),
-	}
+	})
+}
+
+func (a *StdinAdapter) ship(msg *protocol.DataMessage) {
 	err := a.uspClient.Ship(msg, a.writeTimeout)
 	if err == uspclient.ErrorBufferFull {
 		a.conf.ClientOptions.OnWarning("stream falling behind")
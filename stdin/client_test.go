@@ -0,0 +1,182 @@
+package usp_stdin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDelimiter(t *testing.T) {
+	for delimiter, expected := range map[string]byte{
+		"":        '\n',
+		"newline": '\n',
+		"crlf":    '\n',
+		"NUL":     0x00,
+		"|":       '|',
+		"0x1e":    0x1e,
+	} {
+		token, isCRLF, err := parseDelimiter(delimiter)
+		require.NoError(t, err, delimiter)
+		assert.Equal(t, expected, token, delimiter)
+		assert.Equal(t, delimiter == "crlf", isCRLF, delimiter)
+	}
+
+	_, _, err := parseDelimiter("0xzz")
+	assert.Error(t, err)
+	_, _, err = parseDelimiter("ab")
+	assert.Error(t, err)
+}
+
+func TestReadRecords(t *testing.T) {
+	isRunning := uint32(1)
+	read := func(input string, token byte, isCRLF bool, maxSize int) ([]string, []string) {
+		records := []string{}
+		warnings := []string{}
+		err := readRecords(strings.NewReader(input), token, isCRLF, maxSize, &isRunning, func(r []byte) {
+			if len(r) != 0 {
+				records = append(records, string(r))
+			}
+		}, func(msg string) {
+			warnings = append(warnings, msg)
+		})
+		require.NoError(t, err)
+		return records, warnings
+	}
+
+	records, _ := read("a\r\nbb\r\nccc", '\n', true, 0)
+	assert.Equal(t, []string{"a", "bb", "ccc"}, records)
+
+	records, _ = read("a\x00b c\x00", 0x00, false, 0)
+	assert.Equal(t, []string{"a", "b c"}, records)
+
+	records, warnings := read("short\nthis one is too long\nok\n", '\n', false, 10)
+	assert.Equal(t, []string{"short", "ok"}, records)
+	assert.Len(t, warnings, 1)
+}
+
+func TestDecodeJSONRecords(t *testing.T) {
+	isRunning := uint32(1)
+	records := []map[string]interface{}{}
+	warnings := []string{}
+	cb := func(r map[string]interface{}) {
+		records = append(records, r)
+	}
+	onWarning := func(msg string) {
+		warnings = append(warnings, msg)
+	}
+
+	err := decodeJSONRecords(strings.NewReader(`{"a":1}{"b":{"c":"d"}}
+[{"e":true},{"f":null}] {"g":[1,2]}`), 0, &isRunning, cb, onWarning)
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]interface{}{
+		{"a": json.Number("1")},
+		{"b": map[string]interface{}{"c": "d"}},
+		{"e": true},
+		{"f": nil},
+		{"g": []interface{}{json.Number("1"), json.Number("2")}},
+	}, records)
+	assert.Empty(t, warnings)
+
+	// Brackets and quotes in strings.
+	records = records[:0]
+	err = decodeJSONRecords(strings.NewReader(`{"a":"}{[\"\\"}`+"\n"+`{"b":"]"}`), 0, &isRunning, cb, onWarning)
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]interface{}{
+		{"a": `}{["\`},
+		{"b": "]"},
+	}, records)
+	assert.Empty(t, warnings)
+
+	// Invalid input is skipped.
+	records = records[:0]
+	err = decodeJSONRecords(strings.NewReader(`{"a":1}
+{"b":,}
+not json
+{"c":3}
+{"d":`), 0, &isRunning, cb, onWarning)
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]interface{}{
+		{"a": json.Number("1")},
+		{"c": json.Number("3")},
+	}, records)
+	assert.Len(t, warnings, 2)
+
+	// Too large values are dropped.
+	records = records[:0]
+	warnings = warnings[:0]
+	err = decodeJSONRecords(strings.NewReader(`{"a":1}
+{"b":"`+strings.Repeat("x", 100)+`"}
+{"c":3}`), 20, &isRunning, cb, onWarning)
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]interface{}{
+		{"a": json.Number("1")},
+		{"c": json.Number("3")},
+	}, records)
+	assert.Len(t, warnings, 1)
+
+	// Too large values spanning lines are skipped up to their end.
+	records = records[:0]
+	warnings = warnings[:0]
+	err = decodeJSONRecords(strings.NewReader(`{"b":[
+"`+strings.Repeat("x", 30)+`",
+{"d":"}\n{"}],
+"e":{"f":1}}
+{"c":3}`), 20, &isRunning, cb, onWarning)
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]interface{}{
+		{"c": json.Number("3")},
+	}, records)
+	assert.Len(t, warnings, 1)
+
+	// Large integers keep their precision.
+	records = records[:0]
+	err = decodeJSONRecords(strings.NewReader(`{"id":9007199254740993}`), 0, &isRunning, cb, onWarning)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	id, err := records[0]["id"].(json.Number).Int64()
+	require.NoError(t, err)
+	assert.Equal(t, int64(9007199254740993), id)
+
+	// Array elements which are not objects are reported.
+	records = records[:0]
+	warnings = warnings[:0]
+	err = decodeJSONRecords(strings.NewReader(`[{"a":1},2,"x"]`), 0, &isRunning, cb, onWarning)
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]interface{}{
+		{"a": json.Number("1")},
+	}, records)
+	assert.Len(t, warnings, 1)
+}
+
+func TestJSONSplitterDefaultMaxSize(t *testing.T) {
+	if testing.Short() {
+		t.Skip("buffers the default max size")
+	}
+	isRunning := uint32(1)
+	warnings := []string{}
+	// An unbalanced value is not buffered past the default size.
+	r := io.MultiReader(strings.NewReader("["), io.LimitReader(repeatReader(`"x",`), defaultMaxJSONSize))
+	err := decodeJSONRecords(r, 0, &isRunning, func(r map[string]interface{}) {
+		t.Errorf("unexpected record: %v", r)
+	}, func(msg string) {
+		warnings = append(warnings, msg)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{fmt.Sprintf("dropping JSON larger than %d bytes", defaultMaxJSONSize)}, warnings)
+}
+
+// repeatReader endlessly repeats its content.
+type repeatReader string
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		n += copy(p[n:], r)
+	}
+	return n, nil
+}
@@ -25,7 +25,7 @@ const (
 
 type SublimeAdapter struct {
 	conf       SublimeConfig
-	uspClient  *uspclient.Client
+	uspClient  *utils.USPClient
 	httpClient *http.Client
 
 	chStopped chan struct{}
@@ -40,6 +40,8 @@ type SublimeConfig struct {
 	ClientOptions uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
 	ApiKey        string                  `json:"api_key" yaml:"api_key"`
 	BaseURL       string                  `json:"base_url" yaml:"base_url"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *SublimeConfig) Validate() error {
@@ -64,7 +66,7 @@ func NewSublimeAdapter(ctx context.Context, conf SublimeConfig) (*SublimeAdapter
 		dedupe: make(map[string]int64),
 	}
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
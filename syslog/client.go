@@ -3,12 +3,10 @@ package usp_syslog
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"net"
-	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -30,7 +28,7 @@ type SyslogAdapter struct {
 	connMutex    sync.Mutex
 	wg           sync.WaitGroup
 	isRunning    uint32
-	uspClient    *uspclient.Client
+	uspClient    *utils.USPClient
 	writeTimeout time.Duration
 }
 
@@ -43,6 +41,8 @@ type SyslogConfig struct {
 	SslKeyPath        string                  `json:"ssl_key" yaml:"ssl_key"`
 	MutualTlsCertPath string                  `json:"mutual_tls_cert,omitempty" yaml:"mutual_tls_cert,omitempty"`
 	WriteTimeoutSec   uint64                  `json:"write_timeout_sec,omitempty" yaml:"write_timeout_sec,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *SyslogConfig) Validate() error {
@@ -75,28 +75,13 @@ func NewSyslogAdapter(ctx context.Context, conf SyslogConfig) (*SyslogAdapter, c
 	var ul *net.UDPConn
 	var err error
 	if conf.SslCertPath != "" && conf.SslKeyPath != "" {
-		var cert tls.Certificate
-		cert, err = tls.LoadX509KeyPair(conf.SslCertPath, conf.SslKeyPath)
+		var tlsConfig *tls.Config
+		tlsConfig, err = utils.LoadServerTLSConfig(conf.SslCertPath, conf.SslKeyPath, conf.MutualTlsCertPath)
 		if err != nil {
-			return nil, nil, fmt.Errorf("error loading certificate with cert path '%s' and key path '%s': %s", conf.SslCertPath, conf.SslKeyPath, err)
-		}
-		tlsConfig := tls.Config{
-			Certificates: []tls.Certificate{cert},
-		}
-
-		// If mutual TLS is enabled, load the client certificate.
-		if conf.MutualTlsCertPath != "" {
-			caCert, err := os.ReadFile(conf.MutualTlsCertPath)
-			if err != nil {
-				return nil, nil, fmt.Errorf("error loading mutual TLS certificate with path '%s': %s", conf.MutualTlsCertPath, err)
-			}
-			caCertPool := x509.NewCertPool()
-			caCertPool.AppendCertsFromPEM(caCert)
-			tlsConfig.ClientCAs = caCertPool
-			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			return nil, nil, err
 		}
 
-		l, err = tls.Listen("tcp", addr, &tlsConfig)
+		l, err = tls.Listen("tcp", addr, tlsConfig)
 	} else if conf.IsUDP {
 		var udpAddr *net.UDPAddr
 		if udpAddr, err = net.ResolveUDPAddr("udp", addr); err != nil {
@@ -113,7 +98,7 @@ func NewSyslogAdapter(ctx context.Context, conf SyslogConfig) (*SyslogAdapter, c
 		return nil, nil, err
 	}
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		if l != nil {
 			l.Close()
@@ -30,6 +30,8 @@ type TrendMicroConfig struct {
 	ClientOptions uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
 	APIToken      string                  `json:"api_token" yaml:"api_token"`
 	Region        string                  `json:"region" yaml:"region"` // "us", "eu", "sg", "jp", "in", "au" - defaults to "us"
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *TrendMicroConfig) Validate() error {
@@ -51,7 +53,7 @@ func (c *TrendMicroConfig) Validate() error {
 
 type TrendMicroAdapter struct {
 	conf       TrendMicroConfig
-	uspClient  *uspclient.Client
+	uspClient  *utils.USPClient
 	httpClient *http.Client
 	chStopped  chan struct{}
 	wgSenders  sync.WaitGroup
@@ -78,7 +80,7 @@ func NewTrendMicroAdapter(ctx context.Context, conf TrendMicroConfig) (*TrendMic
 	// Set regional base URL
 	a.baseURL = regionalDomains[conf.Region]
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -128,7 +128,8 @@ func buildFieldTypesMap(t reflect.Type, prefix string, fieldTypes map[string]ref
 		} else if field.Type.Kind() == reflect.Slice {
 			// For slices, we need to handle the element type
 			elemType := field.Type.Elem()
-			if elemType.Kind() == reflect.Struct {
+			// Recursive types, like rules of rules, are not expanded.
+			if elemType.Kind() == reflect.Struct && elemType != t {
 				buildFieldTypesMap(elemType, currentPath, fieldTypes)
 			}
 		}
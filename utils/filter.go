@@ -0,0 +1,238 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FilterRule matches events on the values at a path, like:
+//
+//	op: and
+//	rules:
+//	  - op: equals
+//	    path: event/level
+//	    value: debug
+//	  - op: not
+//	    rules:
+//	      - op: exists
+//	        path: event/error
+//
+// Paths use the same syntax as the Dict accessors, a rule
+// matches if any of the values found at its path do.
+type FilterRule struct {
+	// Name of the rule in the counters of dropped events.
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// One of "equals", "contains", "regex", "exists", "gt", "gte",
+	// "lt", "lte" on the path, or "and", "or" and "not" on the
+	// sub-rules.
+	Op    string      `json:"op" yaml:"op"`
+	Path  string      `json:"path,omitempty" yaml:"path,omitempty"`
+	Value interface{} `json:"value,omitempty" yaml:"value,omitempty"`
+	// Compares strings case insensitively.
+	IsCaseInsensitive bool         `json:"case_insensitive,omitempty" yaml:"case_insensitive,omitempty"`
+	Rules             []FilterRule `json:"rules,omitempty" yaml:"rules,omitempty"`
+}
+
+// Filter is a compiled FilterRule.
+type Filter func(evt Dict) bool
+
+func (r FilterRule) Compile() (Filter, error) {
+	op := strings.ToLower(r.Op)
+	switch op {
+	case "and", "or", "not":
+		if len(r.Rules) == 0 {
+			return nil, fmt.Errorf("%s: missing rules", op)
+		}
+		if op == "not" && len(r.Rules) != 1 {
+			return nil, errors.New("not: expects a single rule")
+		}
+		filters := make([]Filter, 0, len(r.Rules))
+		for _, sub := range r.Rules {
+			f, err := sub.Compile()
+			if err != nil {
+				return nil, err
+			}
+			filters = append(filters, f)
+		}
+		return combineFilters(op, filters), nil
+	}
+
+	if r.Path == "" {
+		return nil, fmt.Errorf("%s: missing path", op)
+	}
+	if op == "exists" {
+		isPresent := MakeExtractorForPresence(r.Path)
+		return func(evt Dict) bool {
+			return isPresent(evt)
+		}, nil
+	}
+
+	if r.Value == nil {
+		return nil, fmt.Errorf("%s: missing value", op)
+	}
+	match, err := r.valueMatcher(op)
+	if err != nil {
+		return nil, err
+	}
+	extract := MakeExtractorForOpaque(r.Path)
+	return func(evt Dict) bool {
+		for _, v := range extract(evt) {
+			// Lists match if any of their elements do.
+			if l := effectiveList(v); l != nil {
+				for _, e := range l {
+					if match(e) {
+						return true
+					}
+				}
+				continue
+			}
+			if match(v) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func combineFilters(op string, filters []Filter) Filter {
+	switch op {
+	case "and":
+		return func(evt Dict) bool {
+			for _, f := range filters {
+				if !f(evt) {
+					return false
+				}
+			}
+			return true
+		}
+	case "or":
+		return func(evt Dict) bool {
+			for _, f := range filters {
+				if f(evt) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	return func(evt Dict) bool {
+		return !filters[0](evt)
+	}
+}
+
+// valueMatcher returns the function matching a single
+// value found at the path of the rule.
+func (r FilterRule) valueMatcher(op string) (func(v interface{}) bool, error) {
+	expected := scalarToString(r.Value)
+	if r.IsCaseInsensitive {
+		expected = strings.ToLower(expected)
+	}
+	normalize := func(v interface{}) (string, bool) {
+		switch v.(type) {
+		case map[string]interface{}, Dict, []interface{}, List:
+			return "", false
+		}
+		s := scalarToString(v)
+		if r.IsCaseInsensitive {
+			s = strings.ToLower(s)
+		}
+		return s, true
+	}
+
+	switch op {
+	case "equals":
+		expectedNum, isNum := toNumber(r.Value)
+		return func(v interface{}) bool {
+			if isNum {
+				if n, ok := toNumber(v); ok {
+					return n == expectedNum
+				}
+			}
+			s, ok := normalize(v)
+			return ok && s == expected
+		}, nil
+	case "contains":
+		return func(v interface{}) bool {
+			s, ok := normalize(v)
+			return ok && strings.Contains(s, expected)
+		}, nil
+	case "regex":
+		pattern := scalarToString(r.Value)
+		if r.IsCaseInsensitive {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("regex: %v", err)
+		}
+		return func(v interface{}) bool {
+			switch v.(type) {
+			case map[string]interface{}, Dict, []interface{}, List:
+				return false
+			}
+			return re.MatchString(scalarToString(v))
+		}, nil
+	case "gt", "gte", "lt", "lte":
+		expectedNum, ok := toNumber(r.Value)
+		if !ok {
+			return nil, fmt.Errorf("%s: value is not a number: %v", op, r.Value)
+		}
+		return func(v interface{}) bool {
+			n, ok := toNumber(v)
+			if !ok {
+				return false
+			}
+			switch op {
+			case "gt":
+				return n > expectedNum
+			case "gte":
+				return n >= expectedNum
+			case "lt":
+				return n < expectedNum
+			}
+			return n <= expectedNum
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported op: %s", r.Op)
+}
+
+func scalarToString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// toNumber converts the numeric types found in events
+// and configs, including numbers in strings.
+func toNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
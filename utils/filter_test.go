@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/go-uspclient/protocol"
+)
+
+func TestFilterRules(t *testing.T) {
+	evt := Dict{
+		"event": map[string]interface{}{
+			"level":  "DEBUG",
+			"status": uint64(404),
+			"ratio":  0.25,
+			"tags":   []interface{}{"a", "noisy"},
+			"count":  "12",
+		},
+		"host": "web-1.example.com",
+	}
+
+	cases := []struct {
+		rule    FilterRule
+		isMatch bool
+	}{
+		{FilterRule{Op: "equals", Path: "event/level", Value: "DEBUG"}, true},
+		{FilterRule{Op: "equals", Path: "event/level", Value: "debug"}, false},
+		{FilterRule{Op: "equals", Path: "event/level", Value: "debug", IsCaseInsensitive: true}, true},
+		{FilterRule{Op: "equals", Path: "event/status", Value: 404}, true},
+		{FilterRule{Op: "equals", Path: "event/status", Value: "404"}, true},
+		{FilterRule{Op: "equals", Path: "event/tags", Value: "noisy"}, true},
+		{FilterRule{Op: "equals", Path: "event/missing", Value: "x"}, false},
+		{FilterRule{Op: "contains", Path: "host", Value: "example"}, true},
+		{FilterRule{Op: "regex", Path: "host", Value: `^web-\d+\.`}, true},
+		{FilterRule{Op: "regex", Path: "event/status", Value: `^4\d\d$`}, true},
+		{FilterRule{Op: "exists", Path: "event/ratio"}, true},
+		{FilterRule{Op: "exists", Path: "event/missing"}, false},
+		{FilterRule{Op: "gte", Path: "event/status", Value: 400}, true},
+		{FilterRule{Op: "lt", Path: "event/ratio", Value: 0.1}, false},
+		{FilterRule{Op: "gt", Path: "event/count", Value: 10}, true},
+		{FilterRule{Op: "lte", Path: "event/level", Value: 10}, false},
+		{FilterRule{Op: "and", Rules: []FilterRule{
+			{Op: "equals", Path: "event/level", Value: "DEBUG"},
+			{Op: "exists", Path: "event/missing"},
+		}}, false},
+		{FilterRule{Op: "or", Rules: []FilterRule{
+			{Op: "equals", Path: "event/level", Value: "INFO"},
+			{Op: "gt", Path: "event/status", Value: 399},
+		}}, true},
+		{FilterRule{Op: "not", Rules: []FilterRule{
+			{Op: "exists", Path: "event/missing"},
+		}}, true},
+	}
+	for i, c := range cases {
+		f, err := c.rule.Compile()
+		if err != nil {
+			t.Errorf("%d: Compile(): %v", i, err)
+			continue
+		}
+		if f(evt) != c.isMatch {
+			t.Errorf("%d: %+v should match: %v", i, c.rule, c.isMatch)
+		}
+	}
+
+	for i, rule := range []FilterRule{
+		{Op: "equals", Value: "x"},
+		{Op: "equals", Path: "a"},
+		{Op: "regex", Path: "a", Value: "("},
+		{Op: "gt", Path: "a", Value: "abc"},
+		{Op: "and"},
+		{Op: "not", Rules: []FilterRule{{Op: "exists", Path: "a"}, {Op: "exists", Path: "b"}}},
+		{Op: "unknown", Path: "a", Value: "x"},
+	} {
+		if _, err := rule.Compile(); err == nil {
+			t.Errorf("%d: %+v should be invalid", i, rule)
+		}
+	}
+}
+
+func TestUSPClientDropRules(t *testing.T) {
+	c, err := NewUSPClient(context.Background(), uspclient.ClientOptions{
+		TestSinkMode: true,
+		DebugLog:     func(msg string) {},
+		OnWarning:    func(msg string) {},
+		OnError:      func(err error) {},
+	}, PipelineConfig{
+		DropRules: []FilterRule{
+			{Name: "debug", Op: "equals", Path: "level", Value: "debug"},
+			{Op: "regex", Path: "text", Value: "^healthcheck"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewUSPClient(): %v", err)
+	}
+	defer c.Close()
+
+	for _, msg := range []*protocol.DataMessage{
+		{JsonPayload: map[string]interface{}{"level": "debug"}},
+		{JsonPayload: map[string]interface{}{"level": "debug"}},
+		{JsonPayload: map[string]interface{}{"level": "error"}},
+		{TextPayload: "healthcheck ok"},
+		{TextPayload: "login failed"},
+	} {
+		if err := c.Ship(msg, 1*time.Second); err != nil {
+			t.Errorf("Ship(): %v", err)
+		}
+	}
+	dropped := c.Dropped()
+	if dropped["debug"] != 2 || dropped["drop_rules[1]"] != 1 {
+		t.Errorf("unexpected drop counts: %v", dropped)
+	}
+
+	if _, err := NewUSPClient(context.Background(), uspclient.ClientOptions{}, PipelineConfig{
+		DropRules: []FilterRule{{Op: "regex", Path: "a", Value: "("}},
+	}); err == nil {
+		t.Error("invalid rule should fail")
+	}
+}
+
+func TestParseCLIPipeline(t *testing.T) {
+	type adapterConfig struct {
+		Port     int            `json:"port"`
+		Pipeline PipelineConfig `json:"pipeline"`
+	}
+	out := adapterConfig{}
+	if err := ParseCLI("", []string{"port=514"}, &out); err != nil {
+		t.Errorf("ParseCLI(): %v", err)
+	}
+	if out.Port != 514 {
+		t.Errorf("unexpected port: %d", out.Port)
+	}
+}
@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const samplingResolution = 1000000
+
+type Sampler interface {
+	// IsSampled returns true if the element with this
+	// key should be kept, always the same for a key.
+	IsSampled(key string) bool
+}
+
+type hashSampler struct {
+	threshold uint64
+}
+
+// NewHashSampler keeps the rate, from 0 to 1, of the keys.
+func NewHashSampler(rate float64) (Sampler, error) {
+	if rate <= 0 || rate > 1 {
+		return nil, errors.New("rate must be between 0 and 1")
+	}
+	return &hashSampler{
+		threshold: uint64(rate * samplingResolution),
+	}, nil
+}
+
+func (s *hashSampler) IsSampled(key string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()%samplingResolution < s.threshold
+}
+
+// AggregatedElement is the first element added with a
+// key during a window and how many were added.
+type AggregatedElement struct {
+	Key       string
+	Element   interface{}
+	Count     uint64
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+type Aggregator interface {
+	Add(key string, element interface{})
+	// Flush sends all the current aggregates.
+	Flush()
+	Close()
+}
+
+type localAggregator struct {
+	window  time.Duration
+	maxKeys int
+	onFlush func([]AggregatedElement)
+
+	stopEvt    *Event
+	m          sync.Mutex
+	mFlush     sync.Mutex
+	aggregates map[string]*AggregatedElement
+	order      []string
+}
+
+// NewLocalAggregator aggregates the elements with the same key over
+// the window, onFlush receives the aggregates in the order their key
+// was first seen. Windows are flushed early when they reach maxKeys.
+func NewLocalAggregator(window time.Duration, maxKeys int, onFlush func([]AggregatedElement)) (Aggregator, error) {
+	if window <= 0 {
+		return nil, errors.New("window must be positive")
+	}
+	if maxKeys <= 0 {
+		return nil, errors.New("maxKeys must be positive")
+	}
+	a := &localAggregator{
+		window:     window,
+		maxKeys:    maxKeys,
+		onFlush:    onFlush,
+		stopEvt:    NewEvent(),
+		aggregates: make(map[string]*AggregatedElement),
+	}
+
+	go func() {
+		for !a.stopEvt.WaitFor(a.window) {
+			a.Flush()
+		}
+	}()
+
+	return a, nil
+}
+
+func (a *localAggregator) Add(key string, element interface{}) {
+	now := time.Now()
+	a.m.Lock()
+	if agg, ok := a.aggregates[key]; ok {
+		agg.Count++
+		agg.LastSeen = now
+		a.m.Unlock()
+		return
+	}
+	a.aggregates[key] = &AggregatedElement{
+		Key:       key,
+		Element:   element,
+		Count:     1,
+		FirstSeen: now,
+		LastSeen:  now,
+	}
+	a.order = append(a.order, key)
+	isFull := len(a.order) >= a.maxKeys
+	a.m.Unlock()
+
+	if isFull {
+		a.Flush()
+	}
+}
+
+func (a *localAggregator) Flush() {
+	// Flushes are serialized so the
+	// aggregates are sent in order.
+	a.mFlush.Lock()
+	defer a.mFlush.Unlock()
+
+	a.m.Lock()
+	aggregates := a.aggregates
+	order := a.order
+	a.aggregates = make(map[string]*AggregatedElement)
+	a.order = nil
+	a.m.Unlock()
+
+	if len(order) == 0 {
+		return
+	}
+	elements := make([]AggregatedElement, 0, len(order))
+	for _, key := range order {
+		elements = append(elements, *aggregates[key])
+	}
+	a.onFlush(elements)
+}
+
+// Close flushes the current aggregates.
+func (a *localAggregator) Close() {
+	a.stopEvt.Set()
+	a.Flush()
+}
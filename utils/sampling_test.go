@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/go-uspclient/protocol"
+)
+
+func TestHashSampler(t *testing.T) {
+	s, err := NewHashSampler(0.1)
+	if err != nil {
+		t.Fatalf("error creating sampler: %v", err)
+	}
+	nSampled := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		isSampled := s.IsSampled(key)
+		if isSampled != s.IsSampled(key) {
+			t.Errorf("%s is not sampled consistently", key)
+		}
+		if isSampled {
+			nSampled++
+		}
+	}
+	if nSampled < 800 || nSampled > 1200 {
+		t.Errorf("unexpected number of sampled keys: %d", nSampled)
+	}
+
+	s, _ = NewHashSampler(1)
+	if !s.IsSampled("key") {
+		t.Error("all keys should be sampled")
+	}
+	for _, rate := range []float64{0, -1, 1.5} {
+		if _, err := NewHashSampler(rate); err == nil {
+			t.Errorf("rate %v should be invalid", rate)
+		}
+	}
+}
+
+func TestLocalAggregator(t *testing.T) {
+	m := sync.Mutex{}
+	flushed := [][]AggregatedElement{}
+	a, err := NewLocalAggregator(1*time.Hour, 3, func(elements []AggregatedElement) {
+		m.Lock()
+		defer m.Unlock()
+		flushed = append(flushed, elements)
+	})
+	if err != nil {
+		t.Fatalf("error creating aggregator: %v", err)
+	}
+
+	a.Add("a", 1)
+	a.Add("b", 2)
+	a.Add("a", 3)
+	a.Flush()
+	if len(flushed) != 1 || len(flushed[0]) != 2 {
+		t.Fatalf("unexpected flush: %+v", flushed)
+	}
+	if agg := flushed[0][0]; agg.Key != "a" || agg.Element != 1 || agg.Count != 2 || agg.LastSeen.Before(agg.FirstSeen) {
+		t.Errorf("unexpected aggregate: %+v", agg)
+	}
+	if agg := flushed[0][1]; agg.Key != "b" || agg.Count != 1 {
+		t.Errorf("unexpected aggregate: %+v", agg)
+	}
+
+	// Flushed early when reaching the max keys.
+	a.Add("a", 1)
+	a.Add("b", 1)
+	a.Add("c", 1)
+	if len(flushed) != 2 || len(flushed[1]) != 3 {
+		t.Errorf("unexpected flush: %+v", flushed)
+	}
+
+	// Flushed on close.
+	a.Add("d", 1)
+	a.Close()
+	if len(flushed) != 3 || flushed[2][0].Key != "d" {
+		t.Errorf("unexpected flush: %+v", flushed)
+	}
+
+	if _, err := NewLocalAggregator(0, 1, nil); err == nil {
+		t.Error("window should be invalid")
+	}
+}
+
+func TestLocalAggregatorWindow(t *testing.T) {
+	chFlushed := make(chan []AggregatedElement, 1)
+	a, err := NewLocalAggregator(100*time.Millisecond, 100, func(elements []AggregatedElement) {
+		chFlushed <- elements
+	})
+	if err != nil {
+		t.Fatalf("error creating aggregator: %v", err)
+	}
+	defer a.Close()
+
+	a.Add("a", 1)
+	a.Add("a", 1)
+	select {
+	case elements := <-chFlushed:
+		if len(elements) != 1 || elements[0].Count != 2 {
+			t.Errorf("unexpected flush: %+v", elements)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("window was not flushed")
+	}
+}
+
+func TestUSPClientSampling(t *testing.T) {
+	c, err := NewUSPClient(context.Background(), uspclient.ClientOptions{
+		TestSinkMode: true,
+	}, PipelineConfig{
+		Sampling: SamplingConfig{Rate: 0.5, KeyPaths: []string{"flow/src"}},
+	})
+	if err != nil {
+		t.Fatalf("NewUSPClient(): %v", err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 100; i++ {
+		// Events with the same key are all kept or dropped.
+		for j := 0; j < 3; j++ {
+			c.Ship(&protocol.DataMessage{JsonPayload: map[string]interface{}{
+				"flow": map[string]interface{}{"src": fmt.Sprintf("10.0.0.%d", i), "bytes": j},
+			}}, 1*time.Second)
+		}
+	}
+	if n := c.Dropped()[samplingCounter]; n%3 != 0 || n < 90 || n > 210 {
+		t.Errorf("unexpected number of sampled out events: %d", n)
+	}
+
+	if _, err := NewUSPClient(context.Background(), uspclient.ClientOptions{}, PipelineConfig{
+		Sampling: SamplingConfig{Rate: 2},
+	}); err == nil {
+		t.Error("invalid rate should fail")
+	}
+}
+
+func TestUSPClientAggregation(t *testing.T) {
+	c, err := NewUSPClient(context.Background(), uspclient.ClientOptions{
+		TestSinkMode: true,
+		OnWarning:    func(msg string) {},
+		OnError:      func(err error) { t.Errorf("unexpected error: %v", err) },
+	}, PipelineConfig{
+		Aggregation: AggregationConfig{WindowSec: 3600},
+	})
+	if err != nil {
+		t.Fatalf("NewUSPClient(): %v", err)
+	}
+	defer c.Close()
+
+	first := &protocol.DataMessage{TextPayload: "connection refused"}
+	c.Ship(first, 1*time.Second)
+	c.Ship(&protocol.DataMessage{TextPayload: "connection refused"}, 1*time.Second)
+	single := &protocol.DataMessage{JsonPayload: map[string]interface{}{"a": 1}}
+	c.Ship(single, 1*time.Second)
+	if err := c.Drain(1 * time.Second); err != nil {
+		t.Errorf("Drain(): %v", err)
+	}
+	// The messages of the caller are not changed.
+	if first.JsonPayload != nil || len(single.JsonPayload) != 1 {
+		t.Errorf("messages changed: %+v %+v", first, single)
+	}
+
+	now := time.Now()
+	msg := aggregateMessage(AggregatedElement{Element: first, Count: 2, FirstSeen: now, LastSeen: now})
+	agg, _ := msg.JsonPayload[aggregationField].(map[string]interface{})
+	if msg.JsonPayload["text"] != "connection refused" || msg.TextPayload != "" || agg["count"] != uint64(2) {
+		t.Errorf("unexpected aggregate: %+v", msg)
+	}
+	msg = aggregateMessage(AggregatedElement{Element: single, Count: 3, FirstSeen: now, LastSeen: now})
+	if _, ok := msg.JsonPayload[aggregationField]; !ok || msg.JsonPayload["a"] != 1 {
+		t.Errorf("unexpected aggregate: %+v", msg)
+	}
+	if _, ok := single.JsonPayload[aggregationField]; ok {
+		t.Errorf("message of the caller changed: %+v", single.JsonPayload)
+	}
+	if msg = aggregateMessage(AggregatedElement{Element: single, Count: 1}); msg != single {
+		t.Errorf("single event should not be changed: %+v", msg)
+	}
+
+	if _, err := NewAckedUSPClient(context.Background(), uspclient.ClientOptions{
+		TestSinkMode: true,
+	}, PipelineConfig{
+		Aggregation: AggregationConfig{WindowSec: 60},
+	}); err == nil {
+		t.Error("aggregation should be refused")
+	}
+}
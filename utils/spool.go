@@ -0,0 +1,353 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	spoolSegmentExt     = ".spool"
+	spoolOffsetFile     = "offset"
+	spoolLockFile       = "lock"
+	maxSpoolSegmentSize = 16 * 1024 * 1024
+	spoolHeaderSize     = 4
+)
+
+var ErrSpoolFull = errors.New("spool full")
+
+// Spool is a FIFO queue of records on disk, kept across restarts.
+// Records are appended to segment files deleted once read, the
+// position of the reader is saved in the offset file.
+type Spool struct {
+	dir         string
+	maxBytes    int64
+	segmentSize int64
+
+	m        sync.Mutex
+	segments []uint64
+	size     int64
+	records  uint64
+
+	writer     *os.File
+	writerSize int64
+
+	reader       *os.File
+	readerSeq    uint64
+	readerOffset int64
+	nextOffset   int64
+	offsetFile   *os.File
+	lockFile     *os.File
+}
+
+// NewSpool opens the spool in the directory, creating it if
+// needed, holding at most maxBytes of records. The directory
+// is locked so that only one process uses it.
+func NewSpool(dir string, maxBytes int64) (*Spool, error) {
+	if maxBytes <= 0 {
+		return nil, errors.New("invalid max size")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &Spool{
+		dir:         dir,
+		maxBytes:    maxBytes,
+		segmentSize: maxSpoolSegmentSize,
+	}
+	if s.segmentSize > maxBytes/4 {
+		s.segmentSize = maxBytes / 4
+	}
+
+	var err error
+	if s.lockFile, err = os.OpenFile(filepath.Join(dir, spoolLockFile), os.O_RDWR|os.O_CREATE, 0600); err != nil {
+		return nil, err
+	}
+	if err := lockFile(s.lockFile); err != nil {
+		s.lockFile.Close()
+		return nil, fmt.Errorf("%s is used by another process: %v", dir, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), spoolSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, seq)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	if s.offsetFile, err = os.OpenFile(filepath.Join(dir, spoolOffsetFile), os.O_RDWR|os.O_CREATE, 0600); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load finds the position of the reader and counts
+// the records left from a previous run.
+func (s *Spool) load() error {
+	offset := make([]byte, 16)
+	if n, _ := s.offsetFile.ReadAt(offset, 0); n == len(offset) {
+		s.readerSeq = binary.BigEndian.Uint64(offset[:8])
+		s.readerOffset = int64(binary.BigEndian.Uint64(offset[8:]))
+	}
+
+	// Segments before the reader were already read.
+	for len(s.segments) != 0 && s.segments[0] < s.readerSeq {
+		if err := os.Remove(s.segmentPath(s.segments[0])); err != nil {
+			return err
+		}
+		s.segments = s.segments[1:]
+	}
+	if len(s.segments) == 0 || s.segments[0] != s.readerSeq {
+		s.readerOffset = 0
+	}
+
+	for i, seq := range s.segments {
+		start := int64(0)
+		if i == 0 {
+			start = s.readerOffset
+		}
+		size, nRecords, err := s.scanSegment(seq, start)
+		if err != nil {
+			return err
+		}
+		s.size += size
+		s.records += nRecords
+	}
+
+	if len(s.segments) == 0 {
+		return s.rotate()
+	}
+	s.readerSeq = s.segments[0]
+	last := s.segments[len(s.segments)-1]
+	var err error
+	if s.writer, err = os.OpenFile(s.segmentPath(last), os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return err
+	}
+	info, err := s.writer.Stat()
+	if err != nil {
+		return err
+	}
+	s.writerSize = info.Size()
+	return nil
+}
+
+// scanSegment counts the records of a segment from the offset, a
+// record partially written when the process stopped is truncated.
+func (s *Spool) scanSegment(seq uint64, start int64) (int64, uint64, error) {
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_RDWR, 0600)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	nRecords := uint64(0)
+	offset := start
+	header := make([]byte, spoolHeaderSize)
+	for offset < info.Size() {
+		if _, err := f.ReadAt(header, offset); err != nil {
+			break
+		}
+		next := offset + spoolHeaderSize + int64(binary.BigEndian.Uint32(header))
+		if next > info.Size() {
+			break
+		}
+		offset = next
+		nRecords++
+	}
+	if offset < info.Size() {
+		if err := f.Truncate(offset); err != nil {
+			return 0, 0, err
+		}
+	}
+	return offset, nRecords, nil
+}
+
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSegmentExt))
+}
+
+// rotate starts a new segment to write to.
+func (s *Spool) rotate() error {
+	seq := s.readerSeq
+	if len(s.segments) != 0 {
+		seq = s.segments[len(s.segments)-1] + 1
+	}
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if s.writer != nil {
+		s.writer.Close()
+	}
+	s.writer = f
+	s.writerSize = 0
+	s.segments = append(s.segments, seq)
+	return nil
+}
+
+// Push appends the record, returns ErrSpoolFull
+// if it would exceed the max size.
+func (s *Spool) Push(data []byte) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	recordSize := int64(spoolHeaderSize + len(data))
+	if s.size+recordSize > s.maxBytes {
+		return ErrSpoolFull
+	}
+	if s.writerSize != 0 && s.writerSize+recordSize > s.segmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	record := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[spoolHeaderSize:], data)
+	if _, err := s.writer.Write(record); err != nil {
+		return err
+	}
+	s.writerSize += recordSize
+	s.size += recordSize
+	s.records++
+	return nil
+}
+
+// Peek returns the oldest record, nil if the spool is empty.
+// The record stays in the spool until Pop is called.
+func (s *Spool) Peek() ([]byte, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.records == 0 {
+		return nil, nil
+	}
+	for {
+		if s.reader == nil {
+			f, err := os.Open(s.segmentPath(s.readerSeq))
+			if err != nil {
+				return nil, err
+			}
+			s.reader = f
+		}
+		header := make([]byte, spoolHeaderSize)
+		_, err := s.reader.ReadAt(header, s.readerOffset)
+		if err == io.EOF && len(s.segments) > 1 {
+			// Done with this segment.
+			if err := s.removeReaderSegment(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := s.reader.ReadAt(data, s.readerOffset+spoolHeaderSize); err != nil {
+			return nil, err
+		}
+		s.nextOffset = s.readerOffset + spoolHeaderSize + int64(len(data))
+		return data, nil
+	}
+}
+
+// Pop removes the record returned by Peek.
+func (s *Spool) Pop() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.records == 0 || s.nextOffset <= s.readerOffset {
+		return errors.New("no record to pop")
+	}
+	s.readerOffset = s.nextOffset
+	s.records--
+
+	// Once empty, restart with a new segment
+	// to reclaim the space on disk.
+	if s.records == 0 {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		for len(s.segments) > 1 {
+			if err := s.removeReaderSegment(); err != nil {
+				return err
+			}
+		}
+	}
+	return s.saveOffset()
+}
+
+func (s *Spool) removeReaderSegment() error {
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+	path := s.segmentPath(s.readerSeq)
+	if info, err := os.Stat(path); err == nil {
+		s.size -= info.Size()
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	s.segments = s.segments[1:]
+	s.readerSeq = s.segments[0]
+	s.readerOffset = 0
+	s.nextOffset = 0
+	return s.saveOffset()
+}
+
+func (s *Spool) saveOffset() error {
+	offset := make([]byte, 16)
+	binary.BigEndian.PutUint64(offset[:8], s.readerSeq)
+	binary.BigEndian.PutUint64(offset[8:], uint64(s.readerOffset))
+	_, err := s.offsetFile.WriteAt(offset, 0)
+	return err
+}
+
+// Depth returns the number of records and
+// the bytes they use on disk.
+func (s *Spool) Depth() (uint64, int64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.records, s.size
+}
+
+func (s *Spool) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var err error
+	// The lock is released last.
+	for _, f := range []*os.File{s.reader, s.writer, s.offsetFile, s.lockFile} {
+		if f == nil {
+			continue
+		}
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
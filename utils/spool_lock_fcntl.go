@@ -0,0 +1,20 @@
+//go:build solaris || aix
+// +build solaris aix
+
+package utils
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on the file,
+// failing if another process holds it. Without
+// flock, it is a record lock on the whole file.
+func lockFile(f *os.File) error {
+	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &syscall.Flock_t{
+		Type:   syscall.F_WRLCK,
+		Whence: io.SeekStart,
+	})
+}
@@ -0,0 +1,202 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSpool(dir, 1024)
+	if err != nil {
+		t.Fatalf("NewSpool(): %v", err)
+	}
+	if data, err := s.Peek(); data != nil || err != nil {
+		t.Errorf("empty spool returned %q, %v", data, err)
+	}
+
+	// Spread over multiple segments.
+	for i := 0; i < 40; i++ {
+		if err := s.Push([]byte(fmt.Sprintf("record-%02d", i))); err != nil {
+			t.Fatalf("Push(): %v", err)
+		}
+	}
+	if err := s.Push(make([]byte, 1024)); err != ErrSpoolFull {
+		t.Errorf("expected full spool: %v", err)
+	}
+	if n, size := s.Depth(); n != 40 || size != 40*13 {
+		t.Errorf("unexpected depth: %d %d", n, size)
+	}
+
+	for i := 0; i < 25; i++ {
+		data, err := s.Peek()
+		if err != nil || string(data) != fmt.Sprintf("record-%02d", i) {
+			t.Fatalf("unexpected record %d: %q %v", i, data, err)
+		}
+		if err := s.Pop(); err != nil {
+			t.Fatalf("Pop(): %v", err)
+		}
+	}
+	s.Close()
+
+	// Records left are kept across restarts.
+	if s, err = NewSpool(dir, 1024); err != nil {
+		t.Fatalf("NewSpool(): %v", err)
+	}
+	if n, _ := s.Depth(); n != 15 {
+		t.Errorf("unexpected depth: %d", n)
+	}
+	for i := 25; i < 40; i++ {
+		data, err := s.Peek()
+		if err != nil || string(data) != fmt.Sprintf("record-%02d", i) {
+			t.Fatalf("unexpected record %d: %q %v", i, data, err)
+		}
+		s.Pop()
+	}
+	if n, size := s.Depth(); n != 0 || size != 0 {
+		t.Errorf("unexpected depth: %d %d", n, size)
+	}
+	if segments, _ := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt)); len(segments) != 1 {
+		t.Errorf("unexpected segments: %v", segments)
+	}
+	s.Close()
+}
+
+func TestSpoolPartialRecord(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSpool(dir, 1024)
+	if err != nil {
+		t.Fatalf("NewSpool(): %v", err)
+	}
+	s.Push([]byte("complete"))
+	s.Close()
+
+	// Record cut while being written.
+	f, _ := os.OpenFile(s.segmentPath(s.readerSeq), os.O_WRONLY|os.O_APPEND, 0600)
+	f.Write([]byte{0, 0, 0, 10, 'p', 'a'})
+	f.Close()
+
+	if s, err = NewSpool(dir, 1024); err != nil {
+		t.Fatalf("NewSpool(): %v", err)
+	}
+	defer s.Close()
+	if n, _ := s.Depth(); n != 1 {
+		t.Errorf("unexpected depth: %d", n)
+	}
+	s.Push([]byte("next"))
+	for _, expected := range []string{"complete", "next"} {
+		if data, _ := s.Peek(); string(data) != expected {
+			t.Errorf("unexpected record: %q", data)
+		}
+		s.Pop()
+	}
+}
+
+func TestUSPClientSpoolReplay(t *testing.T) {
+	dir := t.TempDir()
+	opts := uspclient.ClientOptions{
+		TestSinkMode:  true,
+		SensorSeedKey: "test",
+		OnWarning:     func(msg string) {},
+		OnError:       func(err error) { t.Errorf("unexpected error: %v", err) },
+	}
+
+	// Events spooled by a previous run.
+	s, err := NewSpool(filepath.Join(dir, spoolName(opts)), 1024*1024)
+	if err != nil {
+		t.Fatalf("NewSpool(): %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		data, _ := msgpack.Marshal(&protocol.DataMessage{JsonPayload: map[string]interface{}{"i": i}})
+		s.Push(data)
+	}
+	s.Close()
+
+	c, err := NewUSPClient(context.Background(), opts, PipelineConfig{
+		Spool: SpoolConfig{Directory: dir, MaxSizeMB: 1},
+	})
+	if err != nil {
+		t.Fatalf("NewUSPClient(): %v", err)
+	}
+	defer c.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n, _ := c.SpoolDepth()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("spool not replayed: %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := c.Ship(&protocol.DataMessage{TextPayload: "live"}, 1*time.Second); err != nil {
+		t.Errorf("Ship(): %v", err)
+	}
+
+	stats := GetPipelineStats()
+	if len(stats) != 1 || stats[0].SensorSeedKey != "test" || stats[0].SpoolRecords != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestUSPClientSpoolClose(t *testing.T) {
+	dir := t.TempDir()
+	opts := uspclient.ClientOptions{
+		TestSinkMode:  true,
+		SensorSeedKey: "test",
+		OnWarning:     func(msg string) {},
+		OnError:       func(err error) { t.Errorf("unexpected error: %v", err) },
+	}
+	c, err := NewUSPClient(context.Background(), opts, PipelineConfig{
+		Spool: SpoolConfig{Directory: dir, MaxSizeMB: 1},
+	})
+	if err != nil {
+		t.Fatalf("NewUSPClient(): %v", err)
+	}
+
+	// The spool is used by this client only.
+	if _, err := NewSpool(filepath.Join(dir, spoolName(opts)), 1024); err == nil {
+		t.Error("spool should be locked")
+	}
+
+	// Stop the replay to keep the events in the spool, like
+	// the events returned by the client when it is closed.
+	c.stopEvt.Set()
+	c.wgReplay.Wait()
+	tooLarge := &protocol.DataMessage{TextPayload: string(make([]byte, 2*1024*1024))}
+	unsent := c.spoolUnsent([]*protocol.DataMessage{
+		{TextPayload: "first"},
+		tooLarge,
+		{TextPayload: "second"},
+	})
+	if len(unsent) != 1 || unsent[0] != tooLarge {
+		t.Errorf("unexpected unsent events: %d", len(unsent))
+	}
+	if _, err := c.Close(); err != nil {
+		t.Errorf("Close(): %v", err)
+	}
+
+	s, err := NewSpool(filepath.Join(dir, spoolName(opts)), 1024*1024)
+	if err != nil {
+		t.Fatalf("NewSpool(): %v", err)
+	}
+	defer s.Close()
+	for _, expected := range []string{"first", "second"} {
+		data, _ := s.Peek()
+		msg := &protocol.DataMessage{}
+		if err := msgpack.Unmarshal(data, msg); err != nil || msg.TextPayload != expected {
+			t.Errorf("unexpected event: %+v %v", msg, err)
+		}
+		s.Pop()
+	}
+}
@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	// Largest chunk of data we will ship in a single bundle.
+	MaxStreamChunkSize = 1024 * 1024 * 100 // 100 MB
+
+	// Default memory ceiling for adapters downloading objects.
+	DefaultMaxMemoryMB = 512
+
+	streamReadBufferSize = 1024 * 64
+)
+
+var ErrRecordTooLarge = errors.New("record too large")
+
+// MemoryBudget caps the amount of memory used to hold object
+// data by a set of concurrent downloaders. The budget is split
+// evenly in chunks, one per concurrent consumer, so that every
+// consumer can always make progress.
+type MemoryBudget struct {
+	sem        *semaphore.Weighted
+	chunkSize  int64
+	recordSize int64
+}
+
+func NewMemoryBudget(maxBytes int64, nConcurrent int) *MemoryBudget {
+	if nConcurrent <= 0 {
+		nConcurrent = 1
+	}
+	chunkSize := maxBytes / int64(nConcurrent)
+	if chunkSize > MaxStreamChunkSize {
+		chunkSize = MaxStreamChunkSize
+	}
+	if chunkSize <= 0 {
+		chunkSize = 1
+	}
+	recordSize := chunkSize * int64(nConcurrent)
+	if recordSize > MaxStreamChunkSize {
+		recordSize = MaxStreamChunkSize
+	}
+	return &MemoryBudget{
+		sem:        semaphore.NewWeighted(chunkSize * int64(nConcurrent)),
+		chunkSize:  chunkSize,
+		recordSize: recordSize,
+	}
+}
+
+// NewFetchMemoryBudgets splits maxBytes between the fetchers
+// downloading files ahead and the file currently being streamed.
+// The fetched files are only released once shipped after the
+// streamed one, so the streamed file gets its own budget, up to
+// half of maxBytes, for its records to use without waiting on them.
+func NewFetchMemoryBudgets(maxBytes int64, nFetchers int) (fetch *MemoryBudget, stream *MemoryBudget) {
+	streamBytes := maxBytes / 2
+	if streamBytes > MaxStreamChunkSize {
+		streamBytes = MaxStreamChunkSize
+	}
+	return NewMemoryBudget(maxBytes-streamBytes, nFetchers), NewMemoryBudget(streamBytes, 1)
+}
+
+// ChunkSize is the largest amount of memory a single
+// consumer can reserve at once.
+func (b *MemoryBudget) ChunkSize() int64 {
+	return b.chunkSize
+}
+
+// Acquire blocks until n bytes are available in the budget.
+// Requests larger than the chunk size are capped to it.
+func (b *MemoryBudget) Acquire(n int64) int64 {
+	if n > b.chunkSize {
+		n = b.chunkSize
+	}
+	b.sem.Acquire(context.Background(), n)
+	return n
+}
+
+// RecordSize is the largest record a consumer can hold,
+// borrowing the whole budget, up to MaxStreamChunkSize.
+func (b *MemoryBudget) RecordSize() int64 {
+	return b.recordSize
+}
+
+// AcquireRecord blocks until RecordSize bytes are available.
+// Consumers must not hold any other part of the budget then.
+func (b *MemoryBudget) AcquireRecord() int64 {
+	b.sem.Acquire(context.Background(), b.recordSize)
+	return b.recordSize
+}
+
+func (b *MemoryBudget) Release(n int64) {
+	b.sem.Release(n)
+}
+
+// recordScanner finds where the records of a stream end. JSON
+// values can span several lines, so in streams starting with a
+// JSON object or array only the newlines outside of a value end
+// a record. In other streams every newline does.
+type recordScanner struct {
+	isStarted bool
+	isJSON    bool
+	depth     int
+	inString  bool
+	isEscaped bool
+}
+
+// scan consumes a fragment of a line, and returns
+// whether a record ends with it.
+func (s *recordScanner) scan(frag []byte) bool {
+	for _, c := range frag {
+		if !s.isStarted {
+			if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+				continue
+			}
+			s.isStarted = true
+			s.isJSON = c == '{' || c == '['
+		}
+		if !s.isJSON {
+			break
+		}
+		if s.inString {
+			if s.isEscaped {
+				s.isEscaped = false
+			} else if c == '\\' {
+				s.isEscaped = true
+			} else if c == '"' {
+				s.inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			s.inString = true
+		case '{', '[':
+			s.depth++
+		case '}', ']':
+			s.depth--
+		}
+	}
+	return frag[len(frag)-1] == '\n' && s.depth <= 0
+}
+
+// ChunkStream reads the stream and calls `cb` with chunks of the data
+// no larger than the budget's chunk size. Chunks are always cut at the
+// end of a record so that records are never split, a record larger than
+// the chunk size borrows the whole budget and is shipped on its own, a
+// record larger than the budget's RecordSize fails with ErrRecordTooLarge.
+// The chunk passed to `cb` is not re-used afterwards so it can be
+// retained.
+func ChunkStream(r io.Reader, budget *MemoryBudget, cb func(chunk []byte) error) error {
+	br := bufio.NewReaderSize(r, streamReadBufferSize)
+	chunkSize := budget.ChunkSize()
+
+	reserved := budget.Acquire(chunkSize)
+	buf := []byte{}
+	lastRecordEnd := 0
+	records := recordScanner{}
+
+	flush := func(n int) error {
+		chunk := buf[:n]
+		remainder := make([]byte, len(buf)-n)
+		copy(remainder, buf[n:])
+		buf = remainder
+		lastRecordEnd = 0
+
+		err := cb(chunk)
+		budget.Release(reserved)
+		reserved = 0
+		return err
+	}
+	defer func() {
+		if reserved != 0 {
+			budget.Release(reserved)
+		}
+	}()
+
+	for {
+		frag, readErr := br.ReadSlice('\n')
+		if len(frag) != 0 {
+			if int64(len(buf)+len(frag)) > chunkSize && lastRecordEnd != 0 {
+				if err := flush(lastRecordEnd); err != nil {
+					return err
+				}
+			}
+			if size := int64(len(buf) + len(frag)); size > reserved {
+				if size > budget.RecordSize() {
+					return fmt.Errorf("%w (%d bytes)", ErrRecordTooLarge, budget.RecordSize())
+				}
+				budget.Release(reserved)
+				reserved = 0
+				if size > chunkSize {
+					reserved = budget.AcquireRecord()
+				} else {
+					reserved = budget.Acquire(chunkSize)
+				}
+			}
+			buf = append(buf, frag...)
+			if records.scan(frag) {
+				lastRecordEnd = len(buf)
+			}
+		}
+		if readErr == bufio.ErrBufferFull {
+			continue
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	return flush(len(buf))
+}
+
+// ChunkCompressedStream is like ChunkStream but decompresses
+// the gzip stream first.
+func ChunkCompressedStream(r io.Reader, budget *MemoryBudget, cb func(chunk []byte) error) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	return ChunkStream(gz, budget, cb)
+}
@@ -0,0 +1,206 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestChunkStream(t *testing.T) {
+	b := NewMemoryBudget(32, 2)
+	if b.ChunkSize() != 16 {
+		t.Fatalf("unexpected chunk size: %d", b.ChunkSize())
+	}
+
+	lines := []string{
+		"line 1",
+		"line 2",
+		"a longer line",
+		"line 4",
+		"last no newline",
+	}
+	data := strings.Join(lines, "\n")
+
+	chunks := []string{}
+	if err := ChunkStream(strings.NewReader(data), b, func(chunk []byte) error {
+		chunks = append(chunks, string(chunk))
+		return nil
+	}); err != nil {
+		t.Fatalf("ChunkStream(): %v", err)
+	}
+
+	expected := []string{
+		"line 1\nline 2\n",
+		"a longer line\n",
+		"line 4\n",
+		"last no newline",
+	}
+	if len(chunks) != len(expected) {
+		t.Fatalf("unexpected chunks: %#v", chunks)
+	}
+	for i := range expected {
+		if chunks[i] != expected[i] {
+			t.Errorf("chunk %d mismatch: %q != %q", i, chunks[i], expected[i])
+		}
+	}
+	if strings.Join(chunks, "") != data {
+		t.Error("reassembled data mismatch")
+	}
+
+	// The whole budget must have been released.
+	if !b.sem.TryAcquire(32) {
+		t.Error("budget not released")
+	}
+}
+
+func TestChunkCompressedStream(t *testing.T) {
+	b := NewMemoryBudget(1024*1024, 1)
+
+	data := strings.Repeat("{\"some\":\"event\"}\n", 1000)
+	compressed := bytes.Buffer{}
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(data))
+	gz.Close()
+
+	out := bytes.Buffer{}
+	if err := ChunkCompressedStream(&compressed, b, func(chunk []byte) error {
+		out.Write(chunk)
+		return nil
+	}); err != nil {
+		t.Fatalf("ChunkCompressedStream(): %v", err)
+	}
+	if out.String() != data {
+		t.Error("decompressed data mismatch")
+	}
+}
+
+func TestChunkStreamCallbackError(t *testing.T) {
+	b := NewMemoryBudget(8, 1)
+	errTest := errors.New("test")
+	n := 0
+	err := ChunkStream(strings.NewReader("aaaa\nbbbb\ncccc\n"), b, func(chunk []byte) error {
+		n++
+		return errTest
+	})
+	if err != errTest {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("callback should stop after error: %d", n)
+	}
+	if !b.sem.TryAcquire(8) {
+		t.Error("budget not released")
+	}
+}
+
+func TestChunkStreamLargeRecord(t *testing.T) {
+	b := NewMemoryBudget(32, 2)
+	if b.RecordSize() != 32 {
+		t.Fatalf("unexpected record size: %d", b.RecordSize())
+	}
+	chunks := []string{}
+	// A record larger than the chunk borrows the whole budget.
+	data := "line 1\n" + strings.Repeat("x", 24) + "\nline 3\n"
+	if err := ChunkStream(strings.NewReader(data), b, func(chunk []byte) error {
+		chunks = append(chunks, string(chunk))
+		if len(chunk) > 16 && b.sem.TryAcquire(1) {
+			t.Error("large record not holding the whole budget")
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("ChunkStream(): %v", err)
+	}
+	expected := []string{"line 1\n", strings.Repeat("x", 24) + "\n", "line 3\n"}
+	if strings.Join(chunks, "|") != strings.Join(expected, "|") {
+		t.Errorf("unexpected chunks: %#v", chunks)
+	}
+	if !b.sem.TryAcquire(32) {
+		t.Error("budget not released")
+	}
+}
+
+func TestChunkStreamRecordTooLarge(t *testing.T) {
+	b := NewMemoryBudget(32, 2)
+	chunks := []string{}
+	// Like a file with a single JSON object on one line.
+	data := "line 1\n" + strings.Repeat("x", 100) + "\nline 3\n"
+	err := ChunkStream(strings.NewReader(data), b, func(chunk []byte) error {
+		chunks = append(chunks, string(chunk))
+		return nil
+	})
+	if !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(chunks) != 1 || chunks[0] != "line 1\n" {
+		t.Errorf("unexpected chunks: %#v", chunks)
+	}
+	if !b.sem.TryAcquire(32) {
+		t.Error("budget not released")
+	}
+}
+
+func TestChunkStreamMultiLineJSON(t *testing.T) {
+	b := NewMemoryBudget(64, 2)
+	records := []string{
+		"{\n  \"a\": 1\n}\n",
+		"{\n  \"b\": \"}\\\"{\"\n}\n",
+		"{\"c\": [\n 1,\n 2\n]}\n",
+	}
+	data := strings.Join(records, "")
+	chunks := []string{}
+	if err := ChunkStream(strings.NewReader(data), b, func(chunk []byte) error {
+		chunks = append(chunks, string(chunk))
+		return nil
+	}); err != nil {
+		t.Fatalf("ChunkStream(): %v", err)
+	}
+	if strings.Join(chunks, "") != data {
+		t.Error("reassembled data mismatch")
+	}
+	for _, c := range chunks {
+		for _, r := range strings.SplitAfter(c, "}\n") {
+			if r == "" {
+				continue
+			}
+			found := false
+			for _, e := range records {
+				if r == e {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("record split: %q", r)
+			}
+		}
+	}
+
+	// A JSON array is a single record.
+	data = "[\n" + strings.Repeat("  {\"a\": 1},\n", 3) + "  {\"a\": 1}\n]\n"
+	chunks = []string{}
+	if err := ChunkStream(strings.NewReader(data), b, func(chunk []byte) error {
+		chunks = append(chunks, string(chunk))
+		return nil
+	}); err != nil {
+		t.Fatalf("ChunkStream(): %v", err)
+	}
+	if len(chunks) != 1 || chunks[0] != data {
+		t.Errorf("unexpected chunks: %#v", chunks)
+	}
+}
+
+func TestNewFetchMemoryBudgets(t *testing.T) {
+	fetch, stream := NewFetchMemoryBudgets(DefaultMaxMemoryMB*1024*1024, 8)
+	if stream.ChunkSize() != MaxStreamChunkSize || stream.RecordSize() != MaxStreamChunkSize {
+		t.Errorf("unexpected stream budget: %d %d", stream.ChunkSize(), stream.RecordSize())
+	}
+	if fetch.ChunkSize() != (DefaultMaxMemoryMB*1024*1024-MaxStreamChunkSize)/8 {
+		t.Errorf("unexpected fetch chunk size: %d", fetch.ChunkSize())
+	}
+
+	fetch, stream = NewFetchMemoryBudgets(64, 2)
+	if stream.RecordSize() != 32 || fetch.ChunkSize() != 16 {
+		t.Errorf("unexpected budgets: %d %d", stream.RecordSize(), fetch.ChunkSize())
+	}
+}
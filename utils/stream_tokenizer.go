@@ -7,41 +7,58 @@ type StreamTokenizer struct {
 	ExpectedSize int
 	Token        byte
 	currentData  []byte
+	isDiscarding bool
 }
 
 var ErrorTooLarge = errors.New("too large")
 
+// Add returns the records completed by data. A record larger
+// than MaxSize is discarded up to the next token and reported
+// as ErrorTooLarge along with the other complete records.
 func (t *StreamTokenizer) Add(data []byte) ([][]byte, error) {
 	dataStart := 0
 
 	toReport := [][]byte{}
+	var err error
 
 	for i, b := range data {
-		if b == t.Token {
-			// Found a newline, so we can use what we
-			// have accumulated before plus this as
-			// a message.
-			if i-1 > dataStart {
-				t.currentData = append(t.currentData, data[dataStart:i]...)
-				if t.MaxSize != 0 && len(t.currentData) > t.MaxSize {
-					t.currentData = nil
-					return nil, ErrorTooLarge
-				}
-			}
-			dataStart = i + 1
-			toReport = append(toReport, t.currentData)
-			t.currentData = make([]byte, 0, t.ExpectedSize)
+		if b != t.Token {
 			continue
 		}
-		if len(data)-1 == i {
-			// This is the end of the buffer and
-			// we got no newline, keep it for later.
-			t.currentData = append(t.currentData, data[dataStart:i+1]...)
+		// Found a token, so we can use what we
+		// have accumulated before plus this as
+		// a message.
+		if !t.isDiscarding {
+			t.currentData = append(t.currentData, data[dataStart:i]...)
 			if t.MaxSize != 0 && len(t.currentData) > t.MaxSize {
-				t.currentData = nil
-				return nil, ErrorTooLarge
+				err = ErrorTooLarge
+			} else {
+				toReport = append(toReport, t.currentData)
 			}
 		}
+		t.isDiscarding = false
+		dataStart = i + 1
+		t.currentData = make([]byte, 0, t.ExpectedSize)
+	}
+
+	// This is the end of the buffer and
+	// we got no token, keep it for later.
+	if !t.isDiscarding && dataStart < len(data) {
+		t.currentData = append(t.currentData, data[dataStart:]...)
+		if t.MaxSize != 0 && len(t.currentData) > t.MaxSize {
+			t.currentData = nil
+			t.isDiscarding = true
+			err = ErrorTooLarge
+		}
 	}
-	return toReport, nil
+	return toReport, err
+}
+
+// Flush returns the data accumulated since the last
+// token, for streams not ending with a token.
+func (t *StreamTokenizer) Flush() []byte {
+	data := t.currentData
+	t.currentData = nil
+	t.isDiscarding = false
+	return data
 }
@@ -115,3 +115,43 @@ func TestStreamTokenizerBounds(t *testing.T) {
 		}
 	}
 }
+
+func TestStreamTokenizerDiscardTooLarge(t *testing.T) {
+	s := StreamTokenizer{
+		MaxSize: 5,
+		Token:   0x00,
+	}
+
+	elems, err := s.Add([]byte("a\x00toolong"))
+	if err != ErrorTooLarge {
+		t.Errorf("expected too large: %v", err)
+	}
+	if len(elems) != 1 || string(elems[0]) != "a" {
+		t.Errorf("unexpected chunks: %q", elems)
+	}
+
+	// The rest of the large record is discarded.
+	elems, err = s.Add([]byte("stilltoolong\x00ok\x00last"))
+	if err != nil {
+		t.Errorf("Add(): %v", err)
+	}
+	if len(elems) != 1 || string(elems[0]) != "ok" {
+		t.Errorf("unexpected chunks: %q", elems)
+	}
+
+	elems, err = s.Add([]byte("toolong\x00b\x00"))
+	if err != ErrorTooLarge {
+		t.Errorf("expected too large: %v", err)
+	}
+	if len(elems) != 1 || string(elems[0]) != "b" {
+		t.Errorf("unexpected chunks: %q", elems)
+	}
+
+	s.Add([]byte("end"))
+	if string(s.Flush()) != "end" {
+		t.Error("unexpected flushed data")
+	}
+	if len(s.Flush()) != 0 {
+		t.Error("flush should reset the data")
+	}
+}
@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// LoadServerTLSConfig returns the TLS configuration of a listening
+// adapter. When mutualTlsCertPath is set, clients are required to
+// present a certificate signed by the CA it contains.
+func LoadServerTLSConfig(certPath string, keyPath string, mutualTlsCertPath string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading certificate with cert path '%s' and key path '%s': %s", certPath, keyPath, err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	// If mutual TLS is enabled, load the client certificate.
+	if mutualTlsCertPath != "" {
+		caCert, err := os.ReadFile(mutualTlsCertPath)
+		if err != nil {
+			return nil, fmt.Errorf("error loading mutual TLS certificate with path '%s': %s", mutualTlsCertPath, err)
+		}
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(caCert)
+		tlsConfig.ClientCAs = caCertPool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,472 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const defaultRedaction = "[REDACTED]"
+
+// Transform modifies events before they are shipped, like:
+//
+//   - op: parse_kv
+//     path: text
+//     to: /
+//   - op: hash
+//     patterns: [email]
+//     key: my-secret
+//   - op: rename
+//     path: src
+//     to: network/source_ip
+//
+// Paths use the same syntax as the Dict accessors, without wildcards,
+// and an empty path is the whole event. Text events are transformed
+// as {"text": <event>}.
+type Transform struct {
+	// One of "rename", "delete", "add", "hash", "redact",
+	// "truncate", "parse_json" or "parse_kv".
+	Op   string `json:"op" yaml:"op"`
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+	// Destination of "rename" and of the parsed values, "/" merges
+	// them in the event. Parsed values replace the string by default.
+	To string `json:"to,omitempty" yaml:"to,omitempty"`
+	// Value set by "add".
+	Value interface{} `json:"value,omitempty" yaml:"value,omitempty"`
+
+	// "hash" and "redact" replace the whole values, or only the parts
+	// matching the regex or the patterns "email", "ip" and "token".
+	Patterns []string `json:"patterns,omitempty" yaml:"patterns,omitempty"`
+	Regex    string   `json:"regex,omitempty" yaml:"regex,omitempty"`
+	// HMAC-SHA256 key of "hash", the same values always
+	// hash the same so they can still be correlated.
+	Key string `json:"key,omitempty" yaml:"key,omitempty"`
+	// Replaces values for "redact", defaults to "[REDACTED]".
+	Replacement string `json:"replacement,omitempty" yaml:"replacement,omitempty"`
+
+	// Strings longer than this are truncated by "truncate".
+	MaxLength int `json:"max_length,omitempty" yaml:"max_length,omitempty"`
+
+	// Separators of "parse_kv", default to " " and "=".
+	FieldSeparator string `json:"field_separator,omitempty" yaml:"field_separator,omitempty"`
+	KVSeparator    string `json:"kv_separator,omitempty" yaml:"kv_separator,omitempty"`
+}
+
+// TransformFunc is a compiled Transform, modifying the event in place.
+type TransformFunc func(evt Dict)
+
+var piiPatterns = map[string]*regexp.Regexp{
+	"email": regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+	// IPv4 addresses, IPv6 ones are matched with ipv6Candidates.
+	"ip": regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`),
+	// JWTs and bearer tokens.
+	"token": regexp.MustCompile(`\beyJ[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]+\.[A-Za-z0-9_\-]*|(?i:bearer)\s+[A-Za-z0-9._~+/\-]+=*`),
+}
+
+// ipv6Candidates may include a leading "key:" or a
+// trailing ":port", they are checked with net.ParseIP.
+var ipv6Candidates = regexp.MustCompile(`(?:\b[0-9A-Fa-f]+)?:[0-9A-Fa-f:]*:[0-9A-Fa-f.]*`)
+
+// replaceIPs replaces the IPv6 and IPv4 addresses in s.
+func replaceIPs(s string, ipv4 *regexp.Regexp, replace func(string) string) string {
+	s = ipv6Candidates.ReplaceAllStringFunc(s, func(m string) string {
+		prefix, ip, suffix := findIPv6(m)
+		if ip == "" {
+			return m
+		}
+		return prefix + replace(ip) + suffix
+	})
+	return ipv4.ReplaceAllStringFunc(s, func(m string) string {
+		if net.ParseIP(m) == nil {
+			return m
+		}
+		return replace(m)
+	})
+}
+
+// findIPv6 splits the candidate around the IPv6 address it
+// contains, trying without a leading "key:" and a trailing
+// ":port" or punctuation.
+func findIPv6(m string) (string, string, string) {
+	starts := []int{0}
+	if i := strings.Index(m, ":"); i != -1 && !strings.HasPrefix(m[i:], "::") {
+		starts = append(starts, i+1)
+	}
+	ends := []int{len(strings.TrimRight(m, ".:"))}
+	if i := strings.LastIndex(m, ":"); i > 0 && m[i-1] != ':' {
+		ends = append(ends, i)
+	}
+	for _, start := range starts {
+		for _, end := range ends {
+			if start >= end {
+				continue
+			}
+			ip := m[start:end]
+			if strings.Count(ip, ":") >= 2 && net.ParseIP(ip) != nil {
+				return m[:start], ip, m[end:]
+			}
+		}
+	}
+	return "", "", ""
+}
+
+func (t Transform) Compile() (TransformFunc, error) {
+	tokens := tokenizePath(t.Path)
+	op := strings.ToLower(t.Op)
+	switch op {
+	case "rename":
+		if len(tokens) == 0 || t.To == "" {
+			return nil, errors.New("rename: missing path or to")
+		}
+		to := tokenizePath(t.To)
+		return func(evt Dict) {
+			if v, ok := removeAtPath(evt, tokens); ok {
+				setAtPath(evt, to, v)
+			}
+		}, nil
+	case "delete":
+		if len(tokens) == 0 {
+			return nil, errors.New("delete: missing path")
+		}
+		return func(evt Dict) {
+			removeAtPath(evt, tokens)
+		}, nil
+	case "add":
+		if len(tokens) == 0 || t.Value == nil {
+			return nil, errors.New("add: missing path or value")
+		}
+		return func(evt Dict) {
+			setAtPath(evt, tokens, t.Value)
+		}, nil
+	case "hash", "redact":
+		replace, err := t.replacer(op)
+		if err != nil {
+			return nil, err
+		}
+		return func(evt Dict) {
+			updateStrings(evt, tokens, replace, true)
+		}, nil
+	case "truncate":
+		if t.MaxLength <= 0 {
+			return nil, errors.New("truncate: missing max_length")
+		}
+		return func(evt Dict) {
+			updateStrings(evt, tokens, func(s string) string {
+				return truncateString(s, t.MaxLength)
+			}, false)
+		}, nil
+	case "parse_json", "parse_kv":
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("%s: missing path", op)
+		}
+		parse := parseJSONValue
+		if op == "parse_kv" {
+			parse = t.kvParser()
+		}
+		to := tokens
+		if t.To != "" {
+			to = tokenizePath(t.To)
+		}
+		return func(evt Dict) {
+			s, ok := getAtPath(evt, tokens).(string)
+			if !ok {
+				return
+			}
+			// Values that do not parse are left as-is.
+			v, ok := parse(s)
+			if !ok {
+				return
+			}
+			setAtPath(evt, to, v)
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported op: %s", t.Op)
+}
+
+// replacer returns the function hashing or redacting a string.
+func (t Transform) replacer(op string) (func(string) string, error) {
+	var replaceValue func(string) string
+	if op == "hash" {
+		if t.Key == "" {
+			return nil, errors.New("hash: missing key")
+		}
+		key := []byte(t.Key)
+		replaceValue = func(s string) string {
+			h := hmac.New(sha256.New, key)
+			h.Write([]byte(s))
+			return hex.EncodeToString(h.Sum(nil))
+		}
+	} else {
+		replacement := t.Replacement
+		if replacement == "" {
+			replacement = defaultRedaction
+		}
+		replaceValue = func(string) string {
+			return replacement
+		}
+	}
+
+	replacers := []func(string) string{}
+	for _, name := range t.Patterns {
+		name = strings.ToLower(name)
+		re, ok := piiPatterns[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown pattern: %s", op, name)
+		}
+		if name == "ip" {
+			replacers = append(replacers, func(s string) string {
+				return replaceIPs(s, re, replaceValue)
+			})
+			continue
+		}
+		replacers = append(replacers, func(s string) string {
+			return re.ReplaceAllStringFunc(s, replaceValue)
+		})
+	}
+	if t.Regex != "" {
+		re, err := regexp.Compile(t.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("%s: regex: %v", op, err)
+		}
+		replacers = append(replacers, func(s string) string {
+			return re.ReplaceAllStringFunc(s, replaceValue)
+		})
+	}
+	if len(replacers) == 0 {
+		if t.Path == "" {
+			return nil, fmt.Errorf("%s: missing path, patterns or regex", op)
+		}
+		return replaceValue, nil
+	}
+	return func(s string) string {
+		for _, replace := range replacers {
+			s = replace(s)
+		}
+		return s
+	}, nil
+}
+
+func (t Transform) kvParser() func(string) (interface{}, bool) {
+	fieldSep := t.FieldSeparator
+	if fieldSep == "" {
+		fieldSep = " "
+	}
+	kvSep := t.KVSeparator
+	if kvSep == "" {
+		kvSep = "="
+	}
+	return func(s string) (interface{}, bool) {
+		out := map[string]interface{}{}
+		for len(s) != 0 {
+			s = strings.TrimLeft(s, fieldSep)
+			i := strings.Index(s, kvSep)
+			if i <= 0 {
+				break
+			}
+			key := strings.TrimSpace(s[:i])
+			s = s[i+len(kvSep):]
+			var value string
+			if strings.HasPrefix(s, `"`) {
+				// Quoted values can contain the separators.
+				end := strings.Index(s[1:], `"`)
+				if end == -1 {
+					value, s = s[1:], ""
+				} else {
+					value, s = s[1:end+1], s[end+2:]
+				}
+			} else if end := strings.Index(s, fieldSep); end == -1 {
+				value, s = s, ""
+			} else {
+				value, s = s[:end], s[end:]
+			}
+			// Words without a kv separator before
+			// the key are skipped.
+			if strings.Contains(key, fieldSep) {
+				key = key[strings.LastIndex(key, fieldSep)+len(fieldSep):]
+			}
+			if key != "" {
+				out[key] = value
+			}
+		}
+		return out, len(out) != 0
+	}
+}
+
+func parseJSONValue(s string) (interface{}, bool) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") && !strings.HasPrefix(s, "[") {
+		return nil, false
+	}
+	d, err := UnmarshalCleanJSON(`{"v":` + s + `}`)
+	if err != nil {
+		return nil, false
+	}
+	return d["v"], true
+}
+
+func truncateString(s string, maxLength int) string {
+	if len(s) <= maxLength {
+		return s
+	}
+	s = s[:maxLength]
+	// Do not split a multi-byte character.
+	for len(s) != 0 && !utf8.ValidString(s) {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// copyDict copies the event deeply enough for the
+// transforms to modify the copy only.
+func copyDict(d map[string]interface{}) Dict {
+	c := make(Dict, len(d))
+	for k, v := range d {
+		c[k] = copyValue(v)
+	}
+	return c
+}
+
+func copyValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return map[string]interface{}(copyDict(val))
+	case Dict:
+		return copyDict(val)
+	case []interface{}:
+		c := make([]interface{}, len(val))
+		for i, e := range val {
+			c[i] = copyValue(e)
+		}
+		return c
+	case List:
+		c := make(List, len(val))
+		for i, e := range val {
+			c[i] = copyValue(e)
+		}
+		return c
+	case nil, string, bool, float64, float32, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, json.Number:
+		return v
+	}
+	// Typed values, like structs or maps of strings, are
+	// converted so that the transforms can access them.
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var converted interface{}
+	if err := json.Unmarshal(data, &converted); err != nil {
+		return v
+	}
+	return converted
+}
+
+func getAtPath(evt Dict, tokens []string) interface{} {
+	var v interface{} = evt
+	for _, token := range tokens {
+		d := effectiveDict(v)
+		if d == nil {
+			return nil
+		}
+		if v = d[token]; v == nil {
+			return nil
+		}
+	}
+	return v
+}
+
+// setAtPath sets the value, creating the parents as
+// needed, or merges it in the event at the root.
+func setAtPath(evt Dict, tokens []string, v interface{}) {
+	if len(tokens) == 0 {
+		if d := effectiveDict(v); d != nil {
+			for k, e := range d {
+				evt[k] = e
+			}
+		}
+		return
+	}
+	parent := evt
+	for _, token := range tokens[:len(tokens)-1] {
+		d := effectiveDict(parent[token])
+		if d == nil {
+			d = Dict{}
+			parent[token] = map[string]interface{}(d)
+		}
+		parent = d
+	}
+	parent[tokens[len(tokens)-1]] = v
+}
+
+func removeAtPath(evt Dict, tokens []string) (interface{}, bool) {
+	parent := effectiveDict(getAtPath(evt, tokens[:len(tokens)-1]))
+	if parent == nil {
+		return nil, false
+	}
+	k := tokens[len(tokens)-1]
+	v, ok := parent[k]
+	delete(parent, k)
+	return v, ok
+}
+
+// updateStrings replaces the strings at the path, and all the ones
+// within it if it is an object or list. Numbers are updated as
+// strings too with isScalars.
+func updateStrings(evt Dict, tokens []string, update func(string) string, isScalars bool) {
+	if len(tokens) == 0 {
+		for k, v := range evt {
+			evt[k] = updateValue(v, update, isScalars)
+		}
+		return
+	}
+	parent := effectiveDict(getAtPath(evt, tokens[:len(tokens)-1]))
+	if parent == nil {
+		return
+	}
+	k := tokens[len(tokens)-1]
+	if v, ok := parent[k]; ok {
+		parent[k] = updateValue(v, update, isScalars)
+	}
+}
+
+func updateValue(v interface{}, update func(string) string, isScalars bool) interface{} {
+	switch val := v.(type) {
+	case string:
+		return update(val)
+	case nil, bool:
+		return val
+	}
+	if d := effectiveDict(v); d != nil {
+		for k, e := range d {
+			d[k] = updateValue(e, update, isScalars)
+		}
+		return v
+	}
+	if l, ok := v.([]interface{}); ok {
+		for i, e := range l {
+			l[i] = updateValue(e, update, isScalars)
+		}
+		return l
+	}
+	if l, ok := v.(List); ok {
+		for i, e := range l {
+			l[i] = updateValue(e, update, isScalars)
+		}
+		return l
+	}
+	if !isScalars {
+		return v
+	}
+	// Other scalars, like numbers.
+	s := fmt.Sprintf("%v", v)
+	if u := update(s); u != s {
+		return u
+	}
+	return v
+}
@@ -0,0 +1,294 @@
+package utils
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/go-uspclient/protocol"
+)
+
+func applyTransforms(t *testing.T, evt Dict, transforms ...Transform) Dict {
+	for i, tr := range transforms {
+		f, err := tr.Compile()
+		if err != nil {
+			t.Fatalf("%d: Compile(): %v", i, err)
+		}
+		f(evt)
+	}
+	return evt
+}
+
+func assertDict(t *testing.T, expected Dict, actual Dict) {
+	e, _ := json.Marshal(expected)
+	a, _ := json.Marshal(actual)
+	if string(e) != string(a) {
+		t.Errorf("mismatch:\n%s\n%s", string(a), string(e))
+	}
+}
+
+func testHMAC(key string, s string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(s))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func TestTransformFields(t *testing.T) {
+	evt := applyTransforms(t, Dict{
+		"src":   "10.0.0.1",
+		"debug": map[string]interface{}{"trace": "x"},
+		"user":  map[string]interface{}{"name": "bob"},
+	},
+		Transform{Op: "rename", Path: "src", To: "network/source_ip"},
+		Transform{Op: "rename", Path: "missing", To: "other"},
+		Transform{Op: "delete", Path: "debug/trace"},
+		Transform{Op: "delete", Path: "user/missing/name"},
+		Transform{Op: "add", Path: "meta/collector", Value: "edge-1"},
+	)
+	assertDict(t, Dict{
+		"debug":   map[string]interface{}{},
+		"meta":    map[string]interface{}{"collector": "edge-1"},
+		"network": map[string]interface{}{"source_ip": "10.0.0.1"},
+		"user":    map[string]interface{}{"name": "bob"},
+	}, evt)
+}
+
+func TestTransformPII(t *testing.T) {
+	evt := applyTransforms(t, Dict{
+		"user":    map[string]interface{}{"email": "bob@example.com", "id": uint64(42)},
+		"message": "login by alice@example.org from 192.168.1.10. at 12:30:45 via fe80::1",
+		"headers": []interface{}{"Authorization: Bearer abc.def-123", "Accept: */*"},
+		"count":   uint64(3),
+	},
+		Transform{Op: "hash", Path: "user/id", Key: "secret"},
+		Transform{Op: "hash", Patterns: []string{"email"}, Key: "secret"},
+		Transform{Op: "redact", Patterns: []string{"ip", "token"}},
+	)
+	assertDict(t, Dict{
+		"count":   uint64(3),
+		"headers": []interface{}{"Authorization: [REDACTED]", "Accept: */*"},
+		"message": "login by " + testHMAC("secret", "alice@example.org") + " from [REDACTED]. at 12:30:45 via [REDACTED]",
+		"user":    map[string]interface{}{"email": testHMAC("secret", "bob@example.com"), "id": testHMAC("secret", "42")},
+	}, evt)
+
+	for input, expected := range map[string]string{
+		"conn 10.0.0.1:443":                      "conn [REDACTED]:443",
+		"addr:10.0.0.1":                          "addr:[REDACTED]",
+		"src:192.168.1.5 dst=8.8.8.8,":           "src:[REDACTED] dst=[REDACTED],",
+		"version 1.2.3 at 12:30:45.123":          "version 1.2.3 at 12:30:45.123",
+		"not an ip 999.1.1.1":                    "not an ip 999.1.1.1",
+		"addr:fe80::1%eth0 and [2001:db8::1]:80": "addr:[REDACTED]%eth0 and [[REDACTED]]:80",
+		"src:2001:db8::5 mapped ::ffff:10.0.0.1": "src:[REDACTED] mapped [REDACTED]",
+		"mac 00:1a:2b:3c:4d:5e":                  "mac 00:1a:2b:3c:4d:5e",
+		"loopback ::1.":                          "loopback [REDACTED].",
+	} {
+		evt = applyTransforms(t, Dict{"message": input}, Transform{Op: "redact", Patterns: []string{"ip"}})
+		if evt["message"] != expected {
+			t.Errorf("redact(%q): %q != %q", input, evt["message"], expected)
+		}
+	}
+
+	evt = applyTransforms(t, Dict{"card": "4111 1111 1111 1111", "note": "ok"},
+		Transform{Op: "redact", Regex: `\d{4} \d{4} \d{4} \d{4}`, Replacement: "****"},
+		Transform{Op: "redact", Path: "note"},
+	)
+	assertDict(t, Dict{"card": "****", "note": "[REDACTED]"}, evt)
+}
+
+func TestTransformTruncateAndParse(t *testing.T) {
+	evt := applyTransforms(t, Dict{
+		"long":    "héllo world",
+		"payload": `{"a":1,"b":["x"]}`,
+		"bad":     `{"a":`,
+		"kv":      `user=bob action="log in" junk status=ok`,
+	},
+		Transform{Op: "truncate", Path: "long", MaxLength: 2},
+		Transform{Op: "parse_json", Path: "payload"},
+		Transform{Op: "parse_json", Path: "bad"},
+		Transform{Op: "parse_kv", Path: "kv", To: "/"},
+	)
+	assertDict(t, Dict{
+		"action":  "log in",
+		"bad":     `{"a":`,
+		"kv":      `user=bob action="log in" junk status=ok`,
+		"long":    "h",
+		"payload": map[string]interface{}{"a": uint64(1), "b": []interface{}{"x"}},
+		"status":  "ok",
+		"user":    "bob",
+	}, evt)
+
+	evt = applyTransforms(t, Dict{
+		"a": "abcdef",
+		"b": map[string]interface{}{"c": "xyz"},
+		"n": uint64(123456),
+	},
+		Transform{Op: "truncate", MaxLength: 2},
+		Transform{Op: "parse_kv", Path: "a", FieldSeparator: ";", KVSeparator: ":"},
+	)
+	assertDict(t, Dict{"a": "ab", "b": map[string]interface{}{"c": "xy"}, "n": uint64(123456)}, evt)
+
+	evt = applyTransforms(t, Dict{"a": "k1:v1;k2:v2"},
+		Transform{Op: "parse_kv", Path: "a", FieldSeparator: ";", KVSeparator: ":"},
+	)
+	assertDict(t, Dict{"a": map[string]interface{}{"k1": "v1", "k2": "v2"}}, evt)
+}
+
+func TestTransformInvalid(t *testing.T) {
+	for i, tr := range []Transform{
+		{Op: "rename", Path: "a"},
+		{Op: "delete"},
+		{Op: "add", Path: "a"},
+		{Op: "hash", Path: "a"},
+		{Op: "redact"},
+		{Op: "redact", Patterns: []string{"phone"}},
+		{Op: "redact", Regex: "("},
+		{Op: "truncate", Path: "a"},
+		{Op: "parse_json"},
+		{Op: "unknown", Path: "a"},
+	} {
+		if _, err := tr.Compile(); err == nil {
+			t.Errorf("%d: %+v should be invalid", i, tr)
+		}
+	}
+}
+
+func TestUSPClientTransforms(t *testing.T) {
+	c, err := NewUSPClient(context.Background(), uspclient.ClientOptions{
+		TestSinkMode: true,
+	}, PipelineConfig{
+		Transforms: []Transform{
+			{Op: "parse_kv", Path: "text", To: "/"},
+			{Op: "redact", Patterns: []string{"email"}},
+		},
+		DropRules: []FilterRule{
+			{Op: "equals", Path: "level", Value: "debug"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewUSPClient(): %v", err)
+	}
+	defer c.Close()
+
+	msg := c.process(&protocol.DataMessage{TextPayload: "level=info user=bob@example.com"})
+	if msg.TextPayload != "" {
+		t.Errorf("text payload not converted: %s", msg.TextPayload)
+	}
+	assertDict(t, Dict{"level": "info", "text": "level=info user=[REDACTED]", "user": "[REDACTED]"}, msg.JsonPayload)
+
+	// Text that does not parse stays text.
+	msg = c.process(&protocol.DataMessage{TextPayload: "contact bob@example.com"})
+	if msg.TextPayload != "contact [REDACTED]" || msg.JsonPayload != nil {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+
+	// Drop rules apply to the transformed events.
+	c.Ship(&protocol.DataMessage{TextPayload: "level=debug"}, 1*time.Second)
+	if dropped := c.Dropped(); dropped["drop_rules[0]"] != 1 {
+		t.Errorf("unexpected drop counts: %v", dropped)
+	}
+}
+
+func TestUSPClientTransformsRetry(t *testing.T) {
+	c, err := NewUSPClient(context.Background(), uspclient.ClientOptions{
+		TestSinkMode: true,
+	}, PipelineConfig{
+		Transforms: []Transform{
+			{Op: "parse_kv", Path: "text", To: "/"},
+			{Op: "hash", Path: "user", Key: "secret"},
+			{Op: "redact", Path: "tags"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewUSPClient(): %v", err)
+	}
+	defer c.Close()
+
+	// Adapters ship the same message again when
+	// the first Ship() fails with ErrorBufferFull.
+	msg := &protocol.DataMessage{TextPayload: "user=bob"}
+	first := c.process(msg)
+	if err := c.Ship(msg, 1*time.Second); err != nil {
+		t.Errorf("Ship(): %v", err)
+	}
+	if msg.TextPayload != "user=bob" || msg.JsonPayload != nil {
+		t.Errorf("message was changed: %+v", msg)
+	}
+	retried := c.process(msg)
+	if first.JsonPayload["user"] != testHMAC("secret", "bob") {
+		t.Errorf("unexpected hash: %+v", first.JsonPayload)
+	}
+	assertDict(t, Dict(first.JsonPayload), retried.JsonPayload)
+
+	nested := &protocol.DataMessage{JsonPayload: map[string]interface{}{
+		"user": "bob",
+		"tags": []interface{}{map[string]interface{}{"user": "bob"}},
+	}}
+	transformed := c.process(nested)
+	assertDict(t, Dict{
+		"user": testHMAC("secret", "bob"),
+		"tags": []interface{}{map[string]interface{}{"user": "[REDACTED]"}},
+	}, transformed.JsonPayload)
+	assertDict(t, Dict{
+		"user": "bob",
+		"tags": []interface{}{map[string]interface{}{"user": "bob"}},
+	}, nested.JsonPayload)
+}
+
+func TestUSPClientTransformsTyped(t *testing.T) {
+	c, err := NewUSPClient(context.Background(), uspclient.ClientOptions{
+		TestSinkMode: true,
+	}, PipelineConfig{
+		Transforms: []Transform{
+			{Op: "redact", Path: "metadata/annotations/owner"},
+			{Op: "delete", Path: "metadata/labels"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewUSPClient(): %v", err)
+	}
+	defer c.Close()
+
+	// Payloads with typed values, like structs.
+	type entity struct {
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+	}
+	msg := c.process(&protocol.DataMessage{JsonPayload: map[string]interface{}{
+		"metadata": entity{
+			Labels:      map[string]string{"app": "web"},
+			Annotations: map[string]string{"owner": "bob@example.com"},
+		},
+	}})
+	assertDict(t, Dict{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{"owner": "[REDACTED]"},
+		},
+	}, msg.JsonPayload)
+}
+
+func TestBundleUSPClient(t *testing.T) {
+	for _, conf := range []PipelineConfig{
+		{Transforms: []Transform{{Op: "delete", Path: "a"}}},
+		{DropRules: []FilterRule{{Op: "exists", Path: "a"}}},
+		{Sampling: SamplingConfig{Rate: 0.5}},
+		{Aggregation: AggregationConfig{WindowSec: 60}},
+	} {
+		if _, err := NewBundleUSPClient(context.Background(), uspclient.ClientOptions{
+			TestSinkMode: true,
+		}, conf); err == nil {
+			t.Errorf("%+v should be refused", conf)
+		}
+	}
+	c, err := NewBundleUSPClient(context.Background(), uspclient.ClientOptions{
+		TestSinkMode: true,
+	}, PipelineConfig{})
+	if err != nil {
+		t.Fatalf("NewBundleUSPClient(): %v", err)
+	}
+	c.Close()
+}
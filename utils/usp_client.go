@@ -0,0 +1,607 @@
+package utils
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	pipelineReportInterval = 1 * time.Minute
+	aggregateShipTimeout   = 10 * time.Minute
+	defaultAggregateKeys   = 10000
+	aggregationField       = "aggregation"
+	samplingCounter        = "sampling"
+	defaultSpoolSizeMB     = 1024
+	spoolShipTimeout       = 1 * time.Second
+	spoolRetryInterval     = 1 * time.Second
+	spoolMaxRetryInterval  = 1 * time.Minute
+)
+
+// PipelineConfig configures the processing applied
+// to the events locally, before they are shipped.
+type PipelineConfig struct {
+	// Applied in order to the events.
+	Transforms []Transform `json:"transforms,omitempty" yaml:"transforms,omitempty"`
+	// Events matching any of the rules once
+	// transformed are dropped.
+	DropRules []FilterRule `json:"drop_rules,omitempty" yaml:"drop_rules,omitempty"`
+	// Applied to the events that were not dropped.
+	Sampling    SamplingConfig    `json:"sampling,omitempty" yaml:"sampling,omitempty"`
+	Aggregation AggregationConfig `json:"aggregation,omitempty" yaml:"aggregation,omitempty"`
+	// Buffers the events on disk when they
+	// cannot be shipped.
+	Spool SpoolConfig `json:"spool,omitempty" yaml:"spool,omitempty"`
+}
+
+// SamplingConfig keeps a fraction of the events, always the
+// same ones for the values at the key paths, or for the whole
+// event without key paths. Disabled when the rate is 0.
+type SamplingConfig struct {
+	Rate     float64  `json:"rate,omitempty" yaml:"rate,omitempty"`
+	KeyPaths []string `json:"key_paths,omitempty" yaml:"key_paths,omitempty"`
+}
+
+// AggregationConfig ships the events with the same values at the
+// key paths, or identical without key paths, once per window with
+// their count. Disabled when the window is 0, and refused by
+// the adapters acknowledging the events once shipped.
+type AggregationConfig struct {
+	WindowSec uint64   `json:"window_sec,omitempty" yaml:"window_sec,omitempty"`
+	KeyPaths  []string `json:"key_paths,omitempty" yaml:"key_paths,omitempty"`
+	// Number of distinct events in a window before
+	// it is shipped early, defaults to 10000.
+	MaxKeys int `json:"max_keys,omitempty" yaml:"max_keys,omitempty"`
+}
+
+// SpoolConfig buffers the events in a directory when the
+// connection falls behind or is down, they are replayed in
+// order once it recovers. Disabled without a directory.
+type SpoolConfig struct {
+	Directory string `json:"directory,omitempty" yaml:"directory,omitempty"`
+	// Size of the spool on disk, defaults to 1024. Once
+	// full, shipping blocks like without a spool.
+	MaxSizeMB int64 `json:"max_size_mb,omitempty" yaml:"max_size_mb,omitempty"`
+}
+
+// USPClient is a uspclient.Client applying the
+// pipeline to the events before shipping them.
+type USPClient struct {
+	*uspclient.Client
+
+	opts       uspclient.ClientOptions
+	transforms []TransformFunc
+	dropRules  []Filter
+	dropNames  []string
+	dropCounts []uint64
+
+	sampler         Sampler
+	samplingKeys    []OpaqueExtractor
+	sampledOut      uint64
+	aggregator      Aggregator
+	aggregationKeys []OpaqueExtractor
+
+	spool *Spool
+	// Held while shipping with the spool
+	// enabled to keep the events in order.
+	mShip    sync.Mutex
+	wgReplay sync.WaitGroup
+
+	stopEvt *Event
+}
+
+func NewUSPClient(ctx context.Context, opts uspclient.ClientOptions, conf PipelineConfig) (*USPClient, error) {
+	c := &USPClient{
+		opts:    opts,
+		stopEvt: NewEvent(),
+	}
+	for i, t := range conf.Transforms {
+		f, err := t.Compile()
+		if err != nil {
+			return nil, fmt.Errorf("pipeline: transforms[%d]: %v", i, err)
+		}
+		c.transforms = append(c.transforms, f)
+	}
+	for i, rule := range conf.DropRules {
+		f, err := rule.Compile()
+		if err != nil {
+			return nil, fmt.Errorf("pipeline: drop_rules[%d]: %v", i, err)
+		}
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("drop_rules[%d]", i)
+		}
+		c.dropRules = append(c.dropRules, f)
+		c.dropNames = append(c.dropNames, name)
+	}
+	c.dropCounts = make([]uint64, len(c.dropRules))
+
+	var err error
+	if conf.Sampling.Rate != 0 {
+		if c.sampler, err = NewHashSampler(conf.Sampling.Rate); err != nil {
+			return nil, fmt.Errorf("pipeline: sampling: %v", err)
+		}
+		c.samplingKeys = makeKeyExtractors(conf.Sampling.KeyPaths)
+	}
+
+	if conf.Spool.Directory != "" {
+		maxSize := conf.Spool.MaxSizeMB
+		if maxSize == 0 {
+			maxSize = defaultSpoolSizeMB
+		}
+		if c.spool, err = NewSpool(filepath.Join(conf.Spool.Directory, spoolName(opts)), maxSize*1024*1024); err != nil {
+			return nil, fmt.Errorf("pipeline: spool: %v", err)
+		}
+	}
+
+	if c.Client, err = uspclient.NewClient(ctx, opts); err != nil {
+		if c.spool != nil {
+			c.spool.Close()
+		}
+		return nil, err
+	}
+
+	if conf.Aggregation.WindowSec != 0 {
+		maxKeys := conf.Aggregation.MaxKeys
+		if maxKeys == 0 {
+			maxKeys = defaultAggregateKeys
+		}
+		c.aggregationKeys = makeKeyExtractors(conf.Aggregation.KeyPaths)
+		if c.aggregator, err = NewLocalAggregator(time.Duration(conf.Aggregation.WindowSec)*time.Second, maxKeys, c.shipAggregates); err != nil {
+			c.Client.Close()
+			if c.spool != nil {
+				c.spool.Close()
+			}
+			return nil, fmt.Errorf("pipeline: aggregation: %v", err)
+		}
+	}
+
+	if c.spool != nil {
+		c.wgReplay.Add(1)
+		go c.replaySpool()
+	}
+	registerPipeline(c)
+
+	if (len(c.dropRules) != 0 || c.sampler != nil) && opts.DebugLog != nil {
+		go c.reportStats()
+	}
+
+	return c, nil
+}
+
+// NewAckedUSPClient is NewUSPClient for adapters acknowledging the
+// events to their source, or saving their progress, once shipped.
+// Aggregation is refused since aggregated events are only sent at
+// the end of the window, after Ship returned, and would be lost on
+// a crash or a failure to send them.
+func NewAckedUSPClient(ctx context.Context, opts uspclient.ClientOptions, conf PipelineConfig) (*USPClient, error) {
+	if conf.Aggregation.WindowSec != 0 {
+		return nil, errors.New("pipeline: aggregation is not supported by this adapter, events are acknowledged to the source once shipped")
+	}
+	return NewUSPClient(ctx, opts, conf)
+}
+
+// NewBundleUSPClient is NewAckedUSPClient for adapters shipping
+// files as bundles of records. The bundles are parsed once sent,
+// so the pipeline stages processing events are refused.
+func NewBundleUSPClient(ctx context.Context, opts uspclient.ClientOptions, conf PipelineConfig) (*USPClient, error) {
+	if len(conf.Transforms) != 0 || len(conf.DropRules) != 0 || conf.Sampling.Rate != 0 || conf.Aggregation.WindowSec != 0 {
+		return nil, errors.New("pipeline: only the spool is supported by this adapter, files are shipped without being parsed")
+	}
+	return NewAckedUSPClient(ctx, opts, conf)
+}
+
+// Ship sends the message through the pipeline, messages
+// dropped by the pipeline are not an error. The message
+// itself is not changed so it can be shipped again.
+func (c *USPClient) Ship(msg *protocol.DataMessage, timeout time.Duration) error {
+	if msg = c.process(msg); msg == nil {
+		return nil
+	}
+	// Bundles are not aggregated.
+	if c.aggregator != nil && payloadDict(msg) != nil {
+		c.aggregator.Add(eventKey(msg, c.aggregationKeys), msg)
+		return nil
+	}
+	return c.send(msg, timeout)
+}
+
+// process returns the message to ship once transformed,
+// or nil if it is dropped or sampled out.
+func (c *USPClient) process(msg *protocol.DataMessage) *protocol.DataMessage {
+	msg = c.transform(msg)
+	if c.isDropped(msg) {
+		return nil
+	}
+	// Bundles are not sampled.
+	if payloadDict(msg) == nil {
+		return msg
+	}
+	if c.sampler != nil && !c.sampler.IsSampled(eventKey(msg, c.samplingKeys)) {
+		atomic.AddUint64(&c.sampledOut, 1)
+		return nil
+	}
+	return msg
+}
+
+// send ships the message, or spools it if the connection
+// is falling behind or events are already spooled.
+func (c *USPClient) send(msg *protocol.DataMessage, timeout time.Duration) error {
+	if c.spool == nil {
+		return c.Client.Ship(msg, timeout)
+	}
+	c.mShip.Lock()
+	if nRecords, _ := c.spool.Depth(); nRecords == 0 {
+		err := c.Client.Ship(msg, spoolShipTimeout)
+		if err != uspclient.ErrorBufferFull {
+			c.mShip.Unlock()
+			return err
+		}
+	}
+	err := c.spoolMessage(msg)
+	c.mShip.Unlock()
+	if err == nil {
+		return nil
+	}
+	if err != ErrSpoolFull {
+		c.opts.OnError(fmt.Errorf("spool: %v", err))
+	}
+	return c.Client.Ship(msg, timeout)
+}
+
+func (c *USPClient) spoolMessage(msg *protocol.DataMessage) error {
+	data, err := msgpack.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.spool.Push(data)
+}
+
+// replaySpool ships the spooled events in order, a spooled
+// event is only removed once it is shipped. Shipping is retried
+// with a backoff on errors, records that cannot be decoded are
+// dropped.
+func (c *USPClient) replaySpool() {
+	defer c.wgReplay.Done()
+	retryInterval := spoolRetryInterval
+	for !c.stopEvt.IsSet() {
+		data, err := c.spool.Peek()
+		if err != nil {
+			c.opts.OnError(fmt.Errorf("spool.Peek(): %v", err))
+			c.stopEvt.WaitFor(spoolRetryInterval)
+			continue
+		}
+		if data == nil {
+			c.stopEvt.WaitFor(spoolRetryInterval)
+			continue
+		}
+		msg := &protocol.DataMessage{}
+		if err := msgpack.Unmarshal(data, msg); err != nil {
+			c.opts.OnError(fmt.Errorf("spool: invalid event: %v", err))
+			c.popSpool()
+			continue
+		}
+		c.mShip.Lock()
+		err = c.Client.Ship(msg, spoolShipTimeout)
+		c.mShip.Unlock()
+		if err == uspclient.ErrorBufferFull {
+			c.stopEvt.WaitFor(spoolRetryInterval)
+			continue
+		}
+		if err != nil {
+			if !c.stopEvt.IsSet() {
+				c.opts.OnError(fmt.Errorf("Ship(): %v, retrying in %v", err, retryInterval))
+			}
+			c.stopEvt.WaitFor(retryInterval)
+			if retryInterval *= 2; retryInterval > spoolMaxRetryInterval {
+				retryInterval = spoolMaxRetryInterval
+			}
+			continue
+		}
+		retryInterval = spoolRetryInterval
+		c.popSpool()
+	}
+}
+
+func (c *USPClient) popSpool() {
+	if err := c.spool.Pop(); err != nil {
+		c.opts.OnError(fmt.Errorf("spool.Pop(): %v", err))
+	}
+}
+
+// SpoolDepth returns the number of events spooled
+// and their size on disk, 0 without a spool.
+func (c *USPClient) SpoolDepth() (uint64, int64) {
+	if c.spool == nil {
+		return 0, 0
+	}
+	return c.spool.Depth()
+}
+
+// Drain ships the current aggregates before draining.
+func (c *USPClient) Drain(timeout time.Duration) error {
+	if c.aggregator != nil {
+		c.aggregator.Flush()
+	}
+	return c.Client.Drain(timeout)
+}
+
+// Close keeps the events still spooled on disk for the next
+// start, with the events not sent yet by the client.
+func (c *USPClient) Close() ([]*protocol.DataMessage, error) {
+	unregisterPipeline(c)
+	if c.aggregator != nil {
+		c.aggregator.Close()
+	}
+	c.stopEvt.Set()
+	c.wgReplay.Wait()
+	messages, err := c.Client.Close()
+	if c.spool != nil {
+		messages = c.spoolUnsent(messages)
+		c.spool.Close()
+	}
+	return messages, err
+}
+
+// spoolUnsent spools the messages the client did not send before
+// closing and returns the ones that could not be. They are behind
+// the events already spooled, so they are replayed out of order.
+func (c *USPClient) spoolUnsent(messages []*protocol.DataMessage) []*protocol.DataMessage {
+	var unsent []*protocol.DataMessage
+	for _, msg := range messages {
+		if err := c.spoolMessage(msg); err != nil {
+			unsent = append(unsent, msg)
+		}
+	}
+	if len(unsent) != 0 {
+		c.opts.OnWarning(fmt.Sprintf("spool: %d unsent events could not be spooled", len(unsent)))
+	}
+	return unsent
+}
+
+// transform returns a copy of the message with the transforms
+// applied, the message itself is left unchanged so that it can
+// be shipped again. Text payloads become JSON ones if they get
+// more fields.
+func (c *USPClient) transform(msg *protocol.DataMessage) *protocol.DataMessage {
+	if len(c.transforms) == 0 {
+		return msg
+	}
+	var evt Dict
+	isText := false
+	if msg.JsonPayload != nil {
+		evt = copyDict(msg.JsonPayload)
+	} else {
+		if msg.TextPayload == "" {
+			return msg
+		}
+		evt = Dict{"text": msg.TextPayload}
+		isText = true
+	}
+	for _, t := range c.transforms {
+		t(evt)
+	}
+	transformed := *msg
+	if !isText {
+		transformed.JsonPayload = evt
+		return &transformed
+	}
+	if text, ok := evt["text"].(string); ok && len(evt) == 1 {
+		transformed.TextPayload = text
+		return &transformed
+	}
+	transformed.TextPayload = ""
+	transformed.JsonPayload = evt
+	return &transformed
+}
+
+// isDropped returns true if the message matches a drop rule,
+// text payloads are matched as {"text": <payload>}.
+func (c *USPClient) isDropped(msg *protocol.DataMessage) bool {
+	if len(c.dropRules) == 0 {
+		return false
+	}
+	evt := payloadDict(msg)
+	if evt == nil {
+		return false
+	}
+	for i, f := range c.dropRules {
+		if f(evt) {
+			atomic.AddUint64(&c.dropCounts[i], 1)
+			return true
+		}
+	}
+	return false
+}
+
+// Dropped returns the number of events dropped by
+// each rule, and by the sampling if enabled.
+func (c *USPClient) Dropped() map[string]uint64 {
+	counts := make(map[string]uint64, len(c.dropNames)+1)
+	for i, name := range c.dropNames {
+		counts[name] = atomic.LoadUint64(&c.dropCounts[i])
+	}
+	if c.sampler != nil {
+		counts[samplingCounter] = atomic.LoadUint64(&c.sampledOut)
+	}
+	return counts
+}
+
+// shipAggregates ships the first event of each aggregate,
+// with its count if it was seen more than once.
+func (c *USPClient) shipAggregates(aggregates []AggregatedElement) {
+	for _, agg := range aggregates {
+		msg := aggregateMessage(agg)
+		err := c.send(msg, aggregateShipTimeout)
+		if err == uspclient.ErrorBufferFull {
+			c.opts.OnWarning("stream falling behind")
+			err = c.send(msg, 1*time.Hour)
+		}
+		if err != nil {
+			c.opts.OnError(fmt.Errorf("Ship(): %v", err))
+		}
+	}
+}
+
+// aggregateMessage returns the message to ship for an aggregate,
+// the message added to the aggregate belongs to the caller of
+// Ship without transforms so it is copied before being changed.
+func aggregateMessage(agg AggregatedElement) *protocol.DataMessage {
+	msg := agg.Element.(*protocol.DataMessage)
+	if agg.Count <= 1 {
+		return msg
+	}
+	aggregated := *msg
+	if msg.JsonPayload == nil {
+		aggregated.JsonPayload = map[string]interface{}{"text": msg.TextPayload}
+		aggregated.TextPayload = ""
+	} else {
+		aggregated.JsonPayload = make(map[string]interface{}, len(msg.JsonPayload)+1)
+		for k, v := range msg.JsonPayload {
+			aggregated.JsonPayload[k] = v
+		}
+	}
+	aggregated.JsonPayload[aggregationField] = map[string]interface{}{
+		"count":         agg.Count,
+		"first_seen_ms": agg.FirstSeen.UnixMilli(),
+		"last_seen_ms":  agg.LastSeen.UnixMilli(),
+	}
+	return &aggregated
+}
+
+// spoolName identifies the client so that clients of the
+// same process sharing the spool directory do not mix.
+func spoolName(opts uspclient.ClientOptions) string {
+	h := sha256.Sum256([]byte(strings.Join([]string{
+		opts.Identity.Oid,
+		opts.SensorSeedKey,
+		opts.Platform,
+		opts.Hostname,
+	}, "\n")))
+	return fmt.Sprintf("%x", h[:8])
+}
+
+func makeKeyExtractors(paths []string) []OpaqueExtractor {
+	extractors := make([]OpaqueExtractor, 0, len(paths))
+	for _, path := range paths {
+		extractors = append(extractors, MakeExtractorForOpaque(path))
+	}
+	return extractors
+}
+
+// eventKey identifies the event by the values at the key
+// paths, or by its whole content without key paths.
+func eventKey(msg *protocol.DataMessage, keys []OpaqueExtractor) string {
+	evt := payloadDict(msg)
+	var data []byte
+	if len(keys) == 0 {
+		data, _ = json.Marshal(evt)
+		data = append([]byte(msg.EventType+"\n"), data...)
+	} else {
+		values := make([][]interface{}, 0, len(keys))
+		for _, extract := range keys {
+			values = append(values, extract(evt))
+		}
+		data, _ = json.Marshal(values)
+	}
+	h := sha256.Sum256(data)
+	return string(h[:])
+}
+
+// payloadDict returns the JSON payload of the message,
+// or {"text": <payload>} for text payloads.
+func payloadDict(msg *protocol.DataMessage) Dict {
+	if msg.JsonPayload != nil {
+		return Dict(msg.JsonPayload)
+	}
+	if msg.TextPayload == "" {
+		return nil
+	}
+	return Dict{"text": msg.TextPayload}
+}
+
+func (c *USPClient) reportStats() {
+	lastTotal := uint64(0)
+	for !c.stopEvt.WaitFor(pipelineReportInterval) {
+		counts := c.Dropped()
+		total := uint64(0)
+		details := make([]string, 0, len(counts))
+		for name, n := range counts {
+			total += n
+			details = append(details, fmt.Sprintf("%s=%d", name, n))
+		}
+		if total == lastTotal {
+			continue
+		}
+		lastTotal = total
+		sort.Strings(details)
+		c.opts.DebugLog(fmt.Sprintf("pipeline dropped %d events: %s", total, strings.Join(details, " ")))
+	}
+}
+
+var (
+	pipelinesMutex sync.Mutex
+	pipelines      = map[*USPClient]struct{}{}
+)
+
+// PipelineStats is the state of the pipeline of a client.
+type PipelineStats struct {
+	SensorSeedKey string            `json:"sensor_seed_key"`
+	Platform      string            `json:"platform,omitempty"`
+	Hostname      string            `json:"hostname,omitempty"`
+	Dropped       map[string]uint64 `json:"dropped,omitempty"`
+	SpoolRecords  uint64            `json:"spool_records"`
+	SpoolBytes    int64             `json:"spool_bytes"`
+}
+
+func registerPipeline(c *USPClient) {
+	pipelinesMutex.Lock()
+	defer pipelinesMutex.Unlock()
+	pipelines[c] = struct{}{}
+}
+
+func unregisterPipeline(c *USPClient) {
+	pipelinesMutex.Lock()
+	defer pipelinesMutex.Unlock()
+	delete(pipelines, c)
+}
+
+// GetPipelineStats returns the stats of the
+// clients of the process, for health checks.
+func GetPipelineStats() []PipelineStats {
+	pipelinesMutex.Lock()
+	defer pipelinesMutex.Unlock()
+	stats := make([]PipelineStats, 0, len(pipelines))
+	for c := range pipelines {
+		s := PipelineStats{
+			SensorSeedKey: c.opts.SensorSeedKey,
+			Platform:      c.opts.Platform,
+			Hostname:      c.opts.Hostname,
+			Dropped:       c.Dropped(),
+		}
+		s.SpoolRecords, s.SpoolBytes = c.SpoolDepth()
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].SensorSeedKey != stats[j].SensorSeedKey {
+			return stats[i].SensorSeedKey < stats[j].SensorSeedKey
+		}
+		if stats[i].Platform != stats[j].Platform {
+			return stats[i].Platform < stats[j].Platform
+		}
+		return stats[i].Hostname < stats[j].Hostname
+	})
+	return stats
+}
@@ -0,0 +1,92 @@
+package usp_webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+const defaultHmacHeader = "X-Hub-Signature-256"
+
+var hmacAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+func (a WebhookAuth) validate() error {
+	if a.HmacAlgorithm != "" {
+		if _, ok := hmacAlgorithms[strings.ToLower(a.HmacAlgorithm)]; !ok {
+			return fmt.Errorf("unsupported hmac_algorithm: %s", a.HmacAlgorithm)
+		}
+	}
+	if a.HmacSecret == "" && (a.HmacHeader != "" || a.HmacAlgorithm != "") {
+		return fmt.Errorf("hmac_header and hmac_algorithm require hmac_secret")
+	}
+	return nil
+}
+
+func (a WebhookAuth) isSet() bool {
+	return a.AuthToken != "" || a.HmacSecret != ""
+}
+
+// isAuthorized checks the bearer token and the body
+// signature, when they are configured.
+func (a WebhookAuth) isAuthorized(r *http.Request, body []byte) bool {
+	if a.AuthToken != "" {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return false
+		}
+		if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(a.AuthToken)) != 1 {
+			return false
+		}
+	}
+	if a.HmacSecret != "" {
+		header := a.HmacHeader
+		if header == "" {
+			header = defaultHmacHeader
+		}
+		algorithm := strings.ToLower(a.HmacAlgorithm)
+		if algorithm == "" {
+			algorithm = "sha256"
+		}
+		signature, ok := decodeSignature(r.Header.Get(header), algorithm)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(hmacAlgorithms[algorithm], []byte(a.HmacSecret))
+		mac.Write(body)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeSignature decodes a signature like "sha256=<hex>",
+// "<hex>" or "<base64>".
+func decodeSignature(value string, algorithm string) ([]byte, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, false
+	}
+	if i := strings.Index(value, "="); i != -1 && strings.EqualFold(value[:i], algorithm) {
+		value = value[i+1:]
+	}
+	if b, err := hex.DecodeString(value); err == nil {
+		return b, true
+	}
+	if b, err := base64.StdEncoding.DecodeString(value); err == nil {
+		return b, true
+	}
+	return nil, false
+}
@@ -0,0 +1,67 @@
+package usp_webhook
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// decompress returns the body decompressed if it was
+// sent gzipped, bounded to maxSize.
+func decompress(body []byte, contentEncoding string, maxSize int64) ([]byte, error) {
+	contentEncoding = strings.ToLower(strings.TrimSpace(contentEncoding))
+	// Some senders gzip without saying so in the headers.
+	isGzip := contentEncoding == "gzip" || (len(body) > 2 && body[0] == 0x1f && body[1] == 0x8b)
+	if !isGzip {
+		if contentEncoding != "" && contentEncoding != "identity" {
+			return nil, fmt.Errorf("unsupported content encoding: %s", contentEncoding)
+		}
+		return body, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("gzip: %v", err)
+	}
+	defer r.Close()
+	decompressed, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("gzip: %v", err)
+	}
+	if int64(len(decompressed)) > maxSize {
+		return nil, fmt.Errorf("decompressed body larger than %d bytes", maxSize)
+	}
+	return decompressed, nil
+}
+
+// decodeJSON returns the objects of a JSON array, of a single
+// JSON object or of a stream of them like NDJSON.
+func decodeJSON(data string) ([]map[string]interface{}, error) {
+	records := []map[string]interface{}{}
+	decoder := json.NewDecoder(strings.NewReader(data))
+	for {
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			if err == io.EOF {
+				return records, nil
+			}
+			return nil, err
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			records = append(records, v)
+		case []interface{}:
+			for _, e := range v {
+				m, ok := e.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("array element is not an object: %T", e)
+				}
+				records = append(records, m)
+			}
+		default:
+			return nil, fmt.Errorf("value is not an object: %T", v)
+		}
+	}
+}
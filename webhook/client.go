@@ -0,0 +1,322 @@
+package usp_webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/refractionPOINT/go-uspclient/protocol"
+	"github.com/refractionPOINT/usp-adapters/utils"
+)
+
+const (
+	defaultMaxBodySize = 32 * 1024 * 1024
+	// Senders retry the requests we reject, so we do
+	// not hold them for long waiting for buffer space.
+	webhookShipTimeout = 10 * time.Second
+	retryAfterSec      = "10"
+)
+
+type WebhookAdapter struct {
+	conf     WebhookConfig
+	wg       sync.WaitGroup
+	server   *http.Server
+	listener net.Listener
+	routes   []*route
+}
+
+type WebhookConfig struct {
+	ClientOptions     uspclient.ClientOptions `json:"client_options" yaml:"client_options"`
+	Port              uint16                  `json:"port" yaml:"port"`
+	Interface         string                  `json:"iface" yaml:"iface"`
+	SslCertPath       string                  `json:"ssl_cert" yaml:"ssl_cert"`
+	SslKeyPath        string                  `json:"ssl_key" yaml:"ssl_key"`
+	MutualTlsCertPath string                  `json:"mutual_tls_cert,omitempty" yaml:"mutual_tls_cert,omitempty"`
+	MaxBodySize       int64                   `json:"max_body_size,omitempty" yaml:"max_body_size,omitempty"`
+
+	// Authentication of all the routes, unless they
+	// have their own.
+	WebhookAuth `json:",inline" yaml:",inline"`
+
+	// Routes the requests of a path to a platform. When
+	// empty, all the paths use the client_options platform.
+	// The routes of a platform share a sensor, which has
+	// "<sensor_seed_key>/<platform>" as seed key unless the
+	// platform is the client_options one.
+	Routes []WebhookRoute `json:"routes,omitempty" yaml:"routes,omitempty"`
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+}
+
+type WebhookAuth struct {
+	// Bearer token the sender must present.
+	AuthToken string `json:"auth_token,omitempty" yaml:"auth_token,omitempty"`
+	// Secret of the HMAC signature of the body the sender puts
+	// in the hmac_header, as hex or base64 with an optional
+	// "sha256=" like prefix, as GitHub does.
+	HmacSecret    string `json:"hmac_secret,omitempty" yaml:"hmac_secret,omitempty"`
+	HmacHeader    string `json:"hmac_header,omitempty" yaml:"hmac_header,omitempty"`
+	HmacAlgorithm string `json:"hmac_algorithm,omitempty" yaml:"hmac_algorithm,omitempty"`
+}
+
+type WebhookRoute struct {
+	Path     string `json:"path" yaml:"path"`
+	Platform string `json:"platform" yaml:"platform"`
+
+	WebhookAuth `json:",inline" yaml:",inline"`
+}
+
+// route is a path served with the client of its
+// platform so its events are parsed as that platform.
+type route struct {
+	path      string
+	auth      WebhookAuth
+	uspClient *utils.USPClient
+}
+
+func (c *WebhookConfig) Validate() error {
+	if err := c.ClientOptions.Validate(); err != nil {
+		return fmt.Errorf("client_options: %v", err)
+	}
+	if c.Port == 0 {
+		return errors.New("missing port")
+	}
+	if (c.SslCertPath == "") != (c.SslKeyPath == "") {
+		return errors.New("ssl_cert and ssl_key must be set together")
+	}
+	if c.MaxBodySize < 0 {
+		return fmt.Errorf("invalid max_body_size: %d", c.MaxBodySize)
+	}
+	if err := c.WebhookAuth.validate(); err != nil {
+		return err
+	}
+	paths := map[string]struct{}{}
+	for _, r := range c.Routes {
+		if !strings.HasPrefix(r.Path, "/") {
+			return fmt.Errorf("invalid route path: %q", r.Path)
+		}
+		if _, ok := paths[r.Path]; ok {
+			return fmt.Errorf("duplicate route path: %s", r.Path)
+		}
+		paths[r.Path] = struct{}{}
+		if r.Platform == "" {
+			return fmt.Errorf("route %s: missing platform", r.Path)
+		}
+		if err := r.WebhookAuth.validate(); err != nil {
+			return fmt.Errorf("route %s: %v", r.Path, err)
+		}
+	}
+	return nil
+}
+
+func NewWebhookAdapter(ctx context.Context, conf WebhookConfig) (*WebhookAdapter, chan struct{}, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, nil, err
+	}
+	a := &WebhookAdapter{
+		conf: conf,
+	}
+	if a.conf.MaxBodySize == 0 {
+		a.conf.MaxBodySize = defaultMaxBodySize
+	}
+
+	var err error
+	mux := http.NewServeMux()
+	a.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	if conf.SslCertPath != "" {
+		if a.server.TLSConfig, err = utils.LoadServerTLSConfig(conf.SslCertPath, conf.SslKeyPath, conf.MutualTlsCertPath); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	routes := conf.Routes
+	if len(routes) == 0 {
+		routes = []WebhookRoute{{Path: "/", Platform: conf.ClientOptions.Platform}}
+	}
+	clients := map[string]*utils.USPClient{}
+	for _, r := range routes {
+		rt := &route{
+			path: r.Path,
+			auth: r.WebhookAuth,
+		}
+		if !rt.auth.isSet() {
+			rt.auth = conf.WebhookAuth
+		}
+		if rt.uspClient = clients[r.Platform]; rt.uspClient == nil {
+			if rt.uspClient, err = utils.NewAckedUSPClient(ctx, routeClientOptions(conf.ClientOptions, r.Platform), conf.Pipeline); err != nil {
+				a.closeClients()
+				return nil, nil, fmt.Errorf("route %s: %v", r.Path, err)
+			}
+			clients[r.Platform] = rt.uspClient
+		}
+		a.routes = append(a.routes, rt)
+		mux.Handle(r.Path, a.handler(rt))
+	}
+
+	addr := fmt.Sprintf("%s:%d", conf.Interface, conf.Port)
+	if a.listener, err = net.Listen("tcp", addr); err != nil {
+		a.closeClients()
+		return nil, nil, err
+	}
+
+	chStopped := make(chan struct{})
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		defer close(chStopped)
+		a.conf.ClientOptions.DebugLog(fmt.Sprintf("listening for requests on %s", a.listener.Addr()))
+		var err error
+		if a.server.TLSConfig != nil {
+			err = a.server.ServeTLS(a.listener, "", "")
+		} else {
+			err = a.server.Serve(a.listener)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			a.conf.ClientOptions.OnError(fmt.Errorf("http.Serve(): %v", err))
+		}
+	}()
+
+	return a, chStopped, nil
+}
+
+func (a *WebhookAdapter) Close() error {
+	a.conf.ClientOptions.DebugLog("closing")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	err1 := a.server.Shutdown(ctx)
+	cancel()
+	a.wg.Wait()
+	err2 := a.closeClients()
+
+	if err1 != nil {
+		return err1
+	}
+
+	return err2
+}
+
+// routeClientOptions returns the options of the client of a
+// platform, a separate sensor with its own seed key so their
+// spools do not collide.
+func routeClientOptions(opts uspclient.ClientOptions, platform string) uspclient.ClientOptions {
+	if platform != opts.Platform {
+		opts.SensorSeedKey = opts.SensorSeedKey + "/" + platform
+		opts.Platform = platform
+	}
+	return opts
+}
+
+func (a *WebhookAdapter) closeClients() error {
+	var err error
+	closed := map[*utils.USPClient]struct{}{}
+	for _, r := range a.routes {
+		if _, ok := closed[r.uspClient]; ok {
+			continue
+		}
+		closed[r.uspClient] = struct{}{}
+		if err1 := r.uspClient.Drain(1 * time.Minute); err1 != nil && err == nil {
+			err = err1
+		}
+		if _, err1 := r.uspClient.Close(); err1 != nil && err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+func (a *WebhookAdapter) handler(rt *route) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, a.conf.MaxBodySize))
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// The signature is of the body as sent, so
+		// it is checked before decompressing it.
+		if !rt.auth.isAuthorized(r, body) {
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("unauthorized request to %s from %s", r.URL.Path, r.RemoteAddr))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		messages, err := decodeBody(body, r.Header.Get("Content-Encoding"), a.conf.MaxBodySize)
+		if err != nil {
+			a.conf.ClientOptions.OnWarning(fmt.Sprintf("invalid request to %s from %s: %v", r.URL.Path, r.RemoteAddr, err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		now := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+		for _, msg := range messages {
+			msg.TimestampMs = now
+			err := rt.uspClient.Ship(msg, webhookShipTimeout)
+			if err == uspclient.ErrorBufferFull {
+				// The sender will retry the whole request, which
+				// may duplicate the events shipped before this one.
+				a.conf.ClientOptions.OnWarning("stream falling behind, rejecting request")
+				w.Header().Set("Retry-After", retryAfterSec)
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			if err != nil {
+				a.conf.ClientOptions.OnError(fmt.Errorf("Ship(): %v", err))
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// decodeBody returns the events of a request body: the objects
+// of a JSON array or of NDJSON, otherwise each line as text.
+func decodeBody(body []byte, contentEncoding string, maxSize int64) ([]*protocol.DataMessage, error) {
+	var err error
+	if body, err = decompress(body, contentEncoding, maxSize); err != nil {
+		return nil, err
+	}
+
+	messages := []*protocol.DataMessage{}
+	trimmed := strings.TrimSpace(string(body))
+	if strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "{") {
+		records, err := decodeJSON(trimmed)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			messages = append(messages, &protocol.DataMessage{
+				JsonPayload: r,
+			})
+		}
+		return messages, nil
+	}
+	for _, line := range strings.Split(trimmed, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		messages = append(messages, &protocol.DataMessage{
+			TextPayload: line,
+		})
+	}
+	return messages, nil
+}
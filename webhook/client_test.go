@@ -0,0 +1,149 @@
+package usp_webhook
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/refractionPOINT/go-uspclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipData(t *testing.T, data string) []byte {
+	b := bytes.Buffer{}
+	w := gzip.NewWriter(&b)
+	_, err := w.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return b.Bytes()
+}
+
+func TestDecodeBody(t *testing.T) {
+	msgs, err := decodeBody([]byte(`[{"a":1},{"a":2}]`), "", defaultMaxBodySize)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	assert.Equal(t, float64(2), msgs[1].JsonPayload["a"])
+
+	msgs, err = decodeBody([]byte("{\"a\":1}\n{\"a\":2}\r\n{\"a\":3}\n"), "", defaultMaxBodySize)
+	require.NoError(t, err)
+	assert.Len(t, msgs, 3)
+
+	msgs, err = decodeBody([]byte("line 1\r\n\nline 2"), "", defaultMaxBodySize)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	assert.Equal(t, "line 1", msgs[0].TextPayload)
+	assert.Equal(t, "line 2", msgs[1].TextPayload)
+
+	// With and without the header.
+	for _, encoding := range []string{"gzip", ""} {
+		msgs, err = decodeBody(gzipData(t, "{\"a\":1}\n{\"a\":2}\n"), encoding, defaultMaxBodySize)
+		require.NoError(t, err)
+		assert.Len(t, msgs, 2)
+	}
+	_, err = decodeBody(gzipData(t, strings.Repeat("a", 1000)), "gzip", 100)
+	assert.Error(t, err)
+
+	for _, invalid := range []string{`{"a":`, `[1, 2]`, `{"a":1} 2`} {
+		_, err = decodeBody([]byte(invalid), "", defaultMaxBodySize)
+		assert.Error(t, err, invalid)
+	}
+	_, err = decodeBody([]byte("a"), "br", defaultMaxBodySize)
+	assert.Error(t, err)
+}
+
+func TestAuth(t *testing.T) {
+	body := []byte(`{"action":"opened"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	request := func(headers map[string]string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		return r
+	}
+
+	auth := WebhookAuth{HmacSecret: "secret"}
+	assert.True(t, auth.isAuthorized(request(map[string]string{"X-Hub-Signature-256": "sha256=" + signature}), body))
+	assert.True(t, auth.isAuthorized(request(map[string]string{"X-Hub-Signature-256": signature}), body))
+	assert.False(t, auth.isAuthorized(request(map[string]string{"X-Hub-Signature-256": "sha256=00" + signature[2:]}), body))
+	assert.False(t, auth.isAuthorized(request(nil), body))
+
+	auth = WebhookAuth{AuthToken: "token", HmacSecret: "secret", HmacHeader: "X-Signature"}
+	assert.True(t, auth.isAuthorized(request(map[string]string{"Authorization": "Bearer token", "X-Signature": signature}), body))
+	assert.False(t, auth.isAuthorized(request(map[string]string{"Authorization": "Bearer other", "X-Signature": signature}), body))
+	assert.False(t, auth.isAuthorized(request(map[string]string{"Authorization": "Bearer token"}), body))
+
+	assert.True(t, WebhookAuth{}.isAuthorized(request(nil), body))
+	assert.Error(t, WebhookAuth{HmacAlgorithm: "md5", HmacSecret: "secret"}.validate())
+	assert.Error(t, WebhookAuth{HmacHeader: "X-Signature"}.validate())
+}
+
+func TestWebhookRoutes(t *testing.T) {
+	// Find a free port.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	a, _, err := NewWebhookAdapter(context.Background(), WebhookConfig{
+		ClientOptions: uspclient.ClientOptions{
+			TestSinkMode: true,
+			Platform:     "json",
+			DebugLog:     func(msg string) {},
+			OnWarning:    func(msg string) {},
+			OnError:      func(err error) { t.Errorf("unexpected error: %v", err) },
+		},
+		Port:        uint16(port),
+		Interface:   "127.0.0.1",
+		WebhookAuth: WebhookAuth{AuthToken: "token"},
+		Routes: []WebhookRoute{
+			{Path: "/logs", Platform: "json"},
+			{Path: "/syslog", Platform: "text", WebhookAuth: WebhookAuth{AuthToken: "other"}},
+			{Path: "/events", Platform: "json"},
+		},
+	})
+	require.NoError(t, err)
+	defer a.Close()
+	require.Len(t, a.routes, 3)
+	assert.Same(t, a.routes[0].uspClient, a.routes[2].uspClient)
+	assert.NotSame(t, a.routes[0].uspClient, a.routes[1].uspClient)
+
+	post := func(path string, token string, body string) int {
+		r, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://127.0.0.1:%d%s", port, path), strings.NewReader(body))
+		require.NoError(t, err)
+		r.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(r)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, post("/logs", "token", `[{"a":1}]`))
+	assert.Equal(t, http.StatusUnauthorized, post("/logs", "other", `[{"a":1}]`))
+	assert.Equal(t, http.StatusOK, post("/syslog", "other", "line"))
+	assert.Equal(t, http.StatusUnauthorized, post("/syslog", "token", "line"))
+	assert.Equal(t, http.StatusBadRequest, post("/logs", "token", `[{"a":`))
+	assert.Equal(t, http.StatusNotFound, post("/other", "token", `[{"a":1}]`))
+
+	opts := uspclient.ClientOptions{Platform: "json", SensorSeedKey: "seed"}
+	assert.Equal(t, opts, routeClientOptions(opts, "json"))
+	textOpts := routeClientOptions(opts, "text")
+	assert.Equal(t, "text", textOpts.Platform)
+	assert.Equal(t, "seed/text", textOpts.SensorSeedKey)
+
+	assert.Error(t, (&WebhookConfig{Port: 1, Routes: []WebhookRoute{{Path: "/a", Platform: "json"}, {Path: "/a", Platform: "text"}}}).Validate())
+	assert.Error(t, (&WebhookConfig{Port: 1, Routes: []WebhookRoute{{Path: "a", Platform: "json"}}}).Validate())
+	assert.Error(t, (&WebhookConfig{Port: 1, Routes: []WebhookRoute{{Path: "/a"}}}).Validate())
+}
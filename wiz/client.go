@@ -19,7 +19,7 @@ import (
 
 type WizAdapter struct {
 	conf       WizConfig
-	uspClient  *uspclient.Client
+	uspClient  *utils.USPClient
 	httpClient *http.Client
 
 	chStopped chan struct{}
@@ -41,6 +41,8 @@ type WizConfig struct {
 	TimeField     string                  `json:"time_field" yaml:"time_field"` // e.g., "createdAt", "updatedAt"
 	DataPath      []string                `json:"data_path" yaml:"data_path"`   // e.g., ["data", "securityIssues", "issues"]
 	IDField       string                  `json:"id_field" yaml:"id_field"`     // e.g., "id"
+
+	Pipeline utils.PipelineConfig `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 func (c *WizConfig) Validate() error {
@@ -79,7 +81,7 @@ func NewWizAdapter(ctx context.Context, conf WizConfig) (*WizAdapter, chan struc
 		doStop: utils.NewEvent(),
 	}
 
-	a.uspClient, err = uspclient.NewClient(ctx, conf.ClientOptions)
+	a.uspClient, err = utils.NewUSPClient(ctx, conf.ClientOptions, conf.Pipeline)
 	if err != nil {
 		return nil, nil, err
 	}